@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxAccessUsers bounds the basic auth users of a server
+	maxAccessUsers = 50
+	// hashPasswordTimeout bounds hashing one password; bcrypt is slow on
+	// purpose
+	hashPasswordTimeout = 30 * time.Second
+)
+
+// AccessUser is a basic auth user of a site. The password is only
+// accepted in requests; it is hashed with bcrypt by the runtime and only
+// the hash is kept.
+type AccessUser struct {
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// AccessConfig protects a server's site, e.g. a staging site on a
+// routable IPv6 address. Clients outside allow_ips get 403; with users,
+// the others must log in with basic auth.
+type AccessConfig struct {
+	Users    []AccessUser `json:"users,omitempty"`
+	AllowIPs []string     `json:"allow_ips,omitempty"` // addresses and CIDR ranges, e.g. 2001:db8::/48
+	Realm    string       `json:"realm,omitempty"`     // shown by browsers when asking to log in
+}
+
+// Validate checks the access options. Users may still carry a plaintext
+// password; hashPasswords replaces it before the options are stored.
+func (ac AccessConfig) Validate() error {
+	if len(ac.Users) == 0 && len(ac.AllowIPs) == 0 {
+		return fmt.Errorf("give users or allow_ips, or null to remove the protection")
+	}
+	if len(ac.Users) > maxAccessUsers {
+		return fmt.Errorf("at most %d users are allowed", maxAccessUsers)
+	}
+	names := make(map[string]bool)
+	for _, user := range ac.Users {
+		if user.Username == "" || len(user.Username) > 64 || strings.ContainsAny(user.Username, " \t\r\n:\"{}") {
+			return fmt.Errorf("invalid username %q", user.Username)
+		}
+		if names[user.Username] {
+			return fmt.Errorf("user %q is listed twice", user.Username)
+		}
+		names[user.Username] = true
+		if (user.Password == "") == (user.PasswordHash == "") {
+			return fmt.Errorf("user %q needs either a password or a password_hash", user.Username)
+		}
+		if strings.ContainsAny(user.PasswordHash, " \t\r\n\"{}") {
+			return fmt.Errorf("invalid password_hash of user %q", user.Username)
+		}
+	}
+	for _, value := range ac.AllowIPs {
+		if _, _, err := net.ParseCIDR(value); err != nil && net.ParseIP(value) == nil {
+			return fmt.Errorf("invalid address or range %q in allow_ips", value)
+		}
+	}
+	if strings.ContainsAny(ac.Realm, "\r\n") {
+		return fmt.Errorf("realm must be a single line")
+	}
+	return nil
+}
+
+// hashPassword hashes a password with the runtime's hash-password command,
+// which writes the bcrypt hash its basic_auth expects. The password goes
+// through stdin to stay out of the process list.
+func hashPassword(ctx context.Context, password string) (string, error) {
+	binary, err := findRuntimeBinary(runtimeBinary)
+	if err != nil {
+		return "", fmt.Errorf("%v; hash the password with `frankenphp hash-password` and give password_hash instead", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hashPasswordTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, "hash-password")
+	cmd.Stdin = strings.NewReader(password + "\n")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s hash-password: %v", binary, err)
+	}
+	hash := strings.TrimSpace(string(output))
+	if hash == "" || strings.ContainsAny(hash, " \t\r\n") {
+		return "", fmt.Errorf("%s hash-password returned no hash", binary)
+	}
+	return hash, nil
+}
+
+// hashPasswords replaces the plaintext passwords of the users with their
+// hashes
+func (ac *AccessConfig) hashPasswords(ctx context.Context) error {
+	for i := range ac.Users {
+		if ac.Users[i].Password == "" {
+			continue
+		}
+		hash, err := hashPassword(ctx, ac.Users[i].Password)
+		if err != nil {
+			return err
+		}
+		ac.Users[i].Password, ac.Users[i].PasswordHash = "", hash
+	}
+	return nil
+}
+
+// Directives returns the Caddyfile site directives enforcing the options.
+// They run in a route after the handle blocks, so the manager's own
+// OPcache endpoint, which checks a token, stays reachable.
+func (ac *AccessConfig) Directives() []string {
+	if ac == nil {
+		return nil
+	}
+
+	var directives []string
+	block := "route {"
+	if len(ac.AllowIPs) > 0 {
+		directives = append(directives, "@psm_access_denied not remote_ip "+strings.Join(ac.AllowIPs, " "))
+		block += "\n\t\trespond @psm_access_denied \"Forbidden\" 403"
+	}
+	if len(ac.Users) > 0 {
+		block += "\n\t\tbasic_auth bcrypt " + caddyQuote(firstNonEmpty(ac.Realm, "restricted")) + " {"
+		for _, user := range ac.Users {
+			block += "\n\t\t\t" + user.Username + " " + user.PasswordHash
+		}
+		block += "\n\t\t}"
+	}
+	return append(directives, block+"\n\t}")
+}
+
+// redacted returns the options without the password hashes
+func (ac *AccessConfig) redacted() *AccessConfig {
+	if ac == nil {
+		return nil
+	}
+	copied := *ac
+	copied.Users = make([]AccessUser, len(ac.Users))
+	for i, user := range ac.Users {
+		copied.Users[i] = AccessUser{Username: user.Username}
+	}
+	return &copied
+}
+
+// SetAccess sets or, with nil, removes the protection of a server
+func (a *App) SetAccess(id string, access *AccessConfig) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Access = access
+
+	a.requestSave()
+	return true
+}
+
+// handleGetAccess shows the protection of a server, without the password
+// hashes
+func (a *App) handleGetAccess(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"access":    server.Access.redacted(),
+	})
+}
+
+// handleSetAccess protects a server with basic auth users and an IP
+// allow-list ({"users": [{"username": "qa", "password": "..."}],
+// "allow_ips": ["2001:db8::/48"]}; null removes it). It takes effect the
+// next time the server starts or reloads.
+func (a *App) handleSetAccess(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	var access *AccessConfig
+	if err := json.NewDecoder(r.Body).Decode(&access); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if access != nil {
+		if err := access.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+		if err := access.hashPasswords(r.Context()); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+	}
+
+	if !a.SetAccess(id, access) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"access":    access.redacted(),
+	})
+}
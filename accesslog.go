@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultAccessLogTail is how many requests the access log endpoint
+	// returns when no tail is given
+	defaultAccessLogTail = 500
+	// maxAccessLogTail bounds the requests returned at once
+	maxAccessLogTail = 10000
+)
+
+// AccessLogRecord is one request of a server's access log
+type AccessLogRecord struct {
+	Time      time.Time `json:"time"`
+	RemoteIP  string    `json:"remote_ip"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"duration"` // seconds
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// parseAccessLogLine reads one line of Caddy's JSON access log
+func parseAccessLogLine(line []byte) (AccessLogRecord, bool) {
+	var entry struct {
+		Timestamp float64 `json:"ts"`
+		Request   struct {
+			RemoteIP string              `json:"remote_ip"`
+			Method   string              `json:"method"`
+			Host     string              `json:"host"`
+			URI      string              `json:"uri"`
+			Proto    string              `json:"proto"`
+			Headers  map[string][]string `json:"headers"`
+		} `json:"request"`
+		Status   int     `json:"status"`
+		Size     int64   `json:"size"`
+		Duration float64 `json:"duration"`
+	}
+	if json.Unmarshal(line, &entry) != nil || entry.Status == 0 {
+		return AccessLogRecord{}, false
+	}
+
+	header := http.Header(entry.Request.Headers)
+	return AccessLogRecord{
+		Time:      time.Unix(0, int64(entry.Timestamp*float64(time.Second))),
+		RemoteIP:  entry.Request.RemoteIP,
+		Method:    entry.Request.Method,
+		Host:      entry.Request.Host,
+		URI:       entry.Request.URI,
+		Proto:     entry.Request.Proto,
+		Status:    entry.Status,
+		Size:      entry.Size,
+		Duration:  entry.Duration,
+		Referer:   header.Get("Referer"),
+		UserAgent: header.Get("User-Agent"),
+	}, true
+}
+
+// Combined renders the record in the Combined Log Format of Apache and
+// nginx, so existing log tools can read it
+func (r AccessLogRecord) Combined() string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %d %q %q",
+		dash(r.RemoteIP), r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URI+" "+r.Proto, r.Status, r.Size, dash(r.Referer), dash(r.UserAgent))
+}
+
+// AccessLogFilter selects records of an access log
+type AccessLogFilter struct {
+	Statuses []string // exact codes such as 404 or classes such as 5xx
+	Path     string   // prefix of the request path
+	Method   string
+	Text     string // case-insensitive substring of the combined line
+}
+
+// parseAccessLogFilter reads the filter from query parameters
+func parseAccessLogFilter(query map[string][]string) (AccessLogFilter, error) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	filter := AccessLogFilter{
+		Path:   get("path"),
+		Method: strings.ToUpper(get("method")),
+		Text:   strings.ToLower(get("filter")),
+	}
+	if statuses := get("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			status = strings.ToLower(strings.TrimSpace(status))
+			if len(status) != 3 || status[0] < '1' || status[0] > '5' {
+				return filter, fmt.Errorf("invalid status %q, use a code such as 404 or a class such as 5xx", status)
+			}
+			if status[1:] != "xx" {
+				if _, err := strconv.Atoi(status); err != nil {
+					return filter, fmt.Errorf("invalid status %q, use a code such as 404 or a class such as 5xx", status)
+				}
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	return filter, nil
+}
+
+// Match reports whether a record passes the filter
+func (f AccessLogFilter) Match(r AccessLogRecord) bool {
+	if len(f.Statuses) > 0 {
+		code := strconv.Itoa(r.Status)
+		matched := false
+		for _, status := range f.Statuses {
+			if status == code || (status[1:] == "xx" && status[0] == code[0]) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.Path != "" {
+		path := r.URI
+		if i := strings.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		if !strings.HasPrefix(path, f.Path) {
+			return false
+		}
+	}
+	if f.Method != "" && r.Method != f.Method {
+		return false
+	}
+	if f.Text != "" && !strings.Contains(strings.ToLower(r.Combined()), f.Text) {
+		return false
+	}
+	return true
+}
+
+// accessLogFiles returns a server's access log and the copies Caddy rolled,
+// newest first. Copies already compressed by storage maintenance are left
+// out; the ones Caddy gzipped are read.
+func accessLogFiles(baseDir, id string) []string {
+	current := serverAccessLog(baseDir, id)
+	files := []string{current}
+
+	entries, err := ioutil.ReadDir(filepath.Dir(current))
+	if err != nil {
+		return files
+	}
+	prefix := strings.TrimSuffix(accessLogName, ".log") + "-"
+	rolled := []string{}
+	for _, entry := range entries {
+		// Rolled copies are named access-<timestamp>.log, so names sort by age
+		name := strings.TrimSuffix(entry.Name(), ".gz")
+		if entry.Mode().IsRegular() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".log") {
+			rolled = append(rolled, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rolled)))
+	for _, name := range rolled {
+		files = append(files, filepath.Join(filepath.Dir(current), name))
+	}
+	return files
+}
+
+// readAccessLog returns the last tail records of a file that pass the
+// filter, oldest first
+func readAccessLog(path string, filter AccessLogFilter, tail int) ([]AccessLogRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	records := []AccessLogRecord{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record, ok := parseAccessLogLine(scanner.Bytes())
+		if !ok || !filter.Match(record) {
+			continue
+		}
+		records = append(records, record)
+		if len(records) > tail {
+			records = records[1:]
+		}
+	}
+	return records, scanner.Err()
+}
+
+// AccessLog returns the last tail requests of a server that pass the
+// filter, oldest first. Rolled files are read when the current one holds
+// too few.
+func (a *App) AccessLog(id string, filter AccessLogFilter, tail int) ([]AccessLogRecord, error) {
+	records := []AccessLogRecord{}
+	for _, path := range accessLogFiles(a.configDir, id) {
+		older, err := readAccessLog(path, filter, tail-len(records))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(older, records...)
+		if len(records) >= tail {
+			break
+		}
+	}
+	return records, nil
+}
+
+// handleGetAccessLog returns the recent requests of a server. ?tail= bounds
+// the count, ?status= takes codes or classes such as 404,5xx, ?path= a path
+// prefix, ?method= a method and ?filter= free text. ?format=combined
+// returns the Combined Log Format as plain text.
+func (a *App) handleGetAccessLog(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	query := r.URL.Query()
+	tail := defaultAccessLogTail
+	if value := query.Get("tail"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "tail must be a positive number")
+			return
+		}
+		tail = n
+	}
+	if tail > maxAccessLogTail {
+		tail = maxAccessLogTail
+	}
+	filter, err := parseAccessLogFilter(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	records, err := a.AccessLog(id, filter, tail)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	if query.Get("format") == "combined" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, record := range records {
+			fmt.Fprintln(w, record.Combined())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"count":     len(records),
+		"records":   records,
+	})
+}
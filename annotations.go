@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAnnotations bounds the number of annotations kept in memory
+const maxAnnotations = 1000
+
+// Annotation marks a lifecycle event of a server on a metrics timeline.
+// Time is in Unix milliseconds, as expected by Grafana.
+type Annotation struct {
+	ID        int64    `json:"id"`
+	Time      int64    `json:"time"`
+	ServerID  string   `json:"server_id"`
+	Event     string   `json:"event"`
+	Text      string   `json:"text"`
+	Tags      []string `json:"tags"`
+	RequestID string   `json:"request_id,omitempty"`
+}
+
+// AnnotationLog records server start, stop and update events so metric
+// spikes can be correlated with them. When PSM_GRAFANA_URL is set, every
+// annotation is also pushed to Grafana's annotations API.
+type AnnotationLog struct {
+	mu           sync.Mutex
+	entries      []Annotation
+	nextID       int64
+	grafanaURL   string
+	grafanaToken string
+	client       *http.Client
+	warnings     *WarningCenter
+}
+
+// NewAnnotationLog creates an annotation log, reading the optional Grafana
+// endpoint from PSM_GRAFANA_URL and PSM_GRAFANA_API_KEY
+func NewAnnotationLog(warnings *WarningCenter) *AnnotationLog {
+	return &AnnotationLog{
+		nextID:       1,
+		grafanaURL:   strings.TrimSuffix(os.Getenv("PSM_GRAFANA_URL"), "/"),
+		grafanaToken: os.Getenv("PSM_GRAFANA_API_KEY"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		warnings:     warnings,
+	}
+}
+
+// Record adds an annotation for a server event
+func (al *AnnotationLog) Record(ctx context.Context, serverID, name, event, text string) {
+	if al == nil {
+		return
+	}
+
+	tags := []string{"php-server-manager", "server:" + serverID, "event:" + event}
+	if name != "" {
+		tags = append(tags, "name:"+name)
+	}
+
+	al.mu.Lock()
+	annotation := Annotation{
+		ID:        al.nextID,
+		Time:      time.Now().UnixNano() / int64(time.Millisecond),
+		ServerID:  serverID,
+		Event:     event,
+		Text:      text,
+		Tags:      tags,
+		RequestID: requestIDFromContext(ctx),
+	}
+	al.nextID++
+	al.entries = append(al.entries, annotation)
+	if len(al.entries) > maxAnnotations {
+		al.entries = al.entries[len(al.entries)-maxAnnotations:]
+	}
+	al.mu.Unlock()
+
+	if al.grafanaURL != "" {
+		go al.push(ctx, annotation)
+	}
+}
+
+// push sends an annotation to Grafana
+func (al *AnnotationLog) push(ctx context.Context, annotation Annotation) {
+	body, err := json.Marshal(map[string]interface{}{
+		"time": annotation.Time,
+		"tags": annotation.Tags,
+		"text": annotation.Text,
+	})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("POST", al.grafanaURL+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		al.warnings.AddContext(ctx, "annotations", "Error creating Grafana request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if al.grafanaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+al.grafanaToken)
+	}
+
+	resp, err := al.client.Do(req)
+	if err != nil {
+		al.warnings.AddContext(ctx, "annotations", "Error pushing annotation to Grafana: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		al.warnings.AddContext(ctx, "annotations", "Grafana rejected annotation: %s", resp.Status)
+	}
+}
+
+// Query returns annotations between from and to (Unix milliseconds, zero
+// for unbounded), optionally filtered by server and event
+func (al *AnnotationLog) Query(from, to int64, serverID, event string) []Annotation {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	result := []Annotation{}
+	for _, annotation := range al.entries {
+		if from > 0 && annotation.Time < from {
+			continue
+		}
+		if to > 0 && annotation.Time > to {
+			continue
+		}
+		if serverID != "" && annotation.ServerID != serverID {
+			continue
+		}
+		if event != "" && annotation.Event != event {
+			continue
+		}
+		result = append(result, annotation)
+	}
+	return result
+}
+
+// parseAnnotationTime accepts Unix milliseconds or RFC 3339
+func parseAnnotationTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// handleGetAnnotations lists annotations; ?from= and ?to= bound the range
+// and ?server= and ?event= filter the results
+func (al *AnnotationLog) handleGetAnnotations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from, err := parseAnnotationTime(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	to, err := parseAnnotationTime(query.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(al.Query(from, to, query.Get("server"), query.Get("event")))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// ManagementAccess restricts which client addresses reach the API and the
+// web UI. A client matching deny is refused; with allow set, so is every
+// client matching none of it. Loopback clients are always let in, so the
+// manager can't be locked out from its own host.
+type ManagementAccess struct {
+	Allow []string `json:"allow,omitempty"` // addresses and CIDR ranges, e.g. 10.8.0.0/24 for a VPN
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Validate checks the addresses and ranges
+func (ma ManagementAccess) Validate() error {
+	for name, values := range map[string][]string{"allow": ma.Allow, "deny": ma.Deny} {
+		for _, value := range values {
+			if _, _, err := net.ParseCIDR(value); err != nil && net.ParseIP(value) == nil {
+				return fmt.Errorf("invalid address or range %q in %s", value, name)
+			}
+		}
+	}
+	return nil
+}
+
+// matchAddress reports whether ip is one of the addresses or in one of the
+// ranges
+func matchAddress(values []string, ip net.IP) bool {
+	for _, value := range values {
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if address := net.ParseIP(value); address != nil && address.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits reports whether a client address may use the manager
+func (ma ManagementAccess) Permits(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	if matchAddress(ma.Deny, ip) {
+		return false
+	}
+	return len(ma.Allow) == 0 || matchAddress(ma.Allow, ip)
+}
+
+// remoteIP returns the address of the client that sent a request
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ManagementAccess returns the address restrictions of the manager
+func (a *App) ManagementAccess() ManagementAccess {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.apiAccess
+}
+
+// SetManagementAccess replaces the address restrictions of the manager
+func (a *App) SetManagementAccess(access ManagementAccess) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.apiAccess = access
+	a.requestSave()
+}
+
+// managementAccessMiddleware refuses clients the address restrictions
+// leave out with 403, before they reach the login
+func (a *App) managementAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !viaUnixSocket(r) && !a.ManagementAccess().Permits(remoteIP(r)) {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "Your address may not use the manager")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleGetManagementAccess shows the address restrictions of the manager
+func (a *App) handleGetManagementAccess(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.ManagementAccess())
+}
+
+// handleSetManagementAccess replaces the address restrictions
+// ({"allow": ["10.8.0.0/24"], "deny": ["10.8.0.13"]}). A change that would
+// refuse the client making it is rejected with 409.
+func (a *App) handleSetManagementAccess(w http.ResponseWriter, r *http.Request) {
+	var access ManagementAccess
+	if err := json.NewDecoder(r.Body).Decode(&access); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := access.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+	if client := remoteIP(r); !viaUnixSocket(r) && !access.Permits(client) {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("This would lock out your own address %s", client))
+		return
+	}
+
+	a.SetManagementAccess(access)
+	logAttrs(r.Context(), slog.LevelInfo, "management access changed", slog.Any("allow", access.Allow), slog.Any("deny", access.Deny))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(access)
+}
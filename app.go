@@ -2,44 +2,190 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // Server represents a PHP server configuration
 type Server struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	Port      string `json:"port"`
-	Directory string `json:"directory"`
-	Running   bool   `json:"running"`
-	VLANInterface string `json:"vlan_interface,omitempty"`
-	IPv6Address   string `json:"ipv6_address,omitempty"`
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Port          string            `json:"port"`
+	Directory     string            `json:"directory"`
+	Running       bool              `json:"running"`
+	VLANInterface string            `json:"vlan_interface,omitempty"`
+	IPv6Address   string            `json:"ipv6_address,omitempty"`
+	VLANOptions   VLANOptions       `json:"vlan_options"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Env           map[string]string `json:"env,omitempty"`
+	PHPIni        map[string]string `json:"php_ini,omitempty"`
+	Settings      Settings          `json:"settings"`
+	Compression   Compression       `json:"compression"`
+	StaticCache   StaticCache       `json:"static_cache"`
+	Limits        ResourceLimits    `json:"limits"`
+	ExpiresAt     *time.Time        `json:"expires_at,omitempty"`
+	RunAsUser     string            `json:"run_as_user,omitempty"`
+	Framework     string            `json:"framework,omitempty"`
+	Git           *GitSource        `json:"git,omitempty"`
+	Headers       []HeaderRule      `json:"headers,omitempty"`
+	Debug         DebugConfig       `json:"debug"`
+	Worker        *WorkerConfig     `json:"worker,omitempty"`
+	Database      *DatabaseConfig   `json:"database,omitempty"`
+	Mail          *MailConfig       `json:"mail,omitempty"`
+	Redis         *RedisConfig      `json:"redis,omitempty"`
+	Watch         *WatchConfig      `json:"watch,omitempty"`
+	Workers       []WorkerProcess   `json:"workers,omitempty"`
+	Access        *AccessConfig     `json:"access,omitempty"`
+	Public        bool              `json:"public,omitempty"` // forward its port on the home router while it runs
+	Lifecycle     *LifecycleHooks   `json:"lifecycle,omitempty"`
+	Runtime       *RuntimeConfig    `json:"runtime,omitempty"` // nil for FrankenPHP on the host
+	Node          string            `json:"node,omitempty"`    // the node serving it when listed by a controller
+	Owner         string            `json:"owner,omitempty"`   // the user who created it; empty for the admins
+}
+
+// ServerSpec describes a server to be created
+type ServerSpec struct {
+	Name        string            `json:"name"`
+	Port        string            `json:"port"`
+	Directory   string            `json:"directory"`
+	VLANOptions VLANOptions       `json:"vlan_options"`
+	Labels      map[string]string `json:"labels"`
+	Env         map[string]string `json:"env"`
+	PHPIni      map[string]string `json:"php_ini,omitempty"`
+	RunAsUser   string            `json:"run_as_user,omitempty"`
+	Template    string            `json:"template,omitempty"`
+	Git         *GitSource        `json:"git,omitempty"`
+	Owner       string            `json:"-"` // the user creating it
+}
+
+// validEnvName restricts environment variable names
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks that a server spec is complete and well formed
+func (spec ServerSpec) Validate() error {
+	if spec.Name == "" || spec.Port == "" || spec.Directory == "" {
+		return fmt.Errorf("all fields are required")
+	}
+
+	if _, err := strconv.Atoi(spec.Port); err != nil {
+		return fmt.Errorf("port must be a number")
+	}
+
+	if err := spec.VLANOptions.Validate(); err != nil {
+		return err
+	}
+
+	if err := validateLabels(spec.Labels); err != nil {
+		return err
+	}
+
+	for name := range spec.Env {
+		if !validEnvName.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+
+	if err := validatePHPIni(spec.PHPIni); err != nil {
+		return err
+	}
+
+	if spec.RunAsUser != "" && !validUsername.MatchString(spec.RunAsUser) {
+		return fmt.Errorf("invalid run_as_user %q", spec.RunAsUser)
+	}
+
+	if spec.Git != nil {
+		return spec.Git.Validate()
+	}
+	return nil
 }
 
 // AppConfig represents the application configuration that will be saved to disk
 type AppConfig struct {
-	Servers map[string]*Server `json:"servers"`
-	NextID  int                `json:"nextID"`
+	Servers        map[string]*Server   `json:"servers"`
+	NextID         int                  `json:"nextID"`
+	Groups         map[string]*Group    `json:"groups,omitempty"`
+	NextGroupID    int                  `json:"nextGroupID,omitempty"`
+	Templates      map[string]*Template `json:"templates,omitempty"`
+	NextTemplateID int                  `json:"nextTemplateID,omitempty"`
+	Settings       Settings             `json:"settings"`
+	HeaderRules    []HeaderRule         `json:"headerRules,omitempty"`
+	Branding       Branding             `json:"branding"`
+	ReadOnly       bool                 `json:"readOnly,omitempty"`
+	Manager        ManagerOptions       `json:"manager"`
+	Access         ManagementAccess     `json:"managementAccess"`
 }
 
 // App struct
 type App struct {
-	ctx        context.Context
-	servers    map[string]*Server
-	nextID     int
-	mu         sync.Mutex
-	processes  map[string]*exec.Cmd
-	configPath string
+	ctx             context.Context
+	servers         map[string]*Server
+	nextID          int
+	groups          map[string]*Group
+	nextGroupID     int
+	templates       map[string]*Template
+	nextTemplateID  int
+	settings        Settings
+	headerRules     []HeaderRule
+	branding        Branding
+	readOnly        bool
+	readOnlyForced  bool // PSM_READONLY
+	managerOptions  ManagerOptions
+	admins          map[string]bool // PSM_ADMINS
+	memberUser      string          // PSM_MEMBER_USER
+	freeze          *FreezeManager
+	apiAccess       ManagementAccess
+	store           *Store
+	saveRequests    chan struct{}
+	flushRequests   chan chan struct{}
+	mu              sync.Mutex
+	editMu          sync.Mutex // serializes conditional updates and deletes of servers
+	processes       map[string]int
+	pendingRestarts map[string]time.Time
+	configPath      string
+	configDir       string
+	configWritten   [sha256.Size]byte // hash of the config file as last written
+	certs           *CertificateStore
+	warnings        *WarningCenter
+	annotations     *AnnotationLog
+	tunnels         *TunnelManager
+	portMappings    *PortMapper
+	runtime         *RuntimeWatcher
+	stats           *StatsCollector
+	traffic         *TrafficTracker
+	logForwarder    *LogForwarder
+	storage         *StorageManager
+	events          *EventLog
+	nodes           *NodeManager
+	reservations    *ReservationManager
+	reservedPorts   []Reservation // ports no server may use, from PSM_RESERVED_PORTS
+	deploys         *DeployManager
+	backups         *BackupManager
+	fileWatcher     *FileWatcher
+	supervisor      *WorkerSupervisor
+	reloads         *ReloadManager
+	tasks           *TaskManager
+	hooks           *HookManager
+	lifecycle       *LifecycleLog
+	trash           *TrashManager
+	notifier        *Notifier
+	health          *HealthChecker
+	privileges      Privileges
+	configErr       error // why the saved configuration could not be loaded
+	ready           bool  // serving requests and not shutting down
 }
 
 // NewApp creates a new App application struct
@@ -56,48 +202,165 @@ func NewApp() *App {
 		os.MkdirAll(configDir, 0755)
 	}
 
-	configPath := filepath.Join(configDir, "config.json")
+	configPath := findConfigFile(configDir)
 
 	return &App{
-		servers:    make(map[string]*Server),
-		nextID:     1,
-		processes:  make(map[string]*exec.Cmd),
-		configPath: configPath,
+		servers:         make(map[string]*Server),
+		nextID:          1,
+		groups:          make(map[string]*Group),
+		nextGroupID:     1,
+		templates:       make(map[string]*Template),
+		nextTemplateID:  1,
+		processes:       make(map[string]int),
+		pendingRestarts: make(map[string]time.Time),
+		configPath:      configPath,
+		configDir:       configDir,
+		saveRequests:    make(chan struct{}, 1),
+		flushRequests:   make(chan chan struct{}),
 	}
 }
 
 // startup is called when the app starts
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
+
+	// Open the embedded database, which keeps the history and preferences
+	// and a copy of the config file's state. Without it the manager runs on
+	// the config file alone.
+	store, err := OpenStore(filepath.Join(a.configDir, "state.db"))
+	if err != nil {
+		a.warnings.Add("config", "Error opening database, history and preferences are unavailable: %v", err)
+	} else {
+		a.store = store
+		a.configPath = restoredConfigPath(a.configPath)
+	}
+
 	a.loadConfig()
+	go a.runConfigWriter()
 }
 
-// shutdown is called when the app is about to exit
-func (a *App) shutdown(ctx context.Context) {
-	// Stop all running servers
+// defaultShutdownTimeout is how long API requests and servers may finish
+// their requests on shutdown, unless PSM_SHUTDOWN_TIMEOUT says otherwise
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdown is called when the app is about to exit. It stops the running
+// servers, giving them until ctx's deadline to finish their requests, then
+// removes the VLAN interfaces and writes the configuration.
+func (a *App) shutdown(ctx context.Context, vlanManager *VLANManager) {
+	a.mu.Lock()
+	running := make([]string, 0, len(a.servers))
 	for id, server := range a.servers {
 		if server.Running {
-			a.StopServer(id)
+			running = append(running, id)
 		}
 	}
-	a.saveConfig()
+	a.mu.Unlock()
+
+	drain := time.Duration(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		drain = time.Until(deadline)
+	}
+	logger.Info("stopping servers", "count", len(running), "drain", drain.String())
+	var wg sync.WaitGroup
+	for _, id := range running {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			a.stopServer(ctx, id, drain)
+		}(id)
+	}
+	wg.Wait()
+
+	if vlanManager != nil {
+		logger.Info("removing VLAN interfaces")
+		vlanManager.RemoveAll()
+	}
+
+	logger.Info("writing configuration")
+	a.flushConfig()
+	if a.store != nil {
+		a.store.Close()
+	}
 }
 
-// loadConfig loads the saved configuration from disk
-func (a *App) loadConfig() {
-	data, err := ioutil.ReadFile(a.configPath)
-	if err != nil {
-		return
+// restoreVLANs recreates the VLAN interfaces of all servers that had one,
+// since they are removed on shutdown. Servers in skip keep their interface.
+func (a *App) restoreVLANs(vlanManager *VLANManager, skip map[string]bool) {
+	a.mu.Lock()
+	servers := make(map[string]Server)
+	for id, server := range a.servers {
+		if server.VLANInterface != "" && !skip[id] {
+			servers[id] = *server
+		}
+	}
+	a.mu.Unlock()
+
+	for id, server := range servers {
+		if _, err := vlanManager.RestoreVLANInterface(server.Port, server.VLANOptions); err != nil {
+			a.warnings.Add("vlan", "Error restoring VLAN interface for server %s: %v", id, err)
+			continue
+		}
+		vlanManager.AssignServer(server.Port, id)
 	}
+}
 
+// loadConfig loads the saved configuration from the config file, which is
+// the source of truth. The database copy is brought up to date with it;
+// when there is no file yet but the database holds state, as after
+// earlier versions imported the file, the state is loaded from the
+// database and the file written from it.
+func (a *App) loadConfig() {
 	var config AppConfig
-	if err := json.Unmarshal(data, &config); err != nil {
-		fmt.Printf("Error loading configuration: %v\n", err)
+	source, err := readConfigFile(a.configPath, &config)
+	switch {
+	case os.IsNotExist(err) && a.store != nil && !a.store.Empty():
+		if config, err = a.store.Load(); err != nil {
+			a.configErr = err
+			a.warnings.Add("config", "Error loading configuration: %v", err)
+			return
+		}
+		a.requestSave()
+	case os.IsNotExist(err):
 		return
+	case err != nil:
+		a.configErr = err
+		a.warnings.Add("config", "Error loading configuration: %v", err)
+		return
+	default:
+		if source != a.configPath {
+			a.warnings.Add("config", "Configuration %s is corrupt; recovered from backup %s", a.configPath, source)
+		}
+		if a.store != nil {
+			if err := a.store.Save(config); err != nil {
+				a.warnings.Add("config", "Error updating the database from %s: %v", a.configPath, err)
+			}
+		}
 	}
 
-	a.servers = config.Servers
-	a.nextID = config.NextID
+	if config.Servers != nil {
+		a.servers = config.Servers
+	}
+	if config.NextID > 0 {
+		a.nextID = config.NextID
+	}
+	if config.Groups != nil {
+		a.groups = config.Groups
+	}
+	if config.NextGroupID > 0 {
+		a.nextGroupID = config.NextGroupID
+	}
+	if config.Templates != nil {
+		a.templates = config.Templates
+	}
+	if config.NextTemplateID > 0 {
+		a.nextTemplateID = config.NextTemplateID
+	}
+	a.settings = config.Settings
+	a.headerRules = config.HeaderRules
+	a.branding = config.Branding
+	a.readOnly = config.ReadOnly
+	a.managerOptions = config.Manager
+	a.apiAccess = config.Access
 
 	// Ensure all servers are marked as not running on startup
 	for _, server := range a.servers {
@@ -105,37 +368,81 @@ func (a *App) loadConfig() {
 	}
 }
 
-// saveConfig saves the current configuration to disk
+// saveConfig writes the current configuration to the config file, as
+// JSON or YAML after its name, atomically and keeping the previous
+// versions as backups, and then to the database
 func (a *App) saveConfig() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	config := AppConfig{
-		Servers: a.servers,
-		NextID:  a.nextID,
+		Servers:        a.servers,
+		NextID:         a.nextID,
+		Groups:         a.groups,
+		NextGroupID:    a.nextGroupID,
+		Templates:      a.templates,
+		NextTemplateID: a.nextTemplateID,
+		Settings:       a.settings,
+		HeaderRules:    a.headerRules,
+		Branding:       a.branding,
+		ReadOnly:       a.readOnly,
+		Manager:        a.managerOptions,
+		Access:         a.apiAccess,
 	}
 
-	data, err := json.MarshalIndent(config, "", "  ")
+	var data []byte
+	var err error
+	if isYAMLFile(a.configPath) {
+		data, err = toYAML(config)
+	} else {
+		data, err = json.MarshalIndent(config, "", "  ")
+	}
 	if err != nil {
-		fmt.Printf("Error serializing configuration: %v\n", err)
+		a.warnings.Add("config", "Error serializing configuration: %v", err)
+		return
+	}
+
+	if err := rotateBackups(a.configPath, data); err != nil {
+		a.warnings.Add("config", "Error rotating configuration backups: %v", err)
+	}
+	if err := writeFileAtomic(a.configPath, data, 0644); err != nil {
+		a.warnings.Add("config", "Error saving configuration: %v", err)
 		return
 	}
+	a.configWritten = sha256.Sum256(data)
 
-	if err := ioutil.WriteFile(a.configPath, data, 0644); err != nil {
-		fmt.Printf("Error saving configuration: %v\n", err)
+	// The database records the history of the changes
+	if a.store != nil {
+		if err := a.store.Save(config); err != nil {
+			a.warnings.Add("config", "Error saving configuration to the database: %v", err)
+		}
 	}
 }
 
-// GetServers returns all configured servers
-func (a *App) GetServers() []*Server {
+// GetServers returns the configured servers matching opts and the number
+// that matched before paging. Zero options return all of them, ordered
+// by ID.
+func (a *App) GetServers(opts ServerListOptions) ([]*Server, int) {
 	a.mu.Lock()
-	defer a.mu.Unlock()
-
 	servers := make([]*Server, 0, len(a.servers))
 	for _, server := range a.servers {
 		servers = append(servers, server)
 	}
-	return servers
+	a.mu.Unlock()
+
+	return listServers(servers, opts)
+}
+
+// GetServer returns a copy of a server's configuration
+func (a *App) GetServer(id string) (Server, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return Server{}, false
+	}
+	return *server, true
 }
 
 // CreateServer adds a new server configuration
@@ -152,13 +459,48 @@ func (a *App) CreateServer(name, port, directory string) string {
 		Port:      port,
 		Directory: directory,
 		Running:   false,
+		Framework: detectFramework(directory).Framework,
 	}
 
 	a.servers[id] = server
-	go a.saveConfig()
+	a.events.Record(context.Background(), eventServerCreated, id, name, fmt.Sprintf("Created %s on port %s", name, port))
+	a.requestSave()
 	return id
 }
 
+// provisionServer creates the VLAN interface, when the manager is allowed
+// to, and the server described by spec
+func (a *App) provisionServer(spec ServerSpec, vlanManager *VLANManager) (string, *VLANInterface, error) {
+	vlanInterface := &VLANInterface{}
+	if vlanManager.privileges.CanManageVLANs() {
+		var err error
+		vlanInterface, err = vlanManager.CreateVLANInterface(spec.Port, spec.VLANOptions)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create VLAN interface: %w", err)
+		}
+	}
+
+	id := a.CreateServer(spec.Name, spec.Port, spec.Directory)
+	vlanManager.AssignServer(spec.Port, id)
+
+	// Update server with VLAN information and the remaining settings
+	a.mu.Lock()
+	if server, exists := a.servers[id]; exists {
+		server.VLANInterface = vlanInterface.Name
+		server.IPv6Address = vlanInterface.IPv6Address
+		server.VLANOptions = spec.VLANOptions
+		server.Labels = spec.Labels
+		server.Env = spec.Env
+		server.PHPIni = spec.PHPIni
+		server.RunAsUser = spec.RunAsUser
+		server.Git = spec.Git
+		server.Owner = spec.Owner
+	}
+	a.mu.Unlock()
+
+	return id, vlanInterface, nil
+}
+
 // UpdateServer updates an existing server configuration
 func (a *App) UpdateServer(id, name, port, directory string) bool {
 	a.mu.Lock()
@@ -178,19 +520,34 @@ func (a *App) UpdateServer(id, name, port, directory string) bool {
 	server.Name = name
 	server.Port = port
 	server.Directory = directory
+	server.Framework = detectFramework(directory).Framework
 
-	go a.saveConfig()
+	a.requestSave()
 	return true
 }
 
 // DeleteServer removes a server configuration
 func (a *App) DeleteServer(id string) bool {
+	server, _, exists := a.detachServer(id)
+	if !exists {
+		return false
+	}
+
+	a.releaseServer(server)
+	a.events.Record(context.Background(), eventServerDeleted, id, server.Name, fmt.Sprintf("Deleted %s", server.Name))
+	return true
+}
+
+// detachServer stops a server and removes it from the configuration and
+// its groups, which are returned, keeping what it owns on disk and in
+// attached services
+func (a *App) detachServer(id string) (Server, []string, bool) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
 	server, exists := a.servers[id]
 	if !exists {
-		return false
+		return Server{}, nil, false
 	}
 
 	if server.Running {
@@ -199,9 +556,58 @@ func (a *App) DeleteServer(id string) bool {
 		a.mu.Lock()
 	}
 
+	groups := []string{}
+	for groupID, group := range a.groups {
+		for _, member := range group.Servers {
+			if member == id {
+				groups = append(groups, groupID)
+				break
+			}
+		}
+	}
+	sortByNumericID(groups)
+
 	delete(a.servers, id)
-	go a.saveConfig()
-	return true
+	a.removeServerFromGroupsLocked(id)
+	a.stats.Forget(id)
+	a.traffic.Forget(id)
+	a.fileWatcher.Forget(id)
+	a.lifecycle.Forget(id)
+	a.health.Forget(id)
+	a.requestSave()
+	return *server, groups, true
+}
+
+// releaseServer drops what a removed server owns: its database, mailbox
+// and Redis, certificates, generated files, deploys, backups, workers,
+// scheduled tasks and webhooks
+func (a *App) releaseServer(server Server) {
+	id := server.ID
+	if server.Database != nil {
+		go func(db DatabaseConfig) {
+			if err := a.dropDatabase(context.Background(), id, db); err != nil {
+				a.warnings.Add("database", "Error dropping the database of deleted server %s: %v", id, err)
+			}
+		}(*server.Database)
+	}
+	if server.Mail != nil {
+		go a.removeMail(context.Background(), id, server.Mail)
+	}
+	if server.Redis != nil {
+		go a.removeRedis(context.Background(), id, server.Redis)
+	}
+	if a.certs != nil {
+		a.certs.Delete(id)
+	}
+	os.RemoveAll(serverPHPDir(a.configDir, id))
+	os.RemoveAll(serverScriptDir(a.configDir, id))
+	os.Remove(serverScriptDir(a.configDir, id) + ".opcache-token")
+	a.logForwarder.Forget(id)
+	a.deploys.Forget(id)
+	a.backups.Forget(id)
+	a.supervisor.Forget(id)
+	a.tasks.Forget(id)
+	a.hooks.Forget(id)
 }
 
 func getCurrentUsername() string {
@@ -214,76 +620,373 @@ func getCurrentUsername() string {
 
 // StartServer starts a PHP server
 func (a *App) StartServer(id string) bool {
+	return a.StartServerContext(context.Background(), id)
+}
+
+// StartServerContext starts a PHP server, tagging logs and warnings with
+// the request ID carried by ctx
+func (a *App) StartServerContext(ctx context.Context, id string) bool {
+	_, started := a.launchServer(ctx, id, "")
+	return started
+}
+
+// launchServer starts the process of a server and returns its PID. With a
+// standby port the server must be running: a second process is started on
+// that port next to it and left to the caller to adopt, as a reload does.
+func (a *App) launchServer(ctx context.Context, id, standbyPort string) (int, bool) {
+	standby := standbyPort != ""
 	a.mu.Lock()
 	server, exists := a.servers[id]
-	if !exists || server.Running {
+	if !exists || server.Running != standby {
 		a.mu.Unlock()
-		return false
+		return 0, false
 	}
 	a.mu.Unlock()
 
+	// Binding the address fails while the interface is down or DAD runs
+	if _, err := a.waitForVLAN(ctx, id); err != nil {
+		a.warnings.AddContext(ctx, "vlan", "Error starting server %s: %v", id, err)
+		return 0, false
+	}
+
+	// Serve from the framework's document root, e.g. public/ for Laravel
+	preset, _ := a.refreshFramework(id)
+	if current, exists := a.GetServer(id); exists {
+		a.warnDotEnv(ctx, current)
+		// A standby process replaces one that is running, so it is no start
+		if !standby && a.runLifecycleHook(ctx, current, "pre_start") != nil {
+			return 0, false
+		}
+	}
+
 	// Use IPv6 address if available, otherwise use 0.0.0.0
-	listenAddr := "0.0.0.0"
+	backend := server.backend()
+	daemon, isDaemon := backend.(daemonBackend)
+	launch := LaunchSpec{ServerID: id, Address: "0.0.0.0", Port: firstNonEmpty(standbyPort, server.Port), Directory: preset.servedRoot(server.Directory)}
 	if server.IPv6Address != "" {
-		listenAddr = "[" + server.IPv6Address + "]"
+		launch.Address = server.IPv6Address
+	}
+	if isDaemon {
+		launch.Address = daemon.ListenAddress(launch.Address)
+	}
+	var frankenphp, workerRoute []string
+	if worker := server.Worker; worker != nil {
+		var err error
+		if workerRoute, err = worker.route(server.Directory, launch.Directory); err != nil {
+			a.warnings.AddContext(ctx, "server", "Error starting server %s: %v", id, err)
+			return 0, false
+		}
+		launch.WorkerScript, launch.WorkerWatch = worker.scriptPath(server.Directory), worker.Watch
+		frankenphp = worker.globalOptions(server.Directory)
+	}
+
+	// Serve over TLS with the uploaded certificate when one is present and
+	// apply per-server site directives such as compression
+	if a.certs != nil {
+		directives := append(server.Compression.Directives(), accessLogDirective(serverAccessLog(a.configDir, id), a.storage.LogPolicy()))
+		directives = append(directives, server.StaticCache.Directives()...)
+		directives = append(directives, preset.Rewrites...)
+		directives = append(directives, workerRoute...)
+		directives = append(directives, headerDirectives(a.effectiveHeaderRules(id))...)
+		directives = append(directives, server.Access.Directives()...)
+		opcache, err := a.opcacheDirectives(id)
+		if err != nil {
+			a.warnings.AddContext(ctx, "server", "Error preparing the OPcache script for server %s: %v", id, err)
+			return 0, false
+		}
+		directives = append(directives, opcache...)
+		launch.Caddyfile, err = a.certs.WriteCaddyfile(id, launch.Address, launch.Port, launch.Directory, frankenphp, directives)
+		if err != nil {
+			a.warnings.AddContext(ctx, "server", "Error preparing Caddyfile for server %s: %v", id, err)
+			return 0, false
+		}
+	}
+	envNames := make([]string, 0, len(server.Env))
+	for name := range server.Env {
+		envNames = append(envNames, name)
+	}
+	sort.Strings(envNames)
+	// Variables of the services attached to the server
+	var serviceEnv []string
+	if server.Database != nil {
+		serviceEnv = server.Database.Environment()
+		if err := a.startDatabase(ctx, id, server.Database); err != nil {
+			a.warnings.AddContext(ctx, "database", "Error starting the database of server %s: %v", id, err)
+		}
+	}
+	if redisEnv, err := a.startRedis(ctx, id, server.Redis); err != nil {
+		a.warnings.AddContext(ctx, "redis", "Error starting the Redis of server %s: %v", id, err)
+	} else {
+		serviceEnv = append(serviceEnv, redisEnv...)
+	}
+	catcher, err := a.startMail(ctx, id, server.Mail)
+	if err != nil {
+		a.warnings.AddContext(ctx, "mail", "Error starting the Mailpit of server %s, its mail is sent as usual: %v", id, err)
+	} else if catcher != nil {
+		serviceEnv = append(serviceEnv, catcher.Environment()...)
+	}
+	if isDaemon {
+		if err := a.fillDaemonSpec(&launch, *server, envNames, serviceEnv); err != nil {
+			a.warnings.AddContext(ctx, "server", "Error starting server %s: %v", id, err)
+			return 0, false
+		}
+	}
+	argv, err := backend.Command(launch)
+	if err != nil {
+		a.warnings.AddContext(ctx, "server", "Error starting server %s: %v", id, err)
+		return 0, false
 	}
 
-	command := fmt.Sprintf("frankenphp php-server --listen %s:%s -r %s", listenAddr, server.Port, server.Directory)
-	os.Setenv("PATH", "/usr/local/bin:"+os.Getenv("PATH"))
-	username := getCurrentUsername()
-	fullCommand := fmt.Sprintf("sudo -u %s /bin/bash -c '%s'", username, command)
-	cmd := exec.Command("/bin/bash", "-c", fullCommand)
+	cmd := exec.Command(argv[0], argv[1:]...)
 
 	cmd.Dir, _ = os.Getwd()
+	// Run in a separate process group so the server outlives one-shot
+	// commands and can be stopped together with any children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = childEnvironment()
+
+	// Drop root for the PHP process by switching to the server's user when
+	// it is started; unprivileged managers run it as themselves. Daemon
+	// backends leave switching to the daemon, which only needs the files
+	// handed over when the server has a run_as_user.
+	logDir := serverLogDir(a.configDir, id)
+	if runAs := a.runAsUser(*server); a.privileges.Root && (!isDaemon || runAs != "") {
+		account, err := lookupRunAccount(runAs)
+		if err != nil {
+			a.warnings.AddContext(ctx, "server", "Error starting server %s: %v", id, err)
+			return 0, false
+		}
+		if !isDaemon {
+			cmd.SysProcAttr.Credential = account.credential()
+			cmd.Env = append(cmd.Env, account.environment()...)
+		}
+
+		os.MkdirAll(logDir, 0755)
+		owned := []string{logDir}
+		if launch.Caddyfile != "" {
+			owned = append(owned, filepath.Dir(launch.Caddyfile), serverScriptDir(a.configDir, id))
+			if keyDir, written := a.certs.writtenKeyDir(id); written {
+				owned = append(owned, keyDir)
+			}
+		}
+		for _, path := range owned {
+			if err := account.chownTree(path); err != nil {
+				a.warnings.AddContext(ctx, "server", "Error handing %s to user %s: %v", path, account.name, err)
+				return 0, false
+			}
+		}
+	} else if !isDaemon && server.RunAsUser != "" && server.RunAsUser != currentUsername() {
+		a.warnings.AddContext(ctx, "server", "Server %s is set to run as %s, which needs a manager running as root", id, server.RunAsUser)
+		return 0, false
+	}
+
+	// Start inside the server's cgroup so its limits apply from the first
+	// instruction
+	if server.Limits.Set() && !isDaemon {
+		cgroup, err := prepareServerCgroup(id, server.Limits)
+		if err != nil {
+			a.warnings.AddContext(ctx, "server", "Error applying resource limits to server %s: %v", id, err)
+			return 0, false
+		}
+		defer cgroup.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+	// Add the generated ini files with the server's php.ini directives and
+	// xdebug settings to the default scan directory; a PHP_INI_SCAN_DIR in the server's env still wins
+	if current, exists := a.GetServer(id); exists {
+		// mail() goes to the Mailpit unless the server sets sendmail_path
+		if catcher != nil {
+			if path, err := catcher.sendmailPath(); err == nil && current.PHPIni["sendmail_path"] == "" {
+				directives := map[string]string{"sendmail_path": path}
+				for key, value := range current.PHPIni {
+					directives[key] = value
+				}
+				current.PHPIni = directives
+			}
+		}
+		iniDir, err := a.writePHPIni(current)
+		if err != nil {
+			a.warnings.AddContext(ctx, "server", "Error writing PHP settings for server %s: %v", id, err)
+			return 0, false
+		}
+		if iniDir != "" {
+			cmd.Env = append(cmd.Env, "PHP_INI_SCAN_DIR=:"+iniDir)
+		}
+	}
+	// The server's own env wins over the services' variables
+	cmd.Env = append(cmd.Env, serviceEnv...)
+	for _, name := range envNames {
+		cmd.Env = append(cmd.Env, name+"="+server.Env[name])
+	}
 
-	err := cmd.Start()
+	// Capture the server's output in its log directory
+	var logFile *os.File
+	if err := os.MkdirAll(logDir, 0755); err == nil {
+		logFile, err = os.OpenFile(filepath.Join(logDir, activeLogName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			a.warnings.AddContext(ctx, "server", "Error opening log for server %s: %v", id, err)
+		} else {
+			cmd.Stdout = logFile
+			cmd.Stderr = logFile
+		}
+	}
+
+	if isDaemon {
+		if err := daemon.Prepare(ctx, launch); err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			a.warnings.AddContext(ctx, "server", "Error preparing %s for server %s: %v", backend.Name(), id, err)
+			return 0, false
+		}
+	}
+
+	logAttrs(ctx, slog.LevelInfo, "exec", slog.String("server", id), slog.String("backend", backend.Name()), slog.Any("argv", argv))
+	err = cmd.Start()
 	if err != nil {
-		fmt.Printf("Error starting server: %v\n", err)
-		return false
+		if logFile != nil {
+			logFile.Close()
+		}
+		a.warnings.AddContext(ctx, "server", "Error starting server %s: %v", id, err)
+		return 0, false
+	}
+
+	pid := cmd.Process.Pid
+	wait := func() {
+		err := cmd.Wait()
+		if logFile != nil {
+			logFile.Close()
+		}
+		a.processExited(id, pid, err != nil)
+	}
+	if standby {
+		logAttrs(ctx, slog.LevelInfo, "standby", slog.String("server", id), slog.Int("pid", pid), slog.String("port", launch.Port))
+		go wait()
+		return pid, true
 	}
 
 	a.mu.Lock()
-	a.processes[id] = cmd
+	a.processes[id] = pid
+	delete(a.pendingRestarts, id)
 	server.Running = true
 	a.mu.Unlock()
 
-	go func() {
-		cmd.Wait()
-		a.mu.Lock()
-		delete(a.processes, id)
-		server.Running = false
-		a.mu.Unlock()
-	}()
+	// Containers bring their own runtime, which host upgrades don't touch
+	if !isDaemon {
+		a.runtime.RecordStart(id)
+	}
 
-	return true
+	if err := writePIDFile(serverPIDPath(a.configDir, id), pid); err != nil {
+		a.warnings.AddContext(ctx, "server", "Error writing PID file for server %s: %v", id, err)
+	}
+
+	if err := a.store.Record(id, "started", fmt.Sprintf("port %s", server.Port)); err != nil {
+		a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, err)
+	}
+	a.annotations.Record(ctx, id, server.Name, "start", fmt.Sprintf("Started %s on port %s", server.Name, server.Port))
+	a.events.Record(ctx, eventServerStarted, id, server.Name, fmt.Sprintf("Started %s on port %s", server.Name, server.Port))
+	a.notifier.Notify(ctx, "started", id, server.Name, fmt.Sprintf("started on port %s", server.Port))
+	a.startWatch(ctx, *server)
+	a.startWorkerProcesses(ctx, *server, server.Workers...)
+	a.openPortMapping(ctx, *server)
+	// Post-start hooks may wait for the server to warm up, so they don't
+	// hold up the start or end with the request
+	go a.runLifecycleHook(context.WithoutCancel(ctx), *server, "post_start")
+
+	go wait()
+
+	return pid, true
 }
 
 // StopServer stops a running PHP server
 func (a *App) StopServer(id string) bool {
+	return a.StopServerContext(context.Background(), id)
+}
+
+// StopServerContext stops a running PHP server, tagging logs and warnings
+// with the request ID carried by ctx
+func (a *App) StopServerContext(ctx context.Context, id string) bool {
+	return a.stopServer(ctx, id, 0)
+}
+
+// stopServer stops a running PHP server. With a drain, the process gets
+// SIGTERM and up to drain to finish its requests before it is killed.
+func (a *App) stopServer(ctx context.Context, id string, drain time.Duration) bool {
 	a.mu.Lock()
+	delete(a.pendingRestarts, id)
 	server, exists := a.servers[id]
 	if !exists || !server.Running {
 		a.mu.Unlock()
 		return false
 	}
 
-	cmd, exists := a.processes[id]
+	pid, exists := a.processes[id]
 	if !exists {
 		server.Running = false
 		a.mu.Unlock()
 		return true
 	}
+	// Released before the kill so the exit is not taken for a crash
+	delete(a.processes, id)
 	a.mu.Unlock()
 
-	if err := cmd.Process.Kill(); err != nil {
-		fmt.Printf("Error stopping server: %v\n", err)
+	a.runLifecycleHook(ctx, *server, "pre_stop")
+	a.tunnels.Close(id)
+	a.portMappings.Close(id)
+	a.fileWatcher.Unwatch(id)
+	a.supervisor.StopAll(id)
+
+	// Killing the client of a daemon backend leaves the server running, so
+	// the daemon is asked to stop it first
+	if daemon, ok := server.backend().(daemonBackend); ok {
+		if err := daemon.Stop(ctx, id); err != nil {
+			a.warnings.AddContext(ctx, "server", "Error stopping server %s through %s: %v", id, daemon.Name(), err)
+		}
+	}
+
+	logAttrs(ctx, slog.LevelInfo, "kill", slog.String("server", id), slog.Int("pid", pid))
+	if drain > 0 {
+		drainProcess(pid, drain)
+	} else if err := killProcessGroup(pid); err != nil {
+		a.mu.Lock()
+		if _, replaced := a.processes[id]; !replaced {
+			a.processes[id] = pid
+		}
+		a.mu.Unlock()
+		a.warnings.AddContext(ctx, "server", "Error stopping server %s: %v", id, err)
 		return false
 	}
 
 	a.mu.Lock()
-	delete(a.processes, id)
 	server.Running = false
 	a.mu.Unlock()
+	removePIDFile(serverPIDPath(a.configDir, id), pid)
+	removeServerCgroup(id)
+	if a.certs != nil {
+		a.certs.RemoveKeyFiles(id)
+	}
+	if err := a.reloads.Clear(id); err != nil {
+		a.warnings.AddContext(ctx, "server", "Error removing the reload rules of server %s: %v", id, err)
+	}
+	if err := a.stopRedis(ctx, id, server.Redis); err != nil {
+		a.warnings.AddContext(ctx, "redis", "Error stopping the Redis of server %s: %v", id, err)
+	}
+	if err := a.stopMail(ctx, id, server.Mail); err != nil {
+		a.warnings.AddContext(ctx, "mail", "Error stopping the Mailpit of server %s: %v", id, err)
+	}
+	if err := a.stopDatabase(ctx, id, server.Database); err != nil {
+		a.warnings.AddContext(ctx, "database", "Error stopping the database of server %s: %v", id, err)
+	}
+
+	if err := a.store.Record(id, "stopped", ""); err != nil {
+		a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, err)
+	}
+	a.annotations.Record(ctx, id, server.Name, "stop", fmt.Sprintf("Stopped %s on port %s", server.Name, server.Port))
+	a.events.Record(ctx, eventServerStopped, id, server.Name, fmt.Sprintf("Stopped %s on port %s", server.Name, server.Port))
+	a.health.Forget(id)
+	a.notifier.Notify(ctx, "stopped", id, server.Name, fmt.Sprintf("stopped on port %s", server.Port))
+	a.runLifecycleHook(ctx, *server, "post_stop")
 
 	return true
 }
@@ -297,6 +1000,19 @@ func (a *App) GetServerStatus(id string) (bool, bool) {
 	if !exists {
 		return false, false
 	}
-	
+
 	return true, server.Running
 }
+
+// portOwner returns the ID of the server assigned to port, if any
+func (a *App) portOwner(port string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for id, server := range a.servers {
+		if server.Port == port {
+			return id, true
+		}
+	}
+	return a.reloads.PortOwner(port)
+}
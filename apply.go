@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ApplyReport is the plan of an apply and what converging to it did
+type ApplyReport struct {
+	*ConfigPlan
+	PlanOnly  bool     `json:"plan_only"`
+	Applied   bool     `json:"applied"`
+	Restarted []string `json:"servers_restarted"`
+	Errors    []string `json:"errors"` // steps that failed while converging
+}
+
+// Apply converges the manager to doc, the complete desired state: servers,
+// groups and templates missing from it are deleted, the rest created or
+// updated, VLAN options applied to the interfaces and running servers
+// whose changes need it restarted. With planOnly only the plan is
+// computed. Nothing changes when the plan has problems.
+func (a *App) Apply(ctx context.Context, doc *ConfigExport, planOnly bool, vlanManager *VLANManager) *ApplyReport {
+	// Deletes and conditional updates must not interleave with an apply
+	a.editMu.Lock()
+	defer a.editMu.Unlock()
+
+	report := &ApplyReport{
+		ConfigPlan: a.PlanConfig(doc, true, vlanManager),
+		PlanOnly:   planOnly,
+		Restarted:  []string{},
+		Errors:     []string{},
+	}
+	if planOnly || len(report.Problems) > 0 {
+		return report
+	}
+
+	imported := a.ImportConfig(doc, true, false, vlanManager)
+	if !imported.Applied {
+		report.Problems = append(report.Problems, imported.Problems...)
+		return report
+	}
+	report.Applied = true
+	report.Errors = append(report.Errors, imported.Problems...)
+	logAttrs(ctx, slog.LevelInfo, "apply", slog.String("plan", report.Summary))
+
+	// Imports only record VLAN options; existing interfaces get them here
+	for _, change := range report.Changes {
+		if change.Resource != "server" || change.Action != "update" {
+			continue
+		}
+		for _, field := range change.Fields {
+			if field.Field != "vlan_options" {
+				continue
+			}
+			server, exists := a.GetServer(change.ID)
+			if !exists || server.VLANInterface == "" || vlanManager.GetVLANForPort(server.Port) == nil {
+				continue
+			}
+			if err := vlanManager.SetVLANOptions(server.Port, server.VLANOptions); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("server %s: applying VLAN options: %v", change.ID, err))
+			}
+		}
+	}
+
+	for _, id := range report.Restarts {
+		if !a.StopServerContext(ctx, id) || !a.StartServerContext(ctx, id) {
+			report.Errors = append(report.Errors, fmt.Sprintf("server %s: did not restart; see /api/warnings", id))
+			continue
+		}
+		report.Restarted = append(report.Restarted, id)
+	}
+	return report
+}
+
+// Text renders the plan and the outcome of the apply for people
+func (r *ApplyReport) Text() string {
+	var b strings.Builder
+	b.WriteString(r.ConfigPlan.Text())
+	for _, id := range r.Restarted {
+		fmt.Fprintf(&b, "restarted server %s\n", id)
+	}
+	for _, message := range r.Errors {
+		fmt.Fprintf(&b, "error: %s\n", message)
+	}
+	switch {
+	case r.Applied:
+		b.WriteString("Apply complete.\n")
+	case !r.PlanOnly:
+		b.WriteString("Nothing was applied.\n")
+	}
+	return b.String()
+}
+
+// handleApply converges the manager to the desired state in a JSON or
+// YAML export and returns the plan it followed. ?plan_only=true only
+// computes the plan; ?output=text or Accept: text/plain returns it as
+// text. Invalid documents get 422 and change nothing.
+func (a *App) handleApply(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	doc, ok := decodeConfigDocument(w, r)
+	if !ok {
+		return
+	}
+	planOnly := r.URL.Query().Get("plan_only") == "true"
+
+	report := a.Apply(r.Context(), doc, planOnly, vlanManager)
+
+	status := http.StatusOK
+	if !planOnly && !report.Applied {
+		status = http.StatusUnprocessableEntity
+	}
+
+	if r.URL.Query().Get("output") == "text" || strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(report.Text()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultStaticMaxAge is how long browsers may cache static assets, in
+// seconds (7 days)
+const defaultStaticMaxAge = 7 * 24 * 3600
+
+// defaultStaticExtensions are the file types treated as static assets
+var defaultStaticExtensions = []string{
+	"css", "js", "mjs", "map", "png", "jpg", "jpeg", "gif", "svg", "webp", "avif", "ico",
+	"woff", "woff2", "ttf", "otf", "eot", "mp4", "webm",
+}
+
+// validExtension matches a file extension without the dot
+var validExtension = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// StaticCache sets Cache-Control on static assets a server serves from
+// disk, so browsers don't ask for them again on every page. Responses from
+// PHP are left alone.
+type StaticCache struct {
+	Enabled    bool     `json:"enabled"`
+	MaxAge     int      `json:"max_age,omitempty"`    // seconds, 7 days when zero
+	Immutable  bool     `json:"immutable,omitempty"`  // for fingerprinted assets such as app.3f9a1c.js
+	Extensions []string `json:"extensions,omitempty"` // without the dot; common asset types when empty
+}
+
+// Validate checks the caching options
+func (sc StaticCache) Validate() error {
+	if sc.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	for _, extension := range sc.Extensions {
+		if !validExtension.MatchString(extension) {
+			return fmt.Errorf("invalid extension %q, use lower case and no dot", extension)
+		}
+	}
+	return nil
+}
+
+// Directives returns the Caddyfile site directives for the options, or
+// nil when caching is disabled. The file matcher limits the header to
+// files that exist on disk.
+func (sc StaticCache) Directives() []string {
+	if !sc.Enabled {
+		return nil
+	}
+
+	extensions := sc.Extensions
+	if len(extensions) == 0 {
+		extensions = defaultStaticExtensions
+	}
+	paths := make([]string, len(extensions))
+	for i, extension := range extensions {
+		paths[i] = "*." + extension
+	}
+
+	maxAge := sc.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultStaticMaxAge
+	}
+	value := "public, max-age=" + strconv.Itoa(maxAge)
+	if sc.Immutable {
+		value += ", immutable"
+	}
+
+	return []string{
+		"@psm_static {\n\t\tfile\n\t\tpath " + strings.Join(paths, " ") + "\n\t}",
+		"header @psm_static Cache-Control " + caddyQuote(value),
+	}
+}
+
+// SetStaticCache replaces the static asset caching options of a server
+func (a *App) SetStaticCache(id string, cache StaticCache) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.StaticCache = cache
+
+	a.requestSave()
+	return true
+}
+
+// handleSetStaticCache sets the static asset caching options of a server.
+// They take effect the next time the server starts.
+func (a *App) handleSetStaticCache(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var cache StaticCache
+	if err := json.NewDecoder(r.Body).Decode(&cache); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := cache.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if !a.SetStaticCache(id, cache) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cache)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxAuditEntries bounds the number of audit entries kept in memory
+const maxAuditEntries = 500
+
+// AuditEntry records an administrative action
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	User      string    `json:"user"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+}
+
+// AuditLog keeps an append-only record of administrative actions
+type AuditLog struct {
+	mu      sync.Mutex
+	path    string
+	entries []AuditEntry
+}
+
+// NewAuditLog creates an audit log backed by a JSON lines file, loading
+// the most recent entries from it
+func NewAuditLog(path string) *AuditLog {
+	al := &AuditLog{path: path}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return al
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			al.entries = append(al.entries, entry)
+		}
+	}
+	if len(al.entries) > maxAuditEntries {
+		al.entries = al.entries[len(al.entries)-maxAuditEntries:]
+	}
+
+	return al
+}
+
+// Record appends an entry tagged with the request ID and the logged in
+// user from ctx
+func (al *AuditLog) Record(ctx context.Context, r *http.Request, action, target, reason string) {
+	entry := AuditEntry{
+		Time:      time.Now(),
+		RequestID: requestIDFromContext(ctx),
+		User:      userFromContext(ctx),
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+	}
+	if r != nil {
+		entry.Remote = r.RemoteAddr
+	}
+
+	logAttrs(ctx, slog.LevelInfo, "audit", slog.String("user", entry.User), slog.String("action", action), slog.String("target", target), slog.String("reason", reason))
+
+	if al == nil {
+		return
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	al.entries = append(al.entries, entry)
+	if len(al.entries) > maxAuditEntries {
+		al.entries = al.entries[len(al.entries)-maxAuditEntries:]
+	}
+
+	file, err := os.OpenFile(al.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	json.NewEncoder(file).Encode(entry)
+}
+
+// Entries returns up to limit of the most recent entries, newest last
+func (al *AuditLog) Entries(limit int) []AuditEntry {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	entries := al.entries
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return append([]AuditEntry{}, entries...)
+}
+
+// handleGetAudit returns recent audit entries; ?limit= bounds the count
+func (al *AuditLog) handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(al.Entries(limit))
+}
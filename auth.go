@@ -1,36 +1,59 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// defaultSessionUser is the admin when PSM_ADMINS is unset, and the user
+// of sessions created before logins named one
+const defaultSessionUser = "admin"
+
+// defaultSessionTTL is how long a login lasts unless the manager options
+// say otherwise
+const defaultSessionTTL = 24 * time.Hour
+
 // AuthMiddleware handles authentication
 type AuthMiddleware struct {
-	password string
-	sessions map[string]*Session
-	mu       sync.Mutex
+	users      *UserStore
+	sessions   SessionStore
+	limiter    LoginLimiter
+	warnings   *WarningCenter
+	events     *EventLog
+	sessionTTL atomic.Int64 // time.Duration of new sessions
 }
 
 // Session represents an authenticated session
 type Session struct {
 	Token     string    `json:"token"`
+	User      string    `json:"user"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
 // NewAuthMiddleware creates a new authentication middleware
-func NewAuthMiddleware(password string) *AuthMiddleware {
-	return &AuthMiddleware{
-		password: password,
-		sessions: make(map[string]*Session),
+func NewAuthMiddleware(users *UserStore) *AuthMiddleware {
+	am := &AuthMiddleware{
+		users:    users,
+		sessions: NewMemorySessionStore(),
+		limiter:  NewMemoryLoginLimiter(),
 	}
+	am.sessionTTL.Store(int64(defaultSessionTTL))
+	return am
+}
+
+// SetSessionTTL sets how long new sessions last; existing sessions keep
+// their expiry
+func (am *AuthMiddleware) SetSessionTTL(ttl time.Duration) {
+	am.sessionTTL.Store(int64(ttl))
 }
 
 // generateToken generates a random session token
@@ -46,41 +69,76 @@ func (am *AuthMiddleware) generateToken() (string, error) {
 func (am *AuthMiddleware) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	var loginData struct {
 		Password string `json:"password"`
+		User     string `json:"user"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&loginData); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	// Each user logs in with their own password from the users file. The
+	// session owns the servers they create and keeps their saved views, and
+	// manages every server when they are listed in PSM_ADMINS.
+	if loginData.User == "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "A user name is required")
+		return
+	}
+	if !validUsername.MatchString(loginData.User) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid user name")
 		return
 	}
 
-	if loginData.Password != am.password {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	// Refuse addresses with too many failed logins until their window ends
+	client := r.RemoteAddr
+	if ip := remoteIP(r); ip != nil {
+		client = ip.String()
+	}
+	failures, retryAfter, err := am.limiter.Failures(r.Context(), client)
+	if err != nil {
+		am.warnings.AddContext(r.Context(), "sessions", "Error reading failed logins: %v", err)
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Failed to check login attempts")
+		return
+	}
+	if failures >= maxFailedLogins {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+		writeError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many failed logins, try again later")
+		return
+	}
+
+	if !am.users.Verify(loginData.User, loginData.Password) {
+		if err := am.limiter.Fail(r.Context(), client); err != nil {
+			am.warnings.AddContext(r.Context(), "sessions", "Error counting failed login: %v", err)
+		}
+		am.events.Record(r.Context(), eventAuthFailed, "", "", fmt.Sprintf("Failed login of %s from %s", loginData.User, r.RemoteAddr))
+		writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Invalid user name or password")
 		return
 	}
 
 	// Generate session token
 	token, err := am.generateToken()
 	if err != nil {
-		http.Error(w, "Failed to generate session", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Failed to generate session")
 		return
 	}
 
 	session := &Session{
 		Token:     token,
+		User:      loginData.User,
 		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(24 * time.Hour), // 24 hour session
+		ExpiresAt: time.Now().Add(time.Duration(am.sessionTTL.Load())),
 	}
 
-	am.mu.Lock()
-	am.sessions[token] = session
-	am.mu.Unlock()
-
-	// Clean up expired sessions
-	go am.cleanupExpiredSessions()
+	if err := am.sessions.Put(r.Context(), session); err != nil {
+		am.warnings.AddContext(r.Context(), "sessions", "Error storing session: %v", err)
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Failed to store session")
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"token":      token,
+		"user":       session.User,
 		"expires_at": session.ExpiresAt.Format(time.RFC3339),
 	})
 }
@@ -89,13 +147,14 @@ func (am *AuthMiddleware) HandleLogin(w http.ResponseWriter, r *http.Request) {
 func (am *AuthMiddleware) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	token := am.extractToken(r)
 	if token == "" {
-		http.Error(w, "No token provided", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "No token provided")
 		return
 	}
 
-	am.mu.Lock()
-	delete(am.sessions, token)
-	am.mu.Unlock()
+	if err := am.sessions.Delete(r.Context(), token); err != nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Failed to delete session")
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -115,52 +174,60 @@ func (am *AuthMiddleware) extractToken(r *http.Request) string {
 	return r.URL.Query().Get("token")
 }
 
-// isValidToken checks if a token is valid and not expired
-func (am *AuthMiddleware) isValidToken(token string) bool {
-	am.mu.Lock()
-	defer am.mu.Unlock()
-
-	session, exists := am.sessions[token]
-	if !exists {
-		return false
+// validSession returns the session of a token that is valid and not
+// expired, or nil. Tokens are rejected when the session store can't be
+// reached.
+func (am *AuthMiddleware) validSession(ctx context.Context, token string) *Session {
+	session, err := am.sessions.Get(ctx, token)
+	if err != nil {
+		am.warnings.AddContext(ctx, "sessions", "Error looking up session: %v", err)
+		return nil
+	}
+	if session == nil {
+		return nil
 	}
 
 	if time.Now().After(session.ExpiresAt) {
-		delete(am.sessions, token)
-		return false
+		am.sessions.Delete(ctx, token)
+		return nil
 	}
 
-	return true
+	return session
+}
+
+// sessionUserKey is the context key for the logged-in user
+type sessionUserKey struct{}
+
+// userFromContext returns the user of the request's session. Sessions
+// created before users were recorded belong to the default user.
+func userFromContext(ctx context.Context) string {
+	if user, _ := ctx.Value(sessionUserKey{}).(string); user != "" {
+		return user
+	}
+	return defaultSessionUser
 }
 
 // Middleware is the authentication middleware function
 func (am *AuthMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip authentication for login endpoint
-		if strings.HasSuffix(r.URL.Path, "/auth/login") {
+		// Skip authentication for login endpoint, the API docs and the UI
+		// strings the login page needs
+		if strings.HasSuffix(r.URL.Path, "/auth/login") || r.URL.Path == "/api/openapi.json" || r.URL.Path == "/api/docs" || r.URL.Path == "/api/i18n" || strings.HasPrefix(r.URL.Path, "/api/i18n/") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		token := am.extractToken(r)
-		if token == "" || !am.isValidToken(token) {
-			http.Error(w, "Authentication required", http.StatusUnauthorized)
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Authentication required")
+			return
+		}
+		session := am.validSession(r.Context(), token)
+		if session == nil {
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Authentication required")
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, session.User)))
 	})
 }
-
-// cleanupExpiredSessions removes expired sessions
-func (am *AuthMiddleware) cleanupExpiredSessions() {
-	am.mu.Lock()
-	defer am.mu.Unlock()
-
-	now := time.Now()
-	for token, session := range am.sessions {
-		if now.After(session.ExpiresAt) {
-			delete(am.sessions, token)
-		}
-	}
-}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// authzTimeout bounds one policy check
+const authzTimeout = 5 * time.Second
+
+// AuthzResource is what a mutating request acts on
+type AuthzResource struct {
+	Type   string            `json:"type"` // server, group, template, ... from the path
+	ID     string            `json:"id,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Owner  string            `json:"owner,omitempty"`
+}
+
+// AuthzRequest is the context a policy decides on
+type AuthzRequest struct {
+	Subject   string        `json:"subject"` // the user named at login
+	Action    string        `json:"action"`  // method and route, e.g. DELETE /api/servers/{id}
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Resource  AuthzResource `json:"resource"`
+	Remote    string        `json:"remote"`
+	Time      time.Time     `json:"time"`
+	Weekday   string        `json:"weekday"`
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+// AuthzDecision is a policy's answer
+type AuthzDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Authorizer decides whether a mutating request may proceed. Every
+// configured authorizer must allow a request.
+type Authorizer interface {
+	Name() string
+	Authorize(ctx context.Context, req AuthzRequest) (AuthzDecision, error)
+}
+
+// policyAuthorizer asks an HTTP policy engine. The request is posted as
+// {"input": ...}, so an Open Policy Agent data API URL such as
+// http://opa:8181/v1/data/psm/allow works as is. The answer is
+// {"result": true|false} or {"result": {"allow": bool, "reason": "..."}}.
+type policyAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+// newPolicyAuthorizer returns an authorizer for the policy engine at url
+func newPolicyAuthorizer(url string) *policyAuthorizer {
+	return &policyAuthorizer{url: url, client: &http.Client{Timeout: authzTimeout}}
+}
+
+// Name returns the authorizer name
+func (pa *policyAuthorizer) Name() string {
+	return "policy " + pa.url
+}
+
+// Authorize posts the request to the policy engine
+func (pa *policyAuthorizer) Authorize(ctx context.Context, req AuthzRequest) (AuthzDecision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": req})
+	if err != nil {
+		return AuthzDecision{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", pa.url, bytes.NewReader(body))
+	if err != nil {
+		return AuthzDecision{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(requestIDHeader, req.RequestID)
+
+	resp, err := pa.client.Do(httpReq)
+	if err != nil {
+		return AuthzDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return AuthzDecision{}, fmt.Errorf("policy engine responded with %s", resp.Status)
+	}
+
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return AuthzDecision{}, err
+	}
+	// An undefined OPA rule has no result and denies
+	var allow bool
+	if err := json.Unmarshal(answer.Result, &allow); err == nil {
+		return AuthzDecision{Allow: allow}, nil
+	}
+	var decision AuthzDecision
+	if err := json.Unmarshal(answer.Result, &decision); err != nil {
+		return AuthzDecision{}, fmt.Errorf("policy engine answered without a result")
+	}
+	return decision, nil
+}
+
+// authzExempt lists mutating endpoints that are never checked, so a broken
+// policy can't lock everyone out of the session endpoints
+var authzExempt = []string{
+	"/api/auth/login",
+	"/api/auth/logout",
+}
+
+// AuthzGuard consults the authorizers on every mutating API request
+type AuthzGuard struct {
+	app         *App
+	audit       *AuditLog
+	authorizers []Authorizer
+	failOpen    bool // allow requests when an authorizer fails
+}
+
+// NewAuthzGuard creates a guard with the policy engine configured by
+// PSM_AUTHZ_POLICY_URL, if any. PSM_AUTHZ_FAIL_OPEN=true lets requests through
+// while the engine is unreachable; by default they are refused.
+func NewAuthzGuard(app *App, audit *AuditLog) *AuthzGuard {
+	guard := &AuthzGuard{app: app, audit: audit, failOpen: os.Getenv("PSM_AUTHZ_FAIL_OPEN") == "true"}
+	if url := os.Getenv("PSM_AUTHZ_POLICY_URL"); url != "" {
+		guard.authorizers = append(guard.authorizers, newPolicyAuthorizer(url))
+	}
+	return guard
+}
+
+// Add registers another authorizer
+func (ag *AuthzGuard) Add(authorizer Authorizer) {
+	ag.authorizers = append(ag.authorizers, authorizer)
+}
+
+// describe builds the policy input for a request
+func (ag *AuthzGuard) describe(r *http.Request) AuthzRequest {
+	now := time.Now()
+	req := AuthzRequest{
+		Subject:   userFromContext(r.Context()),
+		Action:    r.Method + " " + r.URL.Path,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Remote:    r.RemoteAddr,
+		Time:      now,
+		Weekday:   now.Weekday().String(),
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			req.Action = r.Method + " " + template
+		}
+	}
+
+	// The resource type is the first path segment after /api
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/"), "/")
+	req.Resource.Type = strings.TrimSuffix(segments[0], "s")
+	vars := mux.Vars(r)
+	req.Resource.ID = vars["id"]
+	switch req.Resource.Type {
+	case "server":
+		if server, exists := ag.app.GetServer(req.Resource.ID); exists {
+			req.Resource.Name = server.Name
+			req.Resource.Labels = server.Labels
+			req.Resource.Owner = server.Owner
+		}
+	case "group":
+		for _, group := range ag.app.GetGroups() {
+			if group.ID == req.Resource.ID {
+				req.Resource.Name = group.Name
+			}
+		}
+	}
+	return req
+}
+
+// Middleware refuses mutating requests a policy denies
+func (ag *AuthzGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(ag.authorizers) == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, path := range authzExempt {
+			if strings.TrimSuffix(r.URL.Path, "/") == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		req := ag.describe(r)
+		for _, authorizer := range ag.authorizers {
+			decision, err := authorizer.Authorize(r.Context(), req)
+			if err != nil {
+				ag.app.warnings.AddContext(r.Context(), "authz", "Error asking %s: %v", authorizer.Name(), err)
+				if ag.failOpen {
+					continue
+				}
+				writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Authorization policy is unavailable")
+				return
+			}
+			if !decision.Allow {
+				reason := decision.Reason
+				if reason == "" {
+					reason = "denied by policy"
+				}
+				ag.audit.Record(r.Context(), r, "authz.denied", req.Action, reason)
+				writeError(w, http.StatusForbidden, errCodeForbidden, "Forbidden: "+reason)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// LaunchSpec describes how a server should be served, independent of the
+// runtime that serves it
+type LaunchSpec struct {
+	ServerID  string
+	Address   string // IP address to bind, without brackets
+	Port      string
+	Directory string
+	Caddyfile string // generated site configuration, if any
+	// WorkerScript runs the server in worker mode; without a Caddyfile
+	// only the script and watch mode can be set
+	WorkerScript string
+	WorkerWatch  bool
+
+	// Set for daemon backends only, which run the server away from the
+	// manager's filesystem, environment and cgroups
+	Interface string   // VLAN interface the address is on, if any
+	Image     string   // container image
+	User      string   // uid:gid to run as, empty for the image's default
+	Env       []string // names of the manager environment variables to pass on
+	Mounts    []string // host directories the server reads or writes
+	Limits    ResourceLimits
+}
+
+// RuntimeBackend turns a launch spec into the argv of the process that
+// serves it. Arguments are passed to the process as they are, so paths
+// with spaces or shell metacharacters need no quoting.
+type RuntimeBackend interface {
+	Name() string
+	Command(spec LaunchSpec) ([]string, error)
+}
+
+// daemonBackend is implemented by backends whose command is only a client
+// of a daemon that runs the server, such as Docker. The client runs as the
+// manager, outside the server's cgroup; the daemon applies the user and
+// limits from the launch spec. Prepare sets up what the daemon needs
+// before the command starts, Operations describes that for dry runs and
+// Stop makes the daemon stop the server, which killing the client alone
+// may not.
+type daemonBackend interface {
+	RuntimeBackend
+	ListenAddress(address string) string
+	Prepare(ctx context.Context, spec LaunchSpec) error
+	Operations(spec LaunchSpec) []string
+	Stop(ctx context.Context, serverID string) error
+}
+
+// RuntimeConfig selects the backend that serves a server
+type RuntimeConfig struct {
+	Backend string `json:"backend"`         // frankenphp, docker or systemd
+	Image   string `json:"image,omitempty"` // docker only, dunglas/frankenphp by default
+}
+
+// runtimeBackends are the backends a server can select by name
+var runtimeBackends = map[string]RuntimeBackend{
+	runtimeBinary: frankenPHPBackend{},
+	"docker":      dockerBackend{},
+	"systemd":     systemdBackend{},
+}
+
+// Validate checks the runtime options
+func (rc RuntimeConfig) Validate() error {
+	if _, ok := runtimeBackends[rc.Backend]; !ok {
+		names := make([]string, 0, len(runtimeBackends))
+		for name := range runtimeBackends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("backend must be one of %s", strings.Join(names, ", "))
+	}
+	if rc.Image != "" {
+		if rc.Backend != "docker" {
+			return fmt.Errorf("image only applies to the docker backend")
+		}
+		if _, err := dockerImageKind(rc.Image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backend returns the backend that serves the server
+func (s Server) backend() RuntimeBackend {
+	if s.Runtime != nil {
+		if backend, ok := runtimeBackends[s.Runtime.Backend]; ok {
+			return backend
+		}
+	}
+	return defaultBackend
+}
+
+// serverOnBackend returns the server of a request if the named backend
+// runs it, writing the error response otherwise
+func (a *App) serverOnBackend(w http.ResponseWriter, r *http.Request, name string) (Server, bool) {
+	server, exists := a.GetServer(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return server, false
+	}
+	if server.backend().Name() != name {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("Server does not run on the %s backend", name))
+		return server, false
+	}
+	return server, true
+}
+
+// findRuntimeBinary locates a runtime binary in PATH or /usr/local/bin,
+// where the FrankenPHP installer puts it
+func findRuntimeBinary(name string) (string, error) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	path := filepath.Join("/usr/local/bin", name)
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return path, nil
+	}
+	return "", fmt.Errorf("%s was not found in PATH or /usr/local/bin", name)
+}
+
+// frankenPHPBackend serves servers with FrankenPHP, from the generated
+// Caddyfile when there is one and with php-server otherwise
+type frankenPHPBackend struct{}
+
+// Name returns the backend name
+func (frankenPHPBackend) Name() string {
+	return runtimeBinary
+}
+
+// Command returns the FrankenPHP argv for spec
+func (frankenPHPBackend) Command(spec LaunchSpec) ([]string, error) {
+	binary, err := findRuntimeBinary(runtimeBinary)
+	if err != nil {
+		return nil, err
+	}
+	return frankenPHPArgs(binary, spec), nil
+}
+
+// frankenPHPArgs returns the argv that runs binary, a FrankenPHP found on
+// the host or in a container, for spec
+func frankenPHPArgs(binary string, spec LaunchSpec) []string {
+	if spec.Caddyfile != "" {
+		return []string{binary, "run", "--config", spec.Caddyfile}
+	}
+	argv := []string{binary, "php-server", "--listen", net.JoinHostPort(spec.Address, spec.Port), "--root", spec.Directory}
+	if spec.WorkerScript != "" {
+		argv = append(argv, "--worker", spec.WorkerScript)
+		if spec.WorkerWatch {
+			argv = append(argv, "--watch")
+		}
+	}
+	return argv
+}
+
+// defaultBackend serves servers that select no backend
+var defaultBackend RuntimeBackend = frankenPHPBackend{}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// backupTimeout bounds a whole backup or restore, database included
+	backupTimeout = 30 * time.Minute
+	// defaultBackupsPerServer is how many backups of a server are kept
+	// unless configured otherwise
+	defaultBackupsPerServer = 10
+	// backupRootName and backupDumpName are the document root and the
+	// database dump inside a backup archive
+	backupRootName = "root"
+	backupDumpName = "database.sql"
+)
+
+var (
+	// errBackupRunning is returned while another backup or restore of the
+	// server runs
+	errBackupRunning = errors.New("a backup or restore of this server is already running")
+	// errBackupNotFound is returned for an unknown backup
+	errBackupNotFound = errors.New("backup not found")
+	// errNoDatabase is returned when backing up or restoring the database
+	// of a server without one
+	errNoDatabase = errors.New("server has no database")
+	// errDatabaseStopped is returned for a container database while its
+	// server is stopped
+	errDatabaseStopped = errors.New("start the server first, its database container only runs with it")
+	// errDatabaseEngine is returned when a dump can't be loaded into the
+	// server's database
+	errDatabaseEngine = errors.New("the backup's database doesn't match the server's")
+)
+
+// Backup is a snapshot of a server's document root and, optionally, its
+// database
+type Backup struct {
+	ID        string    `json:"id"`
+	ServerID  string    `json:"server_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Directory string    `json:"directory"`
+	Database  string    `json:"database,omitempty"` // engine of the dumped database
+	Note      string    `json:"note,omitempty"`
+	Archive   string    `json:"archive"`
+	Bytes     int64     `json:"bytes"`
+}
+
+// BackupState is the persisted retention policy and the backups of every
+// server
+type BackupState struct {
+	Keep    int                 `json:"keep"`
+	Backups map[string][]Backup `json:"backups"`
+}
+
+// BackupManager writes backups to backups/<server> below the config
+// directory, keeps the newest of each server and records them in
+// backups.json. Only one backup or restore per server runs at a time.
+type BackupManager struct {
+	mu      sync.Mutex
+	baseDir string
+	path    string
+	state   BackupState
+	busy    map[string]bool
+}
+
+// NewBackupManager loads the backups recorded below baseDir
+func NewBackupManager(baseDir string) *BackupManager {
+	bm := &BackupManager{
+		baseDir: baseDir,
+		path:    filepath.Join(baseDir, "backups.json"),
+		state:   BackupState{Keep: defaultBackupsPerServer, Backups: make(map[string][]Backup)},
+		busy:    make(map[string]bool),
+	}
+
+	if data, err := ioutil.ReadFile(bm.path); err == nil {
+		json.Unmarshal(data, &bm.state)
+	}
+	if bm.state.Backups == nil {
+		bm.state.Backups = make(map[string][]Backup)
+	}
+
+	return bm
+}
+
+// serverBackupDir holds the backup archives of a server
+func serverBackupDir(baseDir, id string) string {
+	return filepath.Join(baseDir, "backups", id)
+}
+
+// saveLocked persists the state; bm.mu must be held
+func (bm *BackupManager) saveLocked() error {
+	data, err := json.MarshalIndent(bm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bm.path, data, 0600)
+}
+
+// Keep returns how many backups per server are kept
+func (bm *BackupManager) Keep() int {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.state.Keep
+}
+
+// SetKeep configures how many backups per server are kept; older ones go
+// with the next backup of the server
+func (bm *BackupManager) SetKeep(keep int) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	bm.state.Keep = keep
+	return bm.saveLocked()
+}
+
+// List returns a server's backups, newest first
+func (bm *BackupManager) List(id string) []Backup {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	backups := make([]Backup, 0, len(bm.state.Backups[id]))
+	for i := len(bm.state.Backups[id]) - 1; i >= 0; i-- {
+		backups = append(backups, bm.state.Backups[id][i])
+	}
+	return backups
+}
+
+// Get returns one backup of a server
+func (bm *BackupManager) Get(id, backupID string) (Backup, bool) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	for _, backup := range bm.state.Backups[id] {
+		if backup.ID == backupID {
+			return backup, true
+		}
+	}
+	return Backup{}, false
+}
+
+// Forget removes the backups of a deleted server
+func (bm *BackupManager) Forget(id string) {
+	if bm == nil {
+		return
+	}
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if _, exists := bm.state.Backups[id]; exists {
+		delete(bm.state.Backups, id)
+		bm.saveLocked()
+	}
+	os.RemoveAll(serverBackupDir(bm.baseDir, id))
+}
+
+// begin marks a server as busy; it returns false when a backup or restore
+// of it already runs
+func (bm *BackupManager) begin(id string) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if bm.busy[id] {
+		return false
+	}
+	bm.busy[id] = true
+	return true
+}
+
+// done clears the busy flag of a server
+func (bm *BackupManager) done(id string) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	delete(bm.busy, id)
+}
+
+// add records a backup and removes the server's backups beyond the
+// retention
+func (bm *BackupManager) add(backup Backup) error {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	backups := append(bm.state.Backups[backup.ServerID], backup)
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].CreatedAt.Before(backups[j].CreatedAt) })
+	for len(backups) > bm.state.Keep {
+		os.Remove(backups[0].Archive)
+		backups = backups[1:]
+	}
+	bm.state.Backups[backup.ServerID] = backups
+	return bm.saveLocked()
+}
+
+// databaseClientCommand returns the command that dumps a server's
+// database, or with restore the one that loads a dump from stdin. It
+// connects as the server's own user, so it works on shared servers too.
+func databaseClientCommand(ctx context.Context, db DatabaseConfig, restore bool) *exec.Cmd {
+	var cmd *exec.Cmd
+	if db.postgres() {
+		args := []string{"--host", db.Host, "--port", db.Port, "--username", db.User, "--dbname", db.Name}
+		if restore {
+			cmd = exec.CommandContext(ctx, "psql", append(args, "--no-psqlrc", "--quiet", "-v", "ON_ERROR_STOP=1")...)
+		} else {
+			// --clean makes the dump replace what is there when restored
+			cmd = exec.CommandContext(ctx, "pg_dump", append(args, "--clean", "--if-exists", "--no-owner")...)
+		}
+		cmd.Env = append(childEnvironment(), "PGPASSWORD="+db.Password)
+		return cmd
+	}
+
+	args := []string{"--host", db.Host, "--port", db.Port, "--user", db.User}
+	if restore {
+		cmd = exec.CommandContext(ctx, "mysql", append(args, db.Name)...)
+	} else {
+		// --no-tablespaces spares the user the PROCESS privilege
+		cmd = exec.CommandContext(ctx, "mysqldump", append(args, "--single-transaction", "--no-tablespaces", db.Name)...)
+	}
+	cmd.Env = append(childEnvironment(), "MYSQL_PWD="+db.Password)
+	return cmd
+}
+
+// runDatabaseClient runs cmd with stdin and stdout connected to files and
+// returns its error output on failure
+func runDatabaseClient(cmd *exec.Cmd, stdin io.Reader, stdout io.Writer) error {
+	var stderr strings.Builder
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", filepath.Base(cmd.Path), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// checkDatabaseReachable returns an error when a server's database can't
+// be dumped or restored now: a container database only runs with its
+// server
+func checkDatabaseReachable(server Server) error {
+	if server.Database == nil {
+		return errNoDatabase
+	}
+	if server.Database.Mode == "container" && !server.Running {
+		return errDatabaseStopped
+	}
+	return nil
+}
+
+// Backup writes a server's document root and, with database, a dump of
+// its database to a new archive
+func (a *App) Backup(ctx context.Context, server Server, database bool, note string) (Backup, error) {
+	id := server.ID
+	if database {
+		if err := checkDatabaseReachable(server); err != nil {
+			return Backup{}, err
+		}
+	}
+	if !a.backups.begin(id) {
+		return Backup{}, errBackupRunning
+	}
+	defer a.backups.done(id)
+
+	ctx, cancel := context.WithTimeout(ctx, backupTimeout)
+	defer cancel()
+
+	suffix, err := randomHex(3)
+	if err != nil {
+		return Backup{}, err
+	}
+	now := time.Now()
+	backup := Backup{
+		ID:        now.UTC().Format("20060102-150405") + "-" + suffix,
+		ServerID:  id,
+		CreatedAt: now,
+		Directory: server.Directory,
+		Note:      note,
+	}
+	dir := serverBackupDir(a.configDir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Backup{}, err
+	}
+	backup.Archive = filepath.Join(dir, backup.ID+".tar.zst")
+
+	trees := []archiveTree{}
+	if database {
+		dump := backup.Archive + ".sql"
+		out, err := os.OpenFile(dump, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return Backup{}, err
+		}
+		defer os.Remove(dump)
+		err = runDatabaseClient(databaseClientCommand(ctx, *server.Database, false), nil, out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return Backup{}, err
+		}
+		backup.Database = server.Database.Engine
+		trees = append(trees, archiveTree{Source: dump, Name: backupDumpName})
+	}
+	trees = append(trees, archiveTree{Source: server.Directory, Name: backupRootName})
+
+	if err := compressTrees(backup.Archive, trees...); err != nil {
+		return Backup{}, err
+	}
+	backup.Bytes = diskUsage(backup.Archive)
+	if err := a.backups.add(backup); err != nil {
+		a.warnings.AddContext(ctx, "backup", "Error saving the backups of server %s: %v", id, err)
+	}
+	if err := a.store.Record(id, "backed_up", backup.ID); err != nil {
+		a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, err)
+	}
+	return backup, nil
+}
+
+// extractBackup writes the document root in archive to dir, which must
+// not exist, and its database dump, if any, to dump. It reports whether
+// the archive had a dump. Running as root, files get their owners back.
+func extractBackup(archive, dir, dump string) (bool, error) {
+	file, err := os.Open(archive)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		return false, err
+	}
+	defer decoder.Close()
+
+	chown := os.Geteuid() == 0
+	hasDump := false
+	// Directory modes are applied last, so read-only ones can be filled
+	var dirs []*tar.Header
+	tr := tar.NewReader(decoder)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hasDump, err
+		}
+
+		if header.Name == backupDumpName {
+			out, err := os.OpenFile(dump, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return hasDump, err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return hasDump, err
+			}
+			hasDump = true
+			continue
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(header.Name, backupRootName), "/")
+		if (header.Name != backupRootName && !strings.HasPrefix(header.Name, backupRootName+"/")) || (rel != "" && !filepath.IsLocal(rel)) {
+			return hasDump, fmt.Errorf("unexpected entry %q in backup", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return hasDump, err
+			}
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return hasDump, err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return hasDump, err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return hasDump, err
+			}
+		default:
+			continue
+		}
+
+		if chown {
+			if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+				return hasDump, err
+			}
+		}
+		if header.Typeflag == tar.TypeReg {
+			os.Chmod(target, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(dirs[i].Name, backupRootName), "/")))
+		os.Chmod(target, dirs[i].FileInfo().Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky))
+		os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime)
+	}
+	return hasDump, nil
+}
+
+// Restore puts a backup back: the document root is replaced as a whole,
+// the database dump, if the backup has one, is loaded into the server's
+// database and the server restarts if it was running. The previous
+// document root is only removed once the new one is in place.
+func (a *App) Restore(ctx context.Context, server Server, backup Backup) (bool, error) {
+	id := server.ID
+	if backup.Database != "" {
+		if err := checkDatabaseReachable(server); err != nil {
+			return false, err
+		}
+		if server.Database.Engine != backup.Database && (server.Database.postgres() || backup.Database == "postgres") {
+			return false, fmt.Errorf("%w: it holds a %s dump, the server has %s", errDatabaseEngine, backup.Database, server.Database.Engine)
+		}
+	}
+	if !a.backups.begin(id) {
+		return false, errBackupRunning
+	}
+	defer a.backups.done(id)
+
+	ctx, cancel := context.WithTimeout(ctx, backupTimeout)
+	defer cancel()
+
+	root := filepath.Clean(server.Directory)
+	stage := filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".restore-"+backup.ID)
+	previous := filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".before-"+backup.ID)
+	dump := stage + ".sql"
+	defer os.RemoveAll(stage)
+	defer os.Remove(dump)
+
+	hasDump, err := extractBackup(backup.Archive, stage, dump)
+	if err != nil {
+		return false, err
+	}
+
+	if hasDump {
+		in, err := os.Open(dump)
+		if err != nil {
+			return false, err
+		}
+		err = runDatabaseClient(databaseClientCommand(ctx, *server.Database, true), in, ioutil.Discard)
+		in.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if err := os.Rename(root, previous); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Rename(stage, root); err != nil {
+		os.Rename(previous, root)
+		return false, err
+	}
+	if err := os.RemoveAll(previous); err != nil {
+		a.warnings.AddContext(ctx, "backup", "Error removing the replaced document root %s: %v", previous, err)
+	}
+
+	a.refreshFramework(id)
+	if err := a.store.Record(id, "restored", backup.ID); err != nil {
+		a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, err)
+	}
+	a.annotations.Record(ctx, id, server.Name, "restored", fmt.Sprintf("restored %s from backup %s", server.Name, backup.ID))
+
+	if server.Running {
+		if !a.StopServerContext(ctx, id) || !a.StartServerContext(ctx, id) {
+			return true, fmt.Errorf("server %s did not restart after the restore", id)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// writeBackupError reports a failed backup or restore: a conflict when it
+// can't run now, upstream_failed when a database client failed
+func writeBackupError(w http.ResponseWriter, operation string, err error) {
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, errBackupRunning), errors.Is(err, errNoDatabase), errors.Is(err, errDatabaseStopped), errors.Is(err, errDatabaseEngine):
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+	case errors.As(err, &exitErr):
+		writeError(w, http.StatusBadGateway, errCodeUpstream, fmt.Sprintf("%s failed: %v", operation, err))
+	default:
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("%s failed: %v", operation, err))
+	}
+}
+
+// handleCreateBackup backs up a server's document root; a body of
+// {"database": true} adds a dump of its database and "note" describes it
+func (a *App) handleCreateBackup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	var request struct {
+		Database bool   `json:"database"`
+		Note     string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	// A client that gives up waiting doesn't leave half an archive
+	ctx := withRequestID(context.Background(), requestIDFromContext(r.Context()))
+	backup, err := a.Backup(ctx, server, request.Database, request.Note)
+	if err != nil {
+		writeBackupError(w, "Backup", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(backup)
+}
+
+// handleGetBackups lists a server's backups, newest first
+func (a *App) handleGetBackups(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.backups.List(id))
+}
+
+// handleRestoreBackup restores a server from one of its backups
+func (a *App) handleRestoreBackup(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	backup, exists := a.backups.Get(id, vars["backup"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, errBackupNotFound.Error())
+		return
+	}
+
+	ctx := withRequestID(context.Background(), requestIDFromContext(r.Context()))
+	restarted, err := a.Restore(ctx, server, backup)
+	if err != nil {
+		writeBackupError(w, "Restore", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"backup":    backup,
+		"restarted": restarted,
+	})
+}
+
+// handleGetBackupConfig returns how many backups per server are kept
+func (bm *BackupManager) handleGetBackupConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"keep": bm.Keep()})
+}
+
+// handleSetBackupConfig sets how many backups per server are kept
+// ({"keep": 10})
+func (bm *BackupManager) handleSetBackupConfig(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		Keep int `json:"keep"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if config.Keep < 1 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "keep must be at least 1")
+		return
+	}
+
+	if err := bm.SetKeep(config.Keep); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save backup config: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"keep": config.Keep})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxLogoSize bounds a logo given as a data URL
+const maxLogoSize = 256 << 10
+
+// validColor matches a CSS hex color such as #0a7 or #0077aa
+var validColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// titleTag matches the title of the web UI
+var titleTag = regexp.MustCompile(`(?is)<title>.*?</title>`)
+
+// Branding white-labels the web UI for teams hosting the manager for
+// their clients. Empty fields keep the defaults.
+type Branding struct {
+	Title        string `json:"title,omitempty"`
+	LogoURL      string `json:"logo_url,omitempty"`      // http(s) URL or data:image/... URL
+	Theme        string `json:"theme,omitempty"`         // light, dark or auto (following the browser)
+	PrimaryColor string `json:"primary_color,omitempty"` // hex color of buttons and links
+	Footer       string `json:"footer,omitempty"`        // plain text shown under the page
+}
+
+// Validate checks the branding
+func (b Branding) Validate() error {
+	if len(b.Title) > 100 || strings.ContainsAny(b.Title, "\r\n") {
+		return fmt.Errorf("title must be a single line of at most 100 characters")
+	}
+	if b.LogoURL != "" {
+		if strings.HasPrefix(b.LogoURL, "data:") {
+			if !strings.HasPrefix(b.LogoURL, "data:image/") || len(b.LogoURL) > maxLogoSize {
+				return fmt.Errorf("logo_url must be a data:image/ URL of at most %d KiB", maxLogoSize>>10)
+			}
+		} else if u, err := url.Parse(b.LogoURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("logo_url must be an http(s) or data:image/ URL")
+		}
+	}
+	switch b.Theme {
+	case "", "light", "dark", "auto":
+	default:
+		return fmt.Errorf("theme must be light, dark or auto")
+	}
+	if b.PrimaryColor != "" && !validColor.MatchString(b.PrimaryColor) {
+		return fmt.Errorf("primary_color must be a hex color such as #0077aa")
+	}
+	if len(b.Footer) > 500 {
+		return fmt.Errorf("footer must be at most 500 characters")
+	}
+	return nil
+}
+
+// inject applies the branding to the web UI page. The title, theme and
+// color are set in the page itself so it renders branded at once; the
+// page's script applies the logo and footer from window.psmBranding.
+func (b Branding) inject(page []byte) []byte {
+	if b.Title != "" {
+		title := "<title>" + html.EscapeString(b.Title) + "</title>"
+		page = titleTag.ReplaceAllLiteral(page, []byte(title))
+	}
+	if b.Theme != "" {
+		page = bytes.Replace(page, []byte("<html"), []byte(`<html data-theme="`+b.Theme+`"`), 1)
+	}
+
+	// json.Marshal escapes <, > and &, so the values can't end the script
+	data, _ := json.Marshal(b)
+	head := "<script>window.psmBranding = " + string(data) + ";</script>\n"
+	if b.PrimaryColor != "" {
+		head = "<style>:root { --primary-color: " + b.PrimaryColor + "; }</style>\n" + head
+	}
+	return bytes.Replace(page, []byte("</head>"), []byte(head+"</head>"), 1)
+}
+
+// Branding returns the branding of the web UI
+func (a *App) Branding() Branding {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.branding
+}
+
+// SetBranding replaces the branding of the web UI
+func (a *App) SetBranding(branding Branding) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.branding = branding
+	a.requestSave()
+}
+
+// serveUI serves the web UI, with the branding applied to its page
+func (a *App) serveUI(w http.ResponseWriter, r *http.Request) {
+	if name := path.Clean("/" + r.URL.Path); name != "/" && name != "/index.html" {
+		serveStatic(w, r)
+		return
+	}
+
+	page, err := readIndexHTML()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(a.Branding().inject(page))
+}
+
+// handleGetBranding shows the branding of the web UI
+func (a *App) handleGetBranding(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Branding())
+}
+
+// handleSetBranding replaces the branding of the web UI. It applies the
+// next time the page is loaded.
+func (a *App) handleSetBranding(w http.ResponseWriter, r *http.Request) {
+	var branding Branding
+	if err := json.NewDecoder(r.Body).Decode(&branding); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := branding.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+	a.SetBranding(branding)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(branding)
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// CertificateStore keeps uploaded certificates encrypted on disk, one for
+// a whole server and one per domain it serves. The encryption key is kept
+// apart from them, and the decrypted certificates are only written to a
+// tmpfs while their server runs.
+type CertificateStore struct {
+	dir        string
+	runtimeDir string
+	key        []byte
+	mu         sync.Mutex
+}
+
+// CertificateBundle is the decrypted certificate material for a server
+type CertificateBundle struct {
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"private_key"`
+	CAChain     string `json:"ca_chain,omitempty"`
+}
+
+// CertificateInfo describes a stored certificate without exposing the key
+type CertificateInfo struct {
+	Domain    string    `json:"domain,omitempty"` // empty for the server's own certificate
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dns_names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	HasCA     bool      `json:"has_ca_chain"`
+}
+
+// validCertificateDomain matches the lowercase domains certificates are
+// uploaded for, wildcards included
+var validCertificateDomain = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// NewCertificateStore creates a certificate store rooted at dir. The key is
+// PSM_CERT_KEY, base64 encoded, so it can come from a secret manager, or
+// else read from PSM_CERT_KEY_FILE, which defaults to certificates.key in
+// the user's config directory and is generated on first use. A store.key
+// left in dir by earlier versions is moved out of it.
+func NewCertificateStore(dir string) (*CertificateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %v", err)
+	}
+
+	legacyPath := filepath.Join(dir, "store.key")
+	legacy, err := ioutil.ReadFile(legacyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read store key: %v", err)
+	}
+	key, err := loadCertificateKey(legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &CertificateStore{dir: dir, runtimeDir: certificateRuntimeDir(), key: key}
+	// Earlier versions left decrypted keys next to the Caddyfiles
+	stale, _ := filepath.Glob(filepath.Join(dir, "run", "*", "*.pem"))
+	for _, path := range stale {
+		os.Remove(path)
+	}
+	if legacy != nil {
+		// Certificates sealed with another key are sealed again with the
+		// configured one before the old key goes
+		if !bytes.Equal(legacy, key) {
+			if err := cs.rekey(legacy); err != nil {
+				return nil, fmt.Errorf("failed to encrypt certificates with the new key: %v", err)
+			}
+		}
+		if err := os.Remove(legacyPath); err != nil {
+			return nil, fmt.Errorf("failed to remove the old store key: %v", err)
+		}
+	}
+	return cs, nil
+}
+
+// loadCertificateKey returns the key from PSM_CERT_KEY or the key file,
+// creating the file from the legacy key or a new random one
+func loadCertificateKey(legacy []byte) ([]byte, error) {
+	if encoded := os.Getenv("PSM_CERT_KEY"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("PSM_CERT_KEY must be 32 bytes, base64 encoded")
+		}
+		return key, nil
+	}
+
+	path := os.Getenv("PSM_CERT_KEY_FILE")
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("no place for the certificate key, set PSM_CERT_KEY_FILE: %v", err)
+		}
+		path = filepath.Join(configDir, "php-server-manager", "certificates.key")
+	}
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key = legacy
+		if key == nil {
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, fmt.Errorf("failed to generate certificate key: %v", err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create the certificate key directory: %v", err)
+		}
+		if err := writeFileAtomic(path, key, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write certificate key: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read certificate key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid certificate key length in %s: %d", path, len(key))
+	}
+	return key, nil
+}
+
+// certificateRuntimeDir returns the tmpfs directory decrypted certificates
+// are written to: below PSM_RUNTIME_DIR, XDG_RUNTIME_DIR or /run for root,
+// and in /dev/shm otherwise
+func certificateRuntimeDir() string {
+	if dir := os.Getenv("PSM_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "certificates")
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "php-server-manager", "certificates")
+	}
+	if os.Geteuid() == 0 {
+		return "/run/php-server-manager/certificates"
+	}
+	return filepath.Join("/dev/shm", fmt.Sprintf("php-server-manager-%d", os.Geteuid()), "certificates")
+}
+
+// ensurePrivateDir creates dir and checks that it and its parent are
+// directories only the manager's user can enter, so keys aren't written
+// where someone else prepared a directory or symlink
+func ensurePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, path := range []string{filepath.Dir(dir), dir} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !info.IsDir() || !ok || int(stat.Uid) != os.Geteuid() {
+			return fmt.Errorf("%s is not a directory of the manager's user", path)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			if err := os.Chmod(path, 0700); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// path returns the encrypted bundle path for a server, or for one of its
+// domains
+func (cs *CertificateStore) path(serverID, domain string) string {
+	if domain == "" {
+		return filepath.Join(cs.dir, serverID+".enc")
+	}
+	return filepath.Join(cs.dir, serverID+"@"+domain+".enc")
+}
+
+// additionalData binds a sealed bundle to its server and domain, so it
+// can't be moved to another one
+func additionalData(serverID, domain string) []byte {
+	if domain == "" {
+		return []byte(serverID)
+	}
+	return []byte(serverID + "@" + domain)
+}
+
+// parseCertificateFile returns the server and domain of an encrypted
+// bundle's file name
+func parseCertificateFile(name string) (serverID, domain string, ok bool) {
+	base, found := strings.CutSuffix(name, ".enc")
+	if !found {
+		return "", "", false
+	}
+	serverID, domain, _ = strings.Cut(base, "@")
+	return serverID, domain, true
+}
+
+// keyDir returns the tmpfs directory holding a server's decrypted
+// certificates while it runs
+func (cs *CertificateStore) keyDir(serverID string) string {
+	return filepath.Join(cs.runtimeDir, serverID)
+}
+
+// writtenKeyDir returns the key directory of a server while its
+// certificates are written out
+func (cs *CertificateStore) writtenKeyDir(serverID string) (string, bool) {
+	dir := cs.keyDir(serverID)
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+	return dir, true
+}
+
+// RemoveKeyFiles deletes the decrypted certificates of a server that
+// stopped
+func (cs *CertificateStore) RemoveKeyFiles(serverID string) {
+	os.RemoveAll(cs.keyDir(serverID))
+}
+
+// Put validates and stores a certificate bundle for a server, or for one
+// of its domains when domain is set; the certificate must cover the domain
+func (cs *CertificateStore) Put(serverID, domain string, bundle *CertificateBundle) (*CertificateInfo, error) {
+	info, err := validateBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if domain != "" && !coversDomain(info.DNSNames, domain) {
+		return nil, fmt.Errorf("certificate is not valid for %s", domain)
+	}
+	info.Domain = domain
+
+	if err := cs.write(serverID, domain, bundle); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// coversDomain reports whether a certificate's names include the domain,
+// directly or through a wildcard
+func coversDomain(names []string, domain string) bool {
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == domain {
+			return true
+		}
+		if parent, found := strings.CutPrefix(name, "*."); found && !strings.HasPrefix(domain, "*.") {
+			if _, rest, ok := strings.Cut(domain, "."); ok && rest == parent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// write encrypts and stores a bundle
+func (cs *CertificateStore) write(serverID, domain string, bundle *CertificateBundle) error {
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(cs.key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, additionalData(serverID, domain))
+	if err := writeFileAtomic(cs.path(serverID, domain), sealed, 0600); err != nil {
+		return fmt.Errorf("failed to store certificate: %v", err)
+	}
+	return nil
+}
+
+// Get decrypts the certificate bundle for a server, or for one of its
+// domains, returning nil if none is stored
+func (cs *CertificateStore) Get(serverID, domain string) (*CertificateBundle, error) {
+	cs.mu.Lock()
+	sealed, err := ioutil.ReadFile(cs.path(serverID, domain))
+	cs.mu.Unlock()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cs.key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("stored certificate is corrupt")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData(serverID, domain))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt certificate: %v", err)
+	}
+
+	var bundle CertificateBundle
+	if err := json.Unmarshal(plaintext, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// Domains returns the domains of a server with their own certificate,
+// sorted
+func (cs *CertificateStore) Domains(serverID string) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	domains := []string{}
+	files, _ := ioutil.ReadDir(cs.dir)
+	for _, file := range files {
+		if id, domain, ok := parseCertificateFile(file.Name()); ok && id == serverID && domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// HasCertificate reports whether a server has any certificate, its own or
+// one of a domain
+func (cs *CertificateStore) HasCertificate(serverID string) bool {
+	if _, err := os.Stat(cs.path(serverID, "")); err == nil {
+		return true
+	}
+	return len(cs.Domains(serverID)) > 0
+}
+
+// Remove deletes the certificate of a server, or of one of its domains
+func (cs *CertificateStore) Remove(serverID, domain string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if err := os.Remove(cs.path(serverID, domain)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Delete removes every certificate stored for a server
+func (cs *CertificateStore) Delete(serverID string) error {
+	for _, domain := range append(cs.Domains(serverID), "") {
+		if err := cs.Remove(serverID, domain); err != nil {
+			return err
+		}
+	}
+	os.RemoveAll(filepath.Join(cs.dir, "run", serverID))
+	cs.RemoveKeyFiles(serverID)
+	return nil
+}
+
+// rekey encrypts the stored bundles, sealed with the old key, with the
+// store's key
+func (cs *CertificateStore) rekey(oldKey []byte) error {
+	old := &CertificateStore{dir: cs.dir, key: oldKey}
+	files, err := ioutil.ReadDir(cs.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		serverID, domain, ok := parseCertificateFile(file.Name())
+		if !ok {
+			continue
+		}
+		bundle, err := old.Get(serverID, domain)
+		if err != nil {
+			// Sealed with the new key before an interrupted start
+			if _, current := cs.Get(serverID, domain); current == nil {
+				continue
+			}
+			return err
+		}
+		if err := cs.write(serverID, domain, bundle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBundle checks that the key matches the certificate, that the
+// certificate is currently valid and that it chains to the CA if one is given
+func validateBundle(bundle *CertificateBundle) (*CertificateInfo, error) {
+	pair, err := tls.X509KeyPair([]byte(bundle.Certificate), []byte(bundle.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("certificate and key do not match: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	if bundle.CAChain != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(bundle.CAChain)) {
+			return nil, fmt.Errorf("CA chain contains no valid certificates")
+		}
+		intermediates := x509.NewCertPool()
+		for _, der := range pair.Certificate[1:] {
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				intermediates.AddCert(cert)
+			}
+		}
+		opts := x509.VerifyOptions{Roots: pool, Intermediates: intermediates}
+		if _, err := leaf.Verify(opts); err != nil {
+			return nil, fmt.Errorf("certificate does not chain to the CA: %v", err)
+		}
+	}
+
+	return &CertificateInfo{
+		Subject:   leaf.Subject.String(),
+		Issuer:    leaf.Issuer.String(),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		HasCA:     bundle.CAChain != "",
+	}, nil
+}
+
+// caddyQuote quotes a Caddyfile token so spaces and braces in paths are
+// taken literally. Backslashes are escaped before quotes, so a token
+// ending in one can't escape the closing quote.
+func caddyQuote(token string) string {
+	token = strings.ReplaceAll(token, `\`, `\\`)
+	return `"` + strings.ReplaceAll(token, `"`, `\"`) + `"`
+}
+
+// hasControlChars reports whether a string holds newlines or other control
+// characters, which no path written into a Caddyfile may contain
+func hasControlChars(value string) bool {
+	return strings.IndexFunc(value, unicode.IsControl) >= 0
+}
+
+// caddyfilePath returns where the Caddyfile of a server is written
+func (cs *CertificateStore) caddyfilePath(serverID string) string {
+	return filepath.Join(cs.dir, "run", serverID, "Caddyfile")
+}
+
+// WriteCaddyfile writes a Caddyfile that serves the directory with the
+// given extra site directives and, when the server has uploaded
+// certificates, over TLS with them. The server's own certificate is
+// presented to clients asking for no domain with one of their own, or the
+// first domain's when there is none. The decrypted certificates are written
+// to the server's key directory, which is removed when it stops. It
+// returns an empty path if there is neither a certificate nor any
+// directive, so the plain php-server command can be used.
+func (cs *CertificateStore) WriteCaddyfile(serverID, listenAddr, port, directory string, frankenphp, directives []string) (string, error) {
+	fallback, err := cs.Get(serverID, "")
+	if err != nil {
+		return "", err
+	}
+	domains := cs.Domains(serverID)
+	bundles := make(map[string]*CertificateBundle, len(domains))
+	for _, domain := range domains {
+		if bundles[domain], err = cs.Get(serverID, domain); err != nil {
+			return "", err
+		}
+	}
+	if fallback == nil && len(domains) > 0 {
+		fallback = bundles[domains[0]]
+	}
+	if fallback == nil && len(directives) == 0 {
+		return "", nil
+	}
+	if hasControlChars(directory) {
+		return "", fmt.Errorf("directory %q contains control characters", directory)
+	}
+
+	runDir := filepath.Join(cs.dir, "run", serverID)
+	if err := os.MkdirAll(runDir, 0700); err != nil {
+		return "", err
+	}
+
+	body := []string{"root * " + caddyQuote(directory)}
+	body = append(body, directives...)
+	body = append(body, "php_server")
+
+	global := "auto_https off"
+	var sites []string
+	site := func(address, tlsDirective string) {
+		lines := []string{"bind " + listenAddr}
+		if tlsDirective != "" {
+			lines = append(lines, tlsDirective)
+		}
+		lines = append(lines, body...)
+		sites = append(sites, fmt.Sprintf("%s {\n\t%s\n}\n", address, strings.Join(lines, "\n\t")))
+	}
+	keyDir := cs.keyDir(serverID)
+	os.RemoveAll(keyDir)
+	if fallback == nil {
+		site(":"+port, "")
+	} else {
+		if err := ensurePrivateDir(cs.runtimeDir); err != nil {
+			return "", err
+		}
+		if err := os.Mkdir(keyDir, 0700); err != nil {
+			return "", err
+		}
+		// Domains are matched first by the name the client asks for; with
+		// them in the site addresses, only switching off automatic HTTPS
+		// keeps Caddy from adding redirects on port 80
+		if len(domains) == 0 {
+			global = "auto_https disable_certs"
+		}
+		tlsDirective, err := writeKeyFiles(keyDir, "default", fallback)
+		if err != nil {
+			return "", err
+		}
+		site(":"+port, tlsDirective)
+		for _, domain := range domains {
+			tlsDirective, err := writeKeyFiles(keyDir, domain, bundles[domain])
+			if err != nil {
+				return "", err
+			}
+			site(domain+":"+port, tlsDirective)
+		}
+	}
+
+	// Options of the frankenphp global block, such as workers
+	options := "frankenphp"
+	if len(frankenphp) > 0 {
+		options += " {\n\t\t" + strings.Join(frankenphp, "\n\t\t") + "\n\t}"
+	}
+
+	caddyfile := fmt.Sprintf(`{
+	%s
+	%s
+}
+
+%s`, options, global, strings.Join(sites, "\n"))
+
+	caddyfilePath := cs.caddyfilePath(serverID)
+	if err := ioutil.WriteFile(caddyfilePath, []byte(caddyfile), 0600); err != nil {
+		return "", err
+	}
+	return caddyfilePath, nil
+}
+
+// writeKeyFiles writes the chain and key of a bundle to dir, readable by
+// their owner only, and returns the tls directive using them
+func writeKeyFiles(dir, name string, bundle *CertificateBundle) (string, error) {
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	chain := bundle.Certificate
+	if bundle.CAChain != "" {
+		chain += "\n" + bundle.CAChain
+	}
+	if err := ioutil.WriteFile(certPath, []byte(chain), 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(keyPath, []byte(bundle.PrivateKey), 0600); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("tls %s %s", caddyQuote(certPath), caddyQuote(keyPath)), nil
+}
+
+// certificateDomain returns the domain in the route, empty for the
+// server's own certificate, and whether it is valid
+func certificateDomain(r *http.Request) (string, bool) {
+	domain, exists := mux.Vars(r)["domain"]
+	if !exists {
+		return "", true
+	}
+	domain = strings.ToLower(domain)
+	return domain, len(domain) <= 253 && validCertificateDomain.MatchString(domain)
+}
+
+// HTTP handlers for certificate management. The routes without a domain
+// manage the server's own certificate, those with one a domain's.
+func (a *App) handleGetCertificate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	domain, ok := certificateDomain(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid domain")
+		return
+	}
+
+	bundle, err := a.certs.Get(id, domain)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	if bundle == nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No certificate uploaded")
+		return
+	}
+
+	info, err := validateBundle(bundle)
+	if err != nil {
+		writeError(w, http.StatusConflict, errCodeConflict, "Stored certificate is no longer valid: "+err.Error())
+		return
+	}
+	info.Domain = domain
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleListCertificates lists the server's own certificate and those of
+// its domains. Certificates that are no longer valid are left out.
+func (a *App) handleListCertificates(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if exists, _ := a.GetServerStatus(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	infos := []CertificateInfo{}
+	for _, domain := range append([]string{""}, a.certs.Domains(id)...) {
+		bundle, err := a.certs.Get(id, domain)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		if bundle == nil {
+			continue
+		}
+		if info, err := validateBundle(bundle); err == nil {
+			info.Domain = domain
+			infos = append(infos, *info)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func (a *App) handlePutCertificate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	domain, ok := certificateDomain(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid domain")
+		return
+	}
+
+	if exists, _ := a.GetServerStatus(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	var bundle CertificateBundle
+	if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if bundle.Certificate == "" || bundle.PrivateKey == "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Certificate and private key are required")
+		return
+	}
+	if block, _ := pem.Decode([]byte(bundle.Certificate)); block == nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Certificate must be PEM encoded")
+		return
+	}
+
+	info, err := a.certs.Put(id, domain, &bundle)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (a *App) handleDeleteCertificate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	domain, ok := certificateDomain(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid domain")
+		return
+	}
+
+	if err := a.certs.Remove(id, domain); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
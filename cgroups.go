@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// cgroupRoot is where the unified (v2) cgroup hierarchy is mounted
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupParent groups the cgroups of all servers
+	cgroupParent = "php-server-manager"
+	// cpuPeriod is the cpu.max period in microseconds
+	cpuPeriod = 100000
+	// minMemoryMB is the smallest memory limit that still lets PHP start
+	minMemoryMB = 16
+)
+
+// ResourceLimits caps the CPU and memory of a server's processes. Zero
+// means unlimited.
+type ResourceLimits struct {
+	CPUPercent int `json:"cpu_percent,omitempty"` // 100 is one full core
+	MemoryMB   int `json:"memory_mb,omitempty"`
+}
+
+// Validate checks the limits
+func (rl ResourceLimits) Validate() error {
+	if rl.CPUPercent < 0 {
+		return fmt.Errorf("cpu_percent must not be negative")
+	}
+	if rl.MemoryMB < 0 || (rl.MemoryMB > 0 && rl.MemoryMB < minMemoryMB) {
+		return fmt.Errorf("memory_mb must be 0 (unlimited) or at least %d", minMemoryMB)
+	}
+	return nil
+}
+
+// Set reports whether any limit is configured
+func (rl ResourceLimits) Set() bool {
+	return rl.CPUPercent > 0 || rl.MemoryMB > 0
+}
+
+// cgroupsAvailable reports whether the unified cgroup hierarchy is mounted
+// with the cpu and memory controllers and this process may create cgroups
+func cgroupsAvailable() bool {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return false
+	}
+	controllers := strings.Fields(string(data))
+	hasCPU, hasMemory := false, false
+	for _, controller := range controllers {
+		hasCPU = hasCPU || controller == "cpu"
+		hasMemory = hasMemory || controller == "memory"
+	}
+	return hasCPU && hasMemory && os.Geteuid() == 0
+}
+
+// serverCgroupDir returns the cgroup of a server
+func serverCgroupDir(id string) string {
+	return filepath.Join(cgroupRoot, cgroupParent, "server-"+id)
+}
+
+// writeLimits writes the limits to the interface files of a cgroup
+func writeLimits(dir string, limits ResourceLimits) error {
+	cpuMax := fmt.Sprintf("max %d", cpuPeriod)
+	if limits.CPUPercent > 0 {
+		cpuMax = fmt.Sprintf("%d %d", limits.CPUPercent*cpuPeriod/100, cpuPeriod)
+	}
+	memoryMax := "max"
+	if limits.MemoryMB > 0 {
+		memoryMax = strconv.FormatInt(int64(limits.MemoryMB)<<20, 10)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(cpuMax), 0644); err != nil {
+		return fmt.Errorf("setting cpu.max: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memoryMax), 0644); err != nil {
+		return fmt.Errorf("setting memory.max: %v", err)
+	}
+	return nil
+}
+
+// prepareServerCgroup creates the cgroup of a server with its limits and
+// returns an open descriptor of it, which places the started process in
+// the cgroup before it runs any code. The caller closes the descriptor.
+func prepareServerCgroup(id string, limits ResourceLimits) (*os.File, error) {
+	if !cgroupsAvailable() {
+		return nil, fmt.Errorf("resource limits need cgroup v2 with the cpu and memory controllers and root privileges")
+	}
+
+	// Controllers must be enabled on every level above the server's cgroup
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644); err != nil {
+			return nil, fmt.Errorf("enabling controllers in %s: %v", dir, err)
+		}
+	}
+
+	dir := serverCgroupDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeLimits(dir, limits); err != nil {
+		return nil, err
+	}
+	return os.Open(dir)
+}
+
+// removeServerCgroup removes a server's cgroup once its processes are
+// gone. A cgroup that still has processes is left in place and reused.
+func removeServerCgroup(id string) {
+	syscall.Rmdir(serverCgroupDir(id))
+}
+
+// SetLimits replaces the resource limits of a server. Limits of a running
+// server with a cgroup are changed in place.
+func (a *App) SetLimits(id string, limits ResourceLimits) (bool, error) {
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	if !exists {
+		a.mu.Unlock()
+		return false, nil
+	}
+	server.Limits = limits
+	running := server.Running
+	a.requestSave()
+	a.mu.Unlock()
+
+	if running {
+		dir := serverCgroupDir(id)
+		if _, err := os.Stat(dir); err == nil {
+			return true, writeLimits(dir, limits)
+		}
+	}
+	return true, nil
+}
+
+// handleSetLimits sets the CPU and memory limits of a server. A running
+// server started with limits gets the new ones immediately; otherwise
+// they take effect the next time it starts.
+func (a *App) handleSetLimits(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var limits ResourceLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := limits.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+	if limits.Set() && !cgroupsAvailable() {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Resource limits need cgroup v2 with the cpu and memory controllers and root privileges")
+		return
+	}
+
+	exists, err := a.SetLimits(id, limits)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Limits were saved but could not be applied to the running server: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// childEnvVars are the variables of the manager's environment that PHP
+// servers, tasks, lifecycle hooks, worker processes and deploys inherit.
+// Everything else, such as PSM_SMTP_PASSWORD, PSM_TOKEN or the manager's
+// Redis and Grafana settings, stays with the manager; what a server needs
+// is set in its env.
+var childEnvVars = map[string]bool{
+	"PATH":                     true,
+	"HOME":                     true,
+	"USER":                     true,
+	"LOGNAME":                  true,
+	"SHELL":                    true,
+	"LANG":                     true,
+	"LANGUAGE":                 true,
+	"TZ":                       true,
+	"TMPDIR":                   true,
+	"TERM":                     true,
+	"SSL_CERT_FILE":            true,
+	"SSL_CERT_DIR":             true,
+	"HTTP_PROXY":               true,
+	"HTTPS_PROXY":              true,
+	"NO_PROXY":                 true,
+	"http_proxy":               true,
+	"https_proxy":              true,
+	"no_proxy":                 true,
+	"DOCKER_HOST":              true, // for the docker backend's client
+	"DOCKER_CONTEXT":           true,
+	"XDG_RUNTIME_DIR":          true, // for systemd-run --user
+	"DBUS_SESSION_BUS_ADDRESS": true,
+}
+
+// childEnvironment returns the part of the manager's environment that
+// processes it starts for servers inherit
+func childEnvironment() []string {
+	env := []string{}
+	for _, variable := range os.Environ() {
+		name, _, _ := strings.Cut(variable, "=")
+		if childEnvVars[name] || strings.HasPrefix(name, "LC_") {
+			env = append(env, variable)
+		}
+	}
+	return env
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// cleanupInterval is how often expired servers are archived and old
+	// archives purged
+	cleanupInterval = time.Hour
+	// defaultRetentionDays is how long archives of expired servers are kept
+	defaultRetentionDays = 7
+)
+
+// ExpiredServer is the archive of a preview server that reached its expiry
+type ExpiredServer struct {
+	ServerID     string    `json:"server_id"`
+	Name         string    `json:"name"`
+	ExpiredAt    time.Time `json:"expired_at"`
+	Archive      string    `json:"archive"`
+	ArchiveBytes int64     `json:"archive_bytes"`
+}
+
+// CleanupState is the persisted retention policy and the archives of
+// expired servers
+type CleanupState struct {
+	RetentionDays int             `json:"retention_days"`
+	Archived      []ExpiredServer `json:"archived"`
+	LastRun       time.Time       `json:"last_run,omitempty"`
+	LastExpired   int             `json:"last_expired"`
+	LastPurged    int             `json:"last_purged"`
+}
+
+// CleanupPreview lists what the next cleanup run will do
+type CleanupPreview struct {
+	NextRun       time.Time       `json:"next_run"`
+	RetentionDays int             `json:"retention_days"`
+	Expire        []Server        `json:"expire"`
+	Purge         []ExpiredServer `json:"purge"`
+}
+
+// CleanupManager archives preview servers once they expire and purges the
+// archives after the retention period. Archives live in expired/ below
+// baseDir and hold the server definition and its logs.
+type CleanupManager struct {
+	mu       sync.Mutex
+	baseDir  string
+	path     string
+	state    CleanupState
+	warnings *WarningCenter
+}
+
+// NewCleanupManager creates a cleanup manager rooted at baseDir
+func NewCleanupManager(baseDir string, warnings *WarningCenter) *CleanupManager {
+	cm := &CleanupManager{
+		baseDir:  baseDir,
+		path:     filepath.Join(baseDir, "cleanup.json"),
+		state:    CleanupState{RetentionDays: defaultRetentionDays, Archived: []ExpiredServer{}},
+		warnings: warnings,
+	}
+
+	if data, err := ioutil.ReadFile(cm.path); err == nil {
+		json.Unmarshal(data, &cm.state)
+	}
+
+	return cm
+}
+
+// State returns the current cleanup state
+func (cm *CleanupManager) State() CleanupState {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	state := cm.state
+	state.Archived = append([]ExpiredServer{}, cm.state.Archived...)
+	return state
+}
+
+// saveLocked persists the state; cm.mu must be held
+func (cm *CleanupManager) saveLocked() error {
+	data, err := json.MarshalIndent(cm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cm.path, data, 0600)
+}
+
+// SetRetentionDays configures how long archives are kept; zero purges
+// expired servers right away
+func (cm *CleanupManager) SetRetentionDays(days int) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.state.RetentionDays = days
+	return cm.saveLocked()
+}
+
+// purgeAt returns when an archive is due to be purged
+func (cm *CleanupManager) purgeAt(archive ExpiredServer, retentionDays int) time.Time {
+	return archive.ExpiredAt.AddDate(0, 0, retentionDays)
+}
+
+// archiveServer writes the definition and logs of a server to a
+// zstd-compressed tar and returns its path
+func (cm *CleanupManager) archiveServer(server Server, now time.Time) (string, error) {
+	stage := filepath.Join(cm.baseDir, "expired", fmt.Sprintf("%s-%d", server.ID, now.Unix()))
+	if err := os.MkdirAll(stage, 0700); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(stage)
+
+	data, err := json.MarshalIndent(server, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(stage, "server.json"), data, 0600); err != nil {
+		return "", err
+	}
+	logDir := serverLogDir(cm.baseDir, server.ID)
+	if _, err := os.Stat(logDir); err == nil {
+		if err := os.Rename(logDir, filepath.Join(stage, "logs")); err != nil {
+			return "", err
+		}
+	}
+
+	archive := stage + ".tar.zst"
+	if err := compressDir(stage, archive); err != nil {
+		return "", err
+	}
+	return archive, nil
+}
+
+// expiredServers returns the servers whose expiry is at or before t
+func (a *App) expiredServers(t time.Time) []Server {
+	expired := []Server{}
+	for _, id := range a.serverIDs() {
+		server, exists := a.GetServer(id)
+		if exists && server.ExpiresAt != nil && !server.ExpiresAt.After(t) {
+			expired = append(expired, server)
+		}
+	}
+	return expired
+}
+
+// Cleanup archives and deletes expired servers, then purges archives
+// older than the retention period
+func (cm *CleanupManager) Cleanup(app *App, vlanManager *VLANManager, now time.Time) (int, int) {
+	expired := 0
+	for _, server := range app.expiredServers(now) {
+		ctx := withRequestID(context.Background(), newRequestID())
+		logAttrs(ctx, slog.LevelInfo, "expire", slog.String("server", server.ID))
+
+		app.StopServerContext(ctx, server.ID)
+		archive, err := cm.archiveServer(server, now)
+		if err != nil {
+			app.warnings.AddContext(ctx, "cleanup", "Error archiving expired server %s: %v", server.ID, err)
+			continue
+		}
+		if err := app.store.Record(server.ID, "expired", archive); err != nil {
+			app.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", server.ID, err)
+		}
+		if err := app.deleteServerWithVLAN(server.ID, vlanManager); err != nil {
+			app.warnings.AddContext(ctx, "cleanup", "Expired server %s: %v", server.ID, err)
+		}
+
+		cm.mu.Lock()
+		cm.state.Archived = append(cm.state.Archived, ExpiredServer{
+			ServerID:     server.ID,
+			Name:         server.Name,
+			ExpiredAt:    now,
+			Archive:      archive,
+			ArchiveBytes: diskUsage(archive),
+		})
+		cm.mu.Unlock()
+		expired++
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	purged := 0
+	kept := []ExpiredServer{}
+	for _, archive := range cm.state.Archived {
+		if cm.purgeAt(archive, cm.state.RetentionDays).After(now) {
+			kept = append(kept, archive)
+			continue
+		}
+		if err := os.Remove(archive.Archive); err != nil && !os.IsNotExist(err) {
+			cm.warnings.Add("cleanup", "Error purging %s: %v", archive.Archive, err)
+			kept = append(kept, archive)
+			continue
+		}
+		purged++
+	}
+	cm.state.Archived = kept
+	cm.state.LastRun = now
+	cm.state.LastExpired = expired
+	cm.state.LastPurged = purged
+	if err := cm.saveLocked(); err != nil {
+		cm.warnings.Add("cleanup", "Error saving cleanup state: %v", err)
+	}
+
+	return expired, purged
+}
+
+// Preview reports the servers the next run will archive and the archives
+// it will purge
+func (cm *CleanupManager) Preview(app *App, now time.Time) CleanupPreview {
+	state := cm.State()
+
+	next := state.LastRun.Add(cleanupInterval)
+	if next.Before(now) {
+		next = now
+	}
+
+	preview := CleanupPreview{
+		NextRun:       next,
+		RetentionDays: state.RetentionDays,
+		Expire:        app.expiredServers(next),
+		Purge:         []ExpiredServer{},
+	}
+	for _, archive := range state.Archived {
+		if !cm.purgeAt(archive, state.RetentionDays).After(next) {
+			preview.Purge = append(preview.Purge, archive)
+		}
+	}
+	// Without retention, servers are purged in the run that expires them
+	if state.RetentionDays == 0 {
+		for _, server := range preview.Expire {
+			preview.Purge = append(preview.Purge, ExpiredServer{ServerID: server.ID, Name: server.Name, ExpiredAt: next})
+		}
+	}
+	return preview
+}
+
+// Run cleans up every interval until the process exits, skipping the
+// runs that fall in a freeze
+func (cm *CleanupManager) Run(interval time.Duration, app *App, vlanManager *VLANManager) {
+	for {
+		if app.Frozen() {
+			logAttrs(context.Background(), slog.LevelInfo, "cleanup skipped", slog.String("reason", "frozen"))
+		} else {
+			cm.Cleanup(app, vlanManager, time.Now())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// SetExpiry sets or clears (nil) the expiry of a server
+func (a *App) SetExpiry(id string, expiresAt *time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.ExpiresAt = expiresAt
+
+	a.requestSave()
+	return true
+}
+
+// handleSetExpiry marks a server as a preview server that is archived and
+// deleted at a point in time ({"expires_at": "..."} or {"ttl": "72h"});
+// {"expires_at": null} makes it permanent again
+func (a *App) handleSetExpiry(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var request struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+		TTL       string     `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if request.TTL != "" {
+		if request.ExpiresAt != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Set either expires_at or ttl")
+			return
+		}
+		ttl, err := time.ParseDuration(request.TTL)
+		if err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "ttl must be a positive duration such as 72h")
+			return
+		}
+		expiresAt := time.Now().Add(ttl)
+		request.ExpiresAt = &expiresAt
+	}
+
+	if !a.SetExpiry(id, request.ExpiresAt) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"expires_at": request.ExpiresAt})
+}
+
+// handleGetCleanupPreview reports what the next cleanup run will archive
+// and purge
+func (a *App) handleGetCleanupPreview(w http.ResponseWriter, r *http.Request, cleanup *CleanupManager) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cleanup.Preview(a, time.Now()))
+}
+
+// handleGetCleanup returns the retention policy and the kept archives
+func (cm *CleanupManager) handleGetCleanup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm.State())
+}
+
+// handleSetCleanupConfig sets the retention period ({"retention_days": 7})
+func (cm *CleanupManager) handleSetCleanupConfig(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		RetentionDays int `json:"retention_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if config.RetentionDays < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "retention_days must not be negative")
+		return
+	}
+
+	if err := cm.SetRetentionDays(config.RetentionDays); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save cleanup config: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm.State())
+}
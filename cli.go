@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultCLIURL is the manager address used when neither --url, PSM_URL
+// nor a stored login names one
+const defaultCLIURL = "http://localhost"
+
+// cliCommands are the subcommands handled by the API client rather than
+// by the manager itself
+var cliCommands = map[string]bool{
+	"login":   true,
+	"logout":  true,
+	"servers": true,
+	"groups":  true,
+	"vlan":    true,
+	"views":   true,
+	"find":    true,
+}
+
+// errCLIUsage reports a malformed command line
+var errCLIUsage = errors.New("usage")
+
+// errCLIRelogin reports a rejected token that can be renewed with the
+// configured password
+var errCLIRelogin = errors.New("token rejected")
+
+// cliCredentials is the login stored in ~/.php-server-manager/cli.json
+type cliCredentials struct {
+	URL       string `json:"url"`
+	Token     string `json:"token"`
+	User      string `json:"user,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// cliClient talks to a running manager's API
+type cliClient struct {
+	baseURL  string
+	token    string
+	password string
+	user     string
+	raw      bool
+	client   *http.Client
+}
+
+// cliCredentialsPath returns where the CLI stores its login
+func cliCredentialsPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		homeDir = "."
+	}
+	return filepath.Join(homeDir, ".php-server-manager", "cli.json")
+}
+
+// loadCLICredentials reads the stored login, if any
+func loadCLICredentials() cliCredentials {
+	var creds cliCredentials
+	data, err := os.ReadFile(cliCredentialsPath())
+	if err != nil {
+		return creds
+	}
+	json.Unmarshal(data, &creds)
+	return creds
+}
+
+// saveCLICredentials stores a login readable only by the current user
+func saveCLICredentials(creds cliCredentials) error {
+	path := cliCredentialsPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments and returns the positional ones
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// runClientCommand runs a CLI subcommand against a running manager, e.g.
+// "servers list", "servers start 3" or "vlan status"
+func runClientCommand(args []string) int {
+	command := args[0]
+	stored := loadCLICredentials()
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	baseURL := flags.String("url", "", "manager URL, or unix:/path for its socket (default $PSM_URL, the stored login or "+defaultCLIURL+")")
+	token := flags.String("token", "", "API token (default $PSM_TOKEN or the stored login)")
+	password := flags.String("password", "", "password for login (default $PSM_PASSWORD or prompt)")
+	user := flags.String("user", "", "user name to log in as (default $PSM_USER or the stored login)")
+	raw := flags.Bool("json", false, "print raw JSON instead of tables")
+	var labels stringList
+	flags.Var(&labels, "label", "filter servers by label (key=value, repeatable)")
+	status := flags.String("status", "", "filter servers by state (running or stopped)")
+	framework := flags.String("framework", "", "filter servers by detected framework")
+	crashedWithin := flags.String("crashed-within", "", "filter servers whose process exited within a duration, e.g. 24h")
+	view := flags.String("view", "", "list the servers of a saved view")
+	description := flags.String("description", "", "description of a saved view")
+	kind := flags.String("type", "", "only find results of this type (server, group, user or event)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:")
+		fmt.Fprintln(os.Stderr, "  psm login [--url URL] [--password PASSWORD] [--user NAME]")
+		fmt.Fprintln(os.Stderr, "  psm logout")
+		fmt.Fprintln(os.Stderr, "  psm servers list [--label key=value] [--status S] [--framework F] [--crashed-within D] [--view NAME]")
+		fmt.Fprintln(os.Stderr, "  psm servers start|stop|status|delete ID")
+		fmt.Fprintln(os.Stderr, "  psm servers start-all|stop-all")
+		fmt.Fprintln(os.Stderr, "  psm groups list")
+		fmt.Fprintln(os.Stderr, "  psm groups start|stop ID")
+		fmt.Fprintln(os.Stderr, "  psm vlan status|interfaces")
+		fmt.Fprintln(os.Stderr, "  psm views list")
+		fmt.Fprintln(os.Stderr, "  psm views show|delete NAME")
+		fmt.Fprintln(os.Stderr, "  psm views save NAME [--description TEXT] [filters as for servers list]")
+		fmt.Fprintln(os.Stderr, "  psm find QUERY [--type server|group|user|event]")
+		fmt.Fprintln(os.Stderr, "Flags:")
+		flags.PrintDefaults()
+	}
+	positional := parseInterspersed(flags, args[1:])
+
+	c := &cliClient{
+		baseURL:  firstNonEmpty(*baseURL, os.Getenv("PSM_URL"), stored.URL, defaultCLIURL),
+		token:    firstNonEmpty(*token, os.Getenv("PSM_TOKEN"), stored.Token),
+		password: firstNonEmpty(*password, os.Getenv("PSM_PASSWORD")),
+		user:     firstNonEmpty(*user, os.Getenv("PSM_USER"), stored.User),
+		raw:      *raw,
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+	c.client = newCLIHTTPClient(c.baseURL, 2*time.Minute)
+
+	filter := url.Values{}
+	for _, label := range labels {
+		filter.Add("label", label)
+	}
+	for key, value := range map[string]string{"status": *status, "framework": *framework, "crashed_within": *crashedWithin} {
+		if value != "" {
+			filter.Set(key, value)
+		}
+	}
+
+	var err error
+	switch command {
+	case "login":
+		err = c.login()
+	case "logout":
+		err = c.logout()
+	case "servers":
+		err = c.servers(positional, filter, *view)
+	case "groups":
+		err = c.groups(positional)
+	case "vlan":
+		err = c.vlan(positional)
+	case "views":
+		err = c.views(positional, filter, *description)
+	case "find":
+		err = c.find(positional, *kind)
+	}
+	if err == errCLIUsage {
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "psm: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// stringList collects a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// firstNonEmpty returns the first non-empty value
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// do sends a request to the API and decodes a JSON response into out.
+// Error envelopes are turned into Go errors. When the token is missing or
+// expired and a password is configured, it logs in again and retries.
+func (c *cliClient) do(method, path string, body, out interface{}) error {
+	return c.doHeader(method, path, nil, body, out)
+}
+
+// doHeader is do with additional request headers
+func (c *cliClient) doHeader(method, path string, header http.Header, body, out interface{}) error {
+	err := c.send(method, path, header, body, out)
+	if err != errCLIRelogin {
+		return err
+	}
+	if _, err := c.authenticate(); err != nil {
+		return err
+	}
+	return c.send(method, path, header, body, out)
+}
+
+// send performs a single API request for doHeader
+func (c *cliClient) send(method, path string, header http.Header, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	base := c.baseURL
+	if _, isSocket := unixSocketPath(base); isSocket {
+		base = socketURLHost
+	}
+	req, err := http.NewRequest(method, base+"/api"+path, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && c.password != "" && path != "/auth/login" {
+		return errCLIRelogin
+	}
+	if resp.StatusCode >= 300 {
+		var envelope struct {
+			Error APIError `json:"error"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error.Message != "" {
+			if envelope.Error.Code == errCodeUnauthorized && c.token == "" && path != "/auth/login" {
+				return fmt.Errorf("%s (run \"psm login\" first)", envelope.Error.Message)
+			}
+			return fmt.Errorf("%s (%s)", envelope.Error.Message, envelope.Error.Code)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if rawOut, ok := out.(*json.RawMessage); ok {
+		*rawOut = append((*rawOut)[:0], data...)
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// printJSON prints a response indented
+func printJSON(data json.RawMessage) {
+	if len(data) == 0 {
+		return
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		os.Stdout.Write(data)
+		return
+	}
+	indented.WriteByte('\n')
+	indented.WriteTo(os.Stdout)
+}
+
+// action performs a POST or DELETE and prints its result
+func (c *cliClient) action(method, path, done string) error {
+	var result json.RawMessage
+	if err := c.do(method, path, nil, &result); err != nil {
+		return err
+	}
+	if c.raw || len(result) > 0 {
+		printJSON(result)
+		return nil
+	}
+	fmt.Println(done)
+	return nil
+}
+
+// authenticate logs in with the configured password and uses the new
+// token for subsequent requests
+func (c *cliClient) authenticate() (cliCredentials, error) {
+	var session struct {
+		Token     string `json:"token"`
+		User      string `json:"user"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := c.send("POST", "/auth/login", nil, map[string]string{"password": c.password, "user": c.user}, &session); err != nil {
+		return cliCredentials{}, err
+	}
+
+	c.token = session.Token
+	return cliCredentials{URL: c.baseURL, Token: session.Token, User: session.User, ExpiresAt: session.ExpiresAt}, nil
+}
+
+func (c *cliClient) login() error {
+	stdin := bufio.NewReader(os.Stdin)
+	if c.user == "" {
+		fmt.Fprint(os.Stderr, "User: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("no user name given")
+		}
+		c.user = strings.TrimSpace(line)
+	}
+	if c.password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("no password given")
+		}
+		c.password = strings.TrimRight(line, "\r\n")
+	}
+
+	creds, err := c.authenticate()
+	if err != nil {
+		return err
+	}
+
+	if err := saveCLICredentials(creds); err != nil {
+		return fmt.Errorf("failed to store token: %v", err)
+	}
+	fmt.Printf("Logged in to %s (token expires %s)\n", c.baseURL, creds.ExpiresAt)
+	return nil
+}
+
+func (c *cliClient) logout() error {
+	if c.token != "" {
+		if err := c.do("POST", "/auth/logout", nil, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "psm: %v\n", err)
+		}
+	}
+	if err := os.Remove(cliCredentialsPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Println("Logged out")
+	return nil
+}
+
+func (c *cliClient) servers(args []string, filter url.Values, view string) error {
+	if len(args) == 0 {
+		return errCLIUsage
+	}
+
+	switch args[0] {
+	case "list":
+		if view != "" {
+			return c.listServers("/views/" + url.PathEscape(view) + "/servers")
+		}
+		path := "/servers"
+		if len(filter) > 0 {
+			path += "?" + filter.Encode()
+		}
+		return c.listServers(path)
+
+	case "start-all", "stop-all":
+		return c.action("POST", "/servers/"+args[0], "Done")
+	}
+
+	if len(args) != 2 {
+		return errCLIUsage
+	}
+	id := url.PathEscape(args[1])
+
+	switch args[0] {
+	case "start":
+		return c.action("POST", "/servers/"+id+"/start", "Server "+args[1]+" started")
+	case "stop":
+		return c.action("POST", "/servers/"+id+"/stop", "Server "+args[1]+" stopped")
+	case "delete":
+		// The server is named by ID on the command line, so whatever its
+		// current version is gets deleted
+		if err := c.doHeader("DELETE", "/servers/"+id, http.Header{"If-Match": {"*"}}, nil, nil); err != nil {
+			return err
+		}
+		fmt.Println("Server " + args[1] + " deleted")
+		return nil
+	case "status":
+		var status struct {
+			Running bool `json:"running"`
+		}
+		var result json.RawMessage
+		if err := c.do("GET", "/servers/"+id+"/status", nil, &result); err != nil {
+			return err
+		}
+		if c.raw {
+			printJSON(result)
+			return nil
+		}
+		if err := json.Unmarshal(result, &status); err != nil {
+			return err
+		}
+		if status.Running {
+			fmt.Printf("Server %s is running\n", args[1])
+		} else {
+			fmt.Printf("Server %s is stopped\n", args[1])
+		}
+		return nil
+	}
+	return errCLIUsage
+}
+
+// listServers prints the servers returned by path as a table
+func (c *cliClient) listServers(path string) error {
+	var result json.RawMessage
+	if err := c.do("GET", path, nil, &result); err != nil {
+		return err
+	}
+	if c.raw {
+		printJSON(result)
+		return nil
+	}
+	var servers []Server
+	if err := json.Unmarshal(result, &servers); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPORT\tSTATUS\tIPV6\tFRAMEWORK\tDIRECTORY")
+	for _, server := range servers {
+		status := "stopped"
+		if server.Running {
+			status = "running"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", server.ID, server.Name, server.Port, status, server.IPv6Address, server.Framework, server.Directory)
+	}
+	return tw.Flush()
+}
+
+// views lists, runs, saves and deletes the user's saved views
+func (c *cliClient) views(args []string, filter url.Values, description string) error {
+	if len(args) == 1 && args[0] == "list" {
+		var result json.RawMessage
+		if err := c.do("GET", "/views", nil, &result); err != nil {
+			return err
+		}
+		if c.raw {
+			printJSON(result)
+			return nil
+		}
+		var views []SavedView
+		if err := json.Unmarshal(result, &views); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tFILTERS\tDESCRIPTION")
+		for _, view := range views {
+			filters := make([]string, 0, len(view.Query))
+			for key, value := range view.Query {
+				filters = append(filters, key+"="+value)
+			}
+			sort.Strings(filters)
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", view.Name, strings.Join(filters, " "), view.Description)
+		}
+		return tw.Flush()
+	}
+
+	if len(args) != 2 {
+		return errCLIUsage
+	}
+	name := url.PathEscape(args[1])
+
+	switch args[0] {
+	case "show":
+		return c.listServers("/views/" + name + "/servers")
+	case "delete":
+		return c.action("DELETE", "/views/"+name, "View "+args[1]+" deleted")
+	case "save":
+		view := SavedView{Description: description, Query: map[string]string{}}
+		for key := range filter {
+			// Several --label flags are combined into one selector
+			view.Query[key] = strings.Join(filter[key], ",")
+		}
+		var result json.RawMessage
+		if err := c.do("PUT", "/views/"+name, view, &result); err != nil {
+			return err
+		}
+		if c.raw {
+			printJSON(result)
+			return nil
+		}
+		fmt.Printf("View %s saved\n", args[1])
+		return nil
+	}
+	return errCLIUsage
+}
+
+// find searches servers, groups, users and recent events
+func (c *cliClient) find(args []string, kind string) error {
+	if len(args) == 0 {
+		return errCLIUsage
+	}
+
+	query := url.Values{"q": {strings.Join(args, " ")}, "limit": {"50"}}
+	if kind != "" {
+		query.Set("type", kind)
+	}
+	var result json.RawMessage
+	if err := c.do("GET", "/search?"+query.Encode(), nil, &result); err != nil {
+		return err
+	}
+	if c.raw {
+		printJSON(result)
+		return nil
+	}
+
+	var found struct {
+		Total   int            `json:"total"`
+		Results []SearchResult `json:"results"`
+	}
+	if err := json.Unmarshal(result, &found); err != nil {
+		return err
+	}
+	if len(found.Results) == 0 {
+		fmt.Println("No matches")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE	ID	TITLE	MATCH	DETAILS")
+	for _, r := range found.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Type, r.ID, r.Title, r.Match, r.Subtitle)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if found.Total > len(found.Results) {
+		fmt.Printf("%d more not shown\n", found.Total-len(found.Results))
+	}
+	return nil
+}
+
+func (c *cliClient) groups(args []string) error {
+	if len(args) == 0 {
+		return errCLIUsage
+	}
+
+	switch args[0] {
+	case "list":
+		var result json.RawMessage
+		if err := c.do("GET", "/groups", nil, &result); err != nil {
+			return err
+		}
+		if c.raw {
+			printJSON(result)
+			return nil
+		}
+		var groups []Group
+		if err := json.Unmarshal(result, &groups); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSERVERS")
+		for _, group := range groups {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", group.ID, group.Name, strings.Join(group.Servers, ","))
+		}
+		return tw.Flush()
+	case "start", "stop":
+		if len(args) != 2 {
+			return errCLIUsage
+		}
+		return c.action("POST", "/groups/"+url.PathEscape(args[1])+"/"+args[0], "Done")
+	}
+	return errCLIUsage
+}
+
+func (c *cliClient) vlan(args []string) error {
+	if len(args) != 1 {
+		return errCLIUsage
+	}
+
+	switch args[0] {
+	case "status":
+		var result json.RawMessage
+		if err := c.do("GET", "/vlan/status", nil, &result); err != nil {
+			return err
+		}
+		if c.raw {
+			printJSON(result)
+			return nil
+		}
+		var status struct {
+			IPv6Prefix  string                `json:"ipv6_prefix"`
+			ActiveVLANs int                   `json:"active_vlans"`
+			Interfaces  []VLANInterfaceReport `json:"interfaces"`
+			Utilization struct {
+				Used    int     `json:"used"`
+				Percent float64 `json:"percent"`
+			} `json:"address_utilization"`
+		}
+		if err := json.Unmarshal(result, &status); err != nil {
+			return err
+		}
+		fmt.Printf("Prefix:       %s\n", status.IPv6Prefix)
+		fmt.Printf("Active VLANs: %d\n", status.ActiveVLANs)
+		fmt.Printf("Addresses:    %d used (%.2f%%)\n\n", status.Utilization.Used, status.Utilization.Percent)
+		return printVLANTable(status.Interfaces)
+	case "interfaces":
+		var result json.RawMessage
+		if err := c.do("GET", "/vlan/interfaces", nil, &result); err != nil {
+			return err
+		}
+		printJSON(result)
+		return nil
+	}
+	return errCLIUsage
+}
+
+// printVLANTable prints one line per VLAN interface
+func printVLANTable(reports []VLANInterfaceReport) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVLAN\tSERVER\tPORT\tSTATE\tIPV6\tRX\tTX")
+	for _, report := range reports {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%d\t%d\n", report.Name, report.VLANID, report.ServerID, report.Port, report.OperState, report.IPv6Address, report.RxBytes, report.TxBytes)
+	}
+	return tw.Flush()
+}
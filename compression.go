@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Compression configures response compression for a server. It is
+// applied through the encode directive of the server's Caddyfile.
+type Compression struct {
+	Enabled   bool     `json:"enabled"`
+	Encodings []string `json:"encodings,omitempty"` // gzip, zstd, br; gzip when empty
+	Level     int      `json:"level,omitempty"`     // 1-9 for gzip and br, 0 for the default
+	MinLength int      `json:"min_length,omitempty"`
+	MIMETypes []string `json:"mime_types,omitempty"` // e.g. text/*, application/json
+}
+
+// validMIMEPattern matches a media type, optionally ending in a wildcard
+var validMIMEPattern = regexp.MustCompile(`^[a-z0-9.+-]+/([a-z0-9.+-]+\*?|\*)$`)
+
+// Validate checks the compression options
+func (c Compression) Validate() error {
+	for _, encoding := range c.Encodings {
+		switch encoding {
+		case "gzip", "zstd", "br":
+		default:
+			return fmt.Errorf("encoding must be gzip, zstd or br, got %q", encoding)
+		}
+	}
+
+	if c.Level < 0 || c.Level > 9 {
+		return fmt.Errorf("level must be between 1 and 9")
+	}
+
+	if c.MinLength < 0 {
+		return fmt.Errorf("min_length must not be negative")
+	}
+
+	for _, mimeType := range c.MIMETypes {
+		if !validMIMEPattern.MatchString(mimeType) {
+			return fmt.Errorf("invalid MIME type %q", mimeType)
+		}
+	}
+	return nil
+}
+
+// Directives returns the Caddyfile site directives for the options, or
+// nil when compression is disabled
+func (c Compression) Directives() []string {
+	if !c.Enabled {
+		return nil
+	}
+
+	encodings := c.Encodings
+	if len(encodings) == 0 {
+		encodings = []string{"gzip"}
+	}
+
+	block := "encode {"
+	for _, encoding := range encodings {
+		line := encoding
+		if c.Level > 0 && encoding != "zstd" {
+			line += " " + strconv.Itoa(c.Level)
+		}
+		block += "\n\t\t" + line
+	}
+	if c.MinLength > 0 {
+		block += "\n\t\tminimum_length " + strconv.Itoa(c.MinLength)
+	}
+	if len(c.MIMETypes) > 0 {
+		block += "\n\t\tmatch {"
+		for _, mimeType := range c.MIMETypes {
+			block += "\n\t\t\theader Content-Type " + mimeType
+		}
+		block += "\n\t\t}"
+	}
+	block += "\n\t}"
+
+	return []string{block}
+}
+
+// SetCompression replaces the compression options of a server
+func (a *App) SetCompression(id string, compression Compression) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Compression = compression
+
+	a.requestSave()
+	return true
+}
+
+// handleSetCompression sets the compression options of a server. They take
+// effect the next time the server starts.
+func (a *App) handleSetCompression(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var compression Compression
+	if err := json.NewDecoder(r.Body).Decode(&compression); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := compression.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if !a.SetCompression(id, compression) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(compression)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ETag returns the entity tag of the server's configuration. It changes
+// whenever any setting of the server changes; starting or stopping the
+// server does not change it.
+func (s Server) ETag() string {
+	s.Running = false
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-Match header names the etag. "*"
+// matches any existing server.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch verifies the If-Match header of a request that changes or
+// deletes a server against the server's current ETag, so an operator
+// working from an outdated copy can't overwrite someone else's changes.
+// It writes the error response and returns false when the request must
+// not proceed. a.editMu must be held until the change is applied.
+func (a *App) checkIfMatch(w http.ResponseWriter, r *http.Request, id string) (Server, bool) {
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return server, false
+	}
+
+	etag := server.ETag()
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		writeErrorDetails(w, http.StatusPreconditionRequired, errCodePreconditionRequired,
+			"If-Match header is required, fetch the server for its current ETag", map[string]interface{}{"etag": etag})
+		return server, false
+	}
+	if !etagMatches(header, etag) {
+		writeErrorDetails(w, http.StatusPreconditionFailed, errCodePreconditionFailed,
+			"Server was changed since it was fetched, reload it and try again", map[string]interface{}{"etag": etag})
+		return server, false
+	}
+	return server, true
+}
+
+// handleGetServer returns a server's configuration with its ETag, which
+// updates and deletes must send back in If-Match
+func (a *App) handleGetServer(w http.ResponseWriter, r *http.Request) {
+	server, exists := a.GetServer(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("ETag", server.ETag())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
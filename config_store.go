@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configBackups is the number of rotated config backups kept next to
+// the config file, e.g. config.json.1 (newest) to config.json.N (oldest)
+const configBackups = 5
+
+// saveDebounce is how long the config writer waits after the first save
+// request so that bursts of mutations are written once
+const saveDebounce = 250 * time.Millisecond
+
+// configFileNames are the names the config file may have in the config
+// directory, in order of preference; config.json is created when none
+// exists
+var configFileNames = []string{"config.yaml", "config.yml", "config.json"}
+
+// findConfigFile returns the path of the config file in dir
+func findConfigFile(dir string) string {
+	for _, name := range configFileNames {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// isYAMLFile reports whether path names a YAML file
+func isYAMLFile(path string) bool {
+	return strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml")
+}
+
+// backupPath returns the path of the n-th backup of path
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory,
+// syncs it and renames it over path so readers never see a partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// rotateBackups shifts the existing backups and stores the current content
+// of path as backup 1. Invalid or unchanged content is not rotated in.
+func rotateBackups(path string, next []byte) error {
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if bytes.Equal(current, next) {
+		return nil
+	}
+	if isYAMLFile(path) {
+		var document interface{}
+		if yaml.Unmarshal(current, &document) != nil {
+			return nil
+		}
+	} else if !json.Valid(current) {
+		return nil
+	}
+
+	for n := configBackups - 1; n >= 1; n-- {
+		if _, err := os.Stat(backupPath(path, n)); err == nil {
+			if err := os.Rename(backupPath(path, n), backupPath(path, n+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return writeFileAtomic(backupPath(path, 1), current, 0644)
+}
+
+// readConfigFile reads and decodes the config at path. When the file is
+// corrupt it falls back to the newest backup that decodes; the returned
+// string names the file that was used.
+func readConfigFile(path string, config *AppConfig) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	firstErr := decodeDocument(data, isYAMLFile(path), config, false)
+	if firstErr == nil {
+		return path, nil
+	}
+
+	for n := 1; n <= configBackups; n++ {
+		data, err := ioutil.ReadFile(backupPath(path, n))
+		if err != nil {
+			continue
+		}
+		var backup AppConfig
+		if err := decodeDocument(data, isYAMLFile(path), &backup, false); err == nil {
+			*config = backup
+			return backupPath(path, n), nil
+		}
+	}
+
+	return "", firstErr
+}
+
+// requestSave schedules a config save. It never blocks, so it may be
+// called with a.mu held; requests made before the writer runs are
+// coalesced into one save.
+func (a *App) requestSave() {
+	select {
+	case a.saveRequests <- struct{}{}:
+	default:
+	}
+}
+
+// flushConfig saves the config immediately and returns once it is
+// written. It must not be called with a.mu held.
+func (a *App) flushConfig() {
+	done := make(chan struct{})
+	a.flushRequests <- done
+	<-done
+}
+
+// runConfigWriter is the single goroutine that writes the config. Save
+// requests are debounced; flushes are written immediately.
+func (a *App) runConfigWriter() {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-a.saveRequests:
+			if timer == nil {
+				timer = time.After(saveDebounce)
+			}
+		case <-timer:
+			timer = nil
+			a.saveConfig()
+		case done := <-a.flushRequests:
+			timer = nil
+			select {
+			case <-a.saveRequests:
+			default:
+			}
+			a.saveConfig()
+			close(done)
+		}
+	}
+}
+
+// handleFlushConfig writes pending config changes before responding
+func (a *App) handleFlushConfig(w http.ResponseWriter, r *http.Request) {
+	a.flushConfig()
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configExportVersion is bumped when the export format changes
+const configExportVersion = 1
+
+// ConfigExport is the portable representation of the manager's state
+type ConfigExport struct {
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Servers    []*Server    `json:"servers"`
+	Groups     []*Group     `json:"groups"`
+	Templates  []*Template  `json:"templates"`
+	Settings   Settings     `json:"settings"`
+	Headers    []HeaderRule `json:"header_rules,omitempty"`
+}
+
+// ImportReport summarizes what an import changed or would change
+type ImportReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Mode     string   `json:"mode"`
+	Created  []string `json:"servers_created"`
+	Updated  []string `json:"servers_updated"`
+	Removed  []string `json:"servers_removed"`
+	Groups   int      `json:"groups"`
+	Problems []string `json:"problems"`
+	Applied  bool     `json:"applied"`
+}
+
+// sortByNumericID sorts IDs numerically
+func sortByNumericID(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		x, _ := strconv.Atoi(ids[i])
+		y, _ := strconv.Atoi(ids[j])
+		return x < y
+	})
+}
+
+// ExportConfig returns a copy of all servers, groups and templates
+func (a *App) ExportConfig() *ConfigExport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	export := &ConfigExport{
+		Version:    configExportVersion,
+		ExportedAt: time.Now(),
+		Servers:    []*Server{},
+		Groups:     []*Group{},
+		Templates:  []*Template{},
+		Settings:   a.settings,
+		Headers:    a.headerRules,
+	}
+
+	ids := make([]string, 0, len(a.servers))
+	for id := range a.servers {
+		ids = append(ids, id)
+	}
+	sortByNumericID(ids)
+	for _, id := range ids {
+		server := *a.servers[id]
+		server.Running = false
+		export.Servers = append(export.Servers, &server)
+	}
+
+	groupIDs := make([]string, 0, len(a.groups))
+	for id := range a.groups {
+		groupIDs = append(groupIDs, id)
+	}
+	sortByNumericID(groupIDs)
+	for _, id := range groupIDs {
+		group := *a.groups[id]
+		export.Groups = append(export.Groups, &group)
+	}
+
+	templateIDs := make([]string, 0, len(a.templates))
+	for id := range a.templates {
+		templateIDs = append(templateIDs, id)
+	}
+	sortByNumericID(templateIDs)
+	for _, id := range templateIDs {
+		template := *a.templates[id]
+		export.Templates = append(export.Templates, &template)
+	}
+
+	return export
+}
+
+// validateImport checks an import document against the resulting state
+func (a *App) validateImport(doc *ConfigExport, replace bool) []string {
+	problems := []string{}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Build the set of servers that would exist after the import
+	result := make(map[string]*Server)
+	if !replace {
+		for id, server := range a.servers {
+			result[id] = server
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, server := range doc.Servers {
+		if server == nil || server.ID == "" {
+			problems = append(problems, fmt.Sprintf("servers[%d]: id is required", i))
+			continue
+		}
+		if seen[server.ID] {
+			problems = append(problems, fmt.Sprintf("servers[%d]: duplicate id %s", i, server.ID))
+			continue
+		}
+		seen[server.ID] = true
+
+		spec := ServerSpec{
+			Name:        server.Name,
+			Port:        server.Port,
+			Directory:   server.Directory,
+			VLANOptions: server.VLANOptions,
+			Labels:      server.Labels,
+			Env:         server.Env,
+			PHPIni:      server.PHPIni,
+			RunAsUser:   server.RunAsUser,
+			Git:         server.Git,
+		}
+		if err := spec.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+		}
+		if err := server.Settings.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+		}
+		if err := validateHeaderRules(server.Headers); err != nil {
+			problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+		}
+		if server.Worker != nil {
+			if err := server.Worker.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+		}
+		if server.Runtime != nil {
+			if err := server.Runtime.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+		}
+		if server.Mail != nil {
+			if err := server.Mail.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+		}
+		if server.Redis != nil {
+			if err := server.Redis.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+		}
+		if server.Watch != nil {
+			if err := server.Watch.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+		}
+		if server.Lifecycle != nil {
+			if err := server.Lifecycle.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+		}
+		if err := validateWorkerProcesses(server.Workers); err != nil {
+			problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+		}
+		if server.Access != nil {
+			if err := server.Access.Validate(); err != nil {
+				problems = append(problems, fmt.Sprintf("server %s: %v", server.ID, err))
+			}
+			for _, user := range server.Access.Users {
+				if user.Password != "" {
+					problems = append(problems, fmt.Sprintf("server %s: user %q must be given with a password_hash", server.ID, user.Username))
+				}
+			}
+		}
+		result[server.ID] = server
+	}
+
+	ports := make(map[string]string)
+	ids := make([]string, 0, len(result))
+	for id := range result {
+		ids = append(ids, id)
+	}
+	sortByNumericID(ids)
+	for _, id := range ids {
+		port := result[id].Port
+		if owner, exists := ports[port]; exists {
+			problems = append(problems, fmt.Sprintf("server %s: port %s is also used by server %s", id, port, owner))
+			continue
+		}
+		ports[port] = id
+	}
+
+	for _, group := range doc.Groups {
+		if group == nil || group.ID == "" || group.Name == "" {
+			problems = append(problems, "groups: id and name are required")
+			continue
+		}
+		if err := group.Settings.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("group %s: %v", group.ID, err))
+		}
+		for _, member := range group.Servers {
+			if _, exists := result[member]; !exists {
+				problems = append(problems, fmt.Sprintf("group %s: server %s does not exist", group.ID, member))
+			}
+		}
+	}
+
+	for _, template := range doc.Templates {
+		if template == nil || template.ID == "" {
+			problems = append(problems, "templates: id is required")
+			continue
+		}
+		if msg := validateTemplate(template); msg != "" {
+			problems = append(problems, fmt.Sprintf("template %s: %s", template.ID, msg))
+		}
+	}
+
+	if err := doc.Settings.Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("settings: %v", err))
+	}
+	if err := validateHeaderRules(doc.Headers); err != nil {
+		problems = append(problems, fmt.Sprintf("header_rules: %v", err))
+	}
+
+	return problems
+}
+
+// ImportConfig merges or replaces the stored state with doc. In dry-run
+// mode only the report is computed.
+func (a *App) ImportConfig(doc *ConfigExport, replace, dryRun bool, vlanManager *VLANManager) *ImportReport {
+	report := &ImportReport{
+		DryRun:   dryRun,
+		Mode:     "merge",
+		Created:  []string{},
+		Updated:  []string{},
+		Removed:  []string{},
+		Groups:   len(doc.Groups),
+		Problems: a.validateImport(doc, replace),
+	}
+	if replace {
+		report.Mode = "replace"
+	}
+
+	imported := make(map[string]bool)
+	a.mu.Lock()
+	for _, server := range doc.Servers {
+		if server == nil {
+			continue
+		}
+		imported[server.ID] = true
+		if _, exists := a.servers[server.ID]; exists {
+			report.Updated = append(report.Updated, server.ID)
+		} else {
+			report.Created = append(report.Created, server.ID)
+		}
+	}
+	if replace {
+		for id := range a.servers {
+			if !imported[id] {
+				report.Removed = append(report.Removed, id)
+			}
+		}
+	}
+	a.mu.Unlock()
+	sortByNumericID(report.Removed)
+
+	if dryRun || len(report.Problems) > 0 {
+		return report
+	}
+
+	// Removed servers are stopped and lose their VLAN interface
+	for _, id := range report.Removed {
+		if err := a.deleteServerWithVLAN(id, vlanManager); err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("server %s: %v", id, err))
+		}
+	}
+
+	a.mu.Lock()
+	for _, incoming := range doc.Servers {
+		server, exists := a.servers[incoming.ID]
+		if !exists {
+			server = &Server{ID: incoming.ID}
+			a.servers[incoming.ID] = server
+		}
+		running := server.Running
+		*server = *incoming
+		server.Running = running
+
+		if n, err := strconv.Atoi(incoming.ID); err == nil && n >= a.nextID {
+			a.nextID = n + 1
+		}
+	}
+
+	if replace {
+		a.groups = make(map[string]*Group)
+		a.templates = make(map[string]*Template)
+		a.settings = doc.Settings
+		a.headerRules = doc.Headers
+	} else {
+		if doc.Settings != (Settings{}) {
+			a.settings = doc.Settings
+		}
+		if doc.Headers != nil {
+			a.headerRules = doc.Headers
+		}
+	}
+	for _, group := range doc.Groups {
+		a.groups[group.ID] = group
+		if n, err := strconv.Atoi(group.ID); err == nil && n >= a.nextGroupID {
+			a.nextGroupID = n + 1
+		}
+	}
+	for _, template := range doc.Templates {
+		a.templates[template.ID] = template
+		if n, err := strconv.Atoi(template.ID); err == nil && n >= a.nextTemplateID {
+			a.nextTemplateID = n + 1
+		}
+	}
+	a.mu.Unlock()
+
+	// Recreate VLAN interfaces recorded in the imported servers
+	if vlanManager.privileges.CanManageVLANs() {
+		for _, incoming := range doc.Servers {
+			if incoming.VLANInterface == "" || vlanManager.GetVLANForPort(incoming.Port) != nil {
+				continue
+			}
+			if _, err := vlanManager.CreateVLANInterface(incoming.Port, incoming.VLANOptions); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("server %s: %v", incoming.ID, err))
+				continue
+			}
+			vlanManager.AssignServer(incoming.Port, incoming.ID)
+		}
+	}
+
+	a.flushConfig()
+	for _, id := range report.Created {
+		if server, exists := a.GetServer(id); exists {
+			a.events.Record(context.Background(), eventServerCreated, id, server.Name, fmt.Sprintf("Imported %s on port %s", server.Name, server.Port))
+		}
+	}
+	report.Applied = true
+	return report
+}
+
+// wantsYAML reports whether the request asks for YAML
+func wantsYAML(r *http.Request, header string) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "yaml" || format == "yml"
+	}
+	value := r.Header.Get(header)
+	return strings.Contains(value, "yaml") || strings.Contains(value, "yml")
+}
+
+// toYAML converts a JSON-tagged value to YAML, keeping the JSON field names
+func toYAML(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+// handleExportConfig returns the state as JSON, or YAML with ?format=yaml
+// or an Accept header asking for YAML
+func (a *App) handleExportConfig(w http.ResponseWriter, r *http.Request) {
+	export := a.ExportConfig()
+
+	if wantsYAML(r, "Accept") {
+		data, err := toYAML(export)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+// decodeImport reads a JSON or YAML export from the request body and the
+// ?mode=merge|replace it should be applied with
+func decodeImport(w http.ResponseWriter, r *http.Request) (*ConfigExport, bool, bool) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Mode must be merge or replace")
+		return nil, false, false
+	}
+
+	doc, ok := decodeConfigDocument(w, r)
+	return doc, mode == "replace", ok
+}
+
+// decodeConfigDocument reads a JSON or YAML export from the request body
+func decodeConfigDocument(w http.ResponseWriter, r *http.Request) (*ConfigExport, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	var doc ConfigExport
+	if err := decodeDocument(body, wantsYAML(r, "Content-Type"), &doc, true); err != nil {
+		var docErr *DocumentError
+		if errors.As(err, &docErr) {
+			writeErrorDetails(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid import document: "+err.Error(), map[string]interface{}{"problems": docErr.Problems})
+			return nil, false
+		}
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid import document: "+err.Error())
+		return nil, false
+	}
+
+	if doc.Version > configExportVersion {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Unsupported export version %d", doc.Version))
+		return nil, false
+	}
+	return &doc, true
+}
+
+// handleImportConfig restores state from a JSON or YAML export.
+// ?mode=merge|replace selects the semantics and ?dry_run=true only validates.
+func (a *App) handleImportConfig(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	doc, replace, ok := decodeImport(w, r)
+	if !ok {
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	report := a.ImportConfig(doc, replace, dryRun, vlanManager)
+
+	status := http.StatusOK
+	if !dryRun && !report.Applied {
+		status = http.StatusUnprocessableEntity
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configReloadDebounce is how long the config file must stay unchanged
+// before an edit is reloaded, so editors that write in steps are read once
+const configReloadDebounce = 500 * time.Millisecond
+
+// watchConfigFile reloads the config file whenever it is edited outside
+// the manager, for as long as the manager runs. A config file of another
+// format written into the config directory is merged the same way.
+func (a *App) watchConfigFile(vlanManager *VLANManager) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		a.warnings.Add("config", "Config file changes are not reloaded: inotify: %v", err)
+		return
+	}
+	file := os.NewFile(uintptr(fd), "inotify")
+	defer file.Close()
+	// Editors replace files by renaming, so the directory is watched
+	if _, err := syscall.InotifyAddWatch(fd, a.configDir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		a.warnings.Add("config", "Config file changes are not reloaded: watching %s: %v", a.configDir, err)
+		return
+	}
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	changed := ""
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+inotifyEventSize <= n; {
+			length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			name := strings.TrimRight(string(buf[offset+inotifyEventSize:offset+inotifyEventSize+length]), "\x00")
+			offset += inotifyEventSize + length
+
+			isConfig := false
+			for _, configName := range configFileNames {
+				isConfig = isConfig || name == configName
+			}
+			if !isConfig {
+				continue
+			}
+
+			mu.Lock()
+			changed = filepath.Join(a.configDir, name)
+			if timer != nil {
+				timer.Reset(configReloadDebounce)
+			} else {
+				timer = time.AfterFunc(configReloadDebounce, func() {
+					mu.Lock()
+					path := changed
+					mu.Unlock()
+					a.reloadConfigFile(path, vlanManager)
+				})
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// reloadConfigFile reads an edited config file and reloads it. Writes of
+// the manager itself are recognized and skipped; a file that doesn't
+// decode is left alone with a warning naming the lines at fault.
+func (a *App) reloadConfigFile(path string, vlanManager *VLANManager) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			a.warnings.Add("config", "Error reading %s for a reload: %v", path, err)
+		}
+		return
+	}
+	a.mu.Lock()
+	written := a.configWritten == sha256.Sum256(data)
+	a.mu.Unlock()
+	if written {
+		return
+	}
+
+	ctx := withRequestID(context.Background(), newRequestID())
+	var config AppConfig
+	if err := decodeDocument(data, isYAMLFile(path), &config, false); err != nil {
+		a.warnings.AddContext(ctx, "config", "Not reloading %s: %v", filepath.Base(path), err)
+		return
+	}
+	a.ReloadConfig(ctx, filepath.Base(path), &config, vlanManager)
+}
+
+// ReloadConfig merges an edited config into the running manager without
+// restarting it. New servers, groups and templates are added; changes to
+// stopped servers, settings and header rules apply as they are. Running
+// servers only take changes that need no restart, such as names and
+// labels: the rest are left out and recorded as config.restart_required
+// events. Nothing is deleted, and a config with problems changes nothing.
+// Servers the file gives no owner keep the one they have. While the
+// manager is frozen nothing is reloaded.
+func (a *App) ReloadConfig(ctx context.Context, source string, config *AppConfig, vlanManager *VLANManager) {
+	if a.Frozen() {
+		a.warnings.AddContext(ctx, "config", "Not reloading %s: the manager is frozen; save the file again once the freeze is lifted", source)
+		return
+	}
+
+	a.editMu.Lock()
+	defer a.editMu.Unlock()
+
+	doc := &ConfigExport{
+		Servers:   []*Server{},
+		Groups:    []*Group{},
+		Templates: []*Template{},
+		Settings:  config.Settings,
+		Headers:   config.HeaderRules,
+	}
+	ids := make([]string, 0, len(config.Servers))
+	for id := range config.Servers {
+		ids = append(ids, id)
+	}
+	sortByNumericID(ids)
+	for _, id := range ids {
+		if server := config.Servers[id]; server != nil {
+			if server.ID == "" {
+				server.ID = id
+			}
+			if current, exists := a.GetServer(server.ID); exists && server.Owner == "" {
+				server.Owner = current.Owner
+			}
+			doc.Servers = append(doc.Servers, server)
+		}
+	}
+	for _, group := range config.Groups {
+		doc.Groups = append(doc.Groups, group)
+	}
+	for _, template := range config.Templates {
+		doc.Templates = append(doc.Templates, template)
+	}
+
+	plan := a.PlanConfig(doc, false, vlanManager)
+	if len(plan.Problems) > 0 {
+		a.warnings.AddContext(ctx, "config", "Not reloading %s: %s", source, strings.Join(plan.Problems, "; "))
+		return
+	}
+	if len(plan.Changes) == 0 {
+		return
+	}
+
+	// Only the servers that changed are imported, running ones with just
+	// the fields they can take while running
+	incoming := make(map[string]*Server, len(doc.Servers))
+	for _, server := range doc.Servers {
+		incoming[server.ID] = server
+	}
+	doc.Servers = []*Server{}
+	created, updated := 0, 0
+	for _, change := range plan.Changes {
+		if change.Resource != "server" {
+			continue
+		}
+		server := incoming[change.ID]
+		current, exists := a.GetServer(change.ID)
+		if change.Action == "create" || !exists || !current.Running {
+			doc.Servers = append(doc.Servers, server)
+			if change.Action == "create" {
+				created++
+			} else {
+				updated++
+			}
+			continue
+		}
+
+		var applied, deferred []string
+		for _, field := range change.Fields {
+			if restartFreeFields[field.Field] {
+				applied = append(applied, field.Field)
+			} else {
+				deferred = append(deferred, field.Field)
+			}
+		}
+		if len(applied) > 0 {
+			merged, err := withServerFields(&current, server, applied)
+			if err != nil {
+				a.warnings.AddContext(ctx, "config", "Not reloading server %s from %s: %v", change.ID, source, err)
+				continue
+			}
+			doc.Servers = append(doc.Servers, merged)
+			updated++
+		}
+		if len(deferred) > 0 {
+			a.events.Record(ctx, eventConfigRestartRequired, change.ID, server.Name,
+				fmt.Sprintf("%s changes %s of the running server; stop it and save the file again, or apply the file with a restart", source, strings.Join(deferred, ", ")))
+		}
+	}
+
+	report := a.ImportConfig(doc, false, false, vlanManager)
+	if !report.Applied {
+		a.warnings.AddContext(ctx, "config", "Not reloading %s: %s", source, strings.Join(report.Problems, "; "))
+		return
+	}
+	for _, problem := range report.Problems {
+		a.warnings.AddContext(ctx, "config", "Reloading %s: %s", source, problem)
+	}
+	logAttrs(ctx, slog.LevelInfo, "config reloaded", slog.String("file", source), slog.Int("created", created), slog.Int("updated", updated))
+	a.events.Record(ctx, eventConfigReloaded, "", "", fmt.Sprintf("Reloaded %s: %d servers added, %d updated", source, created, updated))
+}
+
+// withServerFields returns a copy of current with the named JSON fields
+// taken from incoming
+func withServerFields(current, incoming *Server, fields []string) (*Server, error) {
+	fieldsOf := func(server *Server) (map[string]json.RawMessage, error) {
+		m := make(map[string]json.RawMessage)
+		data, err := json.Marshal(server)
+		if err != nil {
+			return nil, err
+		}
+		return m, json.Unmarshal(data, &m)
+	}
+	merged, err := fieldsOf(current)
+	if err != nil {
+		return nil, err
+	}
+	taken, err := fieldsOf(incoming)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if value, exists := taken[field]; exists {
+			merged[field] = value
+		} else {
+			delete(merged, field)
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{}
+	return server, json.Unmarshal(data, server)
+}
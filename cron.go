@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros are the shorthand schedules cron accepts
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronSchedule is a parsed five-field cron expression. Each field is a
+// bit set of the values it allows; times are local like in cron.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// A restricted day of month and day of week match either, as in cron
+	domAny, dowAny bool
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week" with
+// lists, ranges, steps and weekday names, or one of the @ macros
+func parseCron(spec string) (cronSchedule, error) {
+	if expanded, ok := cronMacros[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf(`schedule must have five fields such as "*/5 * * * *" or be a macro such as @hourly`)
+	}
+
+	var cs cronSchedule
+	var err error
+	if cs.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return cronSchedule{}, fmt.Errorf("minute: %v", err)
+	}
+	if cs.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return cronSchedule{}, fmt.Errorf("hour: %v", err)
+	}
+	if cs.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return cronSchedule{}, fmt.Errorf("day of month: %v", err)
+	}
+	if cs.month, err = parseCronField(fields[3], 1, 12, nil); err != nil {
+		return cronSchedule{}, fmt.Errorf("month: %v", err)
+	}
+	if cs.dow, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		return cronSchedule{}, fmt.Errorf("day of week: %v", err)
+	}
+	// Both 0 and 7 are Sunday
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.domAny = strings.HasPrefix(fields[2], "*")
+	cs.dowAny = strings.HasPrefix(fields[4], "*")
+	return cs, nil
+}
+
+// parseCronField parses a comma-separated list of *, values and ranges,
+// each with an optional /step, into a bit set
+func parseCronField(field string, min, max int, names map[string]time.Weekday) (uint64, error) {
+	value := func(s string) (int, error) {
+		if day, ok := names[strings.ToLower(s)]; ok {
+			return int(day), nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		low, high := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			from, to, _ := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = value(from); err != nil {
+				return 0, err
+			}
+			if high, err = value(to); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("range %q runs backwards", rangePart)
+			}
+		default:
+			n, err := value(rangePart)
+			if err != nil {
+				return 0, err
+			}
+			low = n
+			// "5/15" runs from 5 to the end in steps
+			if !hasStep {
+				high = n
+			}
+		}
+		for n := low; n <= high; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches reports whether the schedule runs on the day of t
+func (cs cronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domAny || cs.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// matches reports whether the schedule runs in the minute of t
+func (cs cronSchedule) matches(t time.Time) bool {
+	return cs.minute&(1<<uint(t.Minute())) != 0 &&
+		cs.hour&(1<<uint(t.Hour())) != 0 &&
+		cs.month&(1<<uint(t.Month())) != 0 &&
+		cs.dayMatches(t)
+}
+
+// next returns the first minute after t the schedule runs in, searching
+// up to five years ahead for schedules such as Feb 29 on a Monday
+func (cs cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		if cs.month&(1<<uint(t.Month())) == 0 || !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) != 0 {
+			return t, true
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// deployTimeout bounds a whole deploy: fetch, checkout and composer
+	deployTimeout = 10 * time.Minute
+	// maxDeploysPerServer bounds the deploy history kept per server
+	maxDeploysPerServer = 50
+	// maxDeployOutput bounds the command output kept with a deploy
+	maxDeployOutput = 16 * 1024
+)
+
+var (
+	// errNoRepository is returned when deploying a server without a git
+	// repository
+	errNoRepository = errors.New("server has no git repository")
+	// errDeployRunning is returned while another deploy of the server runs
+	errDeployRunning = errors.New("a deploy of this server is already running")
+	// errNotDeployed is returned when rolling back to an unknown commit
+	errNotDeployed = errors.New("commit was never deployed to this server")
+
+	// validGitBranch matches branch names that can't be mistaken for options
+	validGitBranch = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._/-]*$`)
+	// validGitCommit matches abbreviated and full commit hashes
+	validGitCommit = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+)
+
+// GitSource is the repository a server's document root is deployed from
+type GitSource struct {
+	URL      string `json:"url"`
+	Branch   string `json:"branch,omitempty"`   // defaults to main
+	Composer bool   `json:"composer,omitempty"` // run composer install after checkout
+}
+
+// Validate checks the repository URL and branch
+func (gs GitSource) Validate() error {
+	if gs.URL == "" || strings.HasPrefix(gs.URL, "-") {
+		return fmt.Errorf("git url is required")
+	}
+	if gs.Branch != "" && !validGitBranch.MatchString(gs.Branch) {
+		return fmt.Errorf("invalid git branch %q", gs.Branch)
+	}
+	return nil
+}
+
+// branch returns the branch to deploy
+func (gs GitSource) branch() string {
+	if gs.Branch == "" {
+		return "main"
+	}
+	return gs.Branch
+}
+
+// Deployment is one deploy or rollback of a server
+type Deployment struct {
+	ID         int       `json:"id"`
+	Commit     string    `json:"commit,omitempty"`
+	Branch     string    `json:"branch"`
+	Rollback   bool      `json:"rollback,omitempty"`
+	Status     string    `json:"status"` // "succeeded" or "failed"
+	Error      string    `json:"error,omitempty"`
+	Restarted  bool      `json:"restarted"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Output     string    `json:"output,omitempty"`
+}
+
+// DeployManager runs deploys and keeps their history in deploys.json
+// below the config directory. Only one deploy per server runs at a time.
+type DeployManager struct {
+	mu      sync.Mutex
+	path    string
+	history map[string][]Deployment
+	busy    map[string]bool
+}
+
+// NewDeployManager loads the deploy history stored below baseDir
+func NewDeployManager(baseDir string) *DeployManager {
+	dm := &DeployManager{
+		path:    filepath.Join(baseDir, "deploys.json"),
+		history: make(map[string][]Deployment),
+		busy:    make(map[string]bool),
+	}
+
+	if data, err := ioutil.ReadFile(dm.path); err == nil {
+		json.Unmarshal(data, &dm.history)
+	}
+
+	return dm
+}
+
+// History returns a server's deploys, newest first
+func (dm *DeployManager) History(id string) []Deployment {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	deploys := make([]Deployment, 0, len(dm.history[id]))
+	for i := len(dm.history[id]) - 1; i >= 0; i-- {
+		deploys = append(deploys, dm.history[id][i])
+	}
+	return deploys
+}
+
+// Forget drops the history of a deleted server
+func (dm *DeployManager) Forget(id string) {
+	if dm == nil {
+		return
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if _, exists := dm.history[id]; exists {
+		delete(dm.history, id)
+		dm.saveLocked()
+	}
+}
+
+// saveLocked persists the history; dm.mu must be held
+func (dm *DeployManager) saveLocked() error {
+	data, err := json.MarshalIndent(dm.history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dm.path, data, 0600)
+}
+
+// begin marks a server as deploying; it returns false when a deploy is
+// already running
+func (dm *DeployManager) begin(id string) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if dm.busy[id] {
+		return false
+	}
+	dm.busy[id] = true
+	return true
+}
+
+// finish records a deploy and clears the busy flag
+func (dm *DeployManager) finish(id string, deploy *Deployment) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	delete(dm.busy, id)
+
+	deploys := dm.history[id]
+	deploy.ID = 1
+	if len(deploys) > 0 {
+		deploy.ID = deploys[len(deploys)-1].ID + 1
+	}
+	deploys = append(deploys, *deploy)
+	if len(deploys) > maxDeploysPerServer {
+		deploys = deploys[len(deploys)-maxDeploysPerServer:]
+	}
+	dm.history[id] = deploys
+	return dm.saveLocked()
+}
+
+// deployed reports whether commit was deployed successfully before
+func (dm *DeployManager) deployed(id, commit string) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	for _, deploy := range dm.history[id] {
+		if deploy.Status == "succeeded" && strings.HasPrefix(deploy.Commit, commit) {
+			return true
+		}
+	}
+	return false
+}
+
+// previous returns the commit deployed successfully before the current
+// one
+func (dm *DeployManager) previous(id string) (string, bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	current := ""
+	deploys := dm.history[id]
+	for i := len(deploys) - 1; i >= 0; i-- {
+		if deploys[i].Status != "succeeded" {
+			continue
+		}
+		if current == "" {
+			current = deploys[i].Commit
+		} else if deploys[i].Commit != current {
+			return deploys[i].Commit, true
+		}
+	}
+	return "", false
+}
+
+// deployRunner runs the commands of one deploy as the server's user and
+// collects their output
+type deployRunner struct {
+	ctx     context.Context
+	account *runAccount
+	output  bytes.Buffer
+}
+
+// run executes a command in dir and returns its trimmed output
+func (dr *deployRunner) run(dir string, name string, args ...string) (string, error) {
+	cmd := exec.CommandContext(dr.ctx, name, args...)
+	cmd.Dir = dir
+	// Never wait for credentials on a terminal that isn't there
+	cmd.Env = append(childEnvironment(), "GIT_TERMINAL_PROMPT=0", "COMPOSER_NO_INTERACTION=1")
+	if dr.account != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: dr.account.credential()}
+		cmd.Env = append(cmd.Env, dr.account.environment()...)
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	fmt.Fprintf(&dr.output, "$ %s %s\n", name, strings.Join(args, " "))
+	err := cmd.Run()
+	dr.output.Write(out.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v", name, args[0], err)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// tail returns the end of the collected output
+func (dr *deployRunner) tail() string {
+	output := dr.output.String()
+	if len(output) > maxDeployOutput {
+		output = "...\n" + output[len(output)-maxDeployOutput:]
+	}
+	return output
+}
+
+// checkout brings directory to commit, or to the head of the source's
+// branch when commit is empty, and returns the commit checked out. An
+// empty or missing directory is cloned into.
+func (dr *deployRunner) checkout(source GitSource, directory, commit string) (string, error) {
+	_, err := os.Stat(filepath.Join(directory, ".git"))
+	switch {
+	case err == nil:
+		if commit == "" {
+			if _, err := dr.run(directory, "git", "fetch", "--prune", "origin", source.branch()); err != nil {
+				return "", err
+			}
+			commit = "FETCH_HEAD"
+		}
+	case os.IsNotExist(err):
+		if entries, _ := os.ReadDir(directory); len(entries) > 0 {
+			return "", fmt.Errorf("%s is not empty and not a git checkout", directory)
+		}
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return "", err
+		}
+		if dr.account != nil {
+			os.Chown(directory, int(dr.account.uid), int(dr.account.gid))
+		}
+		if _, err := dr.run(directory, "git", "clone", "--branch", source.branch(), "--", source.URL, "."); err != nil {
+			return "", err
+		}
+		if commit == "" {
+			commit = "HEAD"
+		}
+	default:
+		return "", err
+	}
+
+	if _, err := dr.run(directory, "git", "reset", "--hard", commit); err != nil {
+		return "", err
+	}
+	return dr.run(directory, "git", "rev-parse", "HEAD")
+}
+
+// Deploy updates a server's document root from its repository, or rolls
+// it back to commit, runs composer when enabled and restarts the server
+// if it was running
+func (a *App) Deploy(ctx context.Context, server Server, commit string) (Deployment, error) {
+	id := server.ID
+	if server.Git == nil {
+		return Deployment{}, errNoRepository
+	}
+	if commit != "" && !a.deploys.deployed(id, commit) {
+		return Deployment{}, errNotDeployed
+	}
+	if !a.deploys.begin(id) {
+		return Deployment{}, errDeployRunning
+	}
+
+	deploy := Deployment{Branch: server.Git.branch(), Rollback: commit != "", StartedAt: time.Now()}
+	runCtx, cancel := context.WithTimeout(ctx, deployTimeout)
+	defer cancel()
+	runner := &deployRunner{ctx: runCtx}
+	err := func() error {
+		// Check out as the server's user so it owns its files
+		if a.privileges.Root {
+			account, err := lookupRunAccount(a.runAsUser(server))
+			if err != nil {
+				return err
+			}
+			runner.account = &account
+		}
+
+		var err error
+		if deploy.Commit, err = runner.checkout(*server.Git, server.Directory, commit); err != nil {
+			return err
+		}
+		if server.Git.Composer {
+			if _, err := os.Stat(filepath.Join(server.Directory, "composer.json")); err == nil {
+				if _, err := runner.run(server.Directory, "composer", "install", "--no-dev", "--prefer-dist", "--optimize-autoloader"); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Pick up the new code and the document root it may have added
+		a.refreshFramework(id)
+		if server.Running {
+			deploy.Restarted = true
+			// Hand over without dropping requests where the manager can
+			if current, _ := a.GetServer(id); a.reloads.Supported(current) == nil {
+				if _, err := a.ReloadServer(ctx, id, defaultReloadDrain); err != nil {
+					return fmt.Errorf("server %s did not reload after the deploy: %w", id, err)
+				}
+			} else if !a.StopServerContext(ctx, id) || !a.StartServerContext(ctx, id) {
+				return fmt.Errorf("server %s did not restart after the deploy", id)
+			}
+		}
+		return nil
+	}()
+
+	deploy.FinishedAt = time.Now()
+	deploy.Output = runner.tail()
+	deploy.Status = "succeeded"
+	event, details := "deployed", fmt.Sprintf("%s@%s", deploy.Branch, shortCommit(deploy.Commit))
+	if deploy.Rollback {
+		event = "rolled_back"
+	}
+	if err != nil {
+		deploy.Status = "failed"
+		deploy.Error = err.Error()
+		event, details = "deploy_failed", err.Error()
+	}
+
+	if saveErr := a.deploys.finish(id, &deploy); saveErr != nil {
+		a.warnings.AddContext(ctx, "deploy", "Error saving deploy history for server %s: %v", id, saveErr)
+	}
+	if recordErr := a.store.Record(id, event, details); recordErr != nil {
+		a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, recordErr)
+	}
+	a.annotations.Record(ctx, id, server.Name, event, fmt.Sprintf("%s %s: %s", strings.Replace(event, "_", " ", 1), server.Name, details))
+	return deploy, nil
+}
+
+// shortCommit abbreviates a commit hash for display
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+// SetGitSource sets or, with nil, clears the repository of a server
+func (a *App) SetGitSource(id string, source *GitSource) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Git = source
+
+	a.requestSave()
+	return true
+}
+
+// handleSetGitSource sets the repository a server is deployed from
+// ({"url": "...", "branch": "main", "composer": true}; null clears it)
+func (a *App) handleSetGitSource(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var source *GitSource
+	if err := json.NewDecoder(r.Body).Decode(&source); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if source != nil {
+		if err := source.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if !a.SetGitSource(id, source) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	server, _ := a.GetServer(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
+
+// handleDeploy deploys the head of a server's branch. A body of
+// {"commit": "..."} rolls back to a previously deployed commit instead;
+// {"rollback": true} picks the one before the current deploy.
+func (a *App) handleDeploy(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	var request struct {
+		Commit   string `json:"commit"`
+		Rollback bool   `json:"rollback"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	if request.Commit != "" && !validGitCommit.MatchString(request.Commit) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "commit must be a hexadecimal commit hash")
+		return
+	}
+	if request.Rollback && request.Commit == "" {
+		previous, exists := a.deploys.previous(id)
+		if !exists {
+			writeError(w, http.StatusConflict, errCodeConflict, "There is no earlier deploy to roll back to")
+			return
+		}
+		request.Commit = previous
+	}
+
+	// A client that gives up waiting doesn't abort the deploy halfway
+	ctx := withRequestID(context.Background(), requestIDFromContext(r.Context()))
+	deploy, err := a.Deploy(ctx, server, request.Commit)
+	if err != nil {
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	if deploy.Status != "succeeded" {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(deploy)
+}
+
+// handleGetDeploys lists a server's deploys, newest first
+func (a *App) handleGetDeploys(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.deploys.History(id))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultDetailLogLines is how many log lines the detail includes
+	// unless ?lines= says otherwise
+	defaultDetailLogLines = 50
+	// maxDetailLogLines bounds ?lines=
+	maxDetailLogLines = 1000
+	// detailHealthEvents is how many health transitions the detail includes
+	detailHealthEvents = 20
+)
+
+// ServerRuntimeStatus is the process state of a server
+type ServerRuntimeStatus struct {
+	Running            bool         `json:"running"`
+	PID                int          `json:"pid,omitempty"`
+	Runtime            *RuntimeInfo `json:"runtime,omitempty"`
+	RestartRecommended bool         `json:"restart_recommended"`
+	PortMapping        *PortMapping `json:"port_mapping,omitempty"`
+}
+
+// ServerHealthDetail is the latest health of a server and its recent
+// transitions between healthy and unhealthy, oldest first
+type ServerHealthDetail struct {
+	Current *HealthStatus   `json:"current,omitempty"` // nil before the first probe
+	History []TimelineEvent `json:"history"`
+}
+
+// ServerDetail gathers what the server detail page shows. A part that
+// could not be read is left empty and its error is listed in Errors, so
+// one failing source does not hide the others.
+type ServerDetail struct {
+	Server  Server               `json:"server"`
+	Status  ServerRuntimeStatus  `json:"status"`
+	VLAN    *VLANInterfaceReport `json:"vlan,omitempty"`
+	Logs    []string             `json:"logs"`
+	Health  ServerHealthDetail   `json:"health"`
+	Stats   ServerStats          `json:"stats"`
+	Workers []WorkerStatus       `json:"workers,omitempty"`
+	Errors  map[string]string    `json:"errors,omitempty"`
+}
+
+// ServerDetail collects the detail of a server with the last logLines
+// lines of its log
+func (a *App) ServerDetail(id string, vlanManager *VLANManager, logLines int) (ServerDetail, bool) {
+	server, exists := a.GetServer(id)
+	if !exists {
+		return ServerDetail{}, false
+	}
+	detail := ServerDetail{Server: server, Logs: []string{}, Errors: make(map[string]string)}
+
+	a.mu.Lock()
+	detail.Status = ServerRuntimeStatus{Running: server.Running, PID: a.processes[id]}
+	a.mu.Unlock()
+	if runtime, exists := a.runtime.Status(id); exists {
+		detail.Status.Runtime = &runtime.StartedWith
+		detail.Status.RestartRecommended = runtime.RestartRecommended
+	}
+	if mapping, exists := a.portMappings.Get(id); exists {
+		detail.Status.PortMapping = &mapping
+	}
+
+	if server.VLANInterface != "" && vlanManager != nil {
+		for _, report := range vlanManager.Report() {
+			if report.Name == server.VLANInterface {
+				detail.VLAN = &report
+				break
+			}
+		}
+	}
+
+	if logLines > 0 {
+		output, err := readLastLines(filepath.Join(serverLogDir(a.configDir, id), activeLogName), logLines)
+		if err != nil && !os.IsNotExist(err) {
+			detail.Errors["logs"] = err.Error()
+		} else if output = strings.TrimRight(output, "\n"); output != "" {
+			detail.Logs = strings.Split(output, "\n")
+		}
+	}
+
+	if status, probed := a.health.Status(id); probed {
+		detail.Health.Current = &status
+	}
+	detail.Health.History = []TimelineEvent{}
+	if events, _, err := a.Timeline(id); err != nil {
+		detail.Errors["health"] = err.Error()
+	} else {
+		for _, event := range events {
+			if event.Event == "health_failed" || event.Event == "health_recovered" {
+				detail.Health.History = append(detail.Health.History, event)
+			}
+		}
+		if extra := len(detail.Health.History) - detailHealthEvents; extra > 0 {
+			detail.Health.History = detail.Health.History[extra:]
+		}
+	}
+
+	detail.Stats = ServerStats{ServerID: id, Running: server.Running, Samples: a.stats.Stats(id, time.Now())}
+	if server.Running && len(detail.Stats.Samples) > 0 {
+		current := detail.Stats.Samples[len(detail.Stats.Samples)-1]
+		detail.Stats.Current = &current
+	}
+
+	for _, wp := range server.Workers {
+		detail.Workers = append(detail.Workers, WorkerStatus{WorkerProcess: wp, Instances: a.supervisor.Status(id, wp.Name)})
+	}
+
+	if len(detail.Errors) == 0 {
+		detail.Errors = nil
+	}
+	return detail, true
+}
+
+// handleGetServerDetail returns a server's configuration, process state,
+// VLAN interface, recent log lines, health and resource usage in one
+// document (?lines= sets the number of log lines, 50 by default)
+func (a *App) handleGetServerDetail(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	lines := defaultDetailLogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		var err error
+		if lines, err = strconv.Atoi(value); err != nil || lines < 0 || lines > maxDetailLogLines {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("lines must be between 0 and %d", maxDetailLogLines))
+			return
+		}
+	}
+
+	detail, exists := a.ServerDetail(mux.Vars(r)["id"], vlanManager, lines)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("ETag", detail.Server.ETag())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultDockerImage is the image of docker servers that name none
+	defaultDockerImage = "dunglas/frankenphp"
+	// dockerServerLabel marks containers run by the manager with their
+	// server's ID
+	dockerServerLabel = "php-server-manager.server"
+	// dockerStopTimeout is how long Docker waits for a container to stop
+	// before killing it
+	dockerStopTimeout = 10
+	// defaultContainerLogLines is how many log lines are shown by default
+	defaultContainerLogLines = 200
+)
+
+// apacheCommand makes the php:apache images listen on the server's port,
+// given in PSM_PORT, instead of 80
+const apacheCommand = `sed -ri "s/^Listen 80$/Listen $PSM_PORT/" /etc/apache2/ports.conf && ` +
+	`sed -i "s/:80>/:$PSM_PORT>/" /etc/apache2/sites-available/000-default.conf && exec apache2-foreground`
+
+// dockerImageKind tells how an image serves PHP: "frankenphp" for
+// FrankenPHP images, which use the generated Caddyfile, and "apache" for
+// the php:*-apache images
+func dockerImageKind(image string) (string, error) {
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	switch {
+	case strings.Contains(name, "frankenphp"):
+		return "frankenphp", nil
+	case strings.HasPrefix(name, "php:") && strings.Contains(name, "apache"):
+		return "apache", nil
+	}
+	return "", fmt.Errorf("image must be a FrankenPHP image or a php:*-apache image")
+}
+
+// containerName is the name of a server's container
+func containerName(serverID string) string {
+	return "psm-server-" + serverID
+}
+
+// dockerNetworkName is the name of the macvlan network on a VLAN interface
+func dockerNetworkName(iface string) string {
+	return "psm-" + iface
+}
+
+// containerAddress returns the address a container takes on its server's
+// VLAN: the server's address with c0 in the fifth group. It can't use the
+// server's own address, which the interface on the host already holds.
+// Other addresses are returned as they are.
+func containerAddress(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil {
+		return address
+	}
+	ip = append(net.IP(nil), ip.To16()...)
+	ip[10], ip[11] = 0x00, 0xc0
+	return ip.String()
+}
+
+// dockerBackend runs each server as a Docker container with the docker
+// CLI attached, so its output reaches the server log and its exit is seen
+// like any other server's. Servers with a VLAN interface join a macvlan
+// network on it; others publish their port on the host.
+type dockerBackend struct{}
+
+// Name returns the backend name
+func (dockerBackend) Name() string {
+	return "docker"
+}
+
+// Command returns the docker run argv for spec
+func (dockerBackend) Command(spec LaunchSpec) ([]string, error) {
+	binary, err := findRuntimeBinary("docker")
+	if err != nil {
+		return nil, err
+	}
+	image := spec.Image
+	if image == "" {
+		image = defaultDockerImage
+	}
+	kind, err := dockerImageKind(image)
+	if err != nil {
+		return nil, err
+	}
+
+	argv := []string{binary, "run", "--rm", "--init", "--name", containerName(spec.ServerID),
+		"--label", dockerServerLabel + "=" + spec.ServerID}
+	if spec.Interface != "" {
+		argv = append(argv, "--network", dockerNetworkName(spec.Interface), "--ip6", spec.Address)
+	} else {
+		argv = append(argv, "--publish", spec.Port+":"+spec.Port)
+	}
+	if spec.User != "" {
+		argv = append(argv, "--user", spec.User)
+	}
+	// Directories are mounted at the same path, so the paths in the
+	// Caddyfile hold inside the container
+	mounts := spec.Mounts
+	if kind == "apache" {
+		mounts = nil
+		argv = append(argv, "--volume", spec.Directory+":/var/www/html", "--env", "PSM_PORT="+spec.Port)
+	}
+	for _, dir := range mounts {
+		if strings.Contains(dir, ":") {
+			return nil, fmt.Errorf("directory %s can't be mounted into a container because it contains a colon", dir)
+		}
+		argv = append(argv, "--volume", dir+":"+dir)
+	}
+	for _, name := range spec.Env {
+		argv = append(argv, "--env", name)
+	}
+	if spec.Limits.CPUPercent > 0 {
+		argv = append(argv, "--cpus", strconv.FormatFloat(float64(spec.Limits.CPUPercent)/100, 'f', 2, 64))
+	}
+	if spec.Limits.MemoryMB > 0 {
+		argv = append(argv, "--memory", fmt.Sprintf("%dm", spec.Limits.MemoryMB))
+	}
+
+	argv = append(argv, image)
+	if kind == "apache" {
+		return append(argv, "sh", "-c", apacheCommand), nil
+	}
+	return append(argv, frankenPHPArgs(runtimeBinary, spec)...), nil
+}
+
+// ListenAddress returns the container's address on the server's VLAN
+func (dockerBackend) ListenAddress(address string) string {
+	return containerAddress(address)
+}
+
+// Operations describes what Prepare does for spec
+func (dockerBackend) Operations(spec LaunchSpec) []string {
+	operations := []string{"remove container " + containerName(spec.ServerID) + " if one was left behind"}
+	if spec.Interface != "" {
+		operations = append(operations, fmt.Sprintf("create Docker macvlan network %s on %s unless it exists; the container takes %s",
+			dockerNetworkName(spec.Interface), spec.Interface, spec.Address))
+	}
+	return operations
+}
+
+// Prepare removes a container left behind by a manager that exited while
+// the server ran and creates the macvlan network on the server's VLAN
+func (dockerBackend) Prepare(ctx context.Context, spec LaunchSpec) error {
+	client := newDockerClient()
+	if err := client.removeContainer(ctx, containerName(spec.ServerID)); err != nil {
+		return err
+	}
+	for _, dir := range spec.Mounts {
+		os.MkdirAll(dir, 0755)
+	}
+	if spec.Interface == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(spec.Address + "/64")
+	if err != nil {
+		return fmt.Errorf("container address %s is not an IPv6 address", spec.Address)
+	}
+	return client.ensureNetwork(ctx, dockerNetworkName(spec.Interface), spec.Interface, subnet.String())
+}
+
+// Stop stops the server's container; Docker removes it once stopped
+func (dockerBackend) Stop(ctx context.Context, serverID string) error {
+	return newDockerClient().stopContainer(ctx, containerName(serverID))
+}
+
+// dockerSocket returns the Docker Engine API socket, from DOCKER_HOST when
+// it names a unix socket
+func dockerSocket() string {
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return "/var/run/docker.sock"
+}
+
+// dockerClient talks to the Docker Engine API over its unix socket
+type dockerClient struct {
+	socket string
+	http   *http.Client
+}
+
+// newDockerClient creates a client for the Docker daemon
+func newDockerClient() *dockerClient {
+	socket := dockerSocket()
+	return &dockerClient{
+		socket: socket,
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// dockerError is an error response of the Docker daemon
+type dockerError struct {
+	Status  int
+	Message string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker: %s (HTTP %d)", e.Message, e.Status)
+}
+
+// isDockerNotFound reports whether err is a 404 from the Docker daemon
+func isDockerNotFound(err error) bool {
+	de, ok := err.(*dockerError)
+	return ok && de.Status == http.StatusNotFound
+}
+
+// open sends a request and returns the response body, which the caller
+// must close. Responses with error statuses are returned as dockerError.
+func (dc *dockerClient) open(ctx context.Context, method, path string, body interface{}) (io.ReadCloser, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := dc.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker daemon at %s is not reachable: %v", dc.socket, err)
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var payload struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&payload)
+		if payload.Message == "" {
+			payload.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, &dockerError{Status: resp.StatusCode, Message: payload.Message}
+	}
+	return resp.Body, nil
+}
+
+// do sends a request and decodes the JSON response into out, if given
+func (dc *dockerClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	respBody, err := dc.open(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer respBody.Close()
+	if out == nil {
+		io.Copy(io.Discard, respBody)
+		return nil
+	}
+	return json.NewDecoder(respBody).Decode(out)
+}
+
+// ensureNetwork creates a macvlan network on parent with the subnet
+// unless a network of that name exists
+func (dc *dockerClient) ensureNetwork(ctx context.Context, name, parent, subnet string) error {
+	err := dc.do(ctx, "GET", "/networks/"+url.PathEscape(name), nil, nil)
+	if !isDockerNotFound(err) {
+		return err
+	}
+	return dc.do(ctx, "POST", "/networks/create", map[string]interface{}{
+		"Name":       name,
+		"Driver":     "macvlan",
+		"EnableIPv6": true,
+		"IPAM":       map[string]interface{}{"Config": []map[string]string{{"Subnet": subnet}}},
+		"Options":    map[string]string{"parent": parent},
+		"Labels":     map[string]string{dockerServerLabel: ""},
+	}, nil)
+}
+
+// stopContainer stops a container; a missing or stopped one is no error
+func (dc *dockerClient) stopContainer(ctx context.Context, name string) error {
+	err := dc.do(ctx, "POST", fmt.Sprintf("/containers/%s/stop?t=%d", url.PathEscape(name), dockerStopTimeout), nil, nil)
+	if isDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// removeContainer removes a container, stopping it first; a missing one
+// is no error
+func (dc *dockerClient) removeContainer(ctx context.Context, name string) error {
+	err := dc.do(ctx, "DELETE", "/containers/"+url.PathEscape(name)+"?force=true", nil, nil)
+	if isDockerNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// pullImage pulls an image, reading the progress stream to its end; a
+// failed pull is reported in the stream rather than in the status
+func (dc *dockerClient) pullImage(ctx context.Context, image string) error {
+	name, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+	body, err := dc.open(ctx, "POST", "/images/create?fromImage="+url.QueryEscape(name)+"&tag="+url.QueryEscape(tag), nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&progress); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if progress.Error != "" {
+			return fmt.Errorf("pulling %s: %s", image, progress.Error)
+		}
+	}
+}
+
+// createContainer creates a container from config, pulling its image
+// first when the daemon doesn't have it
+func (dc *dockerClient) createContainer(ctx context.Context, name string, config map[string]interface{}) error {
+	path := "/containers/create?name=" + url.QueryEscape(name)
+	err := dc.do(ctx, "POST", path, config, nil)
+	if !isDockerNotFound(err) {
+		return err
+	}
+	if err := dc.pullImage(ctx, config["Image"].(string)); err != nil {
+		return err
+	}
+	return dc.do(ctx, "POST", path, config, nil)
+}
+
+// ensureContainer creates a container from config unless one of that
+// name exists, starts it unless it runs and returns its status
+func (dc *dockerClient) ensureContainer(ctx context.Context, name string, config map[string]interface{}) (ContainerStatus, error) {
+	status, err := dc.inspectContainer(ctx, name)
+	if isDockerNotFound(err) {
+		err = dc.createContainer(ctx, name, config)
+	}
+	if err != nil {
+		return ContainerStatus{}, err
+	}
+	if status.Running {
+		return status, nil
+	}
+	if err := dc.startContainer(ctx, name); err != nil {
+		return ContainerStatus{}, err
+	}
+	return dc.inspectContainer(ctx, name)
+}
+
+// startContainer starts a container; a running one is no error
+func (dc *dockerClient) startContainer(ctx context.Context, name string) error {
+	return dc.do(ctx, "POST", "/containers/"+url.PathEscape(name)+"/start", nil, nil)
+}
+
+// ContainerStatus is what the Docker daemon reports about a server's
+// container
+type ContainerStatus struct {
+	ServerID     string            `json:"server_id"`
+	Name         string            `json:"name"`
+	ID           string            `json:"id"`
+	Image        string            `json:"image"`
+	State        string            `json:"state"` // created, running, paused, restarting, removing, exited or dead
+	Running      bool              `json:"running"`
+	StartedAt    time.Time         `json:"started_at"`
+	ExitCode     int               `json:"exit_code"`
+	Error        string            `json:"error,omitempty"`
+	OOMKilled    bool              `json:"oom_killed"`
+	Network      string            `json:"network,omitempty"`
+	Address      string            `json:"address,omitempty"`
+	Ports        map[string]string `json:"ports,omitempty"` // container port to host address, e.g. 8025/tcp to 127.0.0.1:49153
+	RestartCount int               `json:"restart_count"`
+}
+
+// inspectContainer returns the status of a container
+func (dc *dockerClient) inspectContainer(ctx context.Context, name string) (ContainerStatus, error) {
+	var inspect struct {
+		ID     string `json:"Id"`
+		Name   string
+		Config struct {
+			Image string
+		}
+		State struct {
+			Status    string
+			Running   bool
+			StartedAt time.Time
+			ExitCode  int
+			Error     string
+			OOMKilled bool
+		}
+		RestartCount    int
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress         string
+				GlobalIPv6Address string
+			}
+			Ports map[string][]struct {
+				HostIP   string `json:"HostIp"`
+				HostPort string
+			}
+		}
+	}
+	if err := dc.do(ctx, "GET", "/containers/"+url.PathEscape(name)+"/json", nil, &inspect); err != nil {
+		return ContainerStatus{}, err
+	}
+
+	status := ContainerStatus{
+		Name:         strings.TrimPrefix(inspect.Name, "/"),
+		ID:           inspect.ID,
+		Image:        inspect.Config.Image,
+		State:        inspect.State.Status,
+		Running:      inspect.State.Running,
+		StartedAt:    inspect.State.StartedAt,
+		ExitCode:     inspect.State.ExitCode,
+		Error:        inspect.State.Error,
+		OOMKilled:    inspect.State.OOMKilled,
+		RestartCount: inspect.RestartCount,
+	}
+	for network, settings := range inspect.NetworkSettings.Networks {
+		status.Network = network
+		status.Address = firstNonEmpty(settings.GlobalIPv6Address, settings.IPAddress)
+	}
+	for port, bindings := range inspect.NetworkSettings.Ports {
+		if len(bindings) > 0 {
+			if status.Ports == nil {
+				status.Ports = make(map[string]string)
+			}
+			status.Ports[port] = net.JoinHostPort(bindings[0].HostIP, bindings[0].HostPort)
+		}
+	}
+	return status, nil
+}
+
+// containerLogs returns the last lines of a container's output. Without a
+// TTY Docker frames each chunk with an 8 byte header carrying the stream
+// and the chunk length, which is stripped.
+func (dc *dockerClient) containerLogs(ctx context.Context, name string, lines int) (string, error) {
+	body, err := dc.open(ctx, "GET", fmt.Sprintf("/containers/%s/logs?stdout=1&stderr=1&tail=%d", url.PathEscape(name), lines), nil)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var out strings.Builder
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(body, header); err != nil {
+			if err == io.EOF {
+				return out.String(), nil
+			}
+			return out.String(), err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(&out, body, size); err != nil {
+			return out.String(), err
+		}
+	}
+}
+
+// fillDaemonSpec adds what a daemon backend needs to run the server away
+// from the manager to launch: the VLAN interface, image, user, the
+// variables to pass on, those of attached services included, and the
+// directories to mount
+func (a *App) fillDaemonSpec(launch *LaunchSpec, server Server, envNames, serviceEnv []string) error {
+	if server.VLANInterface != "" && server.IPv6Address != "" {
+		launch.Interface = server.VLANInterface
+	}
+	if server.Runtime != nil {
+		launch.Image = server.Runtime.Image
+	}
+	if runAs := a.runAsUser(server); runAs != "" {
+		account, err := lookupRunAccount(runAs)
+		if err != nil {
+			return err
+		}
+		launch.User = fmt.Sprintf("%d:%d", account.uid, account.gid)
+	}
+	launch.Env = envNames
+	for _, variable := range serviceEnv {
+		name, _, _ := strings.Cut(variable, "=")
+		launch.Env = append(launch.Env, name)
+	}
+	if len(server.PHPIni) > 0 || server.Debug.Enabled {
+		launch.Env = append(launch.Env, "PHP_INI_SCAN_DIR")
+	}
+	launch.Mounts = []string{server.Directory, serverLogDir(a.configDir, server.ID), serverPHPDir(a.configDir, server.ID), serverScriptDir(a.configDir, server.ID)}
+	if launch.Caddyfile != "" {
+		launch.Mounts = append(launch.Mounts, filepath.Dir(launch.Caddyfile))
+		if keyDir, written := a.certs.writtenKeyDir(server.ID); written {
+			launch.Mounts = append(launch.Mounts, keyDir)
+		}
+	}
+	launch.Limits = server.Limits
+	return nil
+}
+
+// SetRuntimeBackend selects the backend of a server; nil serves it with
+// FrankenPHP on the host
+func (a *App) SetRuntimeBackend(id string, runtime *RuntimeConfig) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Runtime = runtime
+
+	a.requestSave()
+	return true
+}
+
+// handleGetRuntimeBackend shows the runtime backend of a server
+func (a *App) handleGetRuntimeBackend(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"runtime":   server.Runtime,
+		"backend":   server.backend().Name(),
+	})
+}
+
+// handleSetRuntimeBackend selects the runtime backend of a server, applied on
+// the next start
+func (a *App) handleSetRuntimeBackend(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var runtime *RuntimeConfig
+	if err := json.NewDecoder(r.Body).Decode(&runtime); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if runtime != nil {
+		if err := runtime.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+		if runtime.Backend == defaultBackend.Name() {
+			runtime = nil
+		}
+	}
+
+	if !a.SetRuntimeBackend(id, runtime) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	backend := defaultBackend.Name()
+	if runtime != nil {
+		backend = runtime.Backend
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"runtime":   runtime,
+		"backend":   backend,
+	})
+}
+
+// writeDockerError reports a failed Docker API call
+func writeDockerError(w http.ResponseWriter, err error) {
+	if isDockerNotFound(err) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server has no container; it is not running")
+		return
+	}
+	writeError(w, http.StatusBadGateway, errCodeUpstream, err.Error())
+}
+
+// handleGetContainer shows the status of a server's container as the
+// Docker daemon reports it
+func (a *App) handleGetContainer(w http.ResponseWriter, r *http.Request) {
+	server, ok := a.serverOnBackend(w, r, "docker")
+	if !ok {
+		return
+	}
+
+	status, err := newDockerClient().inspectContainer(r.Context(), containerName(server.ID))
+	if err != nil {
+		writeDockerError(w, err)
+		return
+	}
+	status.ServerID = server.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleGetContainerLogs returns the last ?lines= lines (200 by default)
+// of a server's container output as plain text
+func (a *App) handleGetContainerLogs(w http.ResponseWriter, r *http.Request) {
+	server, ok := a.serverOnBackend(w, r, "docker")
+	if !ok {
+		return
+	}
+	lines := defaultContainerLogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "lines must be a positive number")
+			return
+		}
+		lines = n
+	}
+
+	logs, err := newDockerClient().containerLogs(r.Context(), containerName(server.ID), lines)
+	if err != nil {
+		writeDockerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, logs)
+}
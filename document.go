@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxDocumentProblems bounds the problems reported for one document
+const maxDocumentProblems = 20
+
+// DocumentProblem is a value of a JSON or YAML document that does not fit
+// the schema it is decoded with
+type DocumentProblem struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path,omitempty"` // e.g. servers[0].port
+	Message string `json:"message"`
+}
+
+// DocumentError lists the problems found in a document
+type DocumentError struct {
+	Problems []DocumentProblem
+}
+
+func (e *DocumentError) Error() string {
+	messages := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		messages[i] = fmt.Sprintf("line %d: ", problem.Line)
+		if problem.Path != "" {
+			messages[i] += problem.Path + ": "
+		}
+		messages[i] += problem.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	byteSliceType       = reflect.TypeOf([]byte(nil))
+)
+
+// decodeDocument decodes a JSON or YAML document into v, a pointer to a
+// JSON-tagged value, after checking it against v's type so that mistakes
+// are reported with their line: a number where a string is expected, a
+// list where an object is, and, when strict, fields v doesn't have.
+func decodeDocument(data []byte, isYAML bool, v interface{}, strict bool) error {
+	if !isYAML {
+		var raw json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				line, column := offsetPosition(data, syntaxErr.Offset)
+				return &DocumentError{Problems: []DocumentProblem{{Line: line, Column: column, Message: syntaxErr.Error()}}}
+			}
+			return err
+		}
+	}
+
+	// JSON is YAML, so both are checked on the YAML node tree, which knows
+	// where each value is
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	if len(root.Content) == 0 {
+		return fmt.Errorf("document is empty")
+	}
+	checker := schemaChecker{strict: strict}
+	checker.check(root.Content[0], reflect.TypeOf(v).Elem(), "")
+	if len(checker.problems) > 0 {
+		return &DocumentError{Problems: checker.problems}
+	}
+
+	if !isYAML {
+		return json.Unmarshal(data, v)
+	}
+	var generic interface{}
+	if err := root.Decode(&generic); err != nil {
+		return err
+	}
+	converted, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(converted, v)
+}
+
+// offsetPosition returns the line and column of a byte offset
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n')
+}
+
+// schemaChecker walks a YAML node tree along the Go type it decodes into
+type schemaChecker struct {
+	strict   bool
+	problems []DocumentProblem
+}
+
+func (c *schemaChecker) fail(node *yaml.Node, path, format string, args ...interface{}) {
+	if len(c.problems) < maxDocumentProblems {
+		c.problems = append(c.problems, DocumentProblem{Line: node.Line, Column: node.Column, Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// jsonFields maps the JSON names of a struct's fields to their types,
+// including the fields of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for name, fieldType := range jsonFields(embedded) {
+					if _, exists := fields[name]; !exists {
+						fields[name] = fieldType
+					}
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// lookupField finds a field the way encoding/json does, preferring an
+// exact match over a case-insensitive one
+func lookupField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if fieldType, exists := fields[key]; exists {
+		return fieldType, true
+	}
+	for name, fieldType := range fields {
+		if strings.EqualFold(name, key) {
+			return fieldType, true
+		}
+	}
+	return nil, false
+}
+
+// joinPath appends a field name to the path of a value
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// describe names the kind of a YAML value for error messages
+func describe(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "an object"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	switch node.Tag {
+	case "!!str":
+		return fmt.Sprintf("the string %q", node.Value)
+	case "!!int", "!!float":
+		return "the number " + node.Value
+	case "!!bool":
+		return node.Value
+	}
+	return node.Value
+}
+
+func (c *schemaChecker) check(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Tag == "!!null" {
+		return
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types that decode themselves, such as time.Time, accept their own
+	// formats
+	if t.Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			c.fail(node, path, "expected an object, got %s", describe(node))
+			return
+		}
+		fields := jsonFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldPath := joinPath(path, key.Value)
+			fieldType, exists := lookupField(fields, key.Value)
+			if !exists {
+				if c.strict {
+					c.fail(key, fieldPath, "unknown field")
+				}
+				continue
+			}
+			c.check(value, fieldType, fieldPath)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			c.fail(node, path, "expected an object, got %s", describe(node))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			c.check(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+	case reflect.Slice, reflect.Array:
+		if t == byteSliceType && node.Kind == yaml.ScalarNode {
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			c.fail(node, path, "expected a list, got %s", describe(node))
+			return
+		}
+		for i, item := range node.Content {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode || (node.Tag != "!!str" && node.Tag != "!!timestamp") {
+			if node.Kind == yaml.ScalarNode {
+				c.fail(node, path, "expected a string, got %s; quote it", describe(node))
+			} else {
+				c.fail(node, path, "expected a string, got %s", describe(node))
+			}
+		}
+	case reflect.Bool:
+		if node.Tag != "!!bool" {
+			c.fail(node, path, "expected true or false, got %s", describe(node))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if node.Tag != "!!int" {
+			c.fail(node, path, "expected a whole number, got %s", describe(node))
+		}
+	case reflect.Float32, reflect.Float64:
+		if node.Tag != "!!int" && node.Tag != "!!float" {
+			c.fail(node, path, "expected a number, got %s", describe(node))
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maskedValue replaces the value of keys that may hold secrets
+const maskedValue = "********"
+
+// publicDotEnvKeys are .env keys whose values are shown; every other value
+// is masked, since keys such as APP_KEY or DATABASE_URL carry credentials
+var publicDotEnvKeys = map[string]bool{
+	"APP_ENV": true, "APP_URL": true, "APP_DEBUG": true, "APP_NAME": true,
+	"APP_LOCALE": true, "APP_TIMEZONE": true, "LOG_CHANNEL": true, "LOG_LEVEL": true,
+	"DB_CONNECTION": true, "DB_HOST": true, "DB_PORT": true, "DB_DATABASE": true,
+	"CACHE_DRIVER": true, "CACHE_STORE": true, "QUEUE_CONNECTION": true, "SESSION_DRIVER": true,
+	"MAIL_MAILER": true, "WP_ENV": true, "WP_HOME": true, "WP_SITEURL": true,
+}
+
+// DotEnvKey is one key of a .env file
+type DotEnvKey struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Masked bool   `json:"masked,omitempty"`
+}
+
+// DotEnv is what was found in a server's .env file
+type DotEnv struct {
+	Path     string      `json:"path"`
+	Keys     []DotEnvKey `json:"keys"`
+	Warnings []string    `json:"warnings"`
+	values   map[string]string
+}
+
+// parseDotEnv reads KEY=value lines, skipping comments and blank lines.
+// An export prefix, surrounding quotes and trailing comments after
+// unquoted values are dropped, as phpdotenv does.
+func parseDotEnv(data []byte) ([]string, map[string]string) {
+	names := []string{}
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		eq := strings.Index(line, "=")
+		if eq < 1 {
+			continue
+		}
+		name := strings.TrimSpace(line[:eq])
+		if !validEnvName.MatchString(name) {
+			continue
+		}
+
+		value := strings.TrimSpace(line[eq+1:])
+		if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+			if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+				value = value[1 : end+1]
+			}
+		} else if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+
+		if _, seen := values[name]; !seen {
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+	return names, values
+}
+
+// readDotEnv reads the .env file in a server directory. It returns nil
+// when there is none.
+func readDotEnv(directory string) (*DotEnv, error) {
+	path := filepath.Join(directory, ".env")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names, values := parseDotEnv(data)
+	env := &DotEnv{Path: path, Keys: []DotEnvKey{}, Warnings: []string{}, values: values}
+	for _, name := range names {
+		key := DotEnvKey{Name: name, Value: values[name]}
+		if !publicDotEnvKeys[name] && key.Value != "" {
+			key.Value, key.Masked = maskedValue, true
+		}
+		env.Keys = append(env.Keys, key)
+	}
+	return env, nil
+}
+
+// checkAppURL compares an APP_URL with how the server is reached. Hosts
+// the server was reached on are accepted with any port, since those
+// requests usually come through a proxy; local addresses must use the
+// server's port.
+func checkAppURL(appURL string, server Server, domains []DomainTraffic) []string {
+	parsed, err := url.Parse(appURL)
+	if err != nil || parsed.Host == "" {
+		return []string{fmt.Sprintf("APP_URL %q is not an absolute URL", appURL)}
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	for _, domain := range domains {
+		if domain.Host == host {
+			return nil
+		}
+	}
+
+	local := map[string]bool{"localhost": true, "127.0.0.1": true, "::1": true, "0.0.0.0": true}
+	if server.IPv6Address != "" {
+		local[strings.ToLower(server.IPv6Address)] = true
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		local[strings.ToLower(hostname)] = true
+	}
+	if !local[host] {
+		return []string{fmt.Sprintf("APP_URL host %s is neither a local address nor a domain this server was reached on", host)}
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if port != server.Port {
+		return []string{fmt.Sprintf("APP_URL %s points at port %s, but the server listens on port %s", appURL, port, server.Port)}
+	}
+	return nil
+}
+
+// inspectDotEnv reads a server's .env and checks it against the server.
+// APP_URL set in the server's environment wins over the file, as real
+// environment variables do in phpdotenv.
+func (a *App) inspectDotEnv(server Server) (*DotEnv, error) {
+	env, err := readDotEnv(server.Directory)
+	if env == nil || err != nil {
+		return env, err
+	}
+
+	appURL, exists := server.Env["APP_URL"]
+	if !exists {
+		appURL, exists = env.values["APP_URL"]
+	}
+	if exists && appURL != "" {
+		env.Warnings = append(env.Warnings, checkAppURL(appURL, server, a.traffic.Domains(server.ID))...)
+	}
+	return env, nil
+}
+
+// warnDotEnv raises a warning for each problem found in a server's .env
+func (a *App) warnDotEnv(ctx context.Context, server Server) {
+	env, err := a.inspectDotEnv(server)
+	if err != nil {
+		a.warnings.AddContext(ctx, "dotenv", "Error reading .env of server %s: %v", server.ID, err)
+		return
+	}
+	if env == nil {
+		return
+	}
+	for _, warning := range env.Warnings {
+		a.warnings.AddContext(ctx, "dotenv", "Server %s (%s): %s", server.ID, server.Name, warning)
+	}
+}
+
+// handleGetDotEnv shows the keys of a server's .env with secrets masked
+// and any mismatch between APP_URL and the server
+func (a *App) handleGetDotEnv(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	env, err := a.inspectDotEnv(server)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	found := env != nil
+	if !found {
+		env = &DotEnv{Path: filepath.Join(server.Directory, ".env"), Keys: []DotEnvKey{}, Warnings: []string{}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"found":     found,
+		"path":      env.Path,
+		"keys":      env.Keys,
+		"warnings":  env.Warnings,
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Error codes returned in the "code" field of API errors
+const (
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeValidation           = "validation_failed"
+	errCodeUnauthorized         = "unauthorized"
+	errCodeForbidden            = "forbidden"
+	errCodeNotFound             = "not_found"
+	errCodeConflict             = "conflict"
+	errCodePreconditionFailed   = "precondition_failed"
+	errCodePreconditionRequired = "precondition_required"
+	errCodePortInUse            = "port_in_use"
+	errCodePortReserved         = "port_reserved"
+	errCodeAddressReserved      = "address_reserved"
+	errCodeVLANExhausted        = "vlan_exhausted"
+	errCodeVLANFailed           = "vlan_failed"
+	errCodeVLANNotReady         = "vlan_not_ready"
+	errCodeAlreadyRunning       = "already_running"
+	errCodeNotRunning           = "not_running"
+	errCodeStartFailed          = "start_failed"
+	errCodeStopFailed           = "stop_failed"
+	errCodeFrozen               = "frozen"
+	errCodeReadOnly             = "read_only"
+	errCodeUnavailable          = "unavailable"
+	errCodeRateLimited          = "rate_limited"
+	errCodeUpstream             = "upstream_failed"
+	errCodePartialFailure       = "partial_failure"
+	errCodeInternal             = "internal"
+	errCodeTemplateNotFound     = "template_not_found"
+)
+
+// APIError is the body of every error response:
+// {"error": {"code": "...", "message": "...", "details": {...}}}
+type APIError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// writeError sends a JSON error envelope with the given status and code
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails sends a JSON error envelope with additional details
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]APIError{
+		"error": {Code: code, Message: message, Details: details},
+	})
+}
+
+// writeProvisionError reports a failure to provision a server's VLAN
+func writeProvisionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errVLANExhausted) {
+		writeError(w, http.StatusConflict, errCodeVLANExhausted, err.Error())
+		return
+	}
+	if errors.Is(err, errAddressReserved) {
+		writeError(w, http.StatusConflict, errCodeAddressReserved, err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, errCodeVLANFailed, err.Error())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxEvents bounds the number of events kept in memory and on disk
+	maxEvents = 2000
+	// defaultEventLimit is how many events a query returns by default
+	defaultEventLimit = 100
+)
+
+// Lifecycle event types. Queries may also name the part before the dot to
+// get every event of that kind, e.g. "server".
+const (
+	eventServerCreated         = "server.created"
+	eventServerDeleted         = "server.deleted"
+	eventServerStarted         = "server.started"
+	eventServerStopped         = "server.stopped"
+	eventServerCrashed         = "server.crashed"
+	eventServerRestored        = "server.restored"
+	eventVLANCreated           = "vlan.created"
+	eventVLANRemoved           = "vlan.removed"
+	eventDatabaseCreated       = "database.created"
+	eventDatabaseDeleted       = "database.deleted"
+	eventAuthFailed            = "auth.failed"
+	eventConfigReloaded        = "config.reloaded"
+	eventConfigRestartRequired = "config.restart_required"
+)
+
+// Event is one lifecycle event of the manager
+type Event struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	ServerID  string    `json:"server_id,omitempty"`
+	Name      string    `json:"name,omitempty"` // the server's name
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// EventLog keeps the most recent lifecycle events in memory and in a JSON
+// lines file, so the activity feed survives restarts. The file is
+// rewritten with only the kept events once it holds twice as many. With
+// UseRedis the events are kept in Redis instead.
+type EventLog struct {
+	mu          sync.Mutex
+	path        string
+	entries     []Event
+	nextID      int64
+	written     int // lines in the file
+	subscribers map[chan Event]bool
+	closed      bool
+	redis       *redis.Client // shares the log between instances when set
+	pubsub      *redis.PubSub
+}
+
+// NewEventLog creates an event log backed by path, loading the events kept
+// in it
+func NewEventLog(path string) *EventLog {
+	el := &EventLog{path: path, nextID: 1, subscribers: make(map[chan Event]bool)}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return el
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		el.entries = append(el.entries, event)
+		el.written++
+		if event.ID >= el.nextID {
+			el.nextID = event.ID + 1
+		}
+	}
+	if len(el.entries) > maxEvents {
+		el.entries = el.entries[len(el.entries)-maxEvents:]
+	}
+
+	return el
+}
+
+// Record adds an event, tagged with the request ID from ctx. It is safe to
+// call on a nil EventLog.
+func (el *EventLog) Record(ctx context.Context, eventType, serverID, name, message string) {
+	if el == nil {
+		return
+	}
+
+	event := Event{
+		Time:      time.Now(),
+		Type:      eventType,
+		ServerID:  serverID,
+		Name:      name,
+		Message:   message,
+		RequestID: requestIDFromContext(ctx),
+	}
+	if el.redis != nil {
+		el.recordRedis(ctx, event)
+		return
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	event.ID = el.nextID
+	el.nextID++
+	el.entries = append(el.entries, event)
+	if len(el.entries) > maxEvents {
+		el.entries = el.entries[len(el.entries)-maxEvents:]
+	}
+	el.publishLocked(event)
+
+	if el.written >= 2*maxEvents {
+		el.compactLocked()
+		return
+	}
+	file, err := os.OpenFile(el.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if json.NewEncoder(file).Encode(event) == nil {
+		el.written++
+	}
+}
+
+// compactLocked rewrites the file with the kept events; el.mu must be held
+func (el *EventLog) compactLocked() {
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	for _, event := range el.entries {
+		encoder.Encode(event)
+	}
+	if err := writeFileAtomic(el.path, []byte(b.String()), 0600); err == nil {
+		el.written = len(el.entries)
+	}
+}
+
+// EventQuery selects events
+type EventQuery struct {
+	Since    time.Time // only events after this time
+	After    int64     // only events with a higher ID
+	Types    []string  // exact types or kinds such as "server"
+	ServerID string
+	Limit    int // the most recent events up to this count
+}
+
+// matchesType reports whether an event type is one of the wanted types or
+// kinds
+func matchesType(eventType string, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if eventType == t || strings.HasPrefix(eventType, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Query returns the most recent events matching q, oldest first
+func (el *EventLog) Query(q EventQuery) []Event {
+	var entries []Event
+	if el.redis != nil {
+		entries = el.redisEntries()
+	} else {
+		el.mu.Lock()
+		entries = el.entries
+		el.mu.Unlock()
+	}
+
+	result := []Event{}
+	for _, event := range entries {
+		if !q.Since.IsZero() && !event.Time.After(q.Since) {
+			continue
+		}
+		if event.ID <= q.After {
+			continue
+		}
+		if q.ServerID != "" && event.ServerID != q.ServerID {
+			continue
+		}
+		if !matchesType(event.Type, q.Types) {
+			continue
+		}
+		result = append(result, event)
+	}
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+	return result
+}
+
+// handleGetEvents lists recent lifecycle events. ?since= takes a time in
+// RFC 3339 or Unix milliseconds, ?after= an event ID, ?type= types or
+// kinds separated by commas, ?server= a server ID and ?limit= bounds the
+// count.
+func (el *EventLog) handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	q := EventQuery{ServerID: query.Get("server"), Limit: defaultEventLimit}
+	if since, err := parseAnnotationTime(query.Get("since")); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	} else if since > 0 {
+		q.Since = time.Unix(0, since*int64(time.Millisecond))
+	}
+	if value := query.Get("after"); value != "" {
+		after, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "after must be an event ID")
+			return
+		}
+		q.After = after
+	}
+	if types := query.Get("type"); types != "" {
+		q.Types = strings.Split(types, ",")
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "limit must be a positive number")
+			return
+		}
+		q.Limit = limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(el.Query(q))
+}
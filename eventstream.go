@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// eventStreamBuffer is how many events a stream may fall behind before
+	// it is closed; the client reconnects and catches up with Last-Event-ID
+	eventStreamBuffer = 64
+	// eventStreamKeepalive is how often an idle stream sends a comment so
+	// proxies don't time it out
+	eventStreamKeepalive = 15 * time.Second
+	// eventStreamRetry is how long clients wait before reconnecting, in
+	// milliseconds
+	eventStreamRetry = 3000
+)
+
+// Subscribe returns a channel receiving every event recorded from now on
+// and a function ending the subscription. The channel is closed when the
+// subscriber falls behind or the log is closed.
+func (el *EventLog) Subscribe() (<-chan Event, func()) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	ch := make(chan Event, eventStreamBuffer)
+	if el.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	el.subscribers[ch] = true
+	return ch, func() {
+		el.mu.Lock()
+		defer el.mu.Unlock()
+		if el.subscribers[ch] {
+			delete(el.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishLocked hands an event to the subscribers; el.mu must be held. A
+// subscriber whose buffer is full is dropped rather than blocking Record.
+func (el *EventLog) publishLocked(event Event) {
+	for ch := range el.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(el.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends all subscriptions, so open streams don't hold up shutdown
+func (el *EventLog) Close() {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	el.closed = true
+	if el.pubsub != nil {
+		el.pubsub.Close()
+	}
+	for ch := range el.subscribers {
+		delete(el.subscribers, ch)
+		close(ch)
+	}
+}
+
+// oldestID returns the ID of the oldest event kept, or zero when there is
+// none
+func (el *EventLog) oldestID() int64 {
+	if el.redis != nil {
+		return el.redisOldestID()
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	if len(el.entries) == 0 {
+		return 0
+	}
+	return el.entries[0].ID
+}
+
+// writeSSE writes one event in the text/event-stream format
+func writeSSE(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// handleEventStream streams lifecycle events as Server-Sent Events, for
+// dashboards that can't use WebSockets or poll. ?type= and ?server= filter
+// as for GET /api/events. A reconnecting client's Last-Event-ID header (or
+// ?last_event_id=) replays what it missed; when that is no longer kept a
+// "reset" event tells it to reload its state.
+func (el *EventLog) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Streaming is not supported")
+		return
+	}
+
+	query := r.URL.Query()
+	q := EventQuery{ServerID: query.Get("server")}
+	if types := query.Get("type"); types != "" {
+		q.Types = strings.Split(types, ",")
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = query.Get("last_event_id")
+	}
+	resume := lastID != ""
+	if resume {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Last-Event-ID must be an event ID")
+			return
+		}
+		q.After = id
+	}
+
+	// Subscribe before replaying so nothing recorded in between is lost
+	events, unsubscribe := el.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventStreamRetry)
+
+	sent := q.After
+	if resume {
+		if oldest := el.oldestID(); oldest > q.After+1 {
+			fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+		}
+		for _, event := range el.Query(q) {
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			sent = event.ID
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			if event.ID <= sent || (q.ServerID != "" && event.ServerID != q.ServerID) || !matchesType(event.Type, q.Types) {
+				continue
+			}
+			if err := writeSSE(w, event); err != nil {
+				return
+			}
+			sent = event.ID
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+)
+
+// Frameworks recognised in a server's directory
+const (
+	frameworkLaravel   = "laravel"
+	frameworkSymfony   = "symfony"
+	frameworkWordPress = "wordpress"
+	frameworkPlain     = "plain"
+)
+
+// FrameworkPreset is how a detected framework is served
+type FrameworkPreset struct {
+	Framework    string   `json:"framework"`
+	DocumentRoot string   `json:"document_root"` // relative to the server directory
+	Evidence     []string `json:"evidence"`      // files the detection is based on
+	Rewrites     []string `json:"rewrites"`      // Caddyfile directives added to the site
+}
+
+// frameworkRule recognises one framework by files that must all exist
+type frameworkRule struct {
+	framework    string
+	files        []string
+	documentRoot string
+	rewrites     []string
+}
+
+// frameworkRules are tried in order; the first match wins. Unknown paths
+// already fall back to the front controller (index.php) in php_server, so
+// rules only add what a framework needs on top of that.
+var frameworkRules = []frameworkRule{
+	{
+		framework:    frameworkLaravel,
+		files:        []string{"artisan", "public/index.php"},
+		documentRoot: "public",
+	},
+	{
+		framework:    frameworkSymfony,
+		files:        []string{"bin/console", "public/index.php"},
+		documentRoot: "public",
+	},
+	{
+		framework:    frameworkWordPress,
+		files:        []string{"wp-load.php", "wp-includes"},
+		documentRoot: ".",
+		rewrites: []string{
+			// Keep the config and uploaded scripts from being served or run
+			`@wp_blocked path_regexp ^/(wp-config\.php|wp-content/uploads/.+\.php|\.ht.*|\.git/.*|\.env)$`,
+			"respond @wp_blocked 403",
+		},
+	},
+}
+
+// detectFramework inspects a server directory. Directories that match no
+// rule are served as plain PHP from the directory itself.
+func detectFramework(directory string) FrameworkPreset {
+	for _, rule := range frameworkRules {
+		matched := true
+		for _, file := range rule.files {
+			if _, err := os.Stat(filepath.Join(directory, file)); err != nil {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return FrameworkPreset{Framework: rule.framework, DocumentRoot: rule.documentRoot, Evidence: rule.files, Rewrites: append([]string{}, rule.rewrites...)}
+		}
+	}
+
+	preset := FrameworkPreset{Framework: frameworkPlain, DocumentRoot: ".", Evidence: []string{}, Rewrites: []string{}}
+	if _, err := os.Stat(filepath.Join(directory, "index.php")); err == nil {
+		preset.Evidence = append(preset.Evidence, "index.php")
+	}
+	return preset
+}
+
+// servedRoot returns the directory the preset serves files from
+func (fp FrameworkPreset) servedRoot(directory string) string {
+	return filepath.Join(directory, fp.DocumentRoot)
+}
+
+// refreshFramework detects the framework of a server again and stores it
+// when it changed
+func (a *App) refreshFramework(id string) (FrameworkPreset, bool) {
+	server, exists := a.GetServer(id)
+	if !exists {
+		return FrameworkPreset{}, false
+	}
+	preset := detectFramework(server.Directory)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if current, exists := a.servers[id]; exists && current.Directory == server.Directory && current.Framework != preset.Framework {
+		current.Framework = preset.Framework
+		a.requestSave()
+	}
+	return preset, true
+}
+
+// handleGetFramework reports the detected framework of a server, the
+// directory that is served and the rewrite rules added for it
+func (a *App) handleGetFramework(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	preset, exists := a.refreshFramework(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	server, _ := a.GetServer(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id":     id,
+		"framework":     preset.Framework,
+		"directory":     server.Directory,
+		"document_root": preset.DocumentRoot,
+		"served_root":   preset.servedRoot(server.Directory),
+		"evidence":      preset.Evidence,
+		"rewrites":      preset.Rewrites,
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FreezeState describes the emergency mutation lock
+type FreezeState struct {
+	Frozen    bool      `json:"frozen"`
+	Reason    string    `json:"reason,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	User      string    `json:"user,omitempty"` // who froze the manager
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// FreezeManager blocks all mutating operations while frozen. The state is
+// persisted so a restart during an incident keeps the lock in place.
+type FreezeManager struct {
+	mu      sync.Mutex
+	state   FreezeState
+	path    string
+	audit   *AuditLog
+	isAdmin func(user string) bool // who may lift the freeze; everyone when nil
+}
+
+// NewFreezeManager creates a freeze manager persisting its state at path
+func NewFreezeManager(path string, audit *AuditLog) *FreezeManager {
+	fm := &FreezeManager{path: path, audit: audit}
+
+	if data, err := ioutil.ReadFile(path); err == nil {
+		json.Unmarshal(data, &fm.state)
+	}
+
+	return fm
+}
+
+// Frozen reports whether mutations are currently blocked. Automated
+// actions must check this before changing anything.
+func (fm *FreezeManager) Frozen() bool {
+	if fm == nil {
+		return false
+	}
+
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return fm.state.Frozen
+}
+
+// Frozen reports whether the emergency freeze is on. The scheduler,
+// reconciler and other background loops skip their actions while it is.
+func (a *App) Frozen() bool {
+	return a.freeze.Frozen()
+}
+
+// State returns the current freeze state
+func (fm *FreezeManager) State() FreezeState {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return fm.state
+}
+
+// setState updates and persists the freeze state
+func (fm *FreezeManager) setState(state FreezeState) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	fm.state = state
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fm.path, data, 0600)
+}
+
+// freezeExempt lists mutating endpoints that stay available while frozen
+var freezeExempt = []string{
+	"/api/auth/login",
+	"/api/auth/logout",
+	"/api/system/freeze",
+	"/api/system/unfreeze",
+}
+
+// Middleware rejects mutating requests while frozen
+func (fm *FreezeManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, path := range freezeExempt {
+			if strings.TrimSuffix(r.URL.Path, "/") == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if fm.Frozen() {
+			writeError(w, http.StatusLocked, errCodeFrozen, "Manager is frozen: "+fm.State().Reason)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// freezeRequest is the request body for freezing and unfreezing
+type freezeRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (fm *FreezeManager) handleGetFreeze(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fm.State())
+}
+
+func (fm *FreezeManager) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	var req freezeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	state := FreezeState{
+		Frozen:    true,
+		Reason:    req.Reason,
+		Since:     time.Now(),
+		User:      userFromContext(r.Context()),
+		RequestID: requestIDFromContext(r.Context()),
+	}
+	if err := fm.setState(state); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Failed to persist freeze state: "+err.Error())
+		return
+	}
+	fm.audit.Record(r.Context(), r, "system.freeze", "", req.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// handleUnfreeze lifts the freeze; only admins may, and they must say why
+func (fm *FreezeManager) handleUnfreeze(w http.ResponseWriter, r *http.Request) {
+	if fm.isAdmin != nil && !fm.isAdmin(userFromContext(r.Context())) {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Only admins may lift the freeze")
+		return
+	}
+
+	var req freezeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "A reason is required to unfreeze")
+		return
+	}
+
+	if !fm.Frozen() {
+		writeError(w, http.StatusConflict, errCodeConflict, "Manager is not frozen")
+		return
+	}
+
+	if err := fm.setState(FreezeState{}); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Failed to persist freeze state: "+err.Error())
+		return
+	}
+	os.Remove(fm.path)
+	fm.audit.Record(r.Context(), r, "system.unfreeze", "", req.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fm.State())
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultBrowseRoots are the directories the directory picker may show
+// when PSM_BROWSE_ROOTS is not set
+var defaultBrowseRoots = []string{"/var/www", "/srv"}
+
+// validateDocumentRoot checks that a server directory exists, can be read
+// and looks like a PHP application: it holds an index.php or a public/
+// folder. It returns a problem code along with the error.
+func validateDocumentRoot(path string) (string, error) {
+	if hasControlChars(path) {
+		return "invalid_path", fmt.Errorf("path contains control characters")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "not_found", fmt.Errorf("directory does not exist")
+	}
+	if !info.IsDir() {
+		return "not_a_directory", fmt.Errorf("path is not a directory")
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return "not_readable", fmt.Errorf("directory is not readable: %v", err)
+	}
+	_, err = dir.Readdirnames(1)
+	dir.Close()
+	if err != nil && err != io.EOF {
+		return "not_readable", fmt.Errorf("directory is not readable: %v", err)
+	}
+
+	if !looksLikeDocumentRoot(path) {
+		return "no_entrypoint", fmt.Errorf("directory contains neither index.php nor a public/ folder")
+	}
+	return "", nil
+}
+
+// looksLikeDocumentRoot reports whether a directory holds an index.php or
+// a public/ folder
+func looksLikeDocumentRoot(path string) bool {
+	if info, err := os.Stat(filepath.Join(path, "index.php")); err == nil && info.Mode().IsRegular() {
+		return true
+	}
+	info, err := os.Stat(filepath.Join(path, "public"))
+	return err == nil && info.IsDir()
+}
+
+// browseRoots returns the directories the picker is confined to, from the
+// colon-separated PSM_BROWSE_ROOTS variable. Roots are resolved so symlinks
+// can't be used to leave them.
+func browseRoots() []string {
+	roots := defaultBrowseRoots
+	if value := os.Getenv("PSM_BROWSE_ROOTS"); value != "" {
+		roots = strings.Split(value, ":")
+	}
+
+	resolved := []string{}
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			continue
+		}
+		if path, err := filepath.EvalSymlinks(root); err == nil {
+			resolved = append(resolved, path)
+		}
+	}
+	return resolved
+}
+
+// withinRoots reports whether path is one of roots or below one
+func withinRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExisting resolves the symlinks of the longest existing prefix of
+// path, so a path that doesn't exist yet can't leave the roots through a
+// linked parent
+func resolveExisting(path string) string {
+	path = filepath.Clean(path)
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest)
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// withinBrowseRoots reports whether a directory lies within the browse
+// roots once its symlinks are resolved. Servers of members must.
+func withinBrowseRoots(directory string) bool {
+	return filepath.IsAbs(directory) && withinRoots(resolveExisting(directory), browseRoots())
+}
+
+// BrowseEntry is a directory shown by the directory picker
+type BrowseEntry struct {
+	Name         string `json:"name"`
+	Path         string `json:"path"`
+	DocumentRoot bool   `json:"document_root"`
+}
+
+// BrowseListing is the content of one directory, or the roots when no
+// path is given
+type BrowseListing struct {
+	Path    string        `json:"path,omitempty"`
+	Parent  string        `json:"parent,omitempty"`
+	Roots   []string      `json:"roots"`
+	Entries []BrowseEntry `json:"entries"`
+}
+
+// browse lists the subdirectories of path, which must lie within roots
+func browse(path string, roots []string, hidden bool) (BrowseListing, int, error) {
+	listing := BrowseListing{Roots: roots, Entries: []BrowseEntry{}}
+	if path == "" {
+		for _, root := range roots {
+			listing.Entries = append(listing.Entries, BrowseEntry{Name: root, Path: root, DocumentRoot: looksLikeDocumentRoot(root)})
+		}
+		return listing, http.StatusOK, nil
+	}
+
+	if !filepath.IsAbs(path) {
+		return listing, http.StatusBadRequest, fmt.Errorf("path must be absolute")
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		// Don't reveal whether paths outside the roots exist
+		if !withinRoots(filepath.Clean(path), roots) {
+			return listing, http.StatusForbidden, fmt.Errorf("path is outside the allowed directories")
+		}
+		return listing, http.StatusNotFound, fmt.Errorf("directory does not exist")
+	}
+	if !withinRoots(resolved, roots) {
+		return listing, http.StatusForbidden, fmt.Errorf("path is outside the allowed directories")
+	}
+
+	entries, err := os.ReadDir(resolved)
+	if err != nil {
+		return listing, http.StatusForbidden, fmt.Errorf("directory is not readable: %v", err)
+	}
+
+	listing.Path = resolved
+	if parent := filepath.Dir(resolved); parent != resolved && withinRoots(parent, roots) {
+		listing.Parent = parent
+	}
+	for _, entry := range entries {
+		if !hidden && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		child := filepath.Join(resolved, entry.Name())
+		// Symlinked directories are listed when they stay within the roots
+		if entry.Type()&os.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(child)
+			if err != nil || !withinRoots(target, roots) {
+				continue
+			}
+			if info, err := os.Stat(target); err != nil || !info.IsDir() {
+				continue
+			}
+		} else if !entry.IsDir() {
+			continue
+		}
+		listing.Entries = append(listing.Entries, BrowseEntry{Name: entry.Name(), Path: child, DocumentRoot: looksLikeDocumentRoot(child)})
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	return listing, http.StatusOK, nil
+}
+
+// handleBrowse lists directories for the directory picker. Without ?path=
+// it returns the allowed roots; ?hidden=true includes dot directories.
+func handleBrowse(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	listing, status, err := browse(query.Get("path"), browseRoots(), query.Get("hidden") == "true")
+	if err != nil {
+		code := errCodeInvalidRequest
+		switch status {
+		case http.StatusNotFound:
+			code = errCodeNotFound
+		case http.StatusForbidden:
+			code = errCodeForbidden
+		}
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
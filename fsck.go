@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FsckIssue describes a problem found in the stored state
+type FsckIssue struct {
+	Check    string `json:"check"`
+	ServerID string `json:"server_id,omitempty"`
+	Message  string `json:"message"`
+	Fixable  bool   `json:"fixable"`
+	Fixed    bool   `json:"fixed"`
+}
+
+// Fsck validates the stored configuration and, when fix is true, repairs
+// the problems that can be fixed automatically
+func (a *App) Fsck(fix bool) []FsckIssue {
+	a.mu.Lock()
+
+	issues := []FsckIssue{}
+	report := func(check, serverID, message string, fixable bool, repair func()) {
+		issue := FsckIssue{Check: check, ServerID: serverID, Message: message, Fixable: fixable}
+		if fix && fixable {
+			repair()
+			issue.Fixed = true
+		}
+		issues = append(issues, issue)
+	}
+
+	if a.servers == nil {
+		report("servers", "", "server list is missing", true, func() {
+			a.servers = make(map[string]*Server)
+		})
+	}
+
+	ids := make([]string, 0, len(a.servers))
+	for id := range a.servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	maxID := 0
+	portOwners := make(map[string][]string)
+	for _, id := range ids {
+		server := a.servers[id]
+		if server == nil {
+			report("servers", id, "server entry is empty", true, func() {
+				delete(a.servers, id)
+			})
+			continue
+		}
+
+		if server.ID != id {
+			report("servers", id, fmt.Sprintf("server ID %q does not match its key", server.ID), true, func() {
+				server.ID = id
+			})
+		}
+
+		if n, err := strconv.Atoi(id); err == nil && n > maxID {
+			maxID = n
+		}
+
+		portOwners[server.Port] = append(portOwners[server.Port], id)
+
+		if info, err := os.Stat(server.Directory); err != nil || !info.IsDir() {
+			report("directory", id, fmt.Sprintf("document root %s does not exist", server.Directory), false, nil)
+		}
+
+		if server.VLANInterface != "" {
+			if server.VLANInterface != "vlan"+server.Port {
+				report("vlan", id, fmt.Sprintf("VLAN interface %s does not match port %s", server.VLANInterface, server.Port), true, func() {
+					server.VLANInterface = ""
+					server.IPv6Address = ""
+				})
+			} else if _, err := net.InterfaceByName(server.VLANInterface); err != nil {
+				report("vlan", id, fmt.Sprintf("VLAN interface %s does not exist", server.VLANInterface), true, func() {
+					server.VLANInterface = ""
+					server.IPv6Address = ""
+				})
+			}
+		}
+	}
+
+	ports := make([]string, 0, len(portOwners))
+	for port := range portOwners {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		if owners := portOwners[port]; len(owners) > 1 {
+			report("ports", "", fmt.Sprintf("port %s is used by servers %s", port, strings.Join(owners, ", ")), false, nil)
+		}
+	}
+
+	if a.nextID <= maxID {
+		report("ids", "", fmt.Sprintf("next server ID %d collides with existing server %d", a.nextID, maxID), true, func() {
+			a.nextID = maxID + 1
+		})
+	}
+
+	for _, group := range a.groups {
+		for _, serverID := range group.Servers {
+			if _, exists := a.servers[serverID]; !exists {
+				group := group
+				serverID := serverID
+				report("groups", serverID, fmt.Sprintf("group %s references missing server", group.ID), true, func() {
+					members := []string{}
+					for _, member := range group.Servers {
+						if member != serverID {
+							members = append(members, member)
+						}
+					}
+					group.Servers = members
+				})
+			}
+		}
+	}
+
+	// Certificates left behind by servers that no longer exist
+	if a.certs != nil {
+		files, _ := ioutil.ReadDir(a.certs.dir)
+		for _, file := range files {
+			name := file.Name()
+			serverID, _, ok := parseCertificateFile(name)
+			if !ok {
+				continue
+			}
+			if _, exists := a.servers[serverID]; !exists {
+				report("certificates", serverID, "certificate stored for missing server", true, func() {
+					os.Remove(filepath.Join(a.certs.dir, name))
+					os.RemoveAll(filepath.Join(a.certs.dir, "run", serverID))
+					a.certs.RemoveKeyFiles(serverID)
+				})
+			}
+		}
+	}
+
+	a.mu.Unlock()
+
+	for _, issue := range issues {
+		if issue.Fixed {
+			a.flushConfig()
+			break
+		}
+	}
+
+	return issues
+}
+
+// runFsckCommand implements the `fsck` subcommand
+func runFsckCommand(a *App, args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "repair problems that can be fixed automatically")
+	flags.Parse(args)
+
+	issues := a.Fsck(*fix)
+	if len(issues) == 0 {
+		fmt.Println("No problems found")
+		return 0
+	}
+
+	unresolved := 0
+	for _, issue := range issues {
+		status := "not fixable"
+		if issue.Fixed {
+			status = "fixed"
+		} else if issue.Fixable {
+			status = "fixable with --fix"
+		}
+		if !issue.Fixed {
+			unresolved++
+		}
+
+		subject := ""
+		if issue.ServerID != "" {
+			subject = " server " + issue.ServerID + ":"
+		}
+		fmt.Printf("[%s]%s %s (%s)\n", issue.Check, subject, issue.Message, status)
+	}
+
+	if unresolved > 0 {
+		return 1
+	}
+	return 0
+}
+
+// handleFsck runs the configuration check; ?fix=true applies repairs
+func (a *App) handleFsck(w http.ResponseWriter, r *http.Request) {
+	fix := r.URL.Query().Get("fix") == "true"
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Fsck(fix))
+}
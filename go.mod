@@ -2,4 +2,20 @@ module php-server-manager
 
 go 1.21
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/gorilla/mux v1.8.0
+	github.com/huin/goupnp v1.0.3
+	github.com/jackpal/go-nat-pmp v1.0.2
+	github.com/klauspost/compress v1.17.9
+	github.com/redis/go-redis/v9 v9.7.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.3.10
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	golang.org/x/sync v0.5.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Group represents a set of related servers managed together
+type Group struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Servers     []string `json:"servers"`
+	Settings    Settings `json:"settings"`
+}
+
+// BulkResult reports the outcome of an operation on a single server
+type BulkResult struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// GetGroups returns all groups ordered by ID
+func (a *App) GetGroups() []*Group {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	groups := make([]*Group, 0, len(a.groups))
+	for _, group := range a.groups {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		x, _ := strconv.Atoi(groups[i].ID)
+		y, _ := strconv.Atoi(groups[j].ID)
+		return x < y
+	})
+	return groups
+}
+
+// GetGroup returns a copy of a group
+func (a *App) GetGroup(id string) (*Group, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	group, exists := a.groups[id]
+	if !exists {
+		return nil, false
+	}
+	copied := *group
+	copied.Servers = append([]string(nil), group.Servers...)
+	return &copied, true
+}
+
+// validateGroupServersLocked checks that every member server exists
+func (a *App) validateGroupServersLocked(servers []string) error {
+	for _, id := range servers {
+		if _, exists := a.servers[id]; !exists {
+			return fmt.Errorf("server %s not found", id)
+		}
+	}
+	return nil
+}
+
+// CreateGroup adds a new group
+func (a *App) CreateGroup(name, description string, servers []string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.validateGroupServersLocked(servers); err != nil {
+		return "", err
+	}
+
+	id := strconv.Itoa(a.nextGroupID)
+	a.nextGroupID++
+
+	if servers == nil {
+		servers = []string{}
+	}
+	a.groups[id] = &Group{
+		ID:          id,
+		Name:        name,
+		Description: description,
+		Servers:     servers,
+	}
+
+	a.requestSave()
+	return id, nil
+}
+
+// UpdateGroup updates an existing group
+func (a *App) UpdateGroup(id, name, description string, servers []string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	group, exists := a.groups[id]
+	if !exists {
+		return false, nil
+	}
+
+	if err := a.validateGroupServersLocked(servers); err != nil {
+		return true, err
+	}
+
+	if servers == nil {
+		servers = []string{}
+	}
+	group.Name = name
+	group.Description = description
+	group.Servers = servers
+
+	a.requestSave()
+	return true, nil
+}
+
+// DeleteGroup removes a group without touching its servers
+func (a *App) DeleteGroup(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.groups[id]; !exists {
+		return false
+	}
+	delete(a.groups, id)
+
+	a.requestSave()
+	return true
+}
+
+// removeServerFromGroupsLocked drops a deleted server from every group
+func (a *App) removeServerFromGroupsLocked(serverID string) {
+	for _, group := range a.groups {
+		members := group.Servers[:0]
+		for _, id := range group.Servers {
+			if id != serverID {
+				members = append(members, id)
+			}
+		}
+		group.Servers = members
+	}
+}
+
+// runBulk runs op for every server concurrently and collects the results
+// in the order the IDs were given
+func runBulk(ids []string, op func(id string) error) []BulkResult {
+	results := make([]BulkResult, len(ids))
+
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			results[i] = BulkResult{ID: id, Success: true}
+			if err := op(id); err != nil {
+				results[i].Success = false
+				results[i].Error = err.Error()
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// bulkStart starts the given servers, skipping ones already running
+func (a *App) bulkStart(ctx context.Context, ids []string) []BulkResult {
+	return runBulk(ids, func(id string) error {
+		exists, running := a.GetServerStatus(id)
+		if !exists {
+			return fmt.Errorf("server not found")
+		}
+		if running {
+			return nil
+		}
+		if !a.StartServerContext(ctx, id) {
+			return fmt.Errorf("failed to start server")
+		}
+		return nil
+	})
+}
+
+// bulkStop stops the given servers, skipping ones already stopped
+func (a *App) bulkStop(ctx context.Context, ids []string) []BulkResult {
+	return runBulk(ids, func(id string) error {
+		exists, running := a.GetServerStatus(id)
+		if !exists {
+			return fmt.Errorf("server not found")
+		}
+		if !running {
+			return nil
+		}
+		if !a.StopServerContext(ctx, id) {
+			return fmt.Errorf("failed to stop server")
+		}
+		return nil
+	})
+}
+
+// deleteServerWithVLAN deletes a server and removes its VLAN interface
+func (a *App) deleteServerWithVLAN(id string, vlanManager *VLANManager) error {
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	var port string
+	if exists {
+		port = server.Port
+	}
+	a.mu.Unlock()
+
+	if !a.DeleteServer(id) {
+		return fmt.Errorf("server not found")
+	}
+
+	if port != "" {
+		if err := vlanManager.RemoveVLANInterface(port); err != nil {
+			return fmt.Errorf("server deleted but failed to remove VLAN interface: %v", err)
+		}
+	}
+	return nil
+}
+
+// HTTP handlers for group management
+func (a *App) handleGetGroups(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.GetGroups())
+}
+
+func (a *App) handleGetGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	group, exists := a.GetGroup(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Group not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// groupRequest is the request body for creating or updating a group
+type groupRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Servers     []string `json:"servers"`
+}
+
+func (a *App) handleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var groupData groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&groupData); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if groupData.Name == "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Name is required")
+		return
+	}
+
+	id, err := a.CreateGroup(groupData.Name, groupData.Description, groupData.Servers)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+func (a *App) handleUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var groupData groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&groupData); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if groupData.Name == "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Name is required")
+		return
+	}
+
+	exists, err := a.UpdateGroup(id, groupData.Name, groupData.Description, groupData.Servers)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Group not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeleteGroup deletes a group; with ?servers=true its member servers
+// are moved to the trash and their VLAN interfaces deleted as well
+func (a *App) handleDeleteGroup(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	id := mux.Vars(r)["id"]
+
+	group, exists := a.GetGroup(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Group not found")
+		return
+	}
+
+	results := []BulkResult{}
+	if r.URL.Query().Get("servers") == "true" {
+		results = runBulk(group.Servers, func(serverID string) error {
+			return a.trashServerWithVLAN(r.Context(), serverID, vlanManager)
+		})
+	}
+
+	a.DeleteGroup(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (a *App) handleStartGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	group, exists := a.GetGroup(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Group not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.bulkStart(r.Context(), group.Servers))
+}
+
+func (a *App) handleStopGroup(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	group, exists := a.GetGroup(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Group not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.bulkStop(r.Context(), group.Servers))
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"strconv"
 
 	"github.com/gorilla/mux"
 )
@@ -11,58 +11,92 @@ import (
 // Enhanced handlers with VLAN support
 
 func (a *App) handleGetServers(w http.ResponseWriter, r *http.Request) {
-	servers := a.GetServers()
+	filter, err := parseServerFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	opts, err := parseServerListOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	ids, err := a.matchServerIDs(filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	ids = a.ownedServerIDs(userFromContext(r.Context()), ids)
+
+	servers, total := listServers(a.serversByID(ids), opts)
+	writePageHeaders(w, r, opts, total)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(servers)
 }
 
 func (a *App) handleCreateServerWithVLAN(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
-	var serverData struct {
-		Name      string `json:"name"`
-		Port      string `json:"port"`
-		Directory string `json:"directory"`
+	var spec ServerSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&serverData); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// A run_as_user of the template was picked by an admin; one in the
+	// request must be too
+	if spec.RunAsUser != "" && a.refuseRunAsUser(w, r) {
 		return
 	}
 
-	// Validate inputs
-	if serverData.Name == "" || serverData.Port == "" || serverData.Directory == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
-		return
+	// Fill in unset fields from the template, if one is given
+	if spec.Template != "" {
+		template, exists := a.GetTemplate(spec.Template)
+		if !exists {
+			writeError(w, http.StatusBadRequest, errCodeTemplateNotFound, "Template not found")
+			return
+		}
+		spec = template.Apply(spec)
 	}
 
-	// Validate port is a number
-	_, err := strconv.Atoi(serverData.Port)
-	if err != nil {
-		http.Error(w, "Port must be a number", http.StatusBadRequest)
+	if writeValidationProblems(w, a.validateServerFields(r.Context(), "", spec.Name, spec.Port, spec.Directory)) {
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
 		return
 	}
 
-	// Create VLAN interface for this port
-	vlanInterface, err := vlanManager.CreateVLANInterface(serverData.Port)
-	if err != nil {
-		http.Error(w, "Failed to create VLAN interface: "+err.Error(), http.StatusInternalServerError)
+	// A git-backed directory is created by the first deploy
+	if spec.Git == nil {
+		if _, err := validateDocumentRoot(spec.Directory); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if owner, inUse := a.portOwner(spec.Port); inUse {
+		writeErrorDetails(w, http.StatusConflict, errCodePortInUse, "Port is already assigned to server "+owner, map[string]interface{}{
+			"port":      spec.Port,
+			"server_id": owner,
+		})
+		return
+	}
+	if a.writeReservedPort(w, spec.Port) {
 		return
 	}
 
-	id := a.CreateServer(serverData.Name, serverData.Port, serverData.Directory)
-	
-	// Update server with VLAN information
-	a.mu.Lock()
-	if server, exists := a.servers[id]; exists {
-		server.VLANInterface = vlanInterface.Name
-		server.IPv6Address = vlanInterface.IPv6Address
+	spec.Owner = userFromContext(r.Context())
+	id, vlanInterface, err := a.provisionServer(spec, vlanManager)
+	if err != nil {
+		writeProvisionError(w, err)
+		return
 	}
-	a.mu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"id": id,
+		"id":             id,
 		"vlan_interface": vlanInterface.Name,
-		"ipv6_address": vlanInterface.IPv6Address,
+		"ipv6_address":   vlanInterface.IPv6Address,
 	})
 }
 
@@ -71,42 +105,128 @@ func (a *App) handleUpdateServer(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	var serverData struct {
-		Name      string `json:"name"`
-		Port      string `json:"port"`
-		Directory string `json:"directory"`
+		Name      string            `json:"name"`
+		Port      string            `json:"port"`
+		Directory string            `json:"directory"`
+		Labels    map[string]string `json:"labels"`
+		RunAsUser *string           `json:"run_as_user"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&serverData); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
 
-	// Validate inputs
-	if serverData.Name == "" || serverData.Port == "" || serverData.Directory == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+	if writeValidationProblems(w, a.validateServerFields(r.Context(), id, serverData.Name, serverData.Port, serverData.Directory)) {
 		return
 	}
 
-	// Validate port is a number
-	_, err := strconv.Atoi(serverData.Port)
-	if err != nil {
-		http.Error(w, "Port must be a number", http.StatusBadRequest)
+	if err := validateLabels(serverData.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if serverData.RunAsUser != nil && *serverData.RunAsUser != "" && !validUsername.MatchString(*serverData.RunAsUser) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid run_as_user")
+		return
+	}
+
+	a.editMu.Lock()
+	defer a.editMu.Unlock()
+	current, ok := a.checkIfMatch(w, r, id)
+	if !ok {
+		return
+	}
+
+	if serverData.RunAsUser != nil && *serverData.RunAsUser != current.RunAsUser && a.refuseRunAsUser(w, r) {
+		return
+	}
+
+	if current.Git == nil {
+		if _, err := validateDocumentRoot(serverData.Directory); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if current.Port != serverData.Port && a.writeReservedPort(w, serverData.Port) {
 		return
 	}
 
 	success := a.UpdateServer(id, serverData.Name, serverData.Port, serverData.Directory)
 	if !success {
-		http.Error(w, "Server not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
 		return
 	}
 
+	// Labels are only replaced when the request includes them
+	if serverData.Labels != nil {
+		a.SetServerLabels(id, serverData.Labels)
+	}
+	if serverData.RunAsUser != nil {
+		a.SetRunAsUser(id, *serverData.RunAsUser)
+	}
+
+	a.annotations.Record(r.Context(), id, serverData.Name, "update", fmt.Sprintf("Updated %s (port %s, directory %s)", serverData.Name, serverData.Port, serverData.Directory))
+
+	if updated, exists := a.GetServer(id); exists {
+		w.Header().Set("ETag", updated.ETag())
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+func (a *App) handleSetVLANOptions(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var opts VLANOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := opts.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	var port string
+	if exists {
+		port = server.Port
+	}
+	a.mu.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	if err := vlanManager.SetVLANOptions(port, opts); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeVLANFailed, "Failed to apply VLAN options: "+err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	server.VLANOptions = opts
+	a.mu.Unlock()
+	a.requestSave()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(opts)
+}
+
 func (a *App) handleDeleteServerWithVLAN(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
+	a.editMu.Lock()
+	defer a.editMu.Unlock()
+	if _, ok := a.checkIfMatch(w, r, id); !ok {
+		return
+	}
+
 	// Get server info before deletion
 	a.mu.Lock()
 	server, exists := a.servers[id]
@@ -116,9 +236,9 @@ func (a *App) handleDeleteServerWithVLAN(w http.ResponseWriter, r *http.Request,
 	}
 	a.mu.Unlock()
 
-	success := a.DeleteServer(id)
+	success := a.TrashServer(r.Context(), id)
 	if !success {
-		http.Error(w, "Server not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
 		return
 	}
 
@@ -126,7 +246,7 @@ func (a *App) handleDeleteServerWithVLAN(w http.ResponseWriter, r *http.Request,
 	if port != "" {
 		if err := vlanManager.RemoveVLANInterface(port); err != nil {
 			// Log error but don't fail the deletion
-			http.Error(w, "Server deleted but failed to remove VLAN interface: "+err.Error(), http.StatusPartialContent)
+			writeError(w, http.StatusPartialContent, errCodePartialFailure, "Server deleted but failed to remove VLAN interface: "+err.Error())
 			return
 		}
 	}
@@ -138,9 +258,44 @@ func (a *App) handleStartServerWithVLAN(w http.ResponseWriter, r *http.Request,
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	success := a.StartServer(id)
+	// ?dry_run=true reports what the start would do without doing it
+	if r.URL.Query().Get("dry_run") == "true" {
+		plan, exists := a.planStart(id)
+		if !exists {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+
+	exists, running := a.GetServerStatus(id)
+	switch {
+	case !exists:
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	case running:
+		writeError(w, http.StatusConflict, errCodeAlreadyRunning, "Server is already running")
+		return
+	}
+
+	// Report an interface that isn't up yet apart from other start failures
+	if readiness, err := a.waitForVLAN(r.Context(), id); err != nil {
+		writeErrorDetails(w, http.StatusServiceUnavailable, errCodeVLANNotReady, err.Error(), map[string]interface{}{
+			"interface":  readiness.Interface,
+			"address":    readiness.Address,
+			"operstate":  readiness.OperState,
+			"assigned":   readiness.Assigned,
+			"tentative":  readiness.Tentative,
+			"dad_failed": readiness.DADFailed,
+		})
+		return
+	}
+
+	success := a.StartServerContext(r.Context(), id)
 	if !success {
-		http.Error(w, "Failed to start server or server is already running", http.StatusBadRequest)
+		writeError(w, http.StatusInternalServerError, errCodeStartFailed, "Failed to start server; see /api/warnings for details")
 		return
 	}
 
@@ -151,9 +306,19 @@ func (a *App) handleStopServerWithVLAN(w http.ResponseWriter, r *http.Request, v
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	success := a.StopServer(id)
+	exists, running := a.GetServerStatus(id)
+	switch {
+	case !exists:
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	case !running:
+		writeError(w, http.StatusConflict, errCodeNotRunning, "Server is not running")
+		return
+	}
+
+	success := a.StopServerContext(r.Context(), id)
 	if !success {
-		http.Error(w, "Failed to stop server or server is already stopped", http.StatusBadRequest)
+		writeError(w, http.StatusInternalServerError, errCodeStopFailed, "Failed to stop server; see /api/warnings for details")
 		return
 	}
 
@@ -166,10 +331,52 @@ func (a *App) handleServerStatus(w http.ResponseWriter, r *http.Request) {
 
 	exists, running := a.GetServerStatus(id)
 	if !exists {
-		http.Error(w, "Server not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	status := map[string]interface{}{"running": running}
+	if runtime, exists := a.runtime.Status(id); exists {
+		status["runtime"] = runtime.StartedWith
+		status["restart_recommended"] = runtime.RestartRecommended
+	}
+	if mapping, exists := a.portMappings.Get(id); exists {
+		status["port_mapping"] = mapping
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// selectServerIDs returns the IDs of servers matching the request's
+// filters, ordered numerically. Supported filters: ?group=<id>,
+// ?label=<selector>, ?status=, ?framework= and ?crashed_within=.
+func (a *App) selectServerIDs(r *http.Request) ([]string, error) {
+	filter, err := parseServerFilter(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	return a.matchServerIDs(filter)
+}
+
+func (a *App) handleStartAll(w http.ResponseWriter, r *http.Request) {
+	ids, err := a.selectServerIDs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.bulkStart(r.Context(), ids))
+}
+
+func (a *App) handleStopAll(w http.ResponseWriter, r *http.Request) {
+	ids, err := a.selectServerIDs(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]bool{"running": running})
+	json.NewEncoder(w).Encode(a.bulkStop(r.Context(), ids))
 }
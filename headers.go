@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// HeaderRule rewrites one response header at the proxy, so legacy apps
+// can be given a charset, caching or CORS headers without code changes
+type HeaderRule struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Action string `json:"action,omitempty"` // set (default), add, default, delete or replace
+	Find   string `json:"find,omitempty"`   // regular expression replaced by value, for replace
+	Path   string `json:"path,omitempty"`   // only requests matching this path, e.g. /api/*
+}
+
+var (
+	// validHeaderName matches header field names
+	validHeaderName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+	// validHeaderPath matches Caddy path patterns with a wildcard
+	validHeaderPath = regexp.MustCompile(`^/[A-Za-z0-9._~/%*-]*$`)
+)
+
+// action returns the rule's action
+func (hr HeaderRule) action() string {
+	if hr.Action == "" {
+		return "set"
+	}
+	return hr.Action
+}
+
+// Validate checks a rule
+func (hr HeaderRule) Validate() error {
+	if !validHeaderName.MatchString(hr.Name) {
+		return fmt.Errorf("invalid header name %q", hr.Name)
+	}
+	if strings.ContainsAny(hr.Value+hr.Find, "\r\n") {
+		return fmt.Errorf("header %s: value must be a single line", hr.Name)
+	}
+	if hr.Path != "" && !validHeaderPath.MatchString(hr.Path) {
+		return fmt.Errorf("header %s: path must look like /api/*", hr.Name)
+	}
+
+	switch hr.action() {
+	case "set", "add", "default":
+	case "delete":
+		if hr.Value != "" {
+			return fmt.Errorf("header %s: delete takes no value", hr.Name)
+		}
+	case "replace":
+		if hr.Find == "" {
+			return fmt.Errorf("header %s: replace needs find", hr.Name)
+		}
+		if _, err := regexp.Compile(hr.Find); err != nil {
+			return fmt.Errorf("header %s: invalid find expression: %v", hr.Name, err)
+		}
+	default:
+		return fmt.Errorf("header %s: action must be set, add, default, delete or replace", hr.Name)
+	}
+	return nil
+}
+
+// field returns the rule as a line of a Caddyfile header block
+func (hr HeaderRule) field() string {
+	switch hr.action() {
+	case "add":
+		return "+" + hr.Name + " " + caddyQuote(hr.Value)
+	case "default":
+		return "?" + hr.Name + " " + caddyQuote(hr.Value)
+	case "delete":
+		return "-" + hr.Name
+	case "replace":
+		return hr.Name + " " + caddyQuote(hr.Find) + " " + caddyQuote(hr.Value)
+	}
+	return hr.Name + " " + caddyQuote(hr.Value)
+}
+
+// validateHeaderRules checks a list of rules
+func validateHeaderRules(rules []HeaderRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeHeaderRules applies a server's rules on top of the global ones. A
+// server rule replaces the global rules for the same header and path.
+func mergeHeaderRules(global, server []HeaderRule) []HeaderRule {
+	overridden := make(map[string]bool, len(server))
+	for _, rule := range server {
+		overridden[strings.ToLower(rule.Name)+" "+rule.Path] = true
+	}
+
+	merged := []HeaderRule{}
+	for _, rule := range global {
+		if !overridden[strings.ToLower(rule.Name)+" "+rule.Path] {
+			merged = append(merged, rule)
+		}
+	}
+	return append(merged, server...)
+}
+
+// headerDirectives returns the Caddyfile site directives for rules, one
+// header block per path. Blocks are deferred so they apply to the headers
+// the PHP app sent.
+func headerDirectives(rules []HeaderRule) []string {
+	paths := []string{}
+	byPath := make(map[string][]HeaderRule)
+	for _, rule := range rules {
+		if _, exists := byPath[rule.Path]; !exists {
+			paths = append(paths, rule.Path)
+		}
+		byPath[rule.Path] = append(byPath[rule.Path], rule)
+	}
+
+	directives := []string{}
+	for i, path := range paths {
+		block := "header {"
+		if path != "" {
+			matcher := "@psm_headers_" + strconv.Itoa(i)
+			directives = append(directives, matcher+" path "+path)
+			block = "header " + matcher + " {"
+		}
+		for _, rule := range byPath[path] {
+			block += "\n\t\t" + rule.field()
+		}
+		block += "\n\t\tdefer\n\t}"
+		directives = append(directives, block)
+	}
+	return directives
+}
+
+// HeaderRules returns the global rules
+func (a *App) HeaderRules() []HeaderRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]HeaderRule{}, a.headerRules...)
+}
+
+// SetHeaderRules replaces the global rules
+func (a *App) SetHeaderRules(rules []HeaderRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.headerRules = rules
+	a.requestSave()
+}
+
+// SetServerHeaderRules replaces the rules of a server
+func (a *App) SetServerHeaderRules(id string, rules []HeaderRule) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Headers = rules
+
+	a.requestSave()
+	return true
+}
+
+// effectiveHeaderRules returns the rules applied to a server
+func (a *App) effectiveHeaderRules(id string) []HeaderRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return nil
+	}
+	return mergeHeaderRules(a.headerRules, server.Headers)
+}
+
+// decodeHeaderRules reads and validates a list of rules from a request
+func decodeHeaderRules(w http.ResponseWriter, r *http.Request) ([]HeaderRule, bool) {
+	var rules []HeaderRule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return nil, false
+	}
+	if err := validateHeaderRules(rules); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return nil, false
+	}
+	if rules == nil {
+		rules = []HeaderRule{}
+	}
+	return rules, true
+}
+
+// handleGetHeaderRules lists the global rules
+func (a *App) handleGetHeaderRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.HeaderRules())
+}
+
+// handleSetHeaderRules replaces the global rules. They take effect the
+// next time each server starts.
+func (a *App) handleSetHeaderRules(w http.ResponseWriter, r *http.Request) {
+	rules, ok := decodeHeaderRules(w, r)
+	if !ok {
+		return
+	}
+	a.SetHeaderRules(rules)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// handleGetServerHeaderRules shows a server's own rules and the merged
+// rules it is started with
+func (a *App) handleGetServerHeaderRules(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	rules := server.Headers
+	if rules == nil {
+		rules = []HeaderRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"rules":     rules,
+		"effective": a.effectiveHeaderRules(id),
+	})
+}
+
+// handleSetServerHeaderRules replaces a server's rules. They take effect
+// the next time the server starts.
+func (a *App) handleSetServerHeaderRules(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rules, ok := decodeHeaderRules(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.SetServerHeaderRules(id, rules) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// healthTick is how often servers due for a check are looked for; each
+	// server is probed every health_interval
+	healthTick = time.Second
+	// healthTimeout bounds one probe
+	healthTimeout = 5 * time.Second
+	// healthFailureThreshold is how many failed probes in a row make a
+	// server unhealthy
+	healthFailureThreshold = 3
+)
+
+// HealthStatus is the result of the latest probes of a server
+type HealthStatus struct {
+	ServerID  string    `json:"server_id"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// HealthChecker probes running servers over HTTP. A server becomes
+// unhealthy after healthFailureThreshold failed probes in a row and is
+// healthy again after one success; both transitions are notified.
+type HealthChecker struct {
+	mu       sync.Mutex
+	status   map[string]*HealthStatus
+	inflight map[string]bool
+	client   *http.Client
+}
+
+// NewHealthChecker creates a health checker
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		status:   make(map[string]*HealthStatus),
+		inflight: make(map[string]bool),
+		client:   newServerClient(healthTimeout),
+	}
+}
+
+// newServerClient returns a client for requests from the manager to its
+// servers. Redirects are not followed.
+func newServerClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		// Uploaded certificates are usually not valid for the address
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// serverBaseURL returns the URL the manager reaches a server at
+func serverBaseURL(server Server, useTLS bool) string {
+	host := "127.0.0.1"
+	if server.IPv6Address != "" {
+		host = server.IPv6Address
+	}
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, server.Port)
+}
+
+// serverUsesTLS reports whether a server is served with an uploaded
+// certificate
+func (a *App) serverUsesTLS(id string) bool {
+	if a.certs == nil {
+		return false
+	}
+	return a.certs.HasCertificate(id)
+}
+
+// Status returns the health of a server; ok is false before its first
+// probe
+func (hc *HealthChecker) Status(id string) (HealthStatus, bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	status, exists := hc.status[id]
+	if !exists {
+		return HealthStatus{ServerID: id}, false
+	}
+	return *status, true
+}
+
+// Forget drops the health of a stopped or deleted server
+func (hc *HealthChecker) Forget(id string) {
+	if hc == nil {
+		return
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.status, id)
+}
+
+// probe requests / from a server. Responses other than 5xx count as
+// healthy, so apps answering with redirects or 404 pass.
+func (hc *HealthChecker) probe(server Server, useTLS bool) error {
+	resp, err := hc.client.Get(serverBaseURL(server, useTLS) + "/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// due reports whether a server should be probed and marks it in flight
+func (hc *HealthChecker) due(id string, interval time.Duration, now time.Time) bool {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.inflight[id] {
+		return false
+	}
+	if status, exists := hc.status[id]; exists && now.Sub(status.LastCheck) < interval {
+		return false
+	}
+	hc.inflight[id] = true
+	return true
+}
+
+// record stores a probe result and returns the event to notify, if any
+func (hc *HealthChecker) record(id string, err error, now time.Time) string {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	delete(hc.inflight, id)
+
+	status, exists := hc.status[id]
+	if !exists {
+		status = &HealthStatus{ServerID: id, Healthy: true}
+		hc.status[id] = status
+	}
+	status.LastCheck = now
+
+	if err == nil {
+		status.Failures = 0
+		status.LastError = ""
+		if !status.Healthy {
+			status.Healthy = true
+			return "health_recovered"
+		}
+		return ""
+	}
+
+	status.Failures++
+	status.LastError = err.Error()
+	if status.Healthy && status.Failures >= healthFailureThreshold {
+		status.Healthy = false
+		return "health_failed"
+	}
+	return ""
+}
+
+// Run probes each running server every health_interval
+func (hc *HealthChecker) Run(app *App) {
+	ticker := time.NewTicker(healthTick)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, id := range app.serverIDs() {
+			server, exists := app.GetServer(id)
+			settings, resolved := app.EffectiveSettings(id)
+			if !exists || !resolved || !server.Running {
+				continue
+			}
+			interval, err := time.ParseDuration(settings["health_interval"].Value)
+			if err != nil || !hc.due(id, interval, now) {
+				continue
+			}
+
+			useTLS := app.serverUsesTLS(id)
+			go func(server Server) {
+				err := hc.probe(server, useTLS)
+				event := hc.record(server.ID, err, time.Now())
+				if event == "" {
+					return
+				}
+				message := "responding again"
+				if err != nil {
+					message = fmt.Sprintf("%d health checks in a row failed: %v", healthFailureThreshold, err)
+				}
+				ctx := withRequestID(context.Background(), newRequestID())
+				if recordErr := app.store.Record(server.ID, event, message); recordErr != nil {
+					app.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", server.ID, recordErr)
+				}
+				app.notifier.Notify(ctx, event, server.ID, server.Name, message)
+			}(server)
+		}
+	}
+}
+
+// handleGetHealth reports the result of a server's latest health checks
+func (a *App) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	status, _ := a.health.Status(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
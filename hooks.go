@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxHookDeliveries bounds the deliveries kept per hook
+	maxHookDeliveries = 100
+	// maxHookPayload bounds the payload read from a delivery
+	maxHookPayload = 5 << 20
+)
+
+// Hook lets a git host trigger a deploy or restart of a server by calling
+// /hooks/{server-id}/{token}. Deliveries must be signed with Secret.
+type Hook struct {
+	ID        string    `json:"id"`
+	ServerID  string    `json:"server_id"`
+	Action    string    `json:"action"`           // "deploy" (pull and restart) or "restart"
+	Branch    string    `json:"branch,omitempty"` // only pushes to this branch; the deployed branch by default
+	Token     string    `json:"token"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HookDelivery is one call of a hook
+type HookDelivery struct {
+	ID        int       `json:"id"`
+	HookID    string    `json:"hook_id"`
+	Time      time.Time `json:"time"`
+	Provider  string    `json:"provider"` // github, gitlab or generic
+	Event     string    `json:"event,omitempty"`
+	Ref       string    `json:"ref,omitempty"`
+	Commit    string    `json:"commit,omitempty"`
+	Status    string    `json:"status"` // rejected, ignored, accepted, succeeded or failed
+	Message   string    `json:"message,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// HookState is the persisted hooks and their deliveries
+type HookState struct {
+	NextID     int                       `json:"next_id"`
+	Hooks      []Hook                    `json:"hooks"`
+	Deliveries map[string][]HookDelivery `json:"deliveries"`
+}
+
+// HookManager stores hooks and delivery logs in hooks.json below the
+// config directory
+type HookManager struct {
+	mu    sync.Mutex
+	path  string
+	state HookState
+}
+
+// NewHookManager loads the hooks stored below baseDir
+func NewHookManager(baseDir string) *HookManager {
+	hm := &HookManager{
+		path:  filepath.Join(baseDir, "hooks.json"),
+		state: HookState{NextID: 1, Hooks: []Hook{}, Deliveries: make(map[string][]HookDelivery)},
+	}
+
+	if data, err := ioutil.ReadFile(hm.path); err == nil {
+		json.Unmarshal(data, &hm.state)
+	}
+	if hm.state.Deliveries == nil {
+		hm.state.Deliveries = make(map[string][]HookDelivery)
+	}
+
+	return hm
+}
+
+// saveLocked persists the hooks; hm.mu must be held
+func (hm *HookManager) saveLocked() error {
+	data, err := json.MarshalIndent(hm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(hm.path, data, 0600)
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Add creates a hook with a fresh token and secret
+func (hm *HookManager) Add(hook Hook) (Hook, error) {
+	var err error
+	if hook.Token, err = randomHex(16); err != nil {
+		return Hook{}, err
+	}
+	if hook.Secret, err = randomHex(32); err != nil {
+		return Hook{}, err
+	}
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	hook.ID = strconv.Itoa(hm.state.NextID)
+	hook.CreatedAt = time.Now()
+	hm.state.NextID++
+	hm.state.Hooks = append(hm.state.Hooks, hook)
+	return hook, hm.saveLocked()
+}
+
+// List returns the hooks of a server with their secrets removed
+func (hm *HookManager) List(serverID string) []Hook {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	hooks := []Hook{}
+	for _, hook := range hm.state.Hooks {
+		if hook.ServerID == serverID {
+			hook.Secret = ""
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// Delete removes a hook of a server and its deliveries
+func (hm *HookManager) Delete(serverID, id string) (bool, error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	for i, hook := range hm.state.Hooks {
+		if hook.ID == id && hook.ServerID == serverID {
+			hm.state.Hooks = append(hm.state.Hooks[:i], hm.state.Hooks[i+1:]...)
+			delete(hm.state.Deliveries, id)
+			return true, hm.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// Forget removes the hooks of a deleted server
+func (hm *HookManager) Forget(serverID string) {
+	if hm == nil {
+		return
+	}
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	kept := hm.state.Hooks[:0]
+	for _, hook := range hm.state.Hooks {
+		if hook.ServerID == serverID {
+			delete(hm.state.Deliveries, hook.ID)
+		} else {
+			kept = append(kept, hook)
+		}
+	}
+	if len(kept) != len(hm.state.Hooks) {
+		hm.state.Hooks = kept
+		hm.saveLocked()
+	}
+}
+
+// lookup finds the hook of a server by its token
+func (hm *HookManager) lookup(serverID, token string) (Hook, bool) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	for _, hook := range hm.state.Hooks {
+		if hook.ServerID == serverID && subtle.ConstantTimeCompare([]byte(hook.Token), []byte(token)) == 1 {
+			return hook, true
+		}
+	}
+	return Hook{}, false
+}
+
+// Deliveries returns the deliveries of a hook, newest first
+func (hm *HookManager) Deliveries(id string) []HookDelivery {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	deliveries := make([]HookDelivery, 0, len(hm.state.Deliveries[id]))
+	for i := len(hm.state.Deliveries[id]) - 1; i >= 0; i-- {
+		deliveries = append(deliveries, hm.state.Deliveries[id][i])
+	}
+	return deliveries
+}
+
+// record stores a delivery and returns its ID
+func (hm *HookManager) record(delivery HookDelivery) int {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	deliveries := hm.state.Deliveries[delivery.HookID]
+	delivery.ID = 1
+	if len(deliveries) > 0 {
+		delivery.ID = deliveries[len(deliveries)-1].ID + 1
+	}
+	deliveries = append(deliveries, delivery)
+	if len(deliveries) > maxHookDeliveries {
+		deliveries = deliveries[len(deliveries)-maxHookDeliveries:]
+	}
+	hm.state.Deliveries[delivery.HookID] = deliveries
+	hm.saveLocked()
+	return delivery.ID
+}
+
+// finish sets the outcome of an accepted delivery
+func (hm *HookManager) finish(hookID string, id int, status, message string) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	for i := range hm.state.Deliveries[hookID] {
+		if delivery := &hm.state.Deliveries[hookID][i]; delivery.ID == id {
+			delivery.Status = status
+			delivery.Message = message
+			hm.saveLocked()
+			return
+		}
+	}
+}
+
+// verifyHookSignature checks a delivery against the hook's secret. GitHub
+// signs the body with HMAC-SHA256 (X-Hub-Signature-256), GitLab sends the
+// secret as X-Gitlab-Token and other callers may use either.
+func verifyHookSignature(r *http.Request, body []byte, secret string) (provider string, err error) {
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return "github", fmt.Errorf("signature does not match")
+		}
+		if r.Header.Get("X-GitHub-Event") == "" {
+			return "generic", nil
+		}
+		return "github", nil
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return "gitlab", fmt.Errorf("token does not match")
+		}
+		return "gitlab", nil
+	}
+	return "generic", fmt.Errorf("missing X-Hub-Signature-256 or X-Gitlab-Token")
+}
+
+// hookPush is the part of GitHub's and GitLab's push payloads a hook uses
+type hookPush struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+}
+
+// handleHook receives a push from a git host and deploys or restarts the
+// server in the background. The host gets 202 as soon as the delivery is
+// verified; its outcome is in the delivery log.
+func (a *App) handleHook(w http.ResponseWriter, r *http.Request, freeze *FreezeManager) {
+	vars := mux.Vars(r)
+	hook, exists := a.hooks.lookup(vars["server"], vars["token"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Hook not found")
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHookPayload))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	delivery := HookDelivery{HookID: hook.ID, Time: time.Now(), RequestID: requestIDFromContext(r.Context())}
+	delivery.Event = r.Header.Get("X-GitHub-Event")
+	if delivery.Event == "" {
+		delivery.Event = r.Header.Get("X-Gitlab-Event")
+	}
+	reject := func(status int, code, message string) {
+		delivery.Status = "rejected"
+		delivery.Message = message
+		a.hooks.record(delivery)
+		writeError(w, status, code, message)
+	}
+	ignore := func(message string) {
+		delivery.Status = "ignored"
+		delivery.Message = message
+		id := a.hooks.record(delivery)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"delivery_id": id, "status": delivery.Status, "message": message})
+	}
+
+	if delivery.Provider, err = verifyHookSignature(r, body, hook.Secret); err != nil {
+		reject(http.StatusUnauthorized, errCodeUnauthorized, err.Error())
+		return
+	}
+
+	switch delivery.Event {
+	case "", "push", "Push Hook":
+	case "ping":
+		ignore("pong")
+		return
+	default:
+		ignore("event " + delivery.Event + " is not a push")
+		return
+	}
+
+	var push hookPush
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &push); err != nil {
+			reject(http.StatusBadRequest, errCodeInvalidRequest, "payload is not JSON: "+err.Error())
+			return
+		}
+	}
+	delivery.Ref, delivery.Commit = push.Ref, push.After
+
+	server, exists := a.GetServer(hook.ServerID)
+	if !exists {
+		reject(http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	branch := hook.Branch
+	if branch == "" && server.Git != nil {
+		branch = server.Git.branch()
+	}
+	if branch != "" && push.Ref != "" && push.Ref != "refs/heads/"+branch {
+		ignore("push to " + push.Ref + " does not match branch " + branch)
+		return
+	}
+	if freeze.Frozen() {
+		reject(http.StatusLocked, errCodeFrozen, "Manager is frozen: "+freeze.State().Reason)
+		return
+	}
+	if a.ReadOnly() {
+		reject(http.StatusForbidden, errCodeReadOnly, "Manager is in read-only mode")
+		return
+	}
+
+	delivery.Status = "accepted"
+	id := a.hooks.record(delivery)
+	ctx := withRequestID(context.Background(), delivery.RequestID)
+	go func() {
+		status, message := a.runHook(ctx, hook, server)
+		a.hooks.finish(hook.ID, id, status, message)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"delivery_id": id, "status": delivery.Status})
+}
+
+// runHook performs a hook's action and returns the delivery outcome
+func (a *App) runHook(ctx context.Context, hook Hook, server Server) (string, string) {
+	if hook.Action == "restart" {
+		if !server.Running {
+			return "ignored", "server is not running"
+		}
+		if !a.StopServerContext(ctx, server.ID) || !a.StartServerContext(ctx, server.ID) {
+			return "failed", "server did not restart; see /api/warnings"
+		}
+		return "succeeded", "restarted"
+	}
+
+	deploy, err := a.Deploy(ctx, server, "")
+	if err != nil {
+		return "failed", err.Error()
+	}
+	if deploy.Status != "succeeded" {
+		return "failed", fmt.Sprintf("deploy %d failed: %s", deploy.ID, deploy.Error)
+	}
+	return "succeeded", fmt.Sprintf("deploy %d of %s", deploy.ID, shortCommit(deploy.Commit))
+}
+
+// hookURL returns where a hook is called, based on the address the
+// request came in on
+func hookURL(r *http.Request, hook Hook) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/hooks/%s/%s", scheme, r.Host, hook.ServerID, hook.Token)
+}
+
+// handleGetHooks lists a server's hooks. Secrets are only shown when a
+// hook is created.
+func (a *App) handleGetHooks(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	hooks := a.hooks.List(id)
+	result := make([]map[string]interface{}, 0, len(hooks))
+	for _, hook := range hooks {
+		result = append(result, map[string]interface{}{"hook": hook, "url": hookURL(r, hook)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleCreateHook creates a hook for a server ({"action": "deploy",
+// "branch": "main"}) and returns its URL and secret
+func (a *App) handleCreateHook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	var hook Hook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	switch hook.Action {
+	case "":
+		hook.Action = "deploy"
+	case "deploy", "restart":
+	default:
+		writeError(w, http.StatusBadRequest, errCodeValidation, "action must be deploy or restart")
+		return
+	}
+	if hook.Action == "deploy" && server.Git == nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Server has no git repository; set one with PUT /api/servers/{id}/git")
+		return
+	}
+	if hook.Branch != "" && !validGitBranch.MatchString(hook.Branch) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "invalid branch")
+		return
+	}
+	hook.ServerID = id
+
+	hook, err := a.hooks.Add(hook)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save hook: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"hook": hook, "url": hookURL(r, hook)})
+}
+
+// handleDeleteHook removes a hook
+func (a *App) handleDeleteHook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deleted, err := a.hooks.Delete(vars["id"], vars["hook"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save hooks: %v", err))
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Hook not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetHookDeliveries lists the deliveries of a hook, newest first
+func (a *App) handleGetHookDeliveries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	found := false
+	for _, hook := range a.hooks.List(vars["id"]) {
+		found = found || hook.ID == vars["hook"]
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Hook not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.hooks.Deliveries(vars["hook"]))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// fallbackLocale provides the strings missing from other locales
+const fallbackLocale = "en"
+
+// builtinCatalogs holds the translations shipped with the manager, one
+// i18n/<locale>.json file of key-string pairs per locale
+//
+//go:embed i18n/*.json
+var builtinCatalogs embed.FS
+
+// validLocale matches BCP 47-style tags such as id or pt-BR
+var validLocale = regexp.MustCompile(`^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$`)
+
+// Catalog serves the strings of the web UI. Files in its directory add
+// locales or override strings of the built-in ones, and are read on every
+// request, so translators see their changes on reload.
+type Catalog struct {
+	dir           string
+	defaultLocale string
+}
+
+// NewCatalog creates the catalog with operator translations in
+// configDir/i18n. An empty defaultLocale means English.
+func NewCatalog(configDir, defaultLocale string) (*Catalog, error) {
+	c := &Catalog{dir: filepath.Join(configDir, "i18n"), defaultLocale: fallbackLocale}
+	if defaultLocale != "" {
+		locale, found := c.Resolve(defaultLocale)
+		if !found {
+			return nil, fmt.Errorf("no translations for locale %q; available: %s", defaultLocale, strings.Join(c.Locales(), ", "))
+		}
+		c.defaultLocale = locale
+	}
+	return c, nil
+}
+
+// normalizeLocale lowercases a locale and separates its parts with '-'
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
+
+// Locales lists the available locales
+func (c *Catalog) Locales() []string {
+	seen := make(map[string]bool)
+	builtin, _ := fs.Glob(builtinCatalogs, "i18n/*.json")
+	operator, _ := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	for _, file := range append(builtin, operator...) {
+		seen[normalizeLocale(strings.TrimSuffix(filepath.Base(file), ".json"))] = true
+	}
+
+	locales := make([]string, 0, len(seen))
+	for locale := range seen {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Resolve returns the available locale serving a requested one: the
+// locale itself or its language, such as id for id-ID. It reports false
+// and the default locale when neither is available.
+func (c *Catalog) Resolve(locale string) (string, bool) {
+	available := make(map[string]bool)
+	for _, name := range c.Locales() {
+		available[name] = true
+	}
+
+	locale = normalizeLocale(locale)
+	if available[locale] {
+		return locale, true
+	}
+	if language, _, found := strings.Cut(locale, "-"); found && available[language] {
+		return language, true
+	}
+	return c.defaultLocale, false
+}
+
+// readBundle reads the strings of a locale, the operator's file taking
+// precedence over the built-in one
+func (c *Catalog) readBundle(locale string, bundle map[string]string) error {
+	sources := []func() ([]byte, error){
+		func() ([]byte, error) { return builtinCatalogs.ReadFile("i18n/" + locale + ".json") },
+		func() ([]byte, error) { return os.ReadFile(filepath.Join(c.dir, locale+".json")) },
+	}
+	for _, read := range sources {
+		data, err := read()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &bundle); err != nil {
+			return fmt.Errorf("translations for %s: %v", locale, err)
+		}
+	}
+	return nil
+}
+
+// Bundle returns the strings of a locale, with English filling in the
+// strings it lacks
+func (c *Catalog) Bundle(locale string) (map[string]string, error) {
+	bundle := make(map[string]string)
+	if err := c.readBundle(fallbackLocale, bundle); err != nil {
+		return nil, err
+	}
+	if locale != fallbackLocale {
+		if err := c.readBundle(locale, bundle); err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+// handleGetLocales lists the available locales and the default one
+func (c *Catalog) handleGetLocales(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default_locale": c.defaultLocale,
+		"locales":        c.Locales(),
+	})
+}
+
+// handleGetTranslations returns the UI strings of a locale. A locale
+// without translations gets the default locale's, named in "locale".
+func (c *Catalog) handleGetTranslations(w http.ResponseWriter, r *http.Request) {
+	requested := mux.Vars(r)["locale"]
+	if !validLocale.MatchString(requested) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid locale %q", requested))
+		return
+	}
+
+	locale, _ := c.Resolve(requested)
+	bundle, err := c.Bundle(locale)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"locale":  locale,
+		"strings": bundle,
+	})
+}
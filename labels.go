@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// validLabelKey restricts label keys to simple identifiers
+var validLabelKey = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,62}[A-Za-z0-9])?$`)
+
+// labelRequirement is a single clause of a label selector
+type labelRequirement struct {
+	key   string
+	value string
+	op    string // "=", "!=" or "exists"
+}
+
+// validateLabels checks label keys and values
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !validLabelKey.MatchString(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if len(value) > 256 {
+			return fmt.Errorf("label %q value is too long", key)
+		}
+	}
+	return nil
+}
+
+// parseLabelSelector parses selectors such as "team=billing",
+// "env!=prod" or "critical". Each expression may hold several
+// comma-separated clauses; all clauses must match.
+func parseLabelSelector(exprs []string) ([]labelRequirement, error) {
+	var requirements []labelRequirement
+	for _, expr := range exprs {
+		for _, clause := range strings.Split(expr, ",") {
+			clause = strings.TrimSpace(clause)
+			if clause == "" {
+				continue
+			}
+
+			var req labelRequirement
+			if parts := strings.SplitN(clause, "!=", 2); len(parts) == 2 {
+				req = labelRequirement{key: parts[0], value: parts[1], op: "!="}
+			} else if parts := strings.SplitN(clause, "=", 2); len(parts) == 2 {
+				req = labelRequirement{key: parts[0], value: parts[1], op: "="}
+			} else {
+				req = labelRequirement{key: clause, op: "exists"}
+			}
+
+			req.key = strings.TrimSpace(req.key)
+			if !validLabelKey.MatchString(req.key) {
+				return nil, fmt.Errorf("invalid label selector %q", clause)
+			}
+			requirements = append(requirements, req)
+		}
+	}
+	return requirements, nil
+}
+
+// matchLabels reports whether labels satisfy every requirement
+func matchLabels(labels map[string]string, requirements []labelRequirement) bool {
+	for _, req := range requirements {
+		value, exists := labels[req.key]
+		switch req.op {
+		case "exists":
+			if !exists {
+				return false
+			}
+		case "=":
+			if !exists || value != req.value {
+				return false
+			}
+		case "!=":
+			if exists && value == req.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SetServerLabels replaces the labels of a server
+func (a *App) SetServerLabels(id string, labels map[string]string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Labels = labels
+
+	a.requestSave()
+	return true
+}
+
+func (a *App) handleSetLabels(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var labels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := validateLabels(labels); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if !a.SetServerLabels(id, labels) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
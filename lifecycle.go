@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultLifecycleTimeout bounds a hook unless it sets its own timeout
+	defaultLifecycleTimeout = 30 * time.Second
+	// maxLifecycleRuns bounds the runs kept per server
+	maxLifecycleRuns = 20
+)
+
+// lifecycleStages names the points of a server's lifecycle hooks run at,
+// in order
+var lifecycleStages = []string{"pre_start", "post_start", "pre_stop", "post_stop"}
+
+// LifecycleHook is a shell command run when a server changes state
+type LifecycleHook struct {
+	Command string `json:"command"`
+	Timeout string `json:"timeout,omitempty"` // 30s by default
+}
+
+// timeout returns how long the hook may run
+func (h LifecycleHook) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(h.Timeout); err == nil {
+		return timeout
+	}
+	return defaultLifecycleTimeout
+}
+
+// LifecycleHooks are the commands run around starts and stops of a
+// server. A failing pre_start hook keeps the server from starting; the
+// others only raise a warning.
+type LifecycleHooks struct {
+	PreStart  *LifecycleHook `json:"pre_start,omitempty"`
+	PostStart *LifecycleHook `json:"post_start,omitempty"`
+	PreStop   *LifecycleHook `json:"pre_stop,omitempty"`
+	PostStop  *LifecycleHook `json:"post_stop,omitempty"`
+}
+
+// hook returns the hook of a stage
+func (h *LifecycleHooks) hook(stage string) *LifecycleHook {
+	if h == nil {
+		return nil
+	}
+	switch stage {
+	case "pre_start":
+		return h.PreStart
+	case "post_start":
+		return h.PostStart
+	case "pre_stop":
+		return h.PreStop
+	case "post_stop":
+		return h.PostStop
+	}
+	return nil
+}
+
+// Validate checks the commands and timeouts
+func (h LifecycleHooks) Validate() error {
+	for _, stage := range lifecycleStages {
+		hook := h.hook(stage)
+		if hook == nil {
+			continue
+		}
+		if strings.TrimSpace(hook.Command) == "" || strings.ContainsRune(hook.Command, 0) {
+			return fmt.Errorf("%s: command is required", stage)
+		}
+		if hook.Timeout != "" {
+			timeout, err := time.ParseDuration(hook.Timeout)
+			if err != nil || timeout < time.Second || timeout > time.Hour {
+				return fmt.Errorf("%s: timeout must be a duration between 1s and 1h", stage)
+			}
+		}
+	}
+	return nil
+}
+
+// LifecycleRun is one run of a lifecycle hook
+type LifecycleRun struct {
+	Stage      string    `json:"stage"`
+	Command    string    `json:"command"`
+	Status     string    `json:"status"` // succeeded, failed or timed_out
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Output     string    `json:"output,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// LifecycleLog keeps the latest hook runs of each server in memory
+type LifecycleLog struct {
+	mu   sync.Mutex
+	runs map[string][]LifecycleRun
+}
+
+// NewLifecycleLog creates an empty run log
+func NewLifecycleLog() *LifecycleLog {
+	return &LifecycleLog{runs: make(map[string][]LifecycleRun)}
+}
+
+// record adds a run of a server's hook
+func (ll *LifecycleLog) record(serverID string, run LifecycleRun) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	runs := append(ll.runs[serverID], run)
+	if len(runs) > maxLifecycleRuns {
+		runs = runs[len(runs)-maxLifecycleRuns:]
+	}
+	ll.runs[serverID] = runs
+}
+
+// Runs returns the hook runs of a server, newest first
+func (ll *LifecycleLog) Runs(serverID string) []LifecycleRun {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	runs := make([]LifecycleRun, 0, len(ll.runs[serverID]))
+	for i := len(ll.runs[serverID]) - 1; i >= 0; i-- {
+		runs = append(runs, ll.runs[serverID][i])
+	}
+	return runs
+}
+
+// Forget drops the runs of a deleted server
+func (ll *LifecycleLog) Forget(serverID string) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	delete(ll.runs, serverID)
+}
+
+// runLifecycleHook runs a server's hook for stage, if it has one, the way
+// scheduled tasks run: with sh in the server directory, as the server's
+// user and with its environment, plus PSM_SERVER_ID, PSM_SERVER_NAME,
+// PSM_SERVER_PORT and PSM_LIFECYCLE_STAGE. Failures are returned and
+// raised as warnings.
+func (a *App) runLifecycleHook(ctx context.Context, server Server, stage string) error {
+	hook := server.Lifecycle.hook(stage)
+	if hook == nil {
+		return nil
+	}
+
+	run := LifecycleRun{Stage: stage, Command: hook.Command, StartedAt: time.Now(), RequestID: requestIDFromContext(ctx)}
+	err := func() error {
+		var account *runAccount
+		if a.privileges.Root {
+			found, err := lookupRunAccount(a.runAsUser(server))
+			if err != nil {
+				return err
+			}
+			account = &found
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, hook.timeout())
+		defer cancel()
+		cmd := exec.CommandContext(runCtx, "sh", "-c", hook.Command)
+		cmd.Dir = server.Directory
+		cmd.Env = append(a.taskEnvironment(ctx, server, account),
+			"PSM_SERVER_ID="+server.ID,
+			"PSM_SERVER_NAME="+server.Name,
+			"PSM_SERVER_PORT="+server.Port,
+			"PSM_LIFECYCLE_STAGE="+stage,
+		)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if account != nil {
+			cmd.SysProcAttr.Credential = account.credential()
+		}
+		cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+		cmd.WaitDelay = taskKillDelay
+
+		output := &tailBuffer{limit: maxTaskOutput}
+		cmd.Stdout, cmd.Stderr = output, output
+		logAttrs(ctx, slog.LevelInfo, "lifecycle hook", slog.String("server", server.ID), slog.String("stage", stage), slog.String("command", hook.Command))
+		err := cmd.Run()
+		run.Output = output.String()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			run.ExitCode = exitErr.ExitCode()
+		}
+		if runCtx.Err() == context.DeadlineExceeded {
+			run.Status = "timed_out"
+			return fmt.Errorf("timed out after %s", hook.timeout())
+		}
+		return err
+	}()
+
+	run.FinishedAt = time.Now()
+	if err == nil {
+		run.Status = "succeeded"
+	} else {
+		if run.Status == "" {
+			run.Status = "failed"
+		}
+		run.Error = err.Error()
+		a.warnings.AddContext(ctx, "lifecycle", "The %s hook of server %s failed: %v", stage, server.ID, err)
+	}
+	a.lifecycle.record(server.ID, run)
+	return err
+}
+
+// SetLifecycleHooks replaces the lifecycle hooks of a server; nil removes
+// them
+func (a *App) SetLifecycleHooks(id string, hooks *LifecycleHooks) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Lifecycle = hooks
+
+	a.requestSave()
+	return true
+}
+
+// handleGetLifecycleHooks shows the lifecycle hooks of a server and their
+// latest runs, newest first
+func (a *App) handleGetLifecycleHooks(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"hooks":     server.Lifecycle,
+		"runs":      a.lifecycle.Runs(id),
+	})
+}
+
+// handleSetLifecycleHooks replaces the lifecycle hooks of a server
+// ({"pre_start": {"command": "php artisan config:cache", "timeout": "1m"}};
+// null removes them). They apply from the next start or stop.
+func (a *App) handleSetLifecycleHooks(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var hooks *LifecycleHooks
+	if err := json.NewDecoder(r.Body).Decode(&hooks); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if hooks != nil {
+		if err := hooks.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if !a.SetLifecycleHooks(id, hooks) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"hooks":     hooks,
+	})
+}
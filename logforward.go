@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logForwardInterval is how often new log lines are shipped
+	logForwardInterval = 5 * time.Second
+	// maxForwardedBytes bounds what is read from one log per run, so a
+	// chatty server can't hold up the others
+	maxForwardedBytes = 1 << 20
+)
+
+// forwardedLogs are the captured logs of a server that are shipped, by
+// the stream label they are sent with
+var forwardedLogs = map[string]string{
+	"server": activeLogName,
+	"access": accessLogName,
+}
+
+// LogLine is one captured line with the labels it is shipped with
+type LogLine struct {
+	Time       time.Time
+	ServerID   string
+	ServerName string
+	Stream     string // "server" for the process output, "access" for requests
+	Message    string
+}
+
+// LogSink ships log lines to an external logging system
+type LogSink interface {
+	Send(lines []LogLine) error
+}
+
+// parseLogForwarding validates a log_forwarding setting and returns its
+// sink; "off" returns nil. Accepted values are "off", "syslog" (local),
+// "syslog://host:port" (UDP), "syslog+tcp://host:port", "journald",
+// "loki+http(s)://host:port[/path]" and
+// "elasticsearch+http(s)://host:port[/index]".
+func parseLogForwarding(value string) (LogSink, error) {
+	switch value {
+	case "", "off":
+		return nil, nil
+	case "syslog":
+		return &syslogSink{network: "unixgram", address: "/dev/log"}, nil
+	case "journald":
+		return &journaldSink{socket: "/run/systemd/journal/socket"}, nil
+	}
+
+	target, err := url.Parse(value)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("log_forwarding must be off, syslog, journald or a syslog://, syslog+tcp://, loki+http(s):// or elasticsearch+http(s):// URL")
+	}
+
+	switch target.Scheme {
+	case "syslog", "syslog+udp", "syslog+tcp":
+		if _, _, err := net.SplitHostPort(target.Host); err != nil {
+			return nil, fmt.Errorf("log_forwarding: syslog address needs a port, e.g. syslog://logs:514")
+		}
+		network := "udp"
+		if target.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		return &syslogSink{network: network, address: target.Host}, nil
+	case "loki+http", "loki+https":
+		target.Scheme = strings.TrimPrefix(target.Scheme, "loki+")
+		if target.Path == "" || target.Path == "/" {
+			target.Path = "/loki/api/v1/push"
+		}
+		return &lokiSink{url: target.String(), client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "elasticsearch+http", "elasticsearch+https":
+		target.Scheme = strings.TrimPrefix(target.Scheme, "elasticsearch+")
+		index := strings.Trim(target.Path, "/")
+		if index == "" {
+			index = "php-server-manager"
+		}
+		if strings.Contains(index, "/") {
+			return nil, fmt.Errorf("log_forwarding: elasticsearch path must be a single index name")
+		}
+		target.Path = "/_bulk"
+		return &elasticsearchSink{url: target.String(), index: index, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("log_forwarding: unsupported scheme %q", target.Scheme)
+}
+
+// syslogSink sends RFC 5424 messages with the labels as structured data
+type syslogSink struct {
+	network string
+	address string
+}
+
+// syslogEscaper escapes structured data parameter values
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Send writes one message per line. Over TCP messages are framed by
+// their length (RFC 6587).
+func (ss *syslogSink) Send(lines []LogLine) error {
+	conn, err := net.DialTimeout(ss.network, ss.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	hostname, _ := os.Hostname()
+	for _, line := range lines {
+		// Facility local0, severity informational
+		message := fmt.Sprintf("<134>1 %s %s php-server-manager - - [psm@32473 server_id=\"%s\" server_name=\"%s\" stream=\"%s\"] %s",
+			line.Time.Format(time.RFC3339Nano), hostname,
+			syslogEscaper.Replace(line.ServerID), syslogEscaper.Replace(line.ServerName), line.Stream, line.Message)
+		if ss.network == "tcp" {
+			message = strconv.Itoa(len(message)) + " " + message
+		}
+		if _, err := io.WriteString(conn, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journaldSink sends entries over journald's native protocol, with the
+// labels as PSM_* fields
+type journaldSink struct {
+	socket string
+}
+
+// Send writes one datagram per line
+func (js *journaldSink) Send(lines []LogLine) error {
+	conn, err := net.Dial("unixgram", js.socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, line := range lines {
+		var entry bytes.Buffer
+		fmt.Fprintf(&entry, "MESSAGE=%s\nPRIORITY=6\nSYSLOG_IDENTIFIER=php-server-manager\n", line.Message)
+		fmt.Fprintf(&entry, "PSM_SERVER_ID=%s\nPSM_SERVER_NAME=%s\nPSM_STREAM=%s\n",
+			line.ServerID, strings.ReplaceAll(line.ServerName, "\n", " "), line.Stream)
+		if _, err := conn.Write(entry.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lokiSink pushes lines to Loki's push API, one stream per server and
+// log
+type lokiSink struct {
+	url    string
+	client *http.Client
+}
+
+// Send pushes all lines in one request
+func (ls *lokiSink) Send(lines []LogLine) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := []*stream{}
+	byKey := make(map[string]*stream)
+	for _, line := range lines {
+		key := line.ServerID + "/" + line.Stream
+		s, exists := byKey[key]
+		if !exists {
+			s = &stream{Stream: map[string]string{
+				"job":         "php-server-manager",
+				"server_id":   line.ServerID,
+				"server_name": line.ServerName,
+				"stream":      line.Stream,
+			}}
+			byKey[key] = s
+			streams = append(streams, s)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(line.Time.UnixNano(), 10), line.Message})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"streams": streams})
+	if err != nil {
+		return err
+	}
+	return postLogs(ls.client, ls.url, "application/json", body)
+}
+
+// elasticsearchSink indexes lines as documents with the bulk API
+type elasticsearchSink struct {
+	url    string
+	index  string
+	client *http.Client
+}
+
+// Send indexes all lines in one bulk request
+func (es *elasticsearchSink) Send(lines []LogLine) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, line := range lines {
+		encoder.Encode(map[string]interface{}{"index": map[string]string{"_index": es.index}})
+		encoder.Encode(map[string]string{
+			"@timestamp":  line.Time.Format(time.RFC3339Nano),
+			"message":     line.Message,
+			"server_id":   line.ServerID,
+			"server_name": line.ServerName,
+			"stream":      line.Stream,
+		})
+	}
+	return postLogs(es.client, es.url, "application/x-ndjson", body.Bytes())
+}
+
+// postLogs sends a request body to a log endpoint. Credentials in the
+// URL are sent as basic auth.
+func postLogs(client *http.Client, endpoint, contentType string, body []byte) error {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+
+	// The bulk API reports failed documents with a 200
+	if contentType == "application/x-ndjson" {
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Errors {
+			return fmt.Errorf("some documents were rejected")
+		}
+	}
+	return nil
+}
+
+// LogForwarder ships the lines appended to servers' captured logs to the
+// sink set by their log_forwarding setting. Logs are followed from where
+// they were when forwarding was enabled or the manager started.
+type LogForwarder struct {
+	mu       sync.Mutex
+	baseDir  string
+	offsets  map[string]int64
+	warnings *WarningCenter
+}
+
+// NewLogForwarder creates a forwarder reading the logs below baseDir
+func NewLogForwarder(baseDir string, warnings *WarningCenter) *LogForwarder {
+	return &LogForwarder{
+		baseDir:  baseDir,
+		offsets:  make(map[string]int64),
+		warnings: warnings,
+	}
+}
+
+// readLogLines returns the complete lines appended to a log since offset
+// and the offset after them. A log that shrank has been rolled and is
+// read from the start.
+func readLogLines(path string, offset int64) ([]string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	if stat, err := file.Stat(); err == nil && stat.Size() < offset {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	lines := []string{}
+	reader := bufio.NewReader(io.LimitReader(file, maxForwardedBytes))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial line is read again once it is complete
+			break
+		}
+		offset += int64(len(line))
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, offset, nil
+}
+
+// Forward ships the new lines of one server's logs. Lines are only
+// skipped once the sink accepted them, so a failing sink is retried on the
+// next run.
+func (lf *LogForwarder) Forward(id, name, setting string, now time.Time) error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	sink, err := parseLogForwarding(setting)
+	for stream, file := range forwardedLogs {
+		key := id + "/" + stream
+		path := filepath.Join(serverLogDir(lf.baseDir, id), file)
+
+		offset, known := lf.offsets[key]
+		if sink == nil || !known {
+			// Start following from the current end
+			if stat, err := os.Stat(path); err == nil {
+				lf.offsets[key] = stat.Size()
+			} else {
+				lf.offsets[key] = 0
+			}
+			continue
+		}
+
+		messages, next, readErr := readLogLines(path, offset)
+		if readErr != nil || len(messages) == 0 {
+			lf.offsets[key] = next
+			continue
+		}
+		lines := make([]LogLine, len(messages))
+		for i, message := range messages {
+			lines[i] = LogLine{Time: now, ServerID: id, ServerName: name, Stream: stream, Message: message}
+		}
+		if err := sink.Send(lines); err != nil {
+			return fmt.Errorf("forwarding %s log: %v", stream, err)
+		}
+		lf.offsets[key] = next
+	}
+	return err
+}
+
+// Forget drops the positions of a deleted server
+func (lf *LogForwarder) Forget(id string) {
+	if lf == nil {
+		return
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	for stream := range forwardedLogs {
+		delete(lf.offsets, id+"/"+stream)
+	}
+}
+
+// Run forwards the logs of every server at the given interval
+func (lf *LogForwarder) Run(interval time.Duration, app *App) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, id := range app.serverIDs() {
+			server, exists := app.GetServer(id)
+			settings, resolved := app.EffectiveSettings(id)
+			if !exists || !resolved {
+				continue
+			}
+			if err := lf.Forward(id, server.Name, settings["log_forwarding"].Value, now); err != nil {
+				lf.warnings.Add("logs", "Error forwarding logs of server %s: %v", id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// logLevel is the manager's log level; it can be changed while running
+var logLevel = new(slog.LevelVar)
+
+// logger is the manager's structured logger. configureLogging replaces it
+// with the configured one when the manager starts.
+var logger = newLogger(os.Stderr, "text")
+
+// newLogger returns a logger writing text or JSON lines to w at logLevel
+func newLogger(w io.Writer, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevel}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// parseLogLevel reads a level name: debug, info, warn or error
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("invalid log level %q, use debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// configureLogging sets up the logger from PSM_LOG_LEVEL (info by default)
+// and PSM_LOG_FORMAT (text or json). It also becomes the default logger,
+// so the standard log package goes through it.
+func configureLogging() error {
+	format := strings.ToLower(os.Getenv("PSM_LOG_FORMAT"))
+	if format != "" && format != "text" && format != "json" {
+		return fmt.Errorf("invalid PSM_LOG_FORMAT %q, use text or json", format)
+	}
+	if name := os.Getenv("PSM_LOG_LEVEL"); name != "" {
+		level, err := parseLogLevel(name)
+		if err != nil {
+			return err
+		}
+		logLevel.Set(level)
+	}
+
+	logger = newLogger(os.Stderr, format)
+	slog.SetDefault(logger)
+	return nil
+}
+
+// logAttrs logs a message with attributes, adding the request ID from ctx
+func logAttrs(ctx context.Context, level slog.Level, message string, attrs ...slog.Attr) {
+	if id := requestIDFromContext(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	logger.LogAttrs(ctx, level, message, attrs...)
+}
+
+// fatal logs an error and exits
+func fatal(format string, args ...interface{}) {
+	logger.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// handleGetLogLevel returns the manager's log level
+func handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
+
+// handleSetLogLevel changes the manager's log level until it restarts
+// ({"level": "debug"})
+func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	logAttrs(r.Context(), slog.LevelWarn, "log level changed",
+		slog.String("from", strings.ToLower(previous.String())), slog.String("to", strings.ToLower(level.String())))
+
+	handleGetLogLevel(w, r)
+}
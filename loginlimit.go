@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// maxFailedLogins is how many failed logins a client address may make
+	// within loginFailureWindow before further attempts are refused
+	maxFailedLogins = 10
+	// loginFailureWindow is how long failed logins are counted
+	loginFailureWindow = 15 * time.Minute
+	// redisLoginPrefix namespaces failed login counters in Redis
+	redisLoginPrefix = "php-server-manager:login-failures:"
+)
+
+// LoginLimiter counts failed logins per client address. Failures returns
+// the count of the current window and how long until it ends.
+type LoginLimiter interface {
+	Failures(ctx context.Context, key string) (int, time.Duration, error)
+	Fail(ctx context.Context, key string) error
+}
+
+// loginWindow is the failed login count of one address
+type loginWindow struct {
+	failures int
+	resetAt  time.Time
+}
+
+// MemoryLoginLimiter counts failed logins in process memory, so each
+// instance allows its own maxFailedLogins
+type MemoryLoginLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*loginWindow
+}
+
+// NewMemoryLoginLimiter creates a limiter without any failures counted
+func NewMemoryLoginLimiter() *MemoryLoginLimiter {
+	return &MemoryLoginLimiter{windows: make(map[string]*loginWindow)}
+}
+
+// Failures returns the failed logins of key in the current window
+func (ml *MemoryLoginLimiter) Failures(ctx context.Context, key string) (int, time.Duration, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	window := ml.windows[key]
+	if window == nil || time.Now().After(window.resetAt) {
+		return 0, 0, nil
+	}
+	return window.failures, time.Until(window.resetAt), nil
+}
+
+// Fail counts a failed login of key and drops windows that ended
+func (ml *MemoryLoginLimiter) Fail(ctx context.Context, key string) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := time.Now()
+	for existing, window := range ml.windows {
+		if now.After(window.resetAt) {
+			delete(ml.windows, existing)
+		}
+	}
+	window := ml.windows[key]
+	if window == nil {
+		window = &loginWindow{resetAt: now.Add(loginFailureWindow)}
+		ml.windows[key] = window
+	}
+	window.failures++
+	return nil
+}
+
+// RedisLoginLimiter counts failed logins in Redis, so the limit holds
+// across every manager instance behind a load balancer
+type RedisLoginLimiter struct {
+	client *redis.Client
+}
+
+// NewRedisLoginLimiter creates a limiter on a Redis connection
+func NewRedisLoginLimiter(client *redis.Client) *RedisLoginLimiter {
+	return &RedisLoginLimiter{client: client}
+}
+
+// Failures returns the failed logins of key in the current window
+func (rl *RedisLoginLimiter) Failures(ctx context.Context, key string) (int, time.Duration, error) {
+	pipe := rl.client.Pipeline()
+	count := pipe.Get(ctx, redisLoginPrefix+key)
+	ttl := pipe.PTTL(ctx, redisLoginPrefix+key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+	failures, err := count.Int()
+	if err == redis.Nil {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return failures, ttl.Val(), nil
+}
+
+// failLoginScript increments a failed login counter, starting its window
+// on the first failure
+var failLoginScript = redis.NewScript(`
+local failures = redis.call("INCR", KEYS[1])
+if failures == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return failures
+`)
+
+// Fail counts a failed login of key; the counter expires with the window
+// that its first failure started
+func (rl *RedisLoginLimiter) Fail(ctx context.Context, key string) error {
+	return failLoginScript.Run(ctx, rl.client, []string{redisLoginPrefix + key}, loginFailureWindow.Milliseconds()).Err()
+}
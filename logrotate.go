@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logRotationInterval is how often server logs are checked for rotation
+const logRotationInterval = time.Minute
+
+// rotateIntervals maps the time-based rotation options to their period
+var rotateIntervals = map[string]time.Duration{
+	"":       0,
+	"off":    0,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// LogPolicy controls how server logs are rotated and how long old logs are
+// kept. It applies to every server's output log and access log.
+type LogPolicy struct {
+	MaxSizeMB     int    `json:"max_size_mb"`      // rotate once the log grows past this size
+	Rotate        string `json:"rotate,omitempty"` // daily, weekly or off for size-based rotation only
+	Compress      bool   `json:"compress"`         // compress rotated logs right away
+	RetentionDays int    `json:"retention_days"`   // delete rotated and archived logs older than this; 0 keeps them
+	MaxFiles      int    `json:"max_files"`        // rotated copies kept per log; 0 keeps all
+}
+
+// defaultLogPolicy applies until a policy is configured
+var defaultLogPolicy = LogPolicy{MaxSizeMB: 50, Compress: true, RetentionDays: 90, MaxFiles: 20}
+
+// Validate checks the policy
+func (lp LogPolicy) Validate() error {
+	if lp.MaxSizeMB <= 0 {
+		return fmt.Errorf("max_size_mb must be positive")
+	}
+	if _, ok := rotateIntervals[lp.Rotate]; !ok {
+		return fmt.Errorf("rotate must be daily, weekly or off")
+	}
+	if lp.RetentionDays < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+	if lp.MaxFiles < 0 {
+		return fmt.Errorf("max_files must not be negative")
+	}
+	return nil
+}
+
+// accessLogOptions returns the options of Caddy's file output that roll a
+// server's access log under the policy. Caddy gzips rolled copies unless
+// told otherwise.
+func (lp LogPolicy) accessLogOptions() []string {
+	options := []string{"roll_size " + strconv.Itoa(lp.MaxSizeMB) + "MiB"}
+	if lp.MaxFiles > 0 {
+		options = append(options, "roll_keep "+strconv.Itoa(lp.MaxFiles))
+	} else {
+		// Caddy's default keeps 10; a very large count keeps them all
+		options = append(options, "roll_keep 100000")
+	}
+	if lp.RetentionDays > 0 {
+		options = append(options, "roll_keep_for "+strconv.Itoa(lp.RetentionDays*24)+"h")
+	}
+	if !lp.Compress {
+		options = append(options, "roll_uncompressed")
+	}
+	return options
+}
+
+// LogPolicy returns the configured log policy, or the default
+func (sm *StorageManager) LogPolicy() LogPolicy {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.state.Logging == nil {
+		return defaultLogPolicy
+	}
+	return *sm.state.Logging
+}
+
+// SetLogPolicy replaces the log policy
+func (sm *StorageManager) SetLogPolicy(policy LogPolicy) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.state.Logging = &policy
+	return sm.saveLocked()
+}
+
+// rotatedLogName returns the name a log is rotated to, e.g.
+// server-2026-10-16T14-05-59.log, so names sort by age as Caddy's do
+func rotatedLogName(name string, t time.Time) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + t.Format("2006-01-02T15-04-05") + ext
+}
+
+// copyTruncate rotates a log that a running server still has open: the
+// content is copied aside and the file truncated. The server writes in
+// append mode, so it carries on at the start of the emptied file.
+func copyTruncate(path, dst string) error {
+	in, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return in.Truncate(0)
+}
+
+// rotateLog rotates an output log of a server, name, when it is due,
+// compressing the copy if the policy says so. It reports whether the log
+// was rotated.
+func (sm *StorageManager) rotateLog(id, name string, policy LogPolicy, lastRotated time.Time, now time.Time) (bool, error) {
+	path := filepath.Join(serverLogDir(sm.baseDir, id), name)
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false, nil
+	}
+
+	interval := rotateIntervals[policy.Rotate]
+	dueBySize := info.Size() >= int64(policy.MaxSizeMB)<<20
+	dueByTime := interval > 0 && now.Sub(lastRotated) >= interval
+	if !dueBySize && !dueByTime {
+		return false, nil
+	}
+
+	dst := filepath.Join(filepath.Dir(path), rotatedLogName(name, now))
+	if err := copyTruncate(path, dst); err != nil {
+		return false, err
+	}
+	if policy.Compress {
+		if err := compressFile(dst, dst+".zst"); err != nil {
+			return true, err
+		}
+		os.Remove(dst)
+	}
+	return true, nil
+}
+
+// pruneLogs deletes a server's rotated and archived logs that the policy
+// no longer keeps. The active logs are never touched. It returns the
+// number of files deleted and the bytes freed.
+func (sm *StorageManager) pruneLogs(id string, policy LogPolicy, now time.Time) (int, int64) {
+	dir := serverLogDir(sm.baseDir, id)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+
+	deleted := 0
+	var freed int64
+	kept := make(map[string]int)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || activeLog(name) {
+			continue
+		}
+
+		// Rotated copies of the same log count against max_files together
+		stream := strings.SplitN(name, "-", 2)[0]
+		kept[stream]++
+		expired := policy.RetentionDays > 0 && entry.ModTime().Before(now.AddDate(0, 0, -policy.RetentionDays))
+		if !expired && (policy.MaxFiles == 0 || kept[stream] <= policy.MaxFiles) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			sm.warnings.Add("storage", "Error deleting old log %s: %v", filepath.Join(dir, name), err)
+			continue
+		}
+		deleted++
+		freed += entry.Size()
+	}
+	return deleted, freed
+}
+
+// RotateLogs rotates the output logs of the given servers that are due and
+// deletes old logs past the retention policy
+func (sm *StorageManager) RotateLogs(ids []string) {
+	policy := sm.LogPolicy()
+	now := time.Now()
+
+	sm.mu.Lock()
+	rotated := make(map[string]time.Time)
+	changed := len(sm.state.Rotated) != len(ids)
+	for _, id := range ids {
+		// The clock of time-based rotation starts when a server is first seen
+		if t, exists := sm.state.Rotated[id]; exists {
+			rotated[id] = t
+		} else {
+			rotated[id] = now
+			changed = true
+		}
+	}
+	sm.mu.Unlock()
+
+	var freed int64
+	deleted := 0
+	for _, id := range ids {
+		// The logs of worker processes rotate with the server's
+		names := []string{activeLogName}
+		workerLogs, _ := filepath.Glob(filepath.Join(serverLogDir(sm.baseDir, id), "*"+workerLogSuffix))
+		for _, path := range workerLogs {
+			names = append(names, filepath.Base(path))
+		}
+		last := rotated[id]
+		for _, name := range names {
+			done, err := sm.rotateLog(id, name, policy, last, now)
+			if err != nil {
+				sm.warnings.Add("storage", "Error rotating log %s of server %s: %v", name, id, err)
+			}
+			if done {
+				rotated[id] = now
+				changed = true
+			}
+		}
+		n, bytes := sm.pruneLogs(id, policy, now)
+		deleted += n
+		freed += bytes
+	}
+	if !changed && deleted == 0 {
+		return
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.state.Rotated = rotated
+	sm.state.ReclaimedBytes += freed
+	sm.state.PrunedLogs += deleted
+	if err := sm.saveLocked(); err != nil {
+		sm.warnings.Add("storage", "Error saving storage state: %v", err)
+	}
+}
+
+// RunLogRotation rotates and prunes logs every interval until the process
+// exits
+func (sm *StorageManager) RunLogRotation(interval time.Duration, ids func() []string) {
+	for {
+		sm.RotateLogs(ids())
+		time.Sleep(interval)
+	}
+}
+
+// handleGetLogPolicy returns the log rotation and retention policy
+func (sm *StorageManager) handleGetLogPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sm.LogPolicy())
+}
+
+// handleSetLogPolicy replaces the log rotation and retention policy. Output
+// logs follow it from the next check; access logs once their server
+// restarts.
+func (sm *StorageManager) handleSetLogPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := sm.LogPolicy()
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if err := sm.SetLogPolicy(policy); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save log policy: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
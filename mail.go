@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// mailpitImage catches mail over SMTP and shows it in a web UI
+	mailpitImage = "axllent/mailpit"
+	// sharedMailpitName is the container shared by servers in shared mode
+	sharedMailpitName = "psm-mailpit"
+	// mailpitSMTPPort and mailpitUIPort are the container's ports
+	mailpitSMTPPort = "1025/tcp"
+	mailpitUIPort   = "8025/tcp"
+)
+
+// MailConfig routes the mail a server sends into Mailpit instead of
+// delivering it
+type MailConfig struct {
+	Mode string `json:"mode"` // shared or dedicated
+}
+
+// Validate checks the mail options
+func (mc MailConfig) Validate() error {
+	if mc.Mode != "shared" && mc.Mode != "dedicated" {
+		return fmt.Errorf("mode must be shared or dedicated")
+	}
+	return nil
+}
+
+// containerName is the Mailpit container that catches the server's mail
+func (mc MailConfig) containerName(serverID string) string {
+	if mc.Mode == "dedicated" {
+		return "psm-mail-" + serverID
+	}
+	return sharedMailpitName
+}
+
+// MailEndpoint is where a running Mailpit takes and shows mail
+type MailEndpoint struct {
+	Container string `json:"container"`
+	SMTP      string `json:"smtp"` // host:port
+	UI        string `json:"ui"`   // host:port of the web UI
+}
+
+// Environment returns the variables that point Laravel (MAIL_*) and
+// Symfony (MAILER_DSN) at the SMTP port
+func (me MailEndpoint) Environment() []string {
+	host, port, _ := net.SplitHostPort(me.SMTP)
+	return []string{"MAIL_MAILER=smtp", "MAIL_HOST=" + host, "MAIL_PORT=" + port, "MAILER_DSN=smtp://" + me.SMTP}
+}
+
+// sendmailPath returns the php.ini sendmail_path that hands mail() to the
+// manager's sendmail stand-in, which relays it to the SMTP port
+func (me MailEndpoint) sendmailPath() (string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%s sendmail --smtp %s"`, binary, me.SMTP), nil
+}
+
+// mailpitUIHost is the address the web UI is published on. It defaults to
+// 127.0.0.1; PSM_MAILPIT_UI_HOST=0.0.0.0 makes it reachable from other
+// hosts, without a password.
+func mailpitUIHost() string {
+	return firstNonEmpty(os.Getenv("PSM_MAILPIT_UI_HOST"), "127.0.0.1")
+}
+
+// mailEndpoint reads the published ports of a running Mailpit container
+func mailEndpoint(status ContainerStatus) (MailEndpoint, error) {
+	endpoint := MailEndpoint{Container: status.Name, SMTP: status.Ports[mailpitSMTPPort], UI: status.Ports[mailpitUIPort]}
+	if endpoint.SMTP == "" || endpoint.UI == "" {
+		return endpoint, fmt.Errorf("container %s does not publish the Mailpit ports", status.Name)
+	}
+	return endpoint, nil
+}
+
+// ensureMailpit creates and starts a Mailpit container unless it runs.
+// Docker picks free host ports each time it starts, so they are read back
+// rather than stored.
+func ensureMailpit(ctx context.Context, name, serverID string) (MailEndpoint, error) {
+	if name == sharedMailpitName {
+		serverID = ""
+	}
+	status, err := newDockerClient().ensureContainer(ctx, name, map[string]interface{}{
+		"Image":        mailpitImage,
+		"Labels":       map[string]string{dockerServerLabel: serverID},
+		"ExposedPorts": map[string]interface{}{mailpitSMTPPort: map[string]interface{}{}, mailpitUIPort: map[string]interface{}{}},
+		"HostConfig": map[string]interface{}{
+			"PortBindings": map[string]interface{}{
+				mailpitSMTPPort: []map[string]string{{"HostIp": "127.0.0.1", "HostPort": ""}},
+				mailpitUIPort:   []map[string]string{{"HostIp": mailpitUIHost(), "HostPort": ""}},
+			},
+		},
+	})
+	if err != nil {
+		return MailEndpoint{}, err
+	}
+	return mailEndpoint(status)
+}
+
+// startMail makes sure the Mailpit of a server runs and returns where it
+// takes mail
+func (a *App) startMail(ctx context.Context, id string, mc *MailConfig) (*MailEndpoint, error) {
+	if mc == nil {
+		return nil, nil
+	}
+	endpoint, err := ensureMailpit(ctx, mc.containerName(id), id)
+	if err != nil {
+		return nil, err
+	}
+	return &endpoint, nil
+}
+
+// stopMail stops a server's dedicated Mailpit; the shared one keeps
+// running for the other servers
+func (a *App) stopMail(ctx context.Context, id string, mc *MailConfig) error {
+	if mc == nil || mc.Mode != "dedicated" {
+		return nil
+	}
+	return newDockerClient().stopContainer(ctx, mc.containerName(id))
+}
+
+// removeMail removes a server's dedicated Mailpit with the mail it caught
+func (a *App) removeMail(ctx context.Context, id string, mc *MailConfig) error {
+	if mc == nil || mc.Mode != "dedicated" {
+		return nil
+	}
+	return newDockerClient().removeContainer(ctx, mc.containerName(id))
+}
+
+// SetMail replaces the mail options of a server and returns the previous
+// ones
+func (a *App) SetMail(id string, mc *MailConfig) (*MailConfig, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return nil, false
+	}
+	previous := server.Mail
+	server.Mail = mc
+
+	a.requestSave()
+	return previous, true
+}
+
+// handleGetMail shows the mail options of a server and, while its Mailpit
+// runs, the SMTP address and a link to the web UI
+func (a *App) handleGetMail(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	response := map[string]interface{}{"server_id": id, "mail": server.Mail}
+	if server.Mail != nil {
+		status, err := newDockerClient().inspectContainer(r.Context(), server.Mail.containerName(id))
+		switch {
+		case isDockerNotFound(err) || (err == nil && !status.Running):
+			response["running"] = false
+		case err != nil:
+			response["error"] = err.Error()
+		default:
+			response["running"] = true
+			if endpoint, err := mailEndpoint(status); err == nil {
+				response["smtp"] = endpoint.SMTP
+				// A UI published on every address is linked on the host the
+				// manager was reached on
+				host, port, _ := net.SplitHostPort(endpoint.UI)
+				if host == "0.0.0.0" || host == "::" {
+					host = requestHostname(r)
+				}
+				response["ui_url"] = "http://" + net.JoinHostPort(host, port) + "/"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// requestHostname returns the host name a request was sent to, without
+// the port
+func requestHostname(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return r.Host
+}
+
+// handleSetMail sets the mail options of a server, applied on its next
+// start. Turning mail off or leaving dedicated mode removes the server's
+// own Mailpit with the mail it caught.
+func (a *App) handleSetMail(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var mc *MailConfig
+	if err := json.NewDecoder(r.Body).Decode(&mc); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if mc != nil {
+		if err := mc.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	previous, exists := a.SetMail(id, mc)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if previous != nil && (mc == nil || mc.Mode != previous.Mode) {
+		if err := a.removeMail(r.Context(), id, previous); err != nil {
+			a.warnings.AddContext(r.Context(), "mail", "Error removing the Mailpit of server %s: %v", id, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"mail":      mc,
+	})
+}
+
+// runSendmailCommand stands in for sendmail in PHP's sendmail_path: it
+// reads a message from stdin and relays it to the SMTP server given with
+// --smtp. Recipients come from the arguments or, with -t or when none are
+// given, from the To, Cc and Bcc headers; the sender from -f or From.
+// Other sendmail flags such as -i are accepted and ignored.
+func runSendmailCommand(args []string) int {
+	var server, from string
+	var recipients []string
+	readHeaders := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--smtp" && i+1 < len(args):
+			i++
+			server = args[i]
+		case arg == "-f" && i+1 < len(args):
+			i++
+			from = args[i]
+		case strings.HasPrefix(arg, "-f"):
+			from = arg[2:]
+		case arg == "-t":
+			readHeaders = true
+		case strings.HasPrefix(arg, "-"):
+		default:
+			recipients = append(recipients, arg)
+		}
+	}
+	if server == "" {
+		fmt.Fprintln(os.Stderr, "sendmail: --smtp host:port is required")
+		return 2
+	}
+
+	raw, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return 1
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return 1
+	}
+	if readHeaders || len(recipients) == 0 {
+		for _, header := range []string{"To", "Cc", "Bcc"} {
+			addresses, _ := message.Header.AddressList(header)
+			for _, address := range addresses {
+				recipients = append(recipients, address.Address)
+			}
+		}
+	}
+	if from == "" {
+		if address, err := mail.ParseAddress(message.Header.Get("From")); err == nil {
+			from = address.Address
+		}
+	}
+	if len(recipients) == 0 {
+		fmt.Fprintln(os.Stderr, "sendmail: no recipients")
+		return 1
+	}
+
+	if err := smtp.SendMail(server, nil, firstNonEmpty(from, "php@localhost"), recipients, raw); err != nil {
+		fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+		return 1
+	}
+	return 0
+}
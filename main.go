@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -335,7 +340,7 @@ func (a *App) GetServerStatus(id string) (bool, bool) {
 	if !exists {
 		return false, false
 	}
-	
+
 	return true, server.Running
 }
 
@@ -605,7 +610,7 @@ func serveStatic(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "static/index.html")
 		return
 	}
-	
+
 	http.ServeFile(w, r, "static"+r.URL.Path)
 }
 
@@ -615,12 +620,12 @@ func corsMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		
+
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -675,15 +680,15 @@ func (am *AuthMiddleware) HandleLogout(w http.ResponseWriter, r *http.Request) {
 
 // VLANManager struct
 type VLANManager struct {
-	subnet string
+	subnet    string
 	usedVLANs map[string]bool
-	mu sync.Mutex
+	mu        sync.Mutex
 }
 
 // NewVLANManager creates a new VLANManager
 func NewVLANManager(subnet string) *VLANManager {
 	return &VLANManager{
-		subnet: subnet,
+		subnet:    subnet,
 		usedVLANs: make(map[string]bool),
 	}
 }
@@ -747,7 +752,7 @@ func (vm *VLANManager) handleGetStatus(w http.ResponseWriter, r *http.Request) {
 	defer vm.mu.Unlock()
 
 	status := map[string]interface{}{
-		"subnet": vm.subnet,
+		"subnet":    vm.subnet,
 		"usedVLANs": vm.usedVLANs,
 	}
 
@@ -756,29 +761,253 @@ func (vm *VLANManager) handleGetStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if err := configureLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// The privileged network helper runs apart from the manager and its
+	// state
+	if len(os.Args) > 1 && os.Args[1] == "net-helper" {
+		os.Exit(runNetHelperCommand(os.Args[2:]))
+	}
+
+	// PHP's sendmail_path runs the manager as sendmail to reach Mailpit
+	if len(os.Args) > 1 && os.Args[1] == "sendmail" {
+		os.Exit(runSendmailCommand(os.Args[2:]))
+	}
+
+	// Client subcommands talk to a running manager and need no local state
+	if len(os.Args) > 1 && cliCommands[os.Args[1]] {
+		os.Exit(runClientCommand(os.Args[1:]))
+	}
+
+	// Initialize the warning center shared by all subsystems
+	warnings := NewWarningCenter()
+
 	// Initialize the App
 	app := NewApp()
+	app.warnings = warnings
+	app.annotations = NewAnnotationLog(warnings)
+	app.tunnels = NewTunnelManager(warnings)
+	app.portMappings = NewPortMapper(warnings)
+	app.runtime = NewRuntimeWatcher(warnings)
+	app.stats = NewStatsCollector()
+	app.traffic = NewTrafficTracker(app.configDir)
+	app.logForwarder = NewLogForwarder(app.configDir, warnings)
+	app.storage = NewStorageManager(app.configDir, warnings)
+	app.events = NewEventLog(filepath.Join(app.configDir, "events.log"))
+	app.nodes = NewNodeManager(app.configDir)
+	app.deploys = NewDeployManager(app.configDir)
+	app.backups = NewBackupManager(app.configDir)
+	app.fileWatcher = NewFileWatcher(app.filesChanged)
+	app.supervisor = NewWorkerSupervisor(app.configDir)
+	app.tasks = NewTaskManager(app.configDir)
+	app.hooks = NewHookManager(app.configDir)
+	app.lifecycle = NewLifecycleLog()
+	app.trash = NewTrashManager(app.configDir, warnings)
+	app.notifier = NewNotifier(app.configDir, warnings)
+	app.health = NewHealthChecker()
 	app.startup(context.Background())
-	defer app.shutdown(context.Background())
+
+	// Initialize certificate store
+	certStore, err := NewCertificateStore(filepath.Join(app.configDir, "certificates"))
+	if err != nil {
+		fatal("Failed to initialize certificate store: %v", err)
+	}
+	app.certs = certStore
+
+	// Subcommands operate on the stored state and exit without serving
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			os.Exit(runFsckCommand(app, os.Args[2:]))
+		case "sudoers":
+			os.Exit(runSudoersCommand(os.Args[2:]))
+		case "passwd":
+			os.Exit(runPasswdCommand(app, os.Args[2:]))
+		case "install-service", "--install-service":
+			os.Exit(runInstallServiceCommand(app, os.Args[2:]))
+		default:
+			if oneShotCommands[os.Args[1]] {
+				os.Exit(runOneShotCommand(app, os.Args[1:]))
+			}
+			fatal("Unknown command: %s", os.Args[1])
+		}
+	}
+
+	// Every user logs in with their own password; there is no default
+	// login, so the manager refuses to start without one
+	users := NewUserStore(usersFilePath(app.configDir))
+	logins, err := users.Users()
+	if err != nil {
+		fatal("Failed to read the users file: %v", err)
+	}
+	if len(logins) == 0 {
+		fatal("No logins are configured in %s; add one with `php-server-manager passwd admin`", users.path)
+	}
+
+	// Detect whether we run as root, with capabilities, next to the
+	// network helper PSM_NET_HELPER names or through sudo
+	helperSocket := os.Getenv("PSM_NET_HELPER")
+	privileges := detectPrivileges(helperSocket)
+	app.privileges = privileges
+	app.reloads = NewReloadManager(app.configDir, privileges)
+	if helperSocket != "" && privileges.Helper == "" && !privileges.NetAdmin {
+		warnings.Add("privileges", "The network helper at %s is not answering; start `php-server-manager net-helper --user %s` as root", helperSocket, currentUsername())
+	}
+	if !privileges.CanManageVLANs() {
+		warnings.Add("privileges", "Neither CAP_NET_ADMIN, the network helper nor sudo is available; servers are created without VLAN interfaces")
+	}
 
 	// Initialize VLAN manager
-	vlanManager := NewVLANManager("2a0e:b107:384:ee25::/64")
+	vlanManager := NewVLANManager(defaultIPv6Prefix)
+	vlanManager.warnings = warnings
+	vlanManager.privileges = privileges
+
+	// Keep ports and addresses used by other systems away from servers
+	app.reservations = NewReservationManager(app.configDir)
+	vlanManager.reservations = app.reservations
+	reservedPorts, err := parseReservedPorts(os.Getenv("PSM_RESERVED_PORTS"))
+	if err != nil {
+		fatal("%v", err)
+	}
+	app.reservedPorts = reservedPorts
+	vlanManager.events = app.events
+
+	// Re-attach to servers that outlived a previous manager process, then
+	// recreate the VLAN interfaces of the others
+	attached := app.reattachServers(vlanManager)
+	if privileges.CanManageVLANs() {
+		app.restoreVLANs(vlanManager, attached)
+	}
+
+	// Initialize the audit log and emergency freeze switch
+	audit := NewAuditLog(filepath.Join(app.configDir, "audit.log"))
+	freeze := NewFreezeManager(filepath.Join(app.configDir, "freeze.json"), audit)
+	freeze.isAdmin = app.isAdmin
+	app.freeze = freeze
+	if freeze.Frozen() {
+		warnings.Add("freeze", "Manager is frozen: %s", freeze.State().Reason)
+	}
+
+	// PSM_READONLY keeps the manager read-only whatever the stored setting
+	if value := os.Getenv("PSM_READONLY"); value != "" {
+		forced, err := strconv.ParseBool(value)
+		if err != nil {
+			fatal("Invalid PSM_READONLY %q: use true or false", value)
+		}
+		app.readOnlyForced = forced
+	}
+
+	// PSM_ADMINS names the users who see every server; the others only see
+	// the servers they created
+	app.admins = parseAdmins(os.Getenv("PSM_ADMINS"))
+	app.memberUser = os.Getenv("PSM_MEMBER_USER")
+	if app.memberUser != "" && !validUsername.MatchString(app.memberUser) {
+		fatal("Invalid PSM_MEMBER_USER %q", app.memberUser)
+	}
+	if !slices.ContainsFunc(logins, app.isAdmin) {
+		warnings.Add("auth", "None of the admins in PSM_ADMINS has a login; add one with `php-server-manager passwd NAME`")
+	}
+
+	// Archive old logs and releases in the background, and rotate and
+	// prune logs under the log policy
+	storage := app.storage
+	go storage.Run(time.Hour, app.serverIDs)
+	go storage.RunLogRotation(logRotationInterval, app.serverIDs)
+
+	// Archive expired preview servers and purge old archives
+	cleanup := NewCleanupManager(app.configDir, warnings)
+	go cleanup.Run(cleanupInterval, app, vlanManager)
+
+	// Purge deleted servers once their retention period ends
+	go app.trash.Run(trashPurgeInterval, app)
+
+	// Flag servers still running a replaced PHP runtime
+	go app.runtime.Run(time.Minute, app)
+
+	// Restart crashed servers according to their restart_policy
+	go app.runReconciler(reconcileInterval)
 
-	// Create router
+	// Sample CPU, memory and open files of running servers
+	go app.stats.Run(statsInterval, app)
+
+	// Ship captured logs to servers' log_forwarding targets
+	go app.logForwarder.Run(logForwardInterval, app)
+
+	// Probe running servers and notify when they become unhealthy
+	go app.health.Run(app)
+
+	// Run scheduled tasks
+	go app.tasks.Run(app)
+
+	// Reload edits made to the config file while the manager runs
+	go app.watchConfigFile(vlanManager)
+
+	// PSM_STATIC_DIR customizes the web UI; its files are served jailed
+	// to the directory
+	if dir := os.Getenv("PSM_STATIC_DIR"); dir != "" {
+		if err := setStaticOverrideDir(dir); err != nil {
+			fatal("Invalid PSM_STATIC_DIR: %v", err)
+		}
+	}
+
+	// Serve UI strings in the operator's language
+	catalog, err := NewCatalog(app.configDir, os.Getenv("PSM_LOCALE"))
+	if err != nil {
+		fatal("Invalid PSM_LOCALE: %v", err)
+	}
+
+	// Create router; clients outside the address restrictions reach
+	// neither the API nor the UI
 	r := mux.NewRouter()
-	
+	r.Use(app.managementAccessMiddleware)
+
 	// Add authentication middleware
-	authMiddleware := NewAuthMiddleware("admin123") // Default password, should be configurable
-	
+	authMiddleware := NewAuthMiddleware(users)
+	authMiddleware.warnings = warnings
+	authMiddleware.events = app.events
+
+	// Share sessions, failed login counts and events between instances
+	// through Redis when configured
+	if redisURL := os.Getenv("PSM_REDIS_URL"); redisURL != "" {
+		client, err := newRedisClient(redisURL)
+		if err != nil {
+			warnings.Add("sessions", "Redis is unavailable, keeping sessions, login limits and events local: %v", err)
+		} else {
+			authMiddleware.sessions = NewRedisSessionStore(client)
+			authMiddleware.limiter = NewRedisLoginLimiter(client)
+			if err := app.events.UseRedis(client); err != nil {
+				warnings.Add("sessions", "Error subscribing to events in Redis, keeping events locally: %v", err)
+			}
+		}
+	}
+
+	// Session lifetime, log level and VLAN range from the stored options
+	applyManagerOptions(app.ManagerOptions(), authMiddleware, vlanManager)
+
 	// API endpoints with authentication
 	api := r.PathPrefix("/api").Subrouter()
+	api.Use(requestIDMiddleware)
 	api.Use(corsMiddleware)
 	api.Use(authMiddleware.Middleware)
+	api.Use(freeze.Middleware)
+	api.Use(app.readOnlyMiddleware)
+	api.Use(app.ownershipMiddleware)
+	api.Use(NewAuthzGuard(app, audit).Middleware)
 	api.HandleFunc("/servers", app.handleGetServers).Methods("GET")
 	api.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
 		app.handleCreateServerWithVLAN(w, r, vlanManager)
 	}).Methods("POST")
+	api.HandleFunc("/servers/validate", func(w http.ResponseWriter, r *http.Request) {
+		app.handleValidateServer(w, r, vlanManager)
+	}).Methods("POST")
+	api.HandleFunc("/servers/start-all", app.handleStartAll).Methods("POST")
+	api.HandleFunc("/servers/stop-all", app.handleStopAll).Methods("POST")
+	api.HandleFunc("/servers/{id}", app.handleGetServer).Methods("GET")
 	api.HandleFunc("/servers/{id}", app.handleUpdateServer).Methods("PUT")
+	api.HandleFunc("/servers/{id}/owner", app.handleSetServerOwner).Methods("PUT")
 	api.HandleFunc("/servers/{id}", func(w http.ResponseWriter, r *http.Request) {
 		app.handleDeleteServerWithVLAN(w, r, vlanManager)
 	}).Methods("DELETE")
@@ -789,33 +1018,317 @@ func main() {
 		app.handleStopServerWithVLAN(w, r, vlanManager)
 	}).Methods("POST")
 	api.HandleFunc("/servers/{id}/status", app.handleServerStatus).Methods("GET")
-	
+	api.HandleFunc("/servers/{id}/url", app.handleGetServerURL).Methods("GET")
+	api.HandleFunc("/servers/{id}/detail", func(w http.ResponseWriter, r *http.Request) {
+		app.handleGetServerDetail(w, r, vlanManager)
+	}).Methods("GET")
+	api.HandleFunc("/servers/{id}/reload", app.handleReloadServer).Methods("POST")
+	api.HandleFunc("/servers/{id}/labels", app.handleSetLabels).Methods("PUT")
+	api.HandleFunc("/servers/{id}/clone", func(w http.ResponseWriter, r *http.Request) {
+		app.handleCloneServer(w, r, vlanManager)
+	}).Methods("POST")
+	api.HandleFunc("/servers/{id}/vlan-options", func(w http.ResponseWriter, r *http.Request) {
+		app.handleSetVLANOptions(w, r, vlanManager)
+	}).Methods("PUT")
+
+	// Certificate endpoints
+	api.HandleFunc("/servers/{id}/compression", app.handleSetCompression).Methods("PUT")
+	api.HandleFunc("/servers/{id}/static-cache", app.handleSetStaticCache).Methods("PUT")
+	api.HandleFunc("/servers/{id}/limits", app.handleSetLimits).Methods("PUT")
+	api.HandleFunc("/servers/{id}/expiry", app.handleSetExpiry).Methods("PUT")
+	api.HandleFunc("/servers/{id}/fix-permissions", app.handleFixPermissions).Methods("POST")
+	api.HandleFunc("/servers/{id}/tunnel", app.handleGetTunnel).Methods("GET")
+	api.HandleFunc("/servers/{id}/tunnel", app.handleOpenTunnel).Methods("POST")
+	api.HandleFunc("/servers/{id}/tunnel", app.handleCloseTunnel).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/public", app.handleSetPublic).Methods("PUT")
+	api.HandleFunc("/servers/{id}/port-mapping", app.handleGetPortMapping).Methods("GET")
+	api.HandleFunc("/tunnels", app.handleGetTunnels).Methods("GET")
+	api.HandleFunc("/servers/{id}/history", app.handleGetHistory).Methods("GET")
+	api.HandleFunc("/servers/{id}/timeline", app.handleGetTimeline).Methods("GET")
+	api.HandleFunc("/servers/{id}/stats", app.handleGetStats).Methods("GET")
+	api.HandleFunc("/servers/{id}/traffic", app.handleGetTraffic).Methods("GET")
+	api.HandleFunc("/servers/{id}/access-log", app.handleGetAccessLog).Methods("GET")
+	api.HandleFunc("/servers/{id}/settings", app.handleSetServerSettings).Methods("PUT")
+	api.HandleFunc("/servers/{id}/effective-settings", app.handleGetEffectiveSettings).Methods("GET")
+	api.HandleFunc("/servers/{id}/maintenance", app.handleGetMaintenance).Methods("GET")
+	api.HandleFunc("/servers/{id}/framework", app.handleGetFramework).Methods("GET")
+	api.HandleFunc("/servers/{id}/dotenv", app.handleGetDotEnv).Methods("GET")
+	api.HandleFunc("/servers/{id}/worker", app.handleGetWorker).Methods("GET")
+	api.HandleFunc("/servers/{id}/worker", app.handleSetWorker).Methods("PUT")
+	api.HandleFunc("/servers/{id}/runtime", app.handleGetRuntimeBackend).Methods("GET")
+	api.HandleFunc("/servers/{id}/runtime", app.handleSetRuntimeBackend).Methods("PUT")
+	api.HandleFunc("/servers/{id}/container", app.handleGetContainer).Methods("GET")
+	api.HandleFunc("/servers/{id}/container/logs", app.handleGetContainerLogs).Methods("GET")
+	api.HandleFunc("/servers/{id}/unit", app.handleGetUnit).Methods("GET")
+	api.HandleFunc("/servers/{id}/unit/logs", app.handleGetUnitLogs).Methods("GET")
+	api.HandleFunc("/servers/{id}/database", app.handleGetDatabase).Methods("GET")
+	api.HandleFunc("/servers/{id}/database", app.handleCreateDatabase).Methods("POST")
+	api.HandleFunc("/servers/{id}/database", app.handleDeleteDatabase).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/mail", app.handleGetMail).Methods("GET")
+	api.HandleFunc("/servers/{id}/mail", app.handleSetMail).Methods("PUT")
+	api.HandleFunc("/servers/{id}/redis", app.handleGetRedis).Methods("GET")
+	api.HandleFunc("/servers/{id}/redis", app.handleSetRedis).Methods("PUT")
+	api.HandleFunc("/servers/{id}/watch", app.handleGetWatch).Methods("GET")
+	api.HandleFunc("/servers/{id}/watch", app.handleSetWatch).Methods("PUT")
+	api.HandleFunc("/servers/{id}/lifecycle", app.handleGetLifecycleHooks).Methods("GET")
+	api.HandleFunc("/servers/{id}/lifecycle", app.handleSetLifecycleHooks).Methods("PUT")
+	api.HandleFunc("/servers/{id}/workers", app.handleGetWorkerProcesses).Methods("GET")
+	api.HandleFunc("/servers/{id}/workers", app.handleCreateWorkerProcess).Methods("POST")
+	api.HandleFunc("/servers/{id}/workers/{name}", app.handleUpdateWorkerProcess).Methods("PUT")
+	api.HandleFunc("/servers/{id}/workers/{name}", app.handleDeleteWorkerProcess).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/workers/{name}/restart", app.handleRestartWorkerProcess).Methods("POST")
+	api.HandleFunc("/servers/{id}/workers/{name}/logs", app.handleGetWorkerProcessLogs).Methods("GET")
+	api.HandleFunc("/servers/{id}/access", app.handleGetAccess).Methods("GET")
+	api.HandleFunc("/servers/{id}/access", app.handleSetAccess).Methods("PUT")
+	api.HandleFunc("/servers/{id}/php-ini", app.handleGetPHPIni).Methods("GET")
+	api.HandleFunc("/servers/{id}/php-ini", app.handleSetPHPIni).Methods("PUT")
+	api.HandleFunc("/servers/{id}/opcache", app.handleGetOPcache).Methods("GET")
+	api.HandleFunc("/servers/{id}/opcache/reset", app.handleResetOPcache).Methods("POST")
+	api.HandleFunc("/servers/{id}/debug", app.handleGetDebug).Methods("GET")
+	api.HandleFunc("/servers/{id}/debug", app.handleSetDebug).Methods("PUT")
+	api.HandleFunc("/servers/{id}/debug/enable", app.handleToggleDebug(true)).Methods("POST")
+	api.HandleFunc("/servers/{id}/debug/disable", app.handleToggleDebug(false)).Methods("POST")
+	api.HandleFunc("/servers/{id}/git", app.handleSetGitSource).Methods("PUT")
+	api.HandleFunc("/servers/{id}/headers", app.handleGetServerHeaderRules).Methods("GET")
+	api.HandleFunc("/servers/{id}/headers", app.handleSetServerHeaderRules).Methods("PUT")
+	api.HandleFunc("/servers/{id}/deploy", app.handleDeploy).Methods("POST")
+	api.HandleFunc("/servers/{id}/deploys", app.handleGetDeploys).Methods("GET")
+	api.HandleFunc("/servers/{id}/backup", app.handleCreateBackup).Methods("POST")
+	api.HandleFunc("/servers/{id}/backups", app.handleGetBackups).Methods("GET")
+	api.HandleFunc("/servers/{id}/restore/{backup}", app.handleRestoreBackup).Methods("POST")
+	api.HandleFunc("/backups/config", app.backups.handleGetBackupConfig).Methods("GET")
+	api.HandleFunc("/backups/config", app.backups.handleSetBackupConfig).Methods("PUT")
+	api.HandleFunc("/servers/{id}/health", app.handleGetHealth).Methods("GET")
+	api.HandleFunc("/servers/{id}/hooks", app.handleGetHooks).Methods("GET")
+	api.HandleFunc("/servers/{id}/hooks", app.handleCreateHook).Methods("POST")
+	api.HandleFunc("/servers/{id}/hooks/{hook}", app.handleDeleteHook).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/hooks/{hook}/deliveries", app.handleGetHookDeliveries).Methods("GET")
+	api.HandleFunc("/servers/{id}/tasks", app.handleGetTasks).Methods("GET")
+	api.HandleFunc("/servers/{id}/tasks", app.handleCreateTask).Methods("POST")
+	api.HandleFunc("/servers/{id}/tasks/{task}", app.handleUpdateTask).Methods("PUT")
+	api.HandleFunc("/servers/{id}/tasks/{task}", app.handleDeleteTask).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/tasks/{task}/run", app.handleRunTask).Methods("POST")
+	api.HandleFunc("/servers/{id}/tasks/{task}/runs", app.handleGetTaskRuns).Methods("GET")
+	api.HandleFunc("/servers/{id}/certificate", app.handleGetCertificate).Methods("GET")
+	api.HandleFunc("/servers/{id}/certificate", app.handlePutCertificate).Methods("PUT")
+	api.HandleFunc("/servers/{id}/certificate", app.handleDeleteCertificate).Methods("DELETE")
+	api.HandleFunc("/servers/{id}/certificates", app.handleListCertificates).Methods("GET")
+	api.HandleFunc("/servers/{id}/certificates/{domain}", app.handleGetCertificate).Methods("GET")
+	api.HandleFunc("/servers/{id}/certificates/{domain}", app.handlePutCertificate).Methods("PUT")
+	api.HandleFunc("/servers/{id}/certificates/{domain}", app.handleDeleteCertificate).Methods("DELETE")
+
 	// Authentication endpoints
 	api.HandleFunc("/auth/login", authMiddleware.HandleLogin).Methods("POST")
 	api.HandleFunc("/auth/logout", authMiddleware.HandleLogout).Methods("POST")
-	
+
+	// API documentation
+	api.HandleFunc("/openapi.json", handleOpenAPI(r)).Methods("GET")
+	api.HandleFunc("/docs", handleDocs).Methods("GET")
+
+	// System endpoints
+	api.HandleFunc("/system/fsck", app.handleFsck).Methods("POST")
+	api.HandleFunc("/system/capabilities", privileges.handleGetCapabilities).Methods("GET")
+	api.HandleFunc("/system/sudoers", handleGetSudoers).Methods("GET")
+	api.HandleFunc("/system/freeze", freeze.handleGetFreeze).Methods("GET")
+	api.HandleFunc("/system/freeze", freeze.handleFreeze).Methods("POST")
+	api.HandleFunc("/system/unfreeze", freeze.handleUnfreeze).Methods("POST")
+	api.HandleFunc("/system/audit", audit.handleGetAudit).Methods("GET")
+	api.HandleFunc("/annotations", app.annotations.handleGetAnnotations).Methods("GET")
+	api.HandleFunc("/fs/browse", handleBrowse).Methods("GET")
+
+	// Managers on other hosts controlled from this one
+	api.HandleFunc("/nodes", app.nodes.handleGetNodes).Methods("GET")
+	api.HandleFunc("/nodes", app.nodes.handleAddNode).Methods("POST")
+	api.HandleFunc("/nodes/{node}", app.nodes.handleDeleteNode).Methods("DELETE")
+	api.HandleFunc("/nodes/{node}/api/{path:.*}", app.nodes.handleNodeProxy).Methods("GET", "POST", "PUT", "PATCH", "DELETE")
+	api.HandleFunc("/cluster/servers", app.handleGetClusterServers).Methods("GET")
+
+	// Reservations for external systems
+	api.HandleFunc("/reservations", app.handleGetReservations).Methods("GET")
+	api.HandleFunc("/reservations", app.handleCreateReservation).Methods("POST")
+	api.HandleFunc("/reservations/{id}", app.handleDeleteReservation).Methods("DELETE")
+
+	// Saved views
+	api.HandleFunc("/views", app.handleGetViews).Methods("GET")
+	api.HandleFunc("/views/{name}", app.handlePutView).Methods("PUT")
+	api.HandleFunc("/views/{name}", app.handleDeleteView).Methods("DELETE")
+	api.HandleFunc("/views/{name}/servers", app.handleGetViewServers).Methods("GET")
+
+	// Storage endpoints
+	api.HandleFunc("/storage", func(w http.ResponseWriter, r *http.Request) {
+		app.handleGetStorage(w, r, storage)
+	}).Methods("GET")
+	api.HandleFunc("/storage/config", storage.handleSetStorageConfig).Methods("PUT")
+	api.HandleFunc("/storage/compress", func(w http.ResponseWriter, r *http.Request) {
+		app.handleCompressStorage(w, r, storage)
+	}).Methods("POST")
+
+	// Cleanup endpoints
+	api.HandleFunc("/cleanup", cleanup.handleGetCleanup).Methods("GET")
+	api.HandleFunc("/cleanup/config", cleanup.handleSetCleanupConfig).Methods("PUT")
+	api.HandleFunc("/cleanup/preview", func(w http.ResponseWriter, r *http.Request) {
+		app.handleGetCleanupPreview(w, r, cleanup)
+	}).Methods("GET")
+
+	// Trash endpoints
+	api.HandleFunc("/trash", app.handleGetTrash).Methods("GET")
+	api.HandleFunc("/trash/config", app.handleSetTrashConfig).Methods("PUT")
+	api.HandleFunc("/trash/{id}/restore", func(w http.ResponseWriter, r *http.Request) {
+		app.handleRestoreServer(w, r, vlanManager)
+	}).Methods("POST")
+
+	// Settings endpoints
+	api.HandleFunc("/settings", app.handleGetGlobalSettings).Methods("GET")
+	api.HandleFunc("/headers", app.handleGetHeaderRules).Methods("GET")
+	api.HandleFunc("/search", app.handleSearch).Methods("GET")
+	api.HandleFunc("/events", app.events.handleGetEvents).Methods("GET")
+	api.HandleFunc("/events/stream", app.events.handleEventStream).Methods("GET")
+	api.HandleFunc("/notifications", app.handleGetNotifications).Methods("GET")
+	api.HandleFunc("/notifications", app.handleCreateNotification).Methods("POST")
+	api.HandleFunc("/notifications/{id}", app.handleUpdateNotification).Methods("PUT")
+	api.HandleFunc("/notifications/{id}", app.handleDeleteNotification).Methods("DELETE")
+	api.HandleFunc("/notifications/{id}/test", app.handleTestNotification).Methods("POST")
+	api.HandleFunc("/headers", app.handleSetHeaderRules).Methods("PUT")
+	api.HandleFunc("/settings", app.handleSetGlobalSettings).Methods("PUT")
+	api.HandleFunc("/settings/logging", storage.handleGetLogPolicy).Methods("GET")
+	api.HandleFunc("/settings/log-level", handleGetLogLevel).Methods("GET")
+	api.HandleFunc("/settings/log-level", handleSetLogLevel).Methods("PUT")
+	api.HandleFunc("/settings/logging", storage.handleSetLogPolicy).Methods("PUT")
+	api.HandleFunc("/settings/branding", app.handleGetBranding).Methods("GET")
+	api.HandleFunc("/i18n", catalog.handleGetLocales).Methods("GET")
+	api.HandleFunc("/i18n/{locale}", catalog.handleGetTranslations).Methods("GET")
+	api.HandleFunc("/settings/branding", app.handleSetBranding).Methods("PUT")
+	api.HandleFunc("/settings/readonly", app.handleGetReadOnly).Methods("GET")
+	api.HandleFunc("/settings/readonly", app.handleSetReadOnly).Methods("PUT")
+	api.HandleFunc("/settings/access", app.handleGetManagementAccess).Methods("GET")
+	api.HandleFunc("/settings/access", app.handleSetManagementAccess).Methods("PUT")
+	api.HandleFunc("/settings/manager", app.handleGetManagerOptions).Methods("GET")
+	api.HandleFunc("/settings/manager", func(w http.ResponseWriter, r *http.Request) {
+		app.handleSetManagerOptions(w, r, authMiddleware, vlanManager)
+	}).Methods("PUT")
+
+	// Config transfer endpoints
+	api.HandleFunc("/config/export", app.handleExportConfig).Methods("GET")
+	api.HandleFunc("/config/flush", app.handleFlushConfig).Methods("POST")
+	api.HandleFunc("/config/import", func(w http.ResponseWriter, r *http.Request) {
+		app.handleImportConfig(w, r, vlanManager)
+	}).Methods("POST")
+	api.HandleFunc("/plan", func(w http.ResponseWriter, r *http.Request) {
+		app.handlePlan(w, r, vlanManager)
+	}).Methods("POST")
+	api.HandleFunc("/apply", func(w http.ResponseWriter, r *http.Request) {
+		app.handleApply(w, r, vlanManager)
+	}).Methods("POST")
+
+	// Template endpoints
+	api.HandleFunc("/templates", app.handleGetTemplates).Methods("GET")
+	api.HandleFunc("/templates", app.handleCreateTemplate).Methods("POST")
+	api.HandleFunc("/templates/{id}", app.handleGetTemplate).Methods("GET")
+	api.HandleFunc("/templates/{id}", app.handleUpdateTemplate).Methods("PUT")
+	api.HandleFunc("/templates/{id}", app.handleDeleteTemplate).Methods("DELETE")
+
+	// Group endpoints
+	api.HandleFunc("/groups", app.handleGetGroups).Methods("GET")
+	api.HandleFunc("/groups", app.handleCreateGroup).Methods("POST")
+	api.HandleFunc("/groups/{id}", app.handleGetGroup).Methods("GET")
+	api.HandleFunc("/groups/{id}", app.handleUpdateGroup).Methods("PUT")
+	api.HandleFunc("/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		app.handleDeleteGroup(w, r, vlanManager)
+	}).Methods("DELETE")
+	api.HandleFunc("/groups/{id}/settings", app.handleSetGroupSettings).Methods("PUT")
+	api.HandleFunc("/groups/{id}/start", app.handleStartGroup).Methods("POST")
+	api.HandleFunc("/groups/{id}/stop", app.handleStopGroup).Methods("POST")
+
+	// Warning center endpoints
+	api.HandleFunc("/warnings", warnings.handleGetWarnings).Methods("GET")
+	api.HandleFunc("/warnings/{id}/acknowledge", warnings.handleAcknowledgeWarning).Methods("POST")
+	api.HandleFunc("/warnings/{id}", warnings.handleDismissWarning).Methods("DELETE")
+
 	// VLAN management endpoints
 	api.HandleFunc("/vlan/interfaces", vlanManager.handleGetInterfaces).Methods("GET")
 	api.HandleFunc("/vlan/status", vlanManager.handleGetStatus).Methods("GET")
-	
-	// Ensure the static directory exists
-	os.MkdirAll("static", 0755)
-	
-	// Create index.html if it doesn't exist
-	if _, err := os.Stat("static/index.html"); os.IsNotExist(err) {
-		if err := createIndexHTML(); err != nil {
-			log.Fatalf("Failed to create index.html: %v", err)
-		}
-	}
-	
+	api.HandleFunc("/runtime", app.handleGetRuntime).Methods("GET")
+	api.HandleFunc("/metrics", app.handleGetMetrics).Methods("GET")
+
+	// Push webhooks from git hosts authenticate with the hook's token and
+	// signature instead of a session
+	r.Handle("/hooks/{server}/{token}", requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.handleHook(w, r, freeze)
+	}))).Methods("POST")
+
+	// Liveness and readiness probes for orchestrators and uptime monitors
+	r.HandleFunc("/healthz", app.handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", app.handleReadyz).Methods("GET")
+
 	// Static files
-	r.PathPrefix("/").HandlerFunc(serveStatic)
+	r.PathPrefix("/").HandlerFunc(app.serveUI)
 
-	// Start web server on port 80
+	// Start web server on port 80, or on the Unix socket PSM_SOCKET names
+	// to keep the API off the network
 	port := ":80"
-	fmt.Printf("PHP Server Manager is running at http://localhost%s\n", port)
-	fmt.Println("Default password: admin123")
-	log.Fatal(http.ListenAndServe(port, r))
+	var listener net.Listener
+	if socketPath := os.Getenv("PSM_SOCKET"); socketPath != "" {
+		mode, err := parseSocketMode(os.Getenv("PSM_SOCKET_MODE"))
+		if err != nil {
+			fatal("%v", err)
+		}
+		if listener, err = listenUnixSocket(socketPath, mode); err != nil {
+			fatal("Failed to listen on %s: %v", socketPath, err)
+		}
+		logger.Info("PHP Server Manager is running", "socket", socketPath)
+	} else {
+		if !privileges.CanBindPrivilegedPorts() {
+			warnings.Add("privileges", "CAP_NET_BIND_SERVICE is missing; binding %s will likely fail", port)
+		}
+		logger.Info("PHP Server Manager is running", "url", "http://localhost"+port)
+	}
+
+	// Stop PHP processes and remove VLAN interfaces on SIGTERM or SIGINT
+	// instead of leaking them. A second signal exits at once.
+	shutdownTimeout := defaultShutdownTimeout
+	if value := os.Getenv("PSM_SHUTDOWN_TIMEOUT"); value != "" {
+		if shutdownTimeout, err = time.ParseDuration(value); err != nil || shutdownTimeout < 0 {
+			fatal("Invalid PSM_SHUTDOWN_TIMEOUT %q: use a duration such as 30s", value)
+		}
+	}
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+
+	server := &http.Server{Addr: port, Handler: r}
+	serveErr := make(chan error, 1)
+	go func() {
+		if listener != nil {
+			serveErr <- server.Serve(listener)
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+	app.SetReady(true)
+
+	exitCode := 0
+	select {
+	case <-signalCtx.Done():
+		logger.Info("shutting down", "timeout", shutdownTimeout.String())
+	case err := <-serveErr:
+		logger.Error("HTTP server failed", "error", err)
+		exitCode = 1
+	}
+	stopSignals()
+
+	// Let API requests finish, then stop the servers, remove the VLAN
+	// interfaces and write the configuration, in that order
+	app.SetReady(false)
+	app.events.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("API requests were cut off", "error", err)
+	}
+	cancel()
+
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	app.shutdown(ctx, vlanManager)
+	cancel()
+	logger.Info("shut down")
+	os.Exit(exitCode)
 }
 
 // createIndexHTML creates the index.html file for the web UI
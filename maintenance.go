@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// weekdayNames maps day abbreviations used in maintenance windows
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// errMaintenanceWindow describes the accepted syntax
+var errMaintenanceWindow = errors.New(`maintenance_window must look like "02:00-04:00" or "Mon-Fri 02:00-04:00; Sat,Sun 00:00-06:00"`)
+
+// maintenanceWindow is one daily time range on a set of weekdays. Times
+// are minutes since local midnight; a range may wrap past midnight, in
+// which case the days refer to the day the window opens.
+type maintenanceWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// parseWeekdays parses "Mon-Fri" or "Sat,Sun"
+func parseWeekdays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.ToLower(strings.TrimSpace(part)), "-", 2)
+		first, ok := weekdayNames[bounds[0]]
+		if !ok {
+			return days, errMaintenanceWindow
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdayNames[bounds[1]]; !ok {
+				return days, errMaintenanceWindow
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseMaintenanceWindows parses a list of windows separated by ";". Each
+// window is a time range "HH:MM-HH:MM", optionally preceded by weekdays.
+func parseMaintenanceWindows(spec string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, part := range strings.Split(spec, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errMaintenanceWindow
+		}
+
+		window := maintenanceWindow{days: [7]bool{true, true, true, true, true, true, true}}
+		if len(fields) == 2 {
+			days, err := parseWeekdays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.days = days
+		}
+
+		bounds := strings.Split(fields[len(fields)-1], "-")
+		if len(bounds) != 2 {
+			return nil, errMaintenanceWindow
+		}
+		for i, bound := range bounds {
+			t, err := time.Parse("15:04", bound)
+			if err != nil {
+				return nil, errMaintenanceWindow
+			}
+			if i == 0 {
+				window.start = t.Hour()*60 + t.Minute()
+			} else {
+				window.end = t.Hour()*60 + t.Minute()
+			}
+		}
+		if window.start == window.end {
+			return nil, fmt.Errorf("maintenance_window ranges must not be empty")
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// open reports whether now falls within the window
+func (mw maintenanceWindow) open(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	if mw.start < mw.end {
+		return mw.days[now.Weekday()] && minute >= mw.start && minute < mw.end
+	}
+	// Wrapping windows belong to the day they opened on
+	if minute >= mw.start {
+		return mw.days[now.Weekday()]
+	}
+	return minute < mw.end && mw.days[(now.Weekday()+6)%7]
+}
+
+// maintenanceWindowOpen reports whether now falls within any window of
+// spec. An empty spec places no restriction.
+func maintenanceWindowOpen(spec string, now time.Time) bool {
+	if spec == "" {
+		return true
+	}
+	windows, err := parseMaintenanceWindows(spec)
+	if err != nil {
+		return false
+	}
+	for _, window := range windows {
+		if window.open(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextMaintenanceWindow returns when a window of spec next opens after now,
+// searching one week ahead
+func nextMaintenanceWindow(spec string, now time.Time) (time.Time, bool) {
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	for end := now.Add(8 * 24 * time.Hour); t.Before(end); t = t.Add(time.Minute) {
+		if maintenanceWindowOpen(spec, t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// MaintenanceOpen reports whether automatic actions (restarts after a
+// crash or a runtime upgrade, scheduled operations) may touch a server at
+// time now. Manual operations are never restricted.
+func (a *App) MaintenanceOpen(id string, now time.Time) bool {
+	settings, exists := a.EffectiveSettings(id)
+	if !exists {
+		return false
+	}
+	return maintenanceWindowOpen(settings["maintenance_window"].Value, now)
+}
+
+// handleGetMaintenance reports a server's resolved maintenance window,
+// whether it is open and when it opens next
+func (a *App) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	settings, exists := a.EffectiveSettings(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	now := time.Now()
+	window := settings["maintenance_window"]
+	status := map[string]interface{}{
+		"window": window.Value,
+		"source": window.Source,
+		"open":   maintenanceWindowOpen(window.Value, now),
+	}
+	if !status["open"].(bool) {
+		if next, ok := nextMaintenanceWindow(window.Value, now); ok {
+			status["next_open"] = next
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultNetHelperSocket is where the network helper listens unless
+	// told otherwise
+	defaultNetHelperSocket = "/run/php-server-manager/net-helper.sock"
+	// netHelperTimeout bounds one command run by the network helper
+	netHelperTimeout = time.Minute
+)
+
+// netHelperRequest asks the network helper to run a command; an empty
+// argv only checks that it answers
+type netHelperRequest struct {
+	Argv []string `json:"argv"`
+}
+
+// netHelperResponse is the outcome of a command run by the network helper
+type netHelperResponse struct {
+	Output   string `json:"output"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"` // the command didn't run
+}
+
+// runNetHelperCommand implements the `net-helper` subcommand. Run as root
+// or with CAP_NET_ADMIN, it is the only privileged part of the manager:
+// it listens on a Unix socket only the manager's user may connect to and
+// runs the ip, sysctl and iptables invocations of the sudo allowlist, and
+// nothing else, on its behalf. `net-helper run -- ARGV` is how the manager
+// sends it one command.
+func runNetHelperCommand(args []string) int {
+	if len(args) > 0 && args[0] == "run" {
+		return runNetHelperClient(args[1:])
+	}
+
+	flags := flag.NewFlagSet("net-helper", flag.ExitOnError)
+	socketPath := flags.String("socket", defaultNetHelperSocket, "Unix socket to listen on")
+	username := flags.String("user", "", "user the manager runs as (required)")
+	flags.Parse(args)
+
+	if *username == "" {
+		fmt.Fprintln(os.Stderr, "net-helper: --user is required")
+		return 2
+	}
+	account, err := user.Lookup(*username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "net-helper: %v\n", err)
+		return 2
+	}
+	uid, _ := strconv.Atoi(account.Uid)
+	gid, _ := strconv.Atoi(account.Gid)
+
+	if err := os.MkdirAll(filepath.Dir(*socketPath), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "net-helper: %v\n", err)
+		return 1
+	}
+	listener, err := listenUnixSocket(*socketPath, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "net-helper: %v\n", err)
+		return 1
+	}
+	defer listener.Close()
+	if err := os.Chown(*socketPath, uid, gid); err != nil {
+		fmt.Fprintf(os.Stderr, "net-helper: %v\n", err)
+		return 1
+	}
+
+	logAttrs(context.Background(), slog.LevelInfo, "network helper is running", slog.String("socket", *socketPath), slog.String("user", *username))
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "net-helper: %v\n", err)
+			return 1
+		}
+		go serveNetHelperConn(conn.(*net.UnixConn), uid)
+	}
+}
+
+// peerUID returns the user ID of the process at the other end of a Unix
+// socket connection
+func peerUID(conn *net.UnixConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// serveNetHelperConn answers one request of the manager. Connections from
+// users other than the manager's and root are dropped, and commands
+// outside the allowlist are refused.
+func serveNetHelperConn(conn *net.UnixConn, allowedUID int) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(netHelperTimeout + 5*time.Second))
+
+	ctx := context.Background()
+	uid, err := peerUID(conn)
+	if err != nil || (uid != allowedUID && uid != 0) {
+		logAttrs(ctx, slog.LevelWarn, "network helper refused a connection", slog.Int("uid", uid))
+		return
+	}
+
+	var request netHelperRequest
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		return
+	}
+	response := netHelperResponse{}
+	switch {
+	case len(request.Argv) == 0:
+	case !sudoAllowed(request.Argv):
+		response.Error = "not in the allowlist"
+		response.ExitCode = 1
+		logAttrs(ctx, slog.LevelWarn, "network helper refused a command", slog.Any("argv", request.Argv))
+	default:
+		cmdCtx, cancel := context.WithTimeout(ctx, netHelperTimeout)
+		output, err := exec.CommandContext(cmdCtx, resolveBinary(request.Argv[0]), request.Argv[1:]...).CombinedOutput()
+		cancel()
+		response.Output = string(output)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			response.ExitCode = exitErr.ExitCode()
+		} else if err != nil {
+			response.Error = err.Error()
+			response.ExitCode = 1
+		}
+		logAttrs(ctx, slog.LevelInfo, "network helper ran a command", slog.Any("argv", request.Argv), slog.Int("exit_code", response.ExitCode))
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+// callNetHelper sends one request to the network helper
+func callNetHelper(socketPath string, argv []string) (netHelperResponse, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return netHelperResponse{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(netHelperTimeout + 10*time.Second))
+
+	if err := json.NewEncoder(conn).Encode(netHelperRequest{Argv: argv}); err != nil {
+		return netHelperResponse{}, err
+	}
+	var response netHelperResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return netHelperResponse{}, fmt.Errorf("network helper closed the connection; is the manager running as its --user?")
+	}
+	return response, nil
+}
+
+// pingNetHelper checks that the network helper answers the manager
+func pingNetHelper(socketPath string) error {
+	_, err := callNetHelper(socketPath, nil)
+	return err
+}
+
+// runNetHelperClient runs one command through the network helper, with
+// the command's output and exit code, like sudo would
+func runNetHelperClient(args []string) int {
+	flags := flag.NewFlagSet("net-helper run", flag.ExitOnError)
+	socketPath := flags.String("socket", defaultNetHelperSocket, "Unix socket of the network helper")
+	flags.Parse(args)
+
+	response, err := callNetHelper(*socketPath, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "net-helper: %v\n", err)
+		return 1
+	}
+	fmt.Fprint(os.Stdout, response.Output)
+	if response.Error != "" {
+		fmt.Fprintf(os.Stderr, "net-helper: %s\n", response.Error)
+	}
+	return response.ExitCode
+}
+
+// netHelperCommand builds a command that runs argv through the network
+// helper, refusing anything outside the allowlist. A refused command fails
+// when it is started.
+func netHelperCommand(socketPath string, argv ...string) *exec.Cmd {
+	self, err := os.Executable()
+	if err != nil {
+		cmd := exec.Command("false")
+		cmd.Err = err
+		return cmd
+	}
+	cmd := exec.Command(self, append([]string{"net-helper", "run", "--socket", socketPath, "--"}, argv...)...)
+	if !sudoAllowed(argv) {
+		cmd.Err = fmt.Errorf("refusing to run %q through the network helper: not in the allowlist", strings.Join(argv, " "))
+	}
+	return cmd
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// nodeTimeout bounds the calls the controller makes to aggregate nodes
+const nodeTimeout = 10 * time.Second
+
+// validNodeName restricts node names, which appear in URLs
+var validNodeName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Node is a manager on another host that this manager controls. Any
+// manager can be a node: it is reached through its own API, logging in
+// with its password.
+type Node struct {
+	Name     string    `json:"name"`
+	URL      string    `json:"url"`
+	Password string    `json:"password,omitempty"`
+	User     string    `json:"user,omitempty"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// Validate checks the node's name and URL
+func (n Node) Validate() error {
+	if !validNodeName.MatchString(n.Name) {
+		return fmt.Errorf("name must be lowercase letters, digits and dashes")
+	}
+	u, err := url.Parse(n.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL such as http://10.0.0.5")
+	}
+	if n.Password == "" {
+		return fmt.Errorf("password is required")
+	}
+	return nil
+}
+
+// NodeStatus is a node as listed by the API, without its password
+type NodeStatus struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	AddedAt   time.Time `json:"added_at"`
+	Reachable bool      `json:"reachable"`
+	Error     string    `json:"error,omitempty"`
+	Servers   int       `json:"servers"`
+	Running   int       `json:"running"`
+}
+
+// count marks the node reachable and counts its servers
+func (ns *NodeStatus) count(servers []*Server) {
+	ns.Reachable = true
+	ns.Servers = len(servers)
+	for _, server := range servers {
+		if server.Running {
+			ns.Running++
+		}
+	}
+}
+
+// nodeClient is the API client of one node. Its token is renewed with the
+// node's password, so calls through it are serialized.
+type nodeClient struct {
+	mu  sync.Mutex
+	api *cliClient
+}
+
+// NodeManager keeps the nodes in nodes.json below the config directory and
+// talks to them
+type NodeManager struct {
+	mu      sync.Mutex
+	path    string
+	nodes   map[string]*Node
+	clients map[string]*nodeClient
+	proxy   *http.Client
+}
+
+// NewNodeManager loads the nodes stored below baseDir
+func NewNodeManager(baseDir string) *NodeManager {
+	nm := &NodeManager{
+		path:    filepath.Join(baseDir, "nodes.json"),
+		nodes:   make(map[string]*Node),
+		clients: make(map[string]*nodeClient),
+		// Proxied requests include event streams, so only the request's
+		// context ends them
+		proxy: &http.Client{},
+	}
+
+	if data, err := ioutil.ReadFile(nm.path); err == nil {
+		json.Unmarshal(data, &nm.nodes)
+	}
+
+	return nm
+}
+
+// saveLocked persists the nodes; nm.mu must be held
+func (nm *NodeManager) saveLocked() error {
+	data, err := json.MarshalIndent(nm.nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(nm.path, data, 0600)
+}
+
+// Names returns the node names in order
+func (nm *NodeManager) Names() []string {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	names := make([]string, 0, len(nm.nodes))
+	for name := range nm.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Add stores a validated node, replacing one of the same name
+func (nm *NodeManager) Add(node Node) (Node, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	node.URL = strings.TrimSuffix(node.URL, "/")
+	node.AddedAt = time.Now()
+	nm.nodes[node.Name] = &node
+	delete(nm.clients, node.Name)
+	return node, nm.saveLocked()
+}
+
+// Delete removes a node
+func (nm *NodeManager) Delete(name string) (bool, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if _, exists := nm.nodes[name]; !exists {
+		return false, nil
+	}
+	delete(nm.nodes, name)
+	delete(nm.clients, name)
+	return true, nm.saveLocked()
+}
+
+// client returns the API client of a node
+func (nm *NodeManager) client(name string) (*nodeClient, bool) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	node, exists := nm.nodes[name]
+	if !exists {
+		return nil, false
+	}
+	client, exists := nm.clients[name]
+	if !exists {
+		client = &nodeClient{api: &cliClient{
+			baseURL:  node.URL,
+			password: node.Password,
+			user:     firstNonEmpty(node.User, defaultSessionUser),
+			client:   &http.Client{Timeout: nodeTimeout},
+		}}
+		nm.clients[name] = client
+	}
+	return client, true
+}
+
+// call sends a JSON request to a node's API and decodes the response into
+// out, logging in when the node asks for it
+func (nm *NodeManager) call(name, method, path string, body, out interface{}) error {
+	client, exists := nm.client(name)
+	if !exists {
+		return fmt.Errorf("node %s does not exist", name)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.api.do(method, path, body, out)
+}
+
+// forward sends a request to a node's API with the node's token. When the
+// token has expired it logs in again and repeats the request once. The
+// caller must close the response body.
+func (nm *NodeManager) forward(ctx context.Context, name, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	client, exists := nm.client(name)
+	if !exists {
+		return nil, fmt.Errorf("node %s does not exist", name)
+	}
+
+	send := func(token string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, client.api.baseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nm.proxy.Do(req)
+	}
+	token := func(renew bool) (string, error) {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		if renew || client.api.token == "" {
+			if _, err := client.api.authenticate(); err != nil {
+				return "", err
+			}
+		}
+		return client.api.token, nil
+	}
+
+	current, err := token(false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := send(current)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	if current, err = token(true); err != nil {
+		return nil, err
+	}
+	return send(current)
+}
+
+// Servers returns the servers of a node, each tagged with the node's name
+func (nm *NodeManager) Servers(name string) ([]*Server, error) {
+	servers := []*Server{}
+	if err := nm.call(name, "GET", "/servers", nil, &servers); err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		server.Node = name
+	}
+	return servers, nil
+}
+
+// AllServers asks every node for its servers at once. Nodes that fail are
+// returned with their error.
+func (nm *NodeManager) AllServers() (map[string][]*Server, map[string]string) {
+	names := nm.Names()
+	results := make([][]*Server, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], errs[i] = nm.Servers(name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	servers := make(map[string][]*Server)
+	failed := make(map[string]string)
+	for i, name := range names {
+		if errs[i] != nil {
+			failed[name] = errs[i].Error()
+			continue
+		}
+		servers[name] = results[i]
+	}
+	return servers, failed
+}
+
+// handleGetNodes lists the nodes with whether they can be reached and how
+// many servers they run
+func (nm *NodeManager) handleGetNodes(w http.ResponseWriter, r *http.Request) {
+	servers, failed := nm.AllServers()
+
+	nm.mu.Lock()
+	statuses := []NodeStatus{}
+	for name, node := range nm.nodes {
+		status := NodeStatus{Name: name, URL: node.URL, AddedAt: node.AddedAt, Error: failed[name]}
+		if list, reached := servers[name]; reached {
+			status.count(list)
+		}
+		statuses = append(statuses, status)
+	}
+	nm.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// handleAddNode registers a node, checking that it can be logged in to
+func (nm *NodeManager) handleAddNode(w http.ResponseWriter, r *http.Request) {
+	var node Node
+	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := node.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	probe := &cliClient{
+		baseURL:  strings.TrimSuffix(node.URL, "/"),
+		password: node.Password,
+		user:     firstNonEmpty(node.User, defaultSessionUser),
+		client:   &http.Client{Timeout: nodeTimeout},
+	}
+	if _, err := probe.authenticate(); err != nil {
+		writeError(w, http.StatusBadGateway, errCodeUpstream, fmt.Sprintf("Failed to log in to node %s: %v", node.Name, err))
+		return
+	}
+
+	node, err := nm.Add(node)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save node: %v", err))
+		return
+	}
+
+	status := NodeStatus{Name: node.Name, URL: node.URL, AddedAt: node.AddedAt}
+	if servers, err := nm.Servers(node.Name); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.count(servers)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleDeleteNode forgets a node; its servers keep running
+func (nm *NodeManager) handleDeleteNode(w http.ResponseWriter, r *http.Request) {
+	deleted, err := nm.Delete(mux.Vars(r)["node"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save nodes: %v", err))
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Node not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// proxiedHeaders are the request headers passed on to a node
+var proxiedHeaders = []string{"Accept", "Content-Type", "If-Match", "Last-Event-ID", "X-Request-ID"}
+
+// handleNodeProxy passes a request under /api/nodes/{node}/api/ on to the
+// node's own API, so everything a manager offers can be used on any node
+// through this one. Responses, including event streams, are passed back
+// as they arrive.
+func (nm *NodeManager) handleNodeProxy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path := "/api/" + vars["path"]
+	if r.URL.RawQuery != "" {
+		// The controller's own token must not reach the node
+		query := r.URL.Query()
+		query.Del("token")
+		path += "?" + query.Encode()
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	header := http.Header{}
+	for _, name := range proxiedHeaders {
+		if value := r.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	if header.Get("X-Request-ID") == "" {
+		header.Set("X-Request-ID", requestIDFromContext(r.Context()))
+	}
+
+	resp, err := nm.forward(r.Context(), vars["node"], r.Method, path, header, body)
+	if err != nil {
+		if _, exists := nm.client(vars["node"]); !exists {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "Node not found")
+			return
+		}
+		writeError(w, http.StatusBadGateway, errCodeUpstream, fmt.Sprintf("Node %s: %v", vars["node"], err))
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range []string{"Content-Type", "ETag", "Link", "X-Total-Count", "Cache-Control"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	// The node's answer is untrusted: opened in a browser it must not run
+	// script on the controller's origin
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleGetClusterServers lists the servers of this manager and of every
+// node. Servers of nodes carry the node's name in "node". ?q=, ?sort=,
+// ?order=, ?page= and ?per_page= work as for GET /api/servers; nodes that
+// can't be reached are listed in "unreachable".
+func (a *App) handleGetClusterServers(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseServerListOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	servers := []*Server{}
+	for _, id := range a.serverIDs() {
+		if server, exists := a.GetServer(id); exists {
+			servers = append(servers, &server)
+		}
+	}
+	remote, failed := a.nodes.AllServers()
+	for _, name := range a.nodes.Names() {
+		servers = append(servers, remote[name]...)
+	}
+
+	page, total := listServers(servers, opts)
+	writePageHeaders(w, r, opts, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"servers":     page,
+		"unreachable": failed,
+	})
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// notificationEvents are the server events channels can subscribe to
+var notificationEvents = map[string]bool{
+	"started":          true,
+	"stopped":          true,
+	"crashed":          true,
+	"health_failed":    true,
+	"health_recovered": true,
+}
+
+// Notification is one server event sent to the matching channels
+type Notification struct {
+	Event      string    `json:"event"`
+	ServerID   string    `json:"server_id"`
+	ServerName string    `json:"server_name"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// NotificationChannel is where notifications are sent. Slack and Discord
+// take an incoming webhook URL, "webhook" POSTs the notification as JSON
+// to any URL and "email" mails it to the given addresses via PSM_SMTP_*.
+type NotificationChannel struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"` // slack, discord, webhook or email
+	URL     string   `json:"url,omitempty"`
+	To      []string `json:"to,omitempty"`
+	Events  []string `json:"events,omitempty"`  // all events when empty
+	Servers []string `json:"servers,omitempty"` // all servers when empty
+}
+
+// Validate checks a channel's type, target and filters
+func (nc NotificationChannel) Validate() error {
+	if nc.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch nc.Type {
+	case "slack", "discord", "webhook":
+		target, err := url.Parse(nc.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("url must be an http(s) URL")
+		}
+	case "email":
+		if len(nc.To) == 0 {
+			return fmt.Errorf("to needs at least one address")
+		}
+		for _, address := range nc.To {
+			if !strings.Contains(address, "@") || strings.ContainsAny(address, "\r\n,<>") {
+				return fmt.Errorf("invalid email address %q", address)
+			}
+		}
+	default:
+		return fmt.Errorf("type must be slack, discord, webhook or email")
+	}
+
+	for _, event := range nc.Events {
+		if !notificationEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the channel subscribes to a notification
+func (nc NotificationChannel) wants(n Notification) bool {
+	return (len(nc.Events) == 0 || containsString(nc.Events, n.Event)) &&
+		(len(nc.Servers) == 0 || containsString(nc.Servers, n.ServerID))
+}
+
+// containsString reports whether list contains value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationState is the persisted list of channels
+type NotificationState struct {
+	NextID   int                   `json:"next_id"`
+	Channels []NotificationChannel `json:"channels"`
+}
+
+// Notifier stores channels in notifications.json below the config
+// directory and sends notifications to them in the background. Email is
+// sent through the server in PSM_SMTP_HOST (PSM_SMTP_PORT, default 587)
+// as PSM_SMTP_FROM, authenticating with PSM_SMTP_USERNAME and
+// PSM_SMTP_PASSWORD when set.
+type Notifier struct {
+	mu       sync.Mutex
+	path     string
+	state    NotificationState
+	client   *http.Client
+	warnings *WarningCenter
+}
+
+// NewNotifier loads the channels stored below baseDir
+func NewNotifier(baseDir string, warnings *WarningCenter) *Notifier {
+	n := &Notifier{
+		path:     filepath.Join(baseDir, "notifications.json"),
+		state:    NotificationState{NextID: 1, Channels: []NotificationChannel{}},
+		client:   &http.Client{Timeout: 10 * time.Second},
+		warnings: warnings,
+	}
+
+	if data, err := ioutil.ReadFile(n.path); err == nil {
+		json.Unmarshal(data, &n.state)
+	}
+
+	return n
+}
+
+// saveLocked persists the channels; n.mu must be held
+func (n *Notifier) saveLocked() error {
+	data, err := json.MarshalIndent(n.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(n.path, data, 0600)
+}
+
+// Channels returns all channels
+func (n *Notifier) Channels() []NotificationChannel {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]NotificationChannel{}, n.state.Channels...)
+}
+
+// Channel returns a channel by ID
+func (n *Notifier) Channel(id string) (NotificationChannel, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, channel := range n.state.Channels {
+		if channel.ID == id {
+			return channel, true
+		}
+	}
+	return NotificationChannel{}, false
+}
+
+// Add stores a validated channel and returns it with its ID
+func (n *Notifier) Add(channel NotificationChannel) (NotificationChannel, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	channel.ID = strconv.Itoa(n.state.NextID)
+	n.state.NextID++
+	n.state.Channels = append(n.state.Channels, channel)
+	return channel, n.saveLocked()
+}
+
+// Update replaces a validated channel
+func (n *Notifier) Update(channel NotificationChannel) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i := range n.state.Channels {
+		if n.state.Channels[i].ID == channel.ID {
+			n.state.Channels[i] = channel
+			return true, n.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// Delete removes a channel
+func (n *Notifier) Delete(id string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, channel := range n.state.Channels {
+		if channel.ID == id {
+			n.state.Channels = append(n.state.Channels[:i], n.state.Channels[i+1:]...)
+			return true, n.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// Notify sends a server event to every channel subscribed to it without
+// blocking the caller. Failures are raised as warnings. It is safe to call
+// on a nil notifier.
+func (n *Notifier) Notify(ctx context.Context, event, serverID, serverName, message string) {
+	if n == nil {
+		return
+	}
+
+	notification := Notification{
+		Event:      event,
+		ServerID:   serverID,
+		ServerName: serverName,
+		Message:    message,
+		Time:       time.Now(),
+		RequestID:  requestIDFromContext(ctx),
+	}
+	for _, channel := range n.Channels() {
+		if channel.wants(notification) {
+			go func(channel NotificationChannel) {
+				if err := n.send(channel, notification); err != nil {
+					n.warnings.AddContext(ctx, "notifications", "Error notifying %s (%s): %v", channel.Name, channel.Type, err)
+				}
+			}(channel)
+		}
+	}
+}
+
+// notificationText formats a notification for chat and email
+func notificationText(notification Notification) string {
+	return fmt.Sprintf("[%s] %s (server %s): %s", notification.Event, notification.ServerName, notification.ServerID, notification.Message)
+}
+
+// send delivers a notification to one channel
+func (n *Notifier) send(channel NotificationChannel, notification Notification) error {
+	var body interface{}
+	switch channel.Type {
+	case "slack":
+		body = map[string]string{"text": notificationText(notification)}
+	case "discord":
+		body = map[string]string{"content": notificationText(notification)}
+	case "webhook":
+		body = notification
+	case "email":
+		return sendNotificationMail(channel.To, notification)
+	default:
+		return fmt.Errorf("unknown channel type %q", channel.Type)
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(channel.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendNotificationMail mails a notification through the PSM_SMTP_* server
+func sendNotificationMail(to []string, notification Notification) error {
+	host := os.Getenv("PSM_SMTP_HOST")
+	if host == "" {
+		return fmt.Errorf("PSM_SMTP_HOST is not set")
+	}
+	port := os.Getenv("PSM_SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("PSM_SMTP_FROM")
+	if from == "" {
+		hostname, _ := os.Hostname()
+		from = "php-server-manager@" + hostname
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("PSM_SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("PSM_SMTP_PASSWORD"), host)
+	}
+
+	subject := fmt.Sprintf("[php-server-manager] %s %s", notification.ServerName, notification.Event)
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+		from, strings.Join(to, ", "), strings.NewReplacer("\r", " ", "\n", " ").Replace(subject), notification.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "%s\r\n\r\nTime: %s\r\n", notificationText(notification), notification.Time.Format(time.RFC3339))
+	if notification.RequestID != "" {
+		fmt.Fprintf(&message, "Request ID: %s\r\n", notification.RequestID)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(host, port), auth, from, to, message.Bytes())
+}
+
+// decodeNotificationChannel reads and validates a channel from a request
+func decodeNotificationChannel(w http.ResponseWriter, r *http.Request) (NotificationChannel, bool) {
+	var channel NotificationChannel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return channel, false
+	}
+	if err := channel.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return channel, false
+	}
+	return channel, true
+}
+
+// handleGetNotifications lists the notification channels
+func (a *App) handleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.notifier.Channels())
+}
+
+// handleCreateNotification adds a notification channel
+func (a *App) handleCreateNotification(w http.ResponseWriter, r *http.Request) {
+	channel, ok := decodeNotificationChannel(w, r)
+	if !ok {
+		return
+	}
+
+	channel, err := a.notifier.Add(channel)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save notification channel: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+// handleUpdateNotification replaces a notification channel
+func (a *App) handleUpdateNotification(w http.ResponseWriter, r *http.Request) {
+	channel, ok := decodeNotificationChannel(w, r)
+	if !ok {
+		return
+	}
+	channel.ID = mux.Vars(r)["id"]
+
+	updated, err := a.notifier.Update(channel)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save notification channel: %v", err))
+		return
+	}
+	if !updated {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Notification channel not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+// handleDeleteNotification removes a notification channel
+func (a *App) handleDeleteNotification(w http.ResponseWriter, r *http.Request) {
+	deleted, err := a.notifier.Delete(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save notification channels: %v", err))
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Notification channel not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTestNotification sends a test notification to one channel and
+// reports the result synchronously
+func (a *App) handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	channel, exists := a.notifier.Channel(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Notification channel not found")
+		return
+	}
+
+	notification := Notification{
+		Event:      "test",
+		ServerName: "php-server-manager",
+		Message:    "Test notification for channel " + channel.Name,
+		Time:       time.Now(),
+		RequestID:  requestIDFromContext(r.Context()),
+	}
+	if err := a.notifier.send(channel, notification); err != nil {
+		writeError(w, http.StatusBadGateway, errCodeUpstream, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// oneShotCommands act directly on the local state without starting the
+// web server, for cron jobs and shutdown scripts
+var oneShotCommands = map[string]bool{
+	"list":      true,
+	"start":     true,
+	"stop":      true,
+	"start-all": true,
+	"stop-all":  true,
+	"export":    true,
+}
+
+// runOneShotCommand runs a one-shot command. Servers it starts keep
+// running after it exits and are stopped again with stop or stop-all.
+func runOneShotCommand(app *App, args []string) int {
+	command := args[0]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	format := flags.String("format", "json", "export format: json or yaml")
+	output := flags.String("output", "", "write the export to this file instead of stdout")
+	flags.Parse(args[1:])
+
+	// The web server holds the database lock while it runs
+	if app.store == nil {
+		if _, err := os.Stat(filepath.Join(app.configDir, "state.db")); err == nil {
+			fmt.Fprintln(os.Stderr, "The state database is in use; the manager is probably running. Use the API client instead (e.g. \"servers start-all\").")
+			return 1
+		}
+	}
+	defer func() {
+		app.flushConfig()
+		if app.store != nil {
+			app.store.Close()
+		}
+	}()
+
+	privileges := detectPrivileges(os.Getenv("PSM_NET_HELPER"))
+	app.privileges = privileges
+	vlanManager := NewVLANManager(defaultIPv6Prefix)
+	vlanManager.warnings = app.warnings
+	vlanManager.privileges = privileges
+
+	var ids []string
+	switch command {
+	case "list":
+		return app.listOneShot()
+	case "export":
+		return app.exportOneShot(*format, *output)
+	case "start", "stop":
+		if flags.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s ID\n", command)
+			return 2
+		}
+		if _, exists := app.GetServer(flags.Arg(0)); !exists {
+			fmt.Fprintf(os.Stderr, "Server %s not found\n", flags.Arg(0))
+			return 1
+		}
+		ids = []string{flags.Arg(0)}
+	case "start-all", "stop-all":
+		ids = app.serverIDs()
+	}
+
+	failed := 0
+	for _, id := range ids {
+		var err error
+		if command == "start" || command == "start-all" {
+			err = app.startOneShot(id, vlanManager)
+		} else {
+			err = app.stopOneShot(id, vlanManager)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Server %s: %v\n", id, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// startOneShot starts a server unless its process is already running
+func (a *App) startOneShot(id string, vlanManager *VLANManager) error {
+	if pid, running := a.detachedPID(id); running {
+		fmt.Printf("Server %s is already running (pid %d)\n", id, pid)
+		return nil
+	}
+
+	server, _ := a.GetServer(id)
+	if server.VLANInterface != "" && a.privileges.CanManageVLANs() {
+		if _, err := vlanManager.RestoreVLANInterface(server.Port, server.VLANOptions); err != nil {
+			return err
+		}
+	}
+
+	if !a.StartServerContext(context.Background(), id) {
+		return fmt.Errorf("failed to start, see the warnings above")
+	}
+	pid, _ := a.detachedPID(id)
+	fmt.Printf("Started server %s on port %s (pid %d)\n", id, server.Port, pid)
+	return nil
+}
+
+// stopOneShot stops a server started by another process and removes its
+// VLAN interface
+func (a *App) stopOneShot(id string, vlanManager *VLANManager) error {
+	server, _ := a.GetServer(id)
+
+	pid, running := a.detachedPID(id)
+	if running {
+		if err := killProcessGroup(pid); err != nil {
+			return fmt.Errorf("failed to stop pid %d: %v", pid, err)
+		}
+		removePIDFile(serverPIDPath(a.configDir, id), pid)
+		if err := a.store.Record(id, "stopped", ""); err != nil {
+			a.warnings.Add("config", "Error recording history for server %s: %v", id, err)
+		}
+		fmt.Printf("Stopped server %s (pid %d)\n", id, pid)
+	}
+
+	if server.VLANInterface != "" && a.privileges.CanManageVLANs() {
+		if err := vlanManager.RemoveStaleInterface(server.Port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listOneShot prints the servers and whether their processes are running
+func (a *App) listOneShot() int {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPORT\tSTATUS\tPID\tDIRECTORY")
+	for _, id := range a.serverIDs() {
+		server, exists := a.GetServer(id)
+		if !exists {
+			continue
+		}
+		status, pidText := "stopped", "-"
+		if pid, running := a.detachedPID(id); running {
+			status, pidText = "running", fmt.Sprint(pid)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", id, server.Name, server.Port, status, pidText, server.Directory)
+	}
+	tw.Flush()
+	return 0
+}
+
+// exportOneShot writes the configuration export as JSON or YAML
+func (a *App) exportOneShot(format, output string) int {
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(a.ExportConfig(), "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = toYAML(a.ExportConfig())
+	default:
+		fmt.Fprintln(os.Stderr, "Format must be json or yaml")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding export: %v\n", err)
+		return 1
+	}
+
+	if output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := writeFileAtomic(output, data, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", output, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// opcachePath is where the status script answers on every server
+	opcachePath = "/.psm/opcache"
+	// opcacheTokenHeader carries the token that unlocks the script
+	opcacheTokenHeader = "X-PSM-Token"
+	// opcacheTimeout bounds one request to the script
+	opcacheTimeout = 10 * time.Second
+)
+
+// opcacheScript reports or resets the OPcache of the runtime it runs in.
+// FrankenPHP threads share one cache, so resetting it here clears the
+// bytecode of the whole site.
+const opcacheScript = `<?php
+// Generated by php-server-manager, changes are overwritten
+header('Content-Type: application/json');
+header('Cache-Control: no-store');
+if (!function_exists('opcache_get_status')) {
+    http_response_code(501);
+    echo json_encode(['error' => 'OPcache is not loaded']);
+    return;
+}
+if (($_GET['action'] ?? '') === 'reset') {
+    echo json_encode(['reset' => opcache_reset()]);
+    return;
+}
+$status = opcache_get_status(false);
+$configuration = opcache_get_configuration();
+echo json_encode([
+    'enabled' => $status !== false && ($status['opcache_enabled'] ?? false),
+    'status' => $status ?: null,
+    'directives' => $configuration['directives'] ?? null,
+]);
+`
+
+// serverScriptDir returns the directory of the scripts injected into a
+// server
+func serverScriptDir(baseDir, id string) string {
+	return filepath.Join(baseDir, "scripts", id)
+}
+
+// opcacheToken returns the token of a server's status script, creating it
+// on first use. It is kept on disk, outside the directory handed to the
+// server's user, so servers started before the manager restarted can still
+// be reached.
+func (a *App) opcacheToken(id string) (string, error) {
+	path := serverScriptDir(a.configDir, id) + ".opcache-token"
+	if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	token, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return token, writeFileAtomic(path, []byte(token), 0600)
+}
+
+// opcacheDirectives writes a server's status script and returns the
+// Caddyfile directives serving it at opcachePath to requests carrying the
+// token
+func (a *App) opcacheDirectives(id string) ([]string, error) {
+	token, err := a.opcacheToken(id)
+	if err != nil {
+		return nil, err
+	}
+	dir := serverScriptDir(a.configDir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "opcache.php"), []byte(opcacheScript), 0644); err != nil {
+		return nil, err
+	}
+
+	return []string{
+		"@psm_opcache {\n\t\tpath " + opcachePath + "\n\t\theader " + opcacheTokenHeader + " " + token + "\n\t}",
+		"handle @psm_opcache {\n\t\troot * " + caddyQuote(dir) + "\n\t\trewrite * /opcache.php\n\t\tphp\n\t}",
+	}, nil
+}
+
+// errOPcacheUnavailable means the runtime has no OPcache
+var errOPcacheUnavailable = errors.New("OPcache is not loaded in this runtime")
+
+// queryOPcache asks a running server's status script for the OPcache
+// status, or to reset the cache when action is "reset"
+func (a *App) queryOPcache(ctx context.Context, server Server, action string) (map[string]interface{}, error) {
+	token, err := a.opcacheToken(server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	url := serverBaseURL(server, a.serverUsesTLS(server.ID)) + opcachePath
+	if action != "" {
+		url += "?action=" + action
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(opcacheTokenHeader, token)
+	req.Header.Set(requestIDHeader, requestIDFromContext(ctx))
+
+	resp, err := newServerClient(opcacheTimeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		// Servers started before the script existed answer with the app
+		return nil, fmt.Errorf("the status script did not answer (%s); restart the server to add it", resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotImplemented {
+		return nil, errOPcacheUnavailable
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the status script responded with %s", resp.Status)
+	}
+	return result, nil
+}
+
+// opcacheServer returns the running server a request is about, or writes
+// the error
+func (a *App) opcacheServer(w http.ResponseWriter, r *http.Request) (Server, bool) {
+	server, exists := a.GetServer(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return server, false
+	}
+	if !server.Running {
+		writeError(w, http.StatusConflict, errCodeNotRunning, "Server is not running")
+		return server, false
+	}
+	return server, true
+}
+
+// writeOPcacheError reports a failed request to the status script
+func writeOPcacheError(w http.ResponseWriter, err error) {
+	if err == errOPcacheUnavailable {
+		writeError(w, http.StatusNotImplemented, errCodeUnavailable, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadGateway, errCodeUpstream, err.Error())
+}
+
+// handleGetOPcache reports the OPcache status and settings of a running
+// server
+func (a *App) handleGetOPcache(w http.ResponseWriter, r *http.Request) {
+	server, ok := a.opcacheServer(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := a.queryOPcache(r.Context(), server, "")
+	if err != nil {
+		writeOPcacheError(w, err)
+		return
+	}
+	result["server_id"] = server.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleResetOPcache clears the OPcache of a running server so freshly
+// deployed code is compiled again, without a restart
+func (a *App) handleResetOPcache(w http.ResponseWriter, r *http.Request) {
+	server, ok := a.opcacheServer(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := a.queryOPcache(r.Context(), server, "reset")
+	if err != nil {
+		writeOPcacheError(w, err)
+		return
+	}
+	if err := a.store.Record(server.ID, "opcache_reset", ""); err != nil {
+		a.warnings.AddContext(r.Context(), "config", "Error recording history for server %s: %v", server.ID, err)
+	}
+	result["server_id"] = server.ID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
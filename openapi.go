@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiOperation documents one endpoint. Request and Response are sample
+// values whose types are turned into JSON schemas.
+type apiOperation struct {
+	Summary  string
+	Tag      string
+	Query    map[string]string
+	Request  interface{}
+	Response interface{}
+	Public   bool
+}
+
+// apiDocs describes the API endpoints, keyed by "METHOD path". Routes are
+// read from the router, so endpoints missing here are still listed.
+// serverFilterDocs describes the filters accepted wherever servers are
+// selected
+var serverFilterDocs = map[string]string{
+	"label":          "Label selector, e.g. team=billing",
+	"group":          "Group ID",
+	"status":         "running or stopped",
+	"framework":      "Detected framework, e.g. laravel",
+	"crashed_within": "Only servers whose process exited within this duration, e.g. 24h",
+}
+
+// serverListDocs describes the search, sort and paging parameters of
+// server lists, on top of the filters
+var serverListDocs = map[string]string{
+	"q":        "Text the name, ID, port, directory, address or a label contains",
+	"sort":     "id, name, port or status",
+	"order":    "asc or desc",
+	"page":     "Page number from 1; every match when unset",
+	"per_page": "Page size (default 50, at most 500)",
+}
+
+var apiDocs = map[string]apiOperation{
+	"POST /api/auth/login": {Summary: "Log in with the admin password", Tag: "auth", Request: struct {
+		Password string `json:"password"`
+		User     string `json:"user"`
+	}{}, Response: map[string]string{}, Public: true},
+	"POST /api/auth/logout": {Summary: "Log out", Tag: "auth"},
+
+	"GET /api/servers":              {Summary: "List servers", Tag: "servers", Query: mergeStringMaps(serverFilterDocs, serverListDocs), Response: []Server{}},
+	"POST /api/servers":             {Summary: "Create a server with a VLAN interface", Tag: "servers", Request: ServerSpec{}, Response: map[string]string{}},
+	"POST /api/servers/validate":    {Summary: "Run all create checks without creating anything", Tag: "servers", Request: ServerSpec{}, Response: map[string][]ValidationProblem{}},
+	"POST /api/servers/start-all":   {Summary: "Start servers concurrently", Tag: "servers", Query: serverFilterDocs, Response: []BulkResult{}},
+	"POST /api/servers/stop-all":    {Summary: "Stop servers concurrently", Tag: "servers", Query: serverFilterDocs, Response: []BulkResult{}},
+	"GET /api/servers/{id}":         {Summary: "Get a server; its ETag header is needed to update or delete it", Tag: "servers", Response: Server{}},
+	"PUT /api/servers/{id}":         {Summary: "Update a server; requires If-Match with the server's ETag", Tag: "servers", Request: ServerSpec{}},
+	"DELETE /api/servers/{id}":      {Summary: "Move a server to the trash and delete its VLAN interface; requires If-Match with the server's ETag", Tag: "servers"},
+	"POST /api/servers/{id}/start":  {Summary: "Start a server", Tag: "servers", Query: map[string]string{"dry_run": "Only report the command line, environment, listen address and VLAN operations"}, Response: StartPlan{}},
+	"POST /api/servers/{id}/stop":   {Summary: "Stop a server", Tag: "servers"},
+	"POST /api/servers/{id}/reload": {Summary: "Replace a running server's process without dropping requests", Tag: "servers", Query: map[string]string{"drain": "how long the old process may finish its requests, 30s by default"}, Response: ReloadResult{}},
+	"GET /api/servers/{id}/detail":  {Summary: "Get a server's configuration, process state, VLAN interface, recent log lines, health and resource usage in one document", Tag: "servers", Query: map[string]string{"lines": "number of log lines, 50 by default"}, Response: ServerDetail{}},
+	"GET /api/servers/{id}/url":     {Summary: "List the URLs a running server can be opened at, with a QR code of the first", Tag: "servers", Query: map[string]string{"kind": "tunnel, public, lan, vlan or host: the URL the QR code encodes", "size": "QR code size in pixels, 256 by default", "format": "png to get the QR code alone as an image"}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/status":  {Summary: "Get whether a server is running and whether a restart is recommended", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/labels":  {Summary: "Replace server labels", Tag: "servers", Request: map[string]string{}, Response: map[string]string{}},
+	"PUT /api/servers/{id}/owner": {Summary: "Hand a server to another user (admins only)", Tag: "servers", Request: struct {
+		Owner string `json:"owner"`
+	}{}, Response: Server{}},
+	"POST /api/servers/{id}/clone": {Summary: "Duplicate a server onto a new port and VLAN", Tag: "servers", Request: struct {
+		Name      string `json:"name"`
+		Port      string `json:"port"`
+		Directory string `json:"directory"`
+	}{}, Response: map[string]string{}},
+	"PUT /api/servers/{id}/vlan-options":     {Summary: "Set VLAN interface options", Tag: "servers", Request: VLANOptions{}, Response: VLANOptions{}},
+	"PUT /api/servers/{id}/compression":      {Summary: "Configure response compression", Tag: "servers", Request: Compression{}, Response: Compression{}},
+	"PUT /api/servers/{id}/static-cache":     {Summary: "Configure Cache-Control headers for static assets", Tag: "servers", Request: StaticCache{}, Response: StaticCache{}},
+	"PUT /api/servers/{id}/limits":           {Summary: "Set CPU and memory limits enforced through cgroup v2", Tag: "servers", Request: ResourceLimits{}, Response: ResourceLimits{}},
+	"POST /api/servers/{id}/fix-permissions": {Summary: "Apply an ownership and permission policy to the document root", Tag: "servers", Query: map[string]string{"dry_run": "Only report what would change"}, Request: PermissionPolicy{}, Response: PermissionReport{}},
+	"PUT /api/servers/{id}/expiry": {Summary: "Make a server a preview server that expires (expires_at or ttl; null clears)", Tag: "servers", Request: struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+		TTL       string     `json:"ttl"`
+	}{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/tunnel": {Summary: "Get the server's public tunnel", Tag: "tunnels", Response: Tunnel{}},
+	"POST /api/servers/{id}/tunnel": {Summary: "Open a public tunnel to a running server", Tag: "tunnels", Request: struct {
+		Driver string `json:"driver"`
+	}{}, Response: Tunnel{}},
+	"DELETE /api/servers/{id}/tunnel": {Summary: "Close the server's tunnel", Tag: "tunnels"},
+	"GET /api/tunnels":                {Summary: "List open tunnels", Tag: "tunnels", Response: []Tunnel{}},
+	"PUT /api/servers/{id}/public": {Summary: "Forward the server's port on the home router through UPnP or NAT-PMP while it runs", Tag: "tunnels", Request: struct {
+		Public bool `json:"public"`
+	}{}},
+	"GET /api/servers/{id}/port-mapping":            {Summary: "Get the router port mapping of a public server", Tag: "tunnels", Response: PortMapping{}},
+	"GET /api/servers/{id}/history":                 {Summary: "Get the change history of a server", Tag: "servers", Query: map[string]string{"limit": "Maximum number of entries"}, Response: []HistoryEntry{}},
+	"GET /api/servers/{id}/timeline":                {Summary: "Get the timeline of a server", Tag: "servers", Query: map[string]string{"since": "Only events after this time (RFC 3339 or Unix milliseconds)", "limit": "Page size"}, Response: TimelinePage{}},
+	"GET /api/servers/{id}/stats":                   {Summary: "Get CPU, memory, open files and uptime of a server with samples from the last hour", Tag: "servers", Response: ServerStats{}},
+	"GET /api/servers/{id}/access-log":              {Summary: "Get the recent requests of a server", Tag: "servers", Query: map[string]string{"tail": "Number of requests (default 500)", "status": "Codes or classes, e.g. 404,5xx", "path": "Path prefix", "method": "Request method", "filter": "Text the line contains", "format": "combined for the Combined Log Format as text"}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/traffic":                 {Summary: "Get requests, bytes and active connections of a server per domain", Tag: "servers", Response: ServerTraffic{}},
+	"GET /api/servers/{id}/framework":               {Summary: "Detect the framework in the server directory and show the served root and rewrite rules", Tag: "servers", Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/worker":                  {Summary: "Show the server's FrankenPHP worker mode options", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/worker":                  {Summary: "Set the worker mode options (null turns worker mode off); they apply on the next start", Tag: "servers", Request: WorkerConfig{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/runtime":                 {Summary: "Show the backend that runs the server", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/runtime":                 {Summary: "Select the backend that runs the server (frankenphp, systemd, or docker with an image; null for frankenphp); it applies on the next start", Tag: "servers", Request: RuntimeConfig{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/container":               {Summary: "Status of a docker server's container as the Docker daemon reports it", Tag: "servers", Response: ContainerStatus{}},
+	"GET /api/servers/{id}/container/logs":          {Summary: "Last lines of a docker server's container output as plain text", Tag: "servers", Query: map[string]string{"lines": "number of lines, 200 by default"}},
+	"GET /api/servers/{id}/unit":                    {Summary: "State, restarts and resource usage of a systemd server's transient service", Tag: "servers", Response: UnitStatus{}},
+	"GET /api/servers/{id}/unit/logs":               {Summary: "Last journal lines of a systemd server's service as plain text", Tag: "servers", Query: map[string]string{"lines": "number of lines, 200 by default"}},
+	"GET /api/servers/{id}/database":                {Summary: "Show the server's database, its environment variables and container status", Tag: "servers", Query: map[string]string{"reveal": "true to show the password"}, Response: map[string]interface{}{}},
+	"POST /api/servers/{id}/database":               {Summary: "Provision a MySQL, MariaDB or PostgreSQL database for the server, in a container or as a schema on a shared server", Tag: "servers", Request: DatabaseRequest{}, Response: map[string]interface{}{}},
+	"DELETE /api/servers/{id}/database":             {Summary: "Drop the server's database with its data", Tag: "servers"},
+	"GET /api/servers/{id}/mail":                    {Summary: "Show the server's mail catching options, SMTP address and Mailpit UI link", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/mail":                    {Summary: "Catch the server's mail in a shared or dedicated Mailpit (null sends mail as usual); it applies on the next start", Tag: "servers", Request: MailConfig{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/redis":                   {Summary: "Show the server's Redis, its address and the variables the server gets", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/redis":                   {Summary: "Attach a shared or dedicated Redis to the server (null detaches it); it applies on the next start", Tag: "servers", Request: RedisConfig{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/watch":                   {Summary: "Show the server's watch mode and the changes the watcher saw", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/watch":                   {Summary: "Restart or reload the server when its files change (null turns it off)", Tag: "servers", Request: WatchConfig{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/lifecycle":               {Summary: "Show the server's lifecycle hooks and their latest runs", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/lifecycle":               {Summary: "Run commands before and after the server starts and stops (null removes them)", Tag: "servers", Request: LifecycleHooks{}, Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/workers":                 {Summary: "List the server's worker processes with the state of their copies", Tag: "servers", Response: []WorkerStatus{}},
+	"POST /api/servers/{id}/workers":                {Summary: "Add a long-running process, such as a queue worker, that starts and stops with the server", Tag: "servers", Request: WorkerProcess{}, Response: WorkerStatus{}},
+	"PUT /api/servers/{id}/workers/{name}":          {Summary: "Replace a worker process; it restarts when the server runs", Tag: "servers", Request: WorkerProcess{}, Response: WorkerStatus{}},
+	"DELETE /api/servers/{id}/workers/{name}":       {Summary: "Stop a worker process and remove it from the server", Tag: "servers"},
+	"POST /api/servers/{id}/workers/{name}/restart": {Summary: "Restart the copies of a worker process of a running server", Tag: "servers", Response: WorkerStatus{}},
+	"GET /api/servers/{id}/workers/{name}/logs":     {Summary: "Last lines a worker process wrote, as plain text", Tag: "servers", Query: map[string]string{"lines": "number of lines, 200 by default"}},
+	"GET /api/servers/{id}/access":                  {Summary: "Show the basic auth users and IP allow-list protecting the server's site, without password hashes", Tag: "servers", Response: AccessConfig{}},
+	"PUT /api/servers/{id}/access":                  {Summary: "Protect the server's site with basic auth users and an IP allow-list, or remove the protection with null; it applies on the next start or reload", Tag: "servers", Request: AccessConfig{}, Response: AccessConfig{}},
+	"GET /api/servers/{id}/php-ini":                 {Summary: "Show the server's php.ini directives", Tag: "servers", Response: map[string]string{}},
+	"PUT /api/servers/{id}/php-ini":                 {Summary: "Replace the server's php.ini directives; they apply on the next start", Tag: "servers", Request: map[string]string{}, Response: map[string]string{}},
+	"GET /api/servers/{id}/opcache":                 {Summary: "Show the OPcache status and settings of a running server", Tag: "servers", Response: map[string]interface{}{}},
+	"POST /api/servers/{id}/opcache/reset":          {Summary: "Clear the OPcache of a running server without restarting it", Tag: "servers", Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/debug":                   {Summary: "Show the server's xdebug options", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/debug":                   {Summary: "Configure xdebug for the server; a running server is restarted", Tag: "servers", Request: DebugConfig{}, Response: map[string]interface{}{}},
+	"POST /api/servers/{id}/debug/enable":           {Summary: "Switch xdebug on, restarting the server when it is running", Tag: "servers", Response: map[string]interface{}{}},
+	"POST /api/servers/{id}/debug/disable":          {Summary: "Switch xdebug off, restarting the server when it is running", Tag: "servers", Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/dotenv":                  {Summary: "Show the keys of the server's .env with secret values masked and check APP_URL against the server", Tag: "servers", Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/headers":                 {Summary: "Show the server's response header rules and the rules merged with the global ones", Tag: "servers", Response: map[string]interface{}{}},
+	"PUT /api/servers/{id}/headers":                 {Summary: "Replace the server's response header rules", Tag: "servers", Request: []HeaderRule{}, Response: []HeaderRule{}},
+	"PUT /api/servers/{id}/git":                     {Summary: "Set the git repository the server is deployed from (null clears it)", Tag: "deploys", Request: GitSource{}, Response: Server{}},
+	"POST /api/servers/{id}/deploy": {Summary: "Deploy the head of the server's branch, or roll back to a previously deployed commit", Tag: "deploys", Request: struct {
+		Commit   string `json:"commit"`
+		Rollback bool   `json:"rollback"`
+	}{}, Response: Deployment{}},
+	"GET /api/servers/{id}/deploys": {Summary: "List the server's deploys, newest first", Tag: "deploys", Response: []Deployment{}},
+	"POST /api/servers/{id}/backup": {Summary: "Back up the server's document root and, optionally, a dump of its database", Tag: "deploys", Request: struct {
+		Database bool   `json:"database"`
+		Note     string `json:"note"`
+	}{}, Response: Backup{}},
+	"GET /api/servers/{id}/backups":           {Summary: "List the server's backups, newest first", Tag: "deploys", Response: []Backup{}},
+	"POST /api/servers/{id}/restore/{backup}": {Summary: "Replace the document root, and database, with a backup; restarts a running server", Tag: "deploys", Response: map[string]interface{}{}},
+	"GET /api/backups/config":                 {Summary: "Show how many backups per server are kept", Tag: "deploys", Response: map[string]int{}},
+	"PUT /api/backups/config": {Summary: "Set how many backups per server are kept", Tag: "deploys", Request: struct {
+		Keep int `json:"keep"`
+	}{}, Response: map[string]int{}},
+	"GET /api/servers/{id}/health": {Summary: "Show the result of the server's latest health checks", Tag: "servers", Response: HealthStatus{}},
+	"GET /api/servers/{id}/hooks":  {Summary: "List the server's push webhooks with their URLs", Tag: "deploys", Response: []map[string]interface{}{}},
+	"POST /api/servers/{id}/hooks": {Summary: "Create a push webhook that deploys or restarts the server; the secret is only returned here", Tag: "deploys", Request: struct {
+		Action string `json:"action"`
+		Branch string `json:"branch"`
+	}{}, Response: map[string]interface{}{}},
+	"DELETE /api/servers/{id}/hooks/{hook}":          {Summary: "Delete a webhook", Tag: "deploys"},
+	"GET /api/servers/{id}/hooks/{hook}/deliveries":  {Summary: "List the webhook's deliveries, newest first", Tag: "deploys", Response: []HookDelivery{}},
+	"GET /api/servers/{id}/tasks":                    {Summary: "List the server's scheduled tasks with their next and last runs", Tag: "tasks", Response: []TaskStatus{}},
+	"POST /api/servers/{id}/tasks":                   {Summary: "Schedule a command in the server directory", Tag: "tasks", Request: TaskRequest{}, Response: TaskStatus{}},
+	"PUT /api/servers/{id}/tasks/{task}":             {Summary: "Replace a task; enabled false pauses it", Tag: "tasks", Request: TaskRequest{}, Response: TaskStatus{}},
+	"DELETE /api/servers/{id}/tasks/{task}":          {Summary: "Delete a task and its runs", Tag: "tasks"},
+	"POST /api/servers/{id}/tasks/{task}/run":        {Summary: "Run a task now and return the run", Tag: "tasks", Response: TaskRun{}},
+	"GET /api/servers/{id}/tasks/{task}/runs":        {Summary: "List the task's runs with their output, newest first", Tag: "tasks", Response: []TaskRun{}},
+	"PUT /api/servers/{id}/settings":                 {Summary: "Replace server settings", Tag: "settings", Request: Settings{}, Response: Settings{}},
+	"GET /api/servers/{id}/effective-settings":       {Summary: "Resolve settings and show where each value came from", Tag: "settings", Response: map[string]EffectiveSetting{}},
+	"GET /api/servers/{id}/maintenance":              {Summary: "Show the server's maintenance window and whether it is open", Tag: "settings", Response: map[string]interface{}{}},
+	"GET /api/servers/{id}/certificate":              {Summary: "Show uploaded certificate details", Tag: "certificates", Response: CertificateInfo{}},
+	"PUT /api/servers/{id}/certificate":              {Summary: "Upload a certificate", Tag: "certificates", Request: CertificateBundle{}, Response: CertificateInfo{}},
+	"DELETE /api/servers/{id}/certificate":           {Summary: "Remove the uploaded certificate", Tag: "certificates"},
+	"GET /api/servers/{id}/certificates":             {Summary: "List the server's and its domains' certificates", Tag: "certificates", Response: []CertificateInfo{}},
+	"GET /api/servers/{id}/certificates/{domain}":    {Summary: "Show a domain's certificate details", Tag: "certificates", Response: CertificateInfo{}},
+	"PUT /api/servers/{id}/certificates/{domain}":    {Summary: "Upload a certificate for a domain", Tag: "certificates", Request: CertificateBundle{}, Response: CertificateInfo{}},
+	"DELETE /api/servers/{id}/certificates/{domain}": {Summary: "Remove a domain's certificate", Tag: "certificates"},
+
+	"GET /api/events":                   {Summary: "List recent lifecycle events", Tag: "system", Query: map[string]string{"since": "Only events after this time (RFC 3339 or Unix milliseconds)", "after": "Only events after this ID", "type": "Types or kinds such as server, separated by commas", "server": "Server ID", "limit": "Maximum number of events (default 100)"}, Response: []Event{}},
+	"GET /api/events/stream":            {Summary: "Stream lifecycle events as Server-Sent Events", Tag: "system", Query: map[string]string{"type": "Types or kinds such as server, separated by commas", "server": "Server ID", "last_event_id": "Replay events after this ID, as the Last-Event-ID header does", "token": "Session token, for clients that can't set headers"}},
+	"GET /api/search":                   {Summary: "Search servers, groups, users and recent events", Tag: "system", Query: map[string]string{"q": "Text to find", "type": "Only server, group, user or event results", "limit": "Maximum number of results (default 20)"}, Response: map[string]interface{}{}},
+	"GET /api/notifications":            {Summary: "List notification channels", Tag: "notifications", Response: []NotificationChannel{}},
+	"POST /api/notifications":           {Summary: "Add a Slack, Discord, webhook or email channel with event and server filters", Tag: "notifications", Request: NotificationChannel{}, Response: NotificationChannel{}},
+	"PUT /api/notifications/{id}":       {Summary: "Replace a notification channel", Tag: "notifications", Request: NotificationChannel{}, Response: NotificationChannel{}},
+	"DELETE /api/notifications/{id}":    {Summary: "Delete a notification channel", Tag: "notifications"},
+	"POST /api/notifications/{id}/test": {Summary: "Send a test notification to a channel", Tag: "notifications"},
+	"GET /api/headers":                  {Summary: "List the global response header rules", Tag: "settings", Response: []HeaderRule{}},
+	"PUT /api/headers":                  {Summary: "Replace the global response header rules", Tag: "settings", Request: []HeaderRule{}, Response: []HeaderRule{}},
+	"GET /api/settings":                 {Summary: "Get global settings", Tag: "settings", Response: Settings{}},
+	"GET /api/settings/logging":         {Summary: "Get the log rotation and retention policy", Tag: "settings", Response: LogPolicy{}},
+	"PUT /api/settings/logging":         {Summary: "Change the log rotation and retention policy", Tag: "settings", Request: LogPolicy{}, Response: LogPolicy{}},
+	"GET /api/settings/branding":        {Summary: "Get the title, logo, theme, color and footer of the web UI", Tag: "settings", Response: Branding{}},
+	"PUT /api/settings/branding":        {Summary: "White-label the web UI; empty fields keep the defaults", Tag: "settings", Request: Branding{}, Response: Branding{}},
+	"GET /api/settings/manager":         {Summary: "Session lifetime, log level, VLAN range, health-check interval and default runtime", Tag: "settings", Response: ManagerOptions{}},
+	"PUT /api/settings/manager":         {Summary: "Change manager options without a restart; fields left out keep their value", Tag: "settings", Request: ManagerOptions{}, Response: ManagerOptions{}},
+	"GET /api/settings/access":          {Summary: "Show which client addresses may use the API and UI", Tag: "settings", Response: ManagementAccess{}},
+	"PUT /api/settings/access":          {Summary: "Restrict the API and UI to client addresses; refused with 409 when it would lock out the caller", Tag: "settings", Request: ManagementAccess{}, Response: ManagementAccess{}},
+	"GET /api/settings/readonly":        {Summary: "Show whether mutating requests are rejected", Tag: "settings", Response: ReadOnlyState{}},
+	"PUT /api/settings/readonly": {Summary: "Turn read-only mode on or off", Tag: "settings", Request: struct {
+		ReadOnly bool `json:"read_only"`
+	}{}, Response: ReadOnlyState{}},
+	"GET /api/i18n":                 {Summary: "List the locales of the web UI and the default one", Tag: "settings", Response: map[string]interface{}{}, Public: true},
+	"GET /api/i18n/{locale}":        {Summary: "Get the web UI strings of a locale; English fills in missing strings and unknown locales get the default one", Tag: "settings", Response: map[string]interface{}{}, Public: true},
+	"GET /api/settings/log-level":   {Summary: "Get the manager's log level", Tag: "settings", Response: map[string]string{}},
+	"PUT /api/settings/log-level":   {Summary: "Change the manager's log level until it restarts", Tag: "settings", Request: map[string]string{}, Response: map[string]string{}},
+	"PUT /api/settings":             {Summary: "Replace global settings", Tag: "settings", Request: Settings{}, Response: Settings{}},
+	"PUT /api/groups/{id}/settings": {Summary: "Replace group settings", Tag: "settings", Request: Settings{}, Response: Settings{}},
+
+	"GET /api/templates":         {Summary: "List templates", Tag: "templates", Response: []Template{}},
+	"POST /api/templates":        {Summary: "Create a template", Tag: "templates", Request: Template{}, Response: map[string]string{}},
+	"GET /api/templates/{id}":    {Summary: "Get a template", Tag: "templates", Response: Template{}},
+	"PUT /api/templates/{id}":    {Summary: "Update a template", Tag: "templates", Request: Template{}},
+	"DELETE /api/templates/{id}": {Summary: "Delete a template", Tag: "templates"},
+
+	"GET /api/groups":             {Summary: "List groups", Tag: "groups", Response: []Group{}},
+	"POST /api/groups":            {Summary: "Create a group", Tag: "groups", Request: groupRequest{}, Response: map[string]string{}},
+	"GET /api/groups/{id}":        {Summary: "Get a group", Tag: "groups", Response: Group{}},
+	"PUT /api/groups/{id}":        {Summary: "Update a group", Tag: "groups", Request: groupRequest{}},
+	"DELETE /api/groups/{id}":     {Summary: "Delete a group", Tag: "groups", Query: map[string]string{"servers": "true to also delete the group's servers"}, Response: []BulkResult{}},
+	"POST /api/groups/{id}/start": {Summary: "Start all servers in a group", Tag: "groups", Response: []BulkResult{}},
+	"POST /api/groups/{id}/stop":  {Summary: "Stop all servers in a group", Tag: "groups", Response: []BulkResult{}},
+
+	"GET /api/config/export":  {Summary: "Export servers, groups, templates and settings", Tag: "config", Query: map[string]string{"format": "json or yaml"}, Response: ConfigExport{}},
+	"POST /api/plan":          {Summary: "Show what importing an export would change, without changing anything", Tag: "config", Query: map[string]string{"mode": "merge or replace", "output": "text for a human-readable plan"}, Request: ConfigExport{}, Response: ConfigPlan{}},
+	"POST /api/apply":         {Summary: "Converge to a desired-state document: create, update and delete servers, groups and templates, and restart what needs it", Tag: "config", Query: map[string]string{"plan_only": "true to only compute the plan", "output": "text for a human-readable plan"}, Request: ConfigExport{}, Response: ApplyReport{}},
+	"POST /api/config/import": {Summary: "Import an export", Tag: "config", Query: map[string]string{"mode": "merge or replace", "dry_run": "true to only validate"}, Request: ConfigExport{}, Response: ImportReport{}},
+	"POST /api/config/flush":  {Summary: "Write pending configuration changes", Tag: "config"},
+
+	"GET /api/storage": {Summary: "Storage usage and archival history", Tag: "storage", Response: map[string]interface{}{}},
+	"PUT /api/storage/config": {Summary: "Set the archive age", Tag: "storage", Request: struct {
+		ArchiveAfterDays int `json:"archive_after_days"`
+	}{}, Response: StorageState{}},
+	"POST /api/storage/compress": {Summary: "Archive old logs and releases now", Tag: "storage", Response: map[string]int64{}},
+
+	"GET /api/cleanup": {Summary: "Retention policy and archives of expired servers", Tag: "storage", Response: CleanupState{}},
+	"PUT /api/cleanup/config": {Summary: "Set how long archives of expired servers are kept", Tag: "storage", Request: struct {
+		RetentionDays int `json:"retention_days"`
+	}{}, Response: CleanupState{}},
+	"GET /api/cleanup/preview": {Summary: "Servers the next cleanup run will archive and archives it will purge", Tag: "storage", Response: CleanupPreview{}},
+
+	"GET /api/trash": {Summary: "Deleted servers kept for restoring and the retention period", Tag: "servers", Response: TrashState{}},
+	"PUT /api/trash/config": {Summary: "Set how long deleted servers are kept", Tag: "servers", Request: struct {
+		RetentionDays int `json:"retention_days"`
+	}{}, Response: TrashState{}},
+	"POST /api/trash/{id}/restore": {Summary: "Restore a deleted server with its VLAN interface", Tag: "servers", Response: Server{}},
+
+	"POST /api/system/fsck":        {Summary: "Check stored state for problems", Tag: "system", Query: map[string]string{"fix": "true to apply automatic repairs"}, Response: []FsckIssue{}},
+	"GET /api/system/capabilities": {Summary: "Show detected privileges and features", Tag: "system", Response: map[string]interface{}{}},
+	"GET /api/system/sudoers":      {Summary: "Generate a minimal sudoers snippet", Tag: "system", Query: map[string]string{"user": "User the manager runs as"}},
+	"GET /api/system/freeze":       {Summary: "Show the emergency freeze state", Tag: "system", Response: FreezeState{}},
+	"POST /api/system/freeze":      {Summary: "Block all mutating operations", Tag: "system", Request: freezeRequest{}, Response: FreezeState{}},
+	"POST /api/system/unfreeze":    {Summary: "Lift the freeze", Tag: "system", Request: freezeRequest{}, Response: FreezeState{}},
+	"GET /api/system/audit":        {Summary: "List recent audit entries", Tag: "system", Query: map[string]string{"limit": "Maximum number of entries"}, Response: []AuditEntry{}},
+	"GET /api/annotations":         {Summary: "List server lifecycle annotations", Tag: "system", Query: map[string]string{"from": "Start time", "to": "End time", "server": "Server ID", "event": "Event name"}, Response: []Annotation{}},
+
+	"GET /api/warnings":                   {Summary: "List background failures", Tag: "warnings", Query: map[string]string{"all": "true to include acknowledged warnings"}, Response: []Warning{}},
+	"POST /api/warnings/{id}/acknowledge": {Summary: "Acknowledge a warning", Tag: "warnings"},
+	"DELETE /api/warnings/{id}":           {Summary: "Dismiss a warning", Tag: "warnings"},
+	"GET /api/vlan/interfaces":            {Summary: "List VLAN interfaces", Tag: "vlan", Response: []VLANInterface{}},
+	"GET /api/vlan/status":                {Summary: "VLAN status with link state and counters", Tag: "vlan", Response: map[string]interface{}{}},
+	"GET /api/runtime":                    {Summary: "Installed PHP runtime and servers still running an older one", Tag: "system", Response: map[string]interface{}{}},
+	"GET /api/metrics":                    {Summary: "Traffic counters of all servers in the Prometheus text format", Tag: "system"},
+	"GET /api/fs/browse":                  {Summary: "List allowed base directories or the subdirectories of one", Tag: "system", Query: map[string]string{"path": "Absolute directory below an allowed base path", "hidden": "true to include dot directories"}, Response: BrowseListing{}},
+	"GET /api/nodes":                      {Summary: "List the nodes with their reachability and server counts", Tag: "nodes", Response: []NodeStatus{}},
+	"POST /api/nodes":                     {Summary: "Register a manager on another host as a node", Tag: "nodes", Request: Node{}, Response: NodeStatus{}},
+	"DELETE /api/nodes/{node}":            {Summary: "Forget a node; its servers keep running", Tag: "nodes"},
+	"GET /api/nodes/{node}/api/{path}":    {Summary: "Call the API of a node, e.g. /api/nodes/lab2/api/servers", Tag: "nodes"},
+	"POST /api/nodes/{node}/api/{path}":   {Summary: "Call the API of a node", Tag: "nodes"},
+	"PUT /api/nodes/{node}/api/{path}":    {Summary: "Call the API of a node", Tag: "nodes"},
+	"PATCH /api/nodes/{node}/api/{path}":  {Summary: "Call the API of a node", Tag: "nodes"},
+	"DELETE /api/nodes/{node}/api/{path}": {Summary: "Call the API of a node", Tag: "nodes"},
+	"GET /api/cluster/servers":            {Summary: "List the servers of this manager and every node", Tag: "nodes", Query: serverListDocs, Response: map[string]interface{}{}},
+	"GET /api/reservations":               {Summary: "List ports and addresses reserved for external systems", Tag: "reservations", Response: []Reservation{}},
+	"POST /api/reservations":              {Summary: "Reserve ports and/or IPv6 addresses so servers are never assigned them", Tag: "reservations", Request: Reservation{}, Response: Reservation{}},
+	"DELETE /api/reservations/{id}":       {Summary: "Release a reservation", Tag: "reservations"},
+	"GET /api/views":                      {Summary: "List the current user's saved views", Tag: "views", Response: []SavedView{}},
+	"PUT /api/views/{name}":               {Summary: "Save a named server filter for the current user", Tag: "views", Request: SavedView{}, Response: SavedView{}},
+	"DELETE /api/views/{name}":            {Summary: "Delete a saved view", Tag: "views"},
+	"GET /api/views/{name}/servers":       {Summary: "List the servers a saved view matches", Tag: "views", Query: serverListDocs, Response: []Server{}},
+	"GET /api/openapi.json":               {Summary: "This document", Tag: "docs", Public: true},
+	"GET /api/docs":                       {Summary: "Swagger UI", Tag: "docs", Public: true},
+}
+
+// schemaBuilder converts Go types to OpenAPI schemas, collecting named
+// structs as components
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the schema for t, registering named structs
+func (sb *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return sb.schema(t.Elem())
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.object(t)
+		}
+		name := t.Name()
+		if _, exists := sb.components[name]; !exists {
+			// Reserve the name first so recursive types terminate
+			sb.components[name] = nil
+			sb.components[name] = sb.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object returns the inline object schema of a struct
+func (sb *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	sb.addFields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// addFields adds the JSON fields of a struct, flattening embedded structs
+func (sb *schemaBuilder) addFields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			sb.addFields(field.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = sb.schema(field.Type)
+	}
+}
+
+// pathParam matches {name} segments in route templates
+var pathParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// buildOpenAPI describes every route registered on router
+func buildOpenAPI(router *mux.Router) map[string]interface{} {
+	sb := &schemaBuilder{components: make(map[string]interface{})}
+	errorSchema := sb.schema(reflect.TypeOf(struct {
+		Error APIError `json:"error"`
+	}{}))
+	paths := make(map[string]map[string]interface{})
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := pathParam.ReplaceAllString(template, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+
+		for _, method := range methods {
+			doc, documented := apiDocs[method+" "+path]
+			if !documented {
+				doc.Summary = method + " " + path
+			}
+
+			parameters := []interface{}{}
+			for _, match := range pathParam.FindAllStringSubmatch(template, -1) {
+				parameters = append(parameters, map[string]interface{}{
+					"name": match[1], "in": "path", "required": true,
+					"schema": map[string]string{"type": "string"},
+				})
+			}
+			queryNames := make([]string, 0, len(doc.Query))
+			for name := range doc.Query {
+				queryNames = append(queryNames, name)
+			}
+			sort.Strings(queryNames)
+			for _, name := range queryNames {
+				parameters = append(parameters, map[string]interface{}{
+					"name": name, "in": "query", "description": doc.Query[name],
+					"schema": map[string]string{"type": "string"},
+				})
+			}
+
+			success := map[string]interface{}{"description": "Success"}
+			if doc.Response != nil {
+				success["content"] = map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": sb.schema(reflect.TypeOf(doc.Response))},
+				}
+			}
+
+			operation := map[string]interface{}{
+				"summary":    doc.Summary,
+				"parameters": parameters,
+				"responses": map[string]interface{}{
+					"200": success,
+					"default": map[string]interface{}{
+						"description": "Error",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{"schema": errorSchema},
+						},
+					},
+				},
+			}
+			if doc.Tag != "" {
+				operation["tags"] = []string{doc.Tag}
+			}
+			if doc.Request != nil {
+				operation["requestBody"] = map[string]interface{}{
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": sb.schema(reflect.TypeOf(doc.Request))},
+					},
+				}
+			}
+			if doc.Public {
+				operation["security"] = []interface{}{}
+			}
+			paths[path][strings.ToLower(method)] = operation
+		}
+		return nil
+	})
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "PHP Server Manager API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": sb.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string][]string{"bearerAuth": {}}},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document generated from router
+func handleOpenAPI(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildOpenAPI(router))
+	}
+}
+
+// swaggerUIPage loads Swagger UI from a CDN and points it at the document
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>PHP Server Manager API</title>
+    <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+    <script>
+        SwaggerUIBundle({ url: '/api/openapi.json', dom_id: '#swagger-ui' });
+    </script>
+</body>
+</html>
+`
+
+// handleDocs serves Swagger UI
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minSessionTTL and maxSessionTTL bound session_ttl
+	minSessionTTL = 5 * time.Minute
+	maxSessionTTL = 30 * 24 * time.Hour
+)
+
+// ManagerOptions are settings of the manager itself that apply while it
+// runs. Empty values keep the defaults. health_interval and
+// default_runtime are the global health_interval and php_version
+// settings, which servers and groups may override.
+type ManagerOptions struct {
+	SessionTTL     string `json:"session_ttl,omitempty"`     // lifetime of new logins, 24h by default
+	LogLevel       string `json:"log_level,omitempty"`       // PSM_LOG_LEVEL or info by default
+	VLANRange      string `json:"vlan_range,omitempty"`      // VLAN IDs, and so ports, that get interfaces; 1-4094 by default
+	HealthInterval string `json:"health_interval,omitempty"` // how often servers are probed, 30s by default
+	DefaultRuntime string `json:"default_runtime,omitempty"` // PHP version servers run, system by default
+}
+
+// parseVLANRange reads a VLAN ID range such as 100-999
+func parseVLANRange(value string) (int, int, error) {
+	if value == "" {
+		return 1, maxVLANID, nil
+	}
+	from, to, _ := strings.Cut(value, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, fmt.Errorf("vlan_range must look like 100-999")
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, fmt.Errorf("vlan_range must look like 100-999")
+	}
+	if first < 1 || last > maxVLANID || first > last {
+		return 0, 0, fmt.Errorf("vlan_range must lie within 1-%d", maxVLANID)
+	}
+	return first, last, nil
+}
+
+// Validate checks the options that are set
+func (o ManagerOptions) Validate() error {
+	if o.SessionTTL != "" {
+		ttl, err := time.ParseDuration(o.SessionTTL)
+		if err != nil || ttl < minSessionTTL || ttl > maxSessionTTL {
+			return fmt.Errorf("session_ttl must be a duration between 5m and 720h")
+		}
+	}
+	if o.LogLevel != "" {
+		if _, err := parseLogLevel(o.LogLevel); err != nil {
+			return err
+		}
+	}
+	if _, _, err := parseVLANRange(o.VLANRange); err != nil {
+		return err
+	}
+	if o.DefaultRuntime != "" && !validPHPVersion.MatchString(o.DefaultRuntime) {
+		return fmt.Errorf("default_runtime must be system or a version such as 8.3")
+	}
+	return Settings{HealthInterval: o.HealthInterval}.Validate()
+}
+
+// ManagerOptions returns the manager options
+func (a *App) ManagerOptions() ManagerOptions {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	options := a.managerOptions
+	options.HealthInterval = a.settings.HealthInterval
+	options.DefaultRuntime = a.settings.PHPVersion
+	return options
+}
+
+// SetManagerOptions stores validated options and applies them to logins,
+// logging and VLAN allocation
+func (a *App) SetManagerOptions(options ManagerOptions, auth *AuthMiddleware, vlanManager *VLANManager) {
+	a.mu.Lock()
+	a.settings.HealthInterval = options.HealthInterval
+	a.settings.PHPVersion = options.DefaultRuntime
+	stored := options
+	stored.HealthInterval, stored.DefaultRuntime = "", ""
+	a.managerOptions = stored
+	a.requestSave()
+	a.mu.Unlock()
+
+	applyManagerOptions(options, auth, vlanManager)
+}
+
+// applyManagerOptions puts the options that live outside the App into
+// effect; they were validated when they were set
+func applyManagerOptions(options ManagerOptions, auth *AuthMiddleware, vlanManager *VLANManager) {
+	ttl := defaultSessionTTL
+	if parsed, err := time.ParseDuration(options.SessionTTL); err == nil {
+		ttl = parsed
+	}
+	auth.SetSessionTTL(ttl)
+
+	level := slog.LevelInfo
+	if name := firstNonEmpty(options.LogLevel, os.Getenv("PSM_LOG_LEVEL")); name != "" {
+		if parsed, err := parseLogLevel(name); err == nil {
+			level = parsed
+		}
+	}
+	logLevel.Set(level)
+
+	if first, last, err := parseVLANRange(options.VLANRange); err == nil {
+		vlanManager.SetVLANRange(first, last)
+	}
+}
+
+// handleGetManagerOptions shows the manager options
+func (a *App) handleGetManagerOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.ManagerOptions())
+}
+
+// handleSetManagerOptions changes manager options without a restart
+// ({"session_ttl": "8h", "vlan_range": "100-999"}). Fields left out keep
+// their value; an empty string restores the default.
+func (a *App) handleSetManagerOptions(w http.ResponseWriter, r *http.Request, auth *AuthMiddleware, vlanManager *VLANManager) {
+	options := a.ManagerOptions()
+	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := options.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	a.SetManagerOptions(options, auth, vlanManager)
+	logAttrs(r.Context(), slog.LevelInfo, "manager options changed", slog.Any("options", options))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
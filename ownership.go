@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// memberRoutes are the routes besides those of their own servers that
+// users who are not admins may call. Everything else, such as groups,
+// settings, imports and the trash, spans servers of all owners and is
+// left to admins.
+var memberRoutes = map[string]bool{
+	"GET /api/servers":             true, // lists only their servers
+	"POST /api/servers":            true,
+	"POST /api/servers/validate":   true,
+	"POST /api/auth/logout":        true,
+	"GET /api/templates":           true,
+	"GET /api/templates/{id}":      true,
+	"GET /api/runtime":             true,
+	"GET /api/system/capabilities": true,
+	"GET /api/settings/branding":   true,
+	"GET /api/views":               true,
+	"PUT /api/views/{name}":        true,
+	"DELETE /api/views/{name}":     true,
+	"GET /api/fs/browse":           true, // confined to the browse roots
+}
+
+// adminOnlyServerRoutes are server routes that even the owner of a server
+// may not call. Tasks, lifecycle hooks and worker processes run shell
+// commands, so only admins may set them; owners may still run and remove
+// them.
+var adminOnlyServerRoutes = map[string]bool{
+	"PUT /api/servers/{id}/owner":          true,
+	"POST /api/servers/{id}/tasks":         true,
+	"PUT /api/servers/{id}/tasks/{task}":   true,
+	"PUT /api/servers/{id}/lifecycle":      true,
+	"POST /api/servers/{id}/workers":       true,
+	"PUT /api/servers/{id}/workers/{name}": true,
+}
+
+// parseAdmins reads the comma-separated PSM_ADMINS user list, which is
+// just admin when unset
+func parseAdmins(value string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, user := range strings.Split(value, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			admins[user] = true
+		}
+	}
+	if len(admins) == 0 {
+		admins[defaultSessionUser] = true
+	}
+	return admins
+}
+
+// isAdmin reports whether a user sees and manages every server
+func (a *App) isAdmin(user string) bool {
+	return a.admins[user]
+}
+
+// ownsServer reports whether a user may see and manage a server. Servers
+// without an owner, such as those created before owners were recorded,
+// belong to the admins.
+func (a *App) ownsServer(user string, server Server) bool {
+	return a.isAdmin(user) || (server.Owner != "" && server.Owner == user)
+}
+
+// ownedServerIDs keeps the IDs of the servers a user owns
+func (a *App) ownedServerIDs(user string, ids []string) []string {
+	if a.isAdmin(user) {
+		return ids
+	}
+	owned := []string{}
+	for _, id := range ids {
+		if server, exists := a.GetServer(id); exists && a.ownsServer(user, server) {
+			owned = append(owned, id)
+		}
+	}
+	return owned
+}
+
+// ownershipMiddleware confines users who are not admins to their own
+// servers. The servers of others answer 404 as if they didn't exist, and
+// routes that aren't about one server are refused with 403 unless listed
+// in memberRoutes.
+func (a *App) ownershipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if a.isAdmin(user) || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		action := r.Method + " " + r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				action = r.Method + " " + template
+			}
+		}
+		if memberRoutes[action] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if id, isServer := mux.Vars(r)["id"]; isServer && strings.HasPrefix(action, r.Method+" /api/servers/{id}") {
+			server, exists := a.GetServer(id)
+			if exists && !a.ownsServer(user, server) {
+				writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+				return
+			}
+			if !adminOnlyServerRoutes[action] {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Only admins may use "+action)
+	})
+}
+
+// refuseRunAsUser answers 403 when a user who isn't an admin picks the
+// system user a server runs as, which could be root; it reports whether
+// it did
+func (a *App) refuseRunAsUser(w http.ResponseWriter, r *http.Request) bool {
+	if a.isAdmin(userFromContext(r.Context())) {
+		return false
+	}
+	writeError(w, http.StatusForbidden, errCodeForbidden, "Only admins may set run_as_user")
+	return true
+}
+
+// handleSetServerOwner hands a server to another user ({"owner": "alice"});
+// an empty owner leaves it to the admins
+func (a *App) handleSetServerOwner(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var request struct {
+		Owner string `json:"owner"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	request.Owner = strings.TrimSpace(request.Owner)
+
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	if exists {
+		server.Owner = request.Owner
+		a.requestSave()
+	}
+	a.mu.Unlock()
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	logAttrs(r.Context(), slog.LevelInfo, "owner changed", slog.String("server", id), slog.String("owner", request.Owner))
+
+	updated, _ := a.GetServer(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
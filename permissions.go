@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+// maxListedPermissionChanges bounds the changes listed in a response; the
+// totals always cover every path
+const maxListedPermissionChanges = 1000
+
+// defaultWritableDirs are the directories frameworks write to at runtime
+var defaultWritableDirs = []string{"storage", "bootstrap/cache", "var", "wp-content/uploads", "writable"}
+
+// PermissionPolicy describes the ownership and modes a document root
+// should have. Modes are octal strings; empty fields use the defaults.
+type PermissionPolicy struct {
+	Owner            string   `json:"owner,omitempty"` // defaults to the server's run_as_user
+	Group            string   `json:"group,omitempty"` // defaults to the owner's primary group
+	DirMode          string   `json:"dir_mode,omitempty"`
+	FileMode         string   `json:"file_mode,omitempty"`
+	WritableDirs     []string `json:"writable_dirs,omitempty"` // relative to the document root
+	WritableDirMode  string   `json:"writable_dir_mode,omitempty"`
+	WritableFileMode string   `json:"writable_file_mode,omitempty"`
+}
+
+// withDefaults fills in unset fields
+func (pp PermissionPolicy) withDefaults() PermissionPolicy {
+	if pp.DirMode == "" {
+		pp.DirMode = "0750"
+	}
+	if pp.FileMode == "" {
+		pp.FileMode = "0640"
+	}
+	if pp.WritableDirs == nil {
+		pp.WritableDirs = defaultWritableDirs
+	}
+	if pp.WritableDirMode == "" {
+		pp.WritableDirMode = "0770"
+	}
+	if pp.WritableFileMode == "" {
+		pp.WritableFileMode = "0660"
+	}
+	return pp
+}
+
+// parseFileMode parses an octal permission string such as "0750"
+func parseFileMode(name, value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%s must be an octal mode such as 0750", name)
+	}
+	return os.FileMode(mode), nil
+}
+
+// PermissionChange is one path whose ownership or mode differs from the
+// policy
+type PermissionChange struct {
+	Path      string `json:"path"`
+	OwnerFrom string `json:"owner_from,omitempty"`
+	OwnerTo   string `json:"owner_to,omitempty"`
+	ModeFrom  string `json:"mode_from,omitempty"`
+	ModeTo    string `json:"mode_to,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PermissionReport is the result of checking or repairing a document root
+type PermissionReport struct {
+	ServerID  string             `json:"server_id"`
+	Directory string             `json:"directory"`
+	DryRun    bool               `json:"dry_run"`
+	Policy    PermissionPolicy   `json:"policy"`
+	Checked   int                `json:"checked"`
+	Changed   int                `json:"changed"`
+	Failed    int                `json:"failed"`
+	Changes   []PermissionChange `json:"changes"`
+	Truncated bool               `json:"truncated,omitempty"`
+}
+
+// permissionTarget is the resolved form of a policy
+type permissionTarget struct {
+	uid, gid                          int
+	owner                             string
+	dirMode, fileMode                 os.FileMode
+	writableDirMode, writableFileMode os.FileMode
+	writable                          []string
+}
+
+// resolvePolicy validates a policy and resolves its user and group
+func resolvePolicy(policy PermissionPolicy, directory, runAsUser string) (permissionTarget, error) {
+	var target permissionTarget
+	var err error
+	if target.dirMode, err = parseFileMode("dir_mode", policy.DirMode); err != nil {
+		return target, err
+	}
+	if target.fileMode, err = parseFileMode("file_mode", policy.FileMode); err != nil {
+		return target, err
+	}
+	if target.writableDirMode, err = parseFileMode("writable_dir_mode", policy.WritableDirMode); err != nil {
+		return target, err
+	}
+	if target.writableFileMode, err = parseFileMode("writable_file_mode", policy.WritableFileMode); err != nil {
+		return target, err
+	}
+
+	for _, dir := range policy.WritableDirs {
+		clean := filepath.Clean(dir)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return target, fmt.Errorf("writable_dirs must be relative to the document root: %q", dir)
+		}
+		target.writable = append(target.writable, filepath.Join(directory, clean))
+	}
+
+	owner := policy.Owner
+	if owner == "" {
+		owner = runAsUser
+	}
+	account, err := lookupRunAccount(owner)
+	if err != nil {
+		return target, err
+	}
+	target.owner, target.uid, target.gid = account.name, int(account.uid), int(account.gid)
+	if policy.Group != "" {
+		group, err := user.LookupGroup(policy.Group)
+		if err != nil {
+			return target, fmt.Errorf("group %s does not exist", policy.Group)
+		}
+		if target.gid, err = strconv.Atoi(group.Gid); err != nil {
+			return target, fmt.Errorf("group %s has a non-numeric gid", policy.Group)
+		}
+		target.owner += ":" + policy.Group
+	}
+	return target, nil
+}
+
+// writableAt reports whether path is one of the writable directories or
+// below one
+func (pt permissionTarget) writableAt(path string) bool {
+	for _, dir := range pt.writable {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantedMode returns the mode path should have. Executable files keep
+// their execute bits for the owner and group.
+func (pt permissionTarget) wantedMode(path string, info os.FileInfo) os.FileMode {
+	writable := pt.writableAt(path)
+	if info.IsDir() {
+		if writable {
+			return pt.writableDirMode
+		}
+		return pt.dirMode
+	}
+	mode := pt.fileMode
+	if writable {
+		mode = pt.writableFileMode
+	}
+	if info.Mode().Perm()&0111 != 0 {
+		mode |= (mode & 0440) >> 2
+	}
+	return mode
+}
+
+// describeOwner formats a uid and gid as names where they resolve
+func describeOwner(uid, gid int) string {
+	owner, group := strconv.Itoa(uid), strconv.Itoa(gid)
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return owner + ":" + group
+}
+
+// FixPermissions compares the document root of a server against the
+// policy and, unless dryRun is set, applies the differences. Symbolic
+// links are neither followed nor changed.
+func (a *App) FixPermissions(id string, policy PermissionPolicy, dryRun bool) (PermissionReport, bool, error) {
+	server, exists := a.GetServer(id)
+	if !exists {
+		return PermissionReport{}, false, nil
+	}
+
+	// The document root itself may be a symlink, e.g. to the live release
+	root, err := filepath.EvalSymlinks(server.Directory)
+	if err != nil {
+		return PermissionReport{}, true, err
+	}
+
+	policy = policy.withDefaults()
+	target, err := resolvePolicy(policy, root, a.runAsUser(server))
+	if err != nil {
+		return PermissionReport{}, true, err
+	}
+	canChown := a.privileges.Root
+
+	report := PermissionReport{ServerID: id, Directory: root, DryRun: dryRun, Policy: policy, Changes: []PermissionChange{}}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		// Unreadable entries are reported and skipped
+		if err != nil {
+			report.Failed++
+			if len(report.Changes) < maxListedPermissionChanges {
+				report.Changes = append(report.Changes, PermissionChange{Path: path, Error: err.Error()})
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		report.Checked++
+
+		change := PermissionChange{Path: path}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && canChown && (int(stat.Uid) != target.uid || int(stat.Gid) != target.gid) {
+			change.OwnerFrom = describeOwner(int(stat.Uid), int(stat.Gid))
+			change.OwnerTo = describeOwner(target.uid, target.gid)
+		}
+		if mode := target.wantedMode(path, info); info.Mode().Perm() != mode {
+			change.ModeFrom = fmt.Sprintf("%04o", info.Mode().Perm())
+			change.ModeTo = fmt.Sprintf("%04o", mode)
+		}
+		if change.OwnerTo == "" && change.ModeTo == "" {
+			return nil
+		}
+
+		if !dryRun {
+			if change.OwnerTo != "" {
+				if err := os.Lchown(path, target.uid, target.gid); err != nil {
+					change.Error = err.Error()
+				}
+			}
+			if change.ModeTo != "" && change.Error == "" {
+				if err := os.Chmod(path, target.wantedMode(path, info)); err != nil {
+					change.Error = err.Error()
+				}
+			}
+		}
+
+		report.Changed++
+		if change.Error != "" {
+			report.Failed++
+		}
+		if len(report.Changes) < maxListedPermissionChanges {
+			report.Changes = append(report.Changes, change)
+		} else {
+			report.Truncated = true
+		}
+		return nil
+	})
+
+	if !dryRun && report.Changed > 0 {
+		details := fmt.Sprintf("%d path(s) changed to %s %s/%s", report.Changed-report.Failed, target.owner, policy.DirMode, policy.FileMode)
+		if err := a.store.Record(id, "permissions_fixed", details); err != nil {
+			a.warnings.Add("config", "Error recording history for server %s: %v", id, err)
+		}
+	}
+	return report, true, nil
+}
+
+// handleFixPermissions applies a permission policy to a server's document
+// root; ?dry_run=true only reports what would change
+func (a *App) handleFixPermissions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	var policy PermissionPolicy
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	// Members may only fix the files of their server as its own user
+	if !a.isAdmin(userFromContext(r.Context())) {
+		if policy.Owner != "" || policy.Group != "" {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "Only admins may choose the owner and group")
+			return
+		}
+		if server, exists := a.GetServer(id); exists && !withinBrowseRoots(server.Directory) {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "The server directory is outside the allowed directories")
+			return
+		}
+	}
+
+	report, exists, err := a.FixPermissions(id, policy, dryRun)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// validIniDirective matches php.ini directive names such as memory_limit
+// or opcache.enable
+var validIniDirective = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// validatePHPIni checks a server's php.ini directives
+func validatePHPIni(directives map[string]string) error {
+	for name, value := range directives {
+		if !validIniDirective.MatchString(name) {
+			return fmt.Errorf("invalid php.ini directive %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("php.ini directive %s: value must be a single line", name)
+		}
+	}
+	return nil
+}
+
+// phpIniFile returns directives as ini lines in name order. Values are
+// written as given so constant expressions such as E_ALL & ~E_NOTICE keep
+// working; quote strings with special characters yourself.
+func phpIniFile(directives map[string]string) string {
+	names := make([]string, 0, len(directives))
+	for name := range directives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"; Generated by php-server-manager, changes are overwritten"}
+	for _, name := range names {
+		lines = append(lines, name+"="+directives[name])
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// serverPHPDir returns the directory of the ini files generated for a
+// server
+func serverPHPDir(baseDir, id string) string {
+	return filepath.Join(baseDir, "php", id)
+}
+
+// writePHPIni regenerates a server's ini directory from its php.ini
+// directives and debug options and returns it, or "" when the server
+// needs no extra settings
+func (a *App) writePHPIni(server Server) (string, error) {
+	dir := serverPHPDir(a.configDir, server.ID)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+
+	files := make(map[string]string)
+	if len(server.PHPIni) > 0 {
+		files["80-overrides.ini"] = phpIniFile(server.PHPIni)
+	}
+	if server.Debug.Enabled {
+		files["90-xdebug.ini"] = server.Debug.ini()
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// SetPHPIni replaces the php.ini directives of a server
+func (a *App) SetPHPIni(id string, directives map[string]string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.PHPIni = directives
+
+	a.requestSave()
+	return true
+}
+
+// handleGetPHPIni shows the php.ini directives of a server
+func (a *App) handleGetPHPIni(w http.ResponseWriter, r *http.Request) {
+	server, exists := a.GetServer(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	directives := server.PHPIni
+	if directives == nil {
+		directives = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(directives)
+}
+
+// handleSetPHPIni replaces the php.ini directives of a server. They take
+// effect the next time the server starts.
+func (a *App) handleSetPHPIni(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var directives map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&directives); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := validatePHPIni(directives); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if !a.SetPHPIni(id, directives) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	if directives == nil {
+		directives = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(directives)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// processPollInterval is how often re-attached processes are checked
+const processPollInterval = 2 * time.Second
+
+// reconcileInterval is how often queued automatic restarts are retried
+const reconcileInterval = 30 * time.Second
+
+// ProcessRecord identifies the process of a server. StartTicks is the
+// process start time from /proc/<pid>/stat; together with the PID it tells
+// a live server apart from an unrelated process that reused the PID.
+type ProcessRecord struct {
+	PID        int       `json:"pid"`
+	StartTicks uint64    `json:"start_ticks,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// serverPIDPath returns the PID file of a server's process
+func serverPIDPath(configDir, id string) string {
+	return filepath.Join(configDir, "run", id+".pid")
+}
+
+// processStartTicks returns the start time of a process in clock ticks
+// since boot
+func processStartTicks(pid int) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces; fields resume after its ')'
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// writePIDFile records the process of a server
+func writePIDFile(path string, pid int) error {
+	record := ProcessRecord{PID: pid, StartedAt: time.Now()}
+	record.StartTicks, _ = processStartTicks(pid)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// readPIDFile returns the process recorded in path
+func readPIDFile(path string) (ProcessRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ProcessRecord{}, err
+	}
+
+	var record ProcessRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.PID <= 0 {
+		return ProcessRecord{}, fmt.Errorf("invalid PID file %s", path)
+	}
+	return record, nil
+}
+
+// removePIDFile removes path if it still records pid, so a late exit of
+// an old process does not remove the PID file of its replacement
+func removePIDFile(path string, pid int) {
+	if record, err := readPIDFile(path); err == nil && record.PID == pid {
+		os.Remove(path)
+	}
+}
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Alive reports whether the recorded process is still running and has
+// not been replaced by another process with the same PID
+func (pr ProcessRecord) Alive() bool {
+	if !processAlive(pr.PID) {
+		return false
+	}
+	if pr.StartTicks == 0 {
+		return true
+	}
+	ticks, err := processStartTicks(pr.PID)
+	return err != nil || ticks == pr.StartTicks
+}
+
+// killProcessGroup kills a server's process together with any children
+// it spawned. Servers are started in their own process group, whose ID is
+// the PID of the started process.
+func killProcessGroup(pid int) error {
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		err = syscall.Kill(pid, syscall.SIGKILL)
+	}
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// detachedPID returns the PID of a server process that is not a child of
+// this manager, such as one started by a one-shot command
+func (a *App) detachedPID(id string) (int, bool) {
+	record, err := readPIDFile(serverPIDPath(a.configDir, id))
+	if err != nil || !record.Alive() {
+		return 0, false
+	}
+	return record.PID, true
+}
+
+// processExited clears the running state of a server once its process
+// is gone, unless the server has been stopped or restarted in the
+// meantime. Depending on the server's restart_policy the exit queues an
+// automatic restart; failed is false for a clean exit.
+func (a *App) processExited(id string, pid int, failed bool) {
+	removePIDFile(serverPIDPath(a.configDir, id), pid)
+
+	a.mu.Lock()
+	if a.processes[id] != pid {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.processes, id)
+	name := ""
+	if server, exists := a.servers[id]; exists {
+		server.Running = false
+		name = server.Name
+	}
+	a.mu.Unlock()
+
+	a.runtime.Forget(id)
+	a.health.Forget(id)
+	a.tunnels.Close(id)
+	a.portMappings.Close(id)
+	a.fileWatcher.Unwatch(id)
+	a.supervisor.StopAll(id)
+	removeServerCgroup(id)
+	if a.certs != nil {
+		a.certs.RemoveKeyFiles(id)
+	}
+	if err := a.reloads.Clear(id); err != nil {
+		a.warnings.Add("server", "Error removing the reload rules of server %s: %v", id, err)
+	}
+
+	details := "exited cleanly"
+	if failed {
+		details = "exited with an error"
+	}
+	level := slog.LevelInfo
+	if failed {
+		level = slog.LevelWarn
+	}
+	logAttrs(context.Background(), level, "exit", slog.String("server", id), slog.Int("pid", pid), slog.Bool("failed", failed))
+	if err := a.store.Record(id, "exited", details); err != nil {
+		a.warnings.Add("config", "Error recording history for server %s: %v", id, err)
+	}
+	// Nobody stopped it, so any exit is a crash
+	a.events.Record(context.Background(), eventServerCrashed, id, name, fmt.Sprintf("Process %d %s", pid, details))
+	a.notifier.Notify(context.Background(), "crashed", id, name, fmt.Sprintf("process %d %s", pid, details))
+
+	settings, exists := a.EffectiveSettings(id)
+	if !exists {
+		return
+	}
+	switch settings["restart_policy"].Value {
+	case "always":
+	case "on-failure":
+		if !failed {
+			return
+		}
+	default:
+		return
+	}
+	a.mu.Lock()
+	a.pendingRestarts[id] = time.Now()
+	a.mu.Unlock()
+}
+
+// reattachServers adopts server processes that outlived a previous
+// manager, so they are shown as running and not started twice. Their
+// VLAN interfaces are adopted as they are, while their worker processes
+// are started anew. It returns the IDs of the re-attached servers.
+func (a *App) reattachServers(vlanManager *VLANManager) map[string]bool {
+	attached := make(map[string]bool)
+
+	for _, id := range a.serverIDs() {
+		reapWorkers(a.configDir, id)
+		pidPath := serverPIDPath(a.configDir, id)
+		record, err := readPIDFile(pidPath)
+		if err != nil {
+			continue
+		}
+		if !record.Alive() {
+			os.Remove(pidPath)
+			continue
+		}
+
+		a.mu.Lock()
+		server, exists := a.servers[id]
+		if !exists {
+			a.mu.Unlock()
+			continue
+		}
+		a.processes[id] = record.PID
+		server.Running = true
+		port, opts, hasVLAN := server.Port, server.VLANOptions, server.VLANInterface != ""
+		a.mu.Unlock()
+
+		if hasVLAN && vlanManager != nil {
+			if err := vlanManager.AdoptVLANInterface(port, opts); err != nil {
+				a.warnings.Add("vlan", "Server %s was re-attached but its VLAN interface is missing: %v", id, err)
+			} else {
+				vlanManager.AssignServer(port, id)
+			}
+		}
+
+		attached[id] = true
+		logAttrs(context.Background(), slog.LevelInfo, "reattach", slog.String("server", id), slog.Int("pid", record.PID))
+		if err := a.store.Record(id, "reattached", fmt.Sprintf("pid %d", record.PID)); err != nil {
+			a.warnings.Add("config", "Error recording history for server %s: %v", id, err)
+		}
+		go a.watchProcess(id, record)
+		if current, exists := a.GetServer(id); exists {
+			a.startWatch(context.Background(), current)
+			a.startWorkerProcesses(context.Background(), current, current.Workers...)
+		}
+	}
+
+	// Rules of reloaded servers that did not survive point nowhere
+	for _, id := range a.serverIDs() {
+		if !attached[id] {
+			if err := a.reloads.Clear(id); err != nil {
+				a.warnings.Add("server", "Error removing the reload rules of server %s: %v", id, err)
+			}
+		}
+	}
+	return attached
+}
+
+// watchProcess polls a process that is not a child of this manager and
+// clears the server's running state when it exits
+func (a *App) watchProcess(id string, record ProcessRecord) {
+	for record.Alive() {
+		time.Sleep(processPollInterval)
+	}
+	// The exit status of a process that is not our child is unknown
+	a.processExited(id, record.PID, true)
+}
+
+// runReconciler restarts servers queued by their restart_policy every
+// interval. A queued server stays down until its maintenance window opens.
+func (a *App) runReconciler(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		a.reconcile(time.Now())
+	}
+}
+
+// reconcile starts the queued servers whose maintenance window is open at
+// time now. Servers that fail to start stay queued, and so do all of them
+// while the manager is frozen.
+func (a *App) reconcile(now time.Time) {
+	a.mu.Lock()
+	pending := make([]string, 0, len(a.pendingRestarts))
+	for id := range a.pendingRestarts {
+		if _, exists := a.servers[id]; !exists {
+			delete(a.pendingRestarts, id)
+			continue
+		}
+		pending = append(pending, id)
+	}
+	a.mu.Unlock()
+	sortByNumericID(pending)
+
+	if len(pending) > 0 && a.Frozen() {
+		logAttrs(context.Background(), slog.LevelInfo, "reconcile skipped", slog.String("reason", "frozen"), slog.Any("servers", pending))
+		return
+	}
+
+	for _, id := range pending {
+		if !a.MaintenanceOpen(id, now) {
+			continue
+		}
+		ctx := withRequestID(context.Background(), newRequestID())
+		logAttrs(ctx, slog.LevelInfo, "auto-restart", slog.String("server", id))
+		if !a.StartServerContext(ctx, id) {
+			a.warnings.AddContext(ctx, "server", "Server %s could not be restarted automatically; retrying", id)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// restartFreeFields are server fields whose changes apply without
+// restarting the process
+var restartFreeFields = map[string]bool{
+	"name": true, "labels": true, "settings": true, "expires_at": true, "git": true, "framework": true, "owner": true,
+}
+
+// FieldChange is one changed field of a resource
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// PlanChange is one resource an import would create, update or delete
+type PlanChange struct {
+	Action   string        `json:"action"`   // create, update or delete
+	Resource string        `json:"resource"` // server, group, template, settings or header_rules
+	ID       string        `json:"id,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Fields   []FieldChange `json:"fields,omitempty"`
+}
+
+// PlanVLAN is a VLAN interface an import would create or remove
+type PlanVLAN struct {
+	ServerID  string `json:"server_id"`
+	Port      string `json:"port"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// ConfigPlan is what importing a document would change, computed without
+// changing anything
+type ConfigPlan struct {
+	Mode          string       `json:"mode"`
+	Changes       []PlanChange `json:"changes"`
+	VLANsAllocate []PlanVLAN   `json:"vlans_to_allocate"`
+	VLANsRelease  []PlanVLAN   `json:"vlans_to_release"`
+	Restarts      []string     `json:"servers_to_restart"`
+	Stops         []string     `json:"servers_to_stop"`
+	Problems      []string     `json:"problems"`
+	Summary       string       `json:"summary"`
+}
+
+// diffFields compares the JSON fields of two values. Fields listed in
+// ignore are skipped.
+func diffFields(before, after interface{}, ignore ...string) []FieldChange {
+	fields := func(v interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		if data, err := json.Marshal(v); err == nil {
+			json.Unmarshal(data, &m)
+		}
+		for _, name := range ignore {
+			delete(m, name)
+		}
+		return m
+	}
+	old, updated := fields(before), fields(after)
+
+	names := []string{}
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range updated {
+		if _, exists := old[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		if !reflect.DeepEqual(old[name], updated[name]) {
+			changes = append(changes, FieldChange{Field: name, Before: old[name], After: updated[name]})
+		}
+	}
+	return changes
+}
+
+// PlanConfig computes what ImportConfig would do with doc: the servers,
+// groups and templates it would create, update or delete, the VLAN
+// interfaces it would create or remove and the running servers that need
+// a restart or would be stopped
+func (a *App) PlanConfig(doc *ConfigExport, replace bool, vlanManager *VLANManager) *ConfigPlan {
+	plan := &ConfigPlan{
+		Mode:          "merge",
+		Changes:       []PlanChange{},
+		VLANsAllocate: []PlanVLAN{},
+		VLANsRelease:  []PlanVLAN{},
+		Restarts:      []string{},
+		Stops:         []string{},
+		Problems:      a.validateImport(doc, replace),
+	}
+	if replace {
+		plan.Mode = "replace"
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	imported := make(map[string]bool)
+	for _, incoming := range doc.Servers {
+		if incoming == nil {
+			continue
+		}
+		imported[incoming.ID] = true
+		current, exists := a.servers[incoming.ID]
+		if !exists {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "create", Resource: "server", ID: incoming.ID, Name: incoming.Name})
+		} else if fields := diffFields(current, incoming, "running"); len(fields) > 0 {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "update", Resource: "server", ID: incoming.ID, Name: incoming.Name, Fields: fields})
+			if current.Running {
+				for _, field := range fields {
+					if !restartFreeFields[field.Field] {
+						plan.Restarts = append(plan.Restarts, incoming.ID)
+						break
+					}
+				}
+			}
+		}
+
+		if vlanManager.privileges.CanManageVLANs() && incoming.VLANInterface != "" && vlanManager.GetVLANForPort(incoming.Port) == nil {
+			plan.VLANsAllocate = append(plan.VLANsAllocate, PlanVLAN{ServerID: incoming.ID, Port: incoming.Port})
+		}
+	}
+
+	if replace {
+		removed := []string{}
+		for id := range a.servers {
+			if !imported[id] {
+				removed = append(removed, id)
+			}
+		}
+		sortByNumericID(removed)
+		for _, id := range removed {
+			server := a.servers[id]
+			plan.Changes = append(plan.Changes, PlanChange{Action: "delete", Resource: "server", ID: id, Name: server.Name})
+			if server.Running {
+				plan.Stops = append(plan.Stops, id)
+			}
+			if server.VLANInterface != "" {
+				plan.VLANsRelease = append(plan.VLANsRelease, PlanVLAN{ServerID: id, Port: server.Port, Interface: server.VLANInterface})
+			}
+		}
+	}
+
+	importedGroups := make(map[string]bool)
+	for _, group := range doc.Groups {
+		importedGroups[group.ID] = true
+		if current, exists := a.groups[group.ID]; !exists {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "create", Resource: "group", ID: group.ID, Name: group.Name})
+		} else if fields := diffFields(current, group); len(fields) > 0 {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "update", Resource: "group", ID: group.ID, Name: group.Name, Fields: fields})
+		}
+	}
+	importedTemplates := make(map[string]bool)
+	for _, template := range doc.Templates {
+		importedTemplates[template.ID] = true
+		if current, exists := a.templates[template.ID]; !exists {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "create", Resource: "template", ID: template.ID, Name: template.Name})
+		} else if fields := diffFields(current, template); len(fields) > 0 {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "update", Resource: "template", ID: template.ID, Name: template.Name, Fields: fields})
+		}
+	}
+	if replace {
+		groups, templates := []string{}, []string{}
+		for id := range a.groups {
+			if !importedGroups[id] {
+				groups = append(groups, id)
+			}
+		}
+		for id := range a.templates {
+			if !importedTemplates[id] {
+				templates = append(templates, id)
+			}
+		}
+		sortByNumericID(groups)
+		sortByNumericID(templates)
+		for _, id := range groups {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "delete", Resource: "group", ID: id, Name: a.groups[id].Name})
+		}
+		for _, id := range templates {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "delete", Resource: "template", ID: id, Name: a.templates[id].Name})
+		}
+	}
+
+	if replace || doc.Settings != (Settings{}) {
+		if fields := diffFields(a.settings, doc.Settings); len(fields) > 0 {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "update", Resource: "settings", Fields: fields})
+		}
+	}
+	if replace || doc.Headers != nil {
+		if !reflect.DeepEqual(a.headerRules, doc.Headers) && len(a.headerRules)+len(doc.Headers) > 0 {
+			plan.Changes = append(plan.Changes, PlanChange{Action: "update", Resource: "header_rules", Fields: []FieldChange{{Field: "header_rules", Before: a.headerRules, After: doc.Headers}}})
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, change := range plan.Changes {
+		counts[change.Action]++
+	}
+	plan.Summary = fmt.Sprintf("%d to create, %d to update, %d to delete, %d to restart", counts["create"], counts["update"], counts["delete"], len(plan.Restarts))
+	return plan
+}
+
+// Text renders the plan for people, one line per change in the style of
+// terraform plan
+func (p *ConfigPlan) Text() string {
+	var b strings.Builder
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-"}
+	for _, change := range p.Changes {
+		fmt.Fprintf(&b, "%s %s", symbols[change.Action], change.Resource)
+		if change.ID != "" {
+			fmt.Fprintf(&b, " %s", change.ID)
+		}
+		if change.Name != "" {
+			fmt.Fprintf(&b, " %q", change.Name)
+		}
+		b.WriteString("\n")
+		for _, field := range change.Fields {
+			before, _ := json.Marshal(field.Before)
+			after, _ := json.Marshal(field.After)
+			fmt.Fprintf(&b, "    %s: %s => %s\n", field.Field, before, after)
+		}
+	}
+	for _, vlan := range p.VLANsAllocate {
+		fmt.Fprintf(&b, "+ vlan for server %s on port %s\n", vlan.ServerID, vlan.Port)
+	}
+	for _, vlan := range p.VLANsRelease {
+		fmt.Fprintf(&b, "- vlan %s of server %s\n", vlan.Interface, vlan.ServerID)
+	}
+	for _, id := range p.Stops {
+		fmt.Fprintf(&b, "! stop server %s\n", id)
+	}
+	for _, id := range p.Restarts {
+		fmt.Fprintf(&b, "! restart server %s to apply the changes\n", id)
+	}
+	for _, problem := range p.Problems {
+		fmt.Fprintf(&b, "error: %s\n", problem)
+	}
+	if len(p.Changes) == 0 {
+		b.WriteString("No changes.\n")
+	}
+	fmt.Fprintf(&b, "Plan (%s): %s.\n", p.Mode, p.Summary)
+	return b.String()
+}
+
+// handlePlan shows what importing a JSON or YAML export would change
+// without applying it. ?mode=merge|replace as for imports; ?output=text or
+// Accept: text/plain returns the human-readable plan.
+func (a *App) handlePlan(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	doc, replace, ok := decodeImport(w, r)
+	if !ok {
+		return
+	}
+	plan := a.PlanConfig(doc, replace, vlanManager)
+
+	if r.URL.Query().Get("output") == "text" || strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(plan.Text()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+const (
+	// portMappingLease is the lease requested from the router. Mappings
+	// are renewed halfway through, so they lapse soon after a crash.
+	portMappingLease = time.Hour
+	// natpmpTimeout bounds how long a NAT-PMP gateway may take to answer
+	natpmpTimeout = 2 * time.Second
+)
+
+// PortMapping is a port forwarded by the home router to a public server
+type PortMapping struct {
+	ServerID        string    `json:"server_id"`
+	State           string    `json:"state"`              // mapping, mapped or failed
+	Protocol        string    `json:"protocol,omitempty"` // upnp or nat-pmp
+	InternalPort    int       `json:"internal_port"`
+	ExternalIP      string    `json:"external_ip,omitempty"`
+	ExternalPort    int       `json:"external_port,omitempty"`
+	ExternalAddress string    `json:"external_address,omitempty"` // host:port to reach the server from the internet
+	Error           string    `json:"error,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	gateway         portGateway
+	stop            chan struct{}
+}
+
+// portGateway is a router that forwards TCP ports on request
+type portGateway interface {
+	Protocol() string
+	// Map forwards externalPort to internalPort on this host and returns
+	// the external port and lease the router granted; a zero lease is
+	// permanent
+	Map(description string, internalPort, externalPort int, lease time.Duration) (int, time.Duration, error)
+	Unmap(internalPort, externalPort int) error
+	ExternalIP() (string, error)
+}
+
+// upnpConnection is the part of the UPnP WAN connection services used to
+// forward ports, which the IP and PPP variants share
+type upnpConnection interface {
+	AddPortMapping(remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, enabled bool, description string, leaseDuration uint32) error
+	DeletePortMapping(remoteHost string, externalPort uint16, protocol string) error
+	GetExternalIPAddress() (string, error)
+	LocalAddr() net.IP
+}
+
+// upnpGateway forwards ports through a UPnP Internet Gateway Device
+type upnpGateway struct {
+	conn upnpConnection
+}
+
+func (g upnpGateway) Protocol() string { return "upnp" }
+
+func (g upnpGateway) Map(description string, internalPort, externalPort int, lease time.Duration) (int, time.Duration, error) {
+	client := g.conn.LocalAddr().String()
+	err := g.conn.AddPortMapping("", uint16(externalPort), "TCP", uint16(internalPort), client, true, description, uint32(lease.Seconds()))
+	if err != nil && lease > 0 {
+		// Some routers only accept permanent mappings
+		if g.conn.AddPortMapping("", uint16(externalPort), "TCP", uint16(internalPort), client, true, description, 0) == nil {
+			return externalPort, 0, nil
+		}
+	}
+	return externalPort, lease, err
+}
+
+func (g upnpGateway) Unmap(internalPort, externalPort int) error {
+	return g.conn.DeletePortMapping("", uint16(externalPort), "TCP")
+}
+
+func (g upnpGateway) ExternalIP() (string, error) {
+	return g.conn.GetExternalIPAddress()
+}
+
+// natpmpGateway forwards ports through a router speaking NAT-PMP
+type natpmpGateway struct {
+	client *natpmp.Client
+}
+
+func (g natpmpGateway) Protocol() string { return "nat-pmp" }
+
+func (g natpmpGateway) Map(description string, internalPort, externalPort int, lease time.Duration) (int, time.Duration, error) {
+	result, err := g.client.AddPortMapping("tcp", internalPort, externalPort, int(lease.Seconds()))
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(result.MappedExternalPort), time.Duration(result.PortMappingLifetimeInSeconds) * time.Second, nil
+}
+
+func (g natpmpGateway) Unmap(internalPort, externalPort int) error {
+	// A zero lifetime deletes the mapping (RFC 6886, section 3.4)
+	_, err := g.client.AddPortMapping("tcp", internalPort, 0, 0)
+	return err
+}
+
+func (g natpmpGateway) ExternalIP() (string, error) {
+	result, err := g.client.GetExternalAddress()
+	if err != nil {
+		return "", err
+	}
+	return net.IP(result.ExternalIPAddress[:]).String(), nil
+}
+
+// defaultGateway returns the IPv4 gateway of the default route
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Iface Destination Gateway ..., in little-endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gateway := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(raw))
+		return gateway, nil
+	}
+	return nil, fmt.Errorf("no default route")
+}
+
+// discoverGateway finds a router that forwards ports, trying UPnP before
+// NAT-PMP
+func discoverGateway() (portGateway, error) {
+	searches := []func() ([]upnpConnection, error){
+		func() ([]upnpConnection, error) {
+			clients, _, err := internetgateway2.NewWANIPConnection2Clients()
+			connections := make([]upnpConnection, len(clients))
+			for i, client := range clients {
+				connections[i] = client
+			}
+			return connections, err
+		},
+		func() ([]upnpConnection, error) {
+			clients, _, err := internetgateway2.NewWANIPConnection1Clients()
+			connections := make([]upnpConnection, len(clients))
+			for i, client := range clients {
+				connections[i] = client
+			}
+			return connections, err
+		},
+		func() ([]upnpConnection, error) {
+			clients, _, err := internetgateway2.NewWANPPPConnection1Clients()
+			connections := make([]upnpConnection, len(clients))
+			for i, client := range clients {
+				connections[i] = client
+			}
+			return connections, err
+		},
+	}
+	for _, search := range searches {
+		if connections, err := search(); err == nil && len(connections) > 0 {
+			return upnpGateway{conn: connections[0]}, nil
+		}
+	}
+
+	gateway, err := defaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("no UPnP gateway answered and %v", err)
+	}
+	client := natpmp.NewClientWithTimeout(gateway, natpmpTimeout)
+	if _, err := client.GetExternalAddress(); err != nil {
+		return nil, fmt.Errorf("no UPnP gateway answered and %s does not speak NAT-PMP: %v", gateway, err)
+	}
+	return natpmpGateway{client: client}, nil
+}
+
+// PortMapper keeps router port mappings for public servers while they
+// run. Mappings are created in the background, since finding the router
+// takes seconds, and removed when the server stops.
+type PortMapper struct {
+	mu       sync.Mutex
+	mappings map[string]*PortMapping
+	warnings *WarningCenter
+}
+
+// NewPortMapper creates a port mapper
+func NewPortMapper(warnings *WarningCenter) *PortMapper {
+	return &PortMapper{
+		mappings: make(map[string]*PortMapping),
+		warnings: warnings,
+	}
+}
+
+// Open asks the router to forward port to a server, on the same external
+// port when the router allows it, and renews the mapping until Close
+func (pm *PortMapper) Open(ctx context.Context, serverID, name string, port int) {
+	mapping := &PortMapping{ServerID: serverID, State: "mapping", InternalPort: port, UpdatedAt: time.Now(), stop: make(chan struct{})}
+	pm.mu.Lock()
+	if _, exists := pm.mappings[serverID]; exists {
+		pm.mu.Unlock()
+		return
+	}
+	pm.mappings[serverID] = mapping
+	pm.mu.Unlock()
+
+	go pm.run(ctx, mapping, fmt.Sprintf("php-server-manager: %s", name))
+}
+
+// run creates a mapping and renews it until it is closed
+func (pm *PortMapper) run(ctx context.Context, mapping *PortMapping, description string) {
+	gateway, err := discoverGateway()
+	if err != nil {
+		pm.fail(ctx, mapping, err)
+		return
+	}
+	externalPort, lease, err := gateway.Map(description, mapping.InternalPort, mapping.InternalPort, portMappingLease)
+	if err != nil {
+		pm.fail(ctx, mapping, fmt.Errorf("%s: %v", gateway.Protocol(), err))
+		return
+	}
+	externalIP, err := gateway.ExternalIP()
+	if err != nil {
+		pm.warnings.AddContext(ctx, "port-mapping", "Port %d of server %s is forwarded, but the router did not tell its external address: %v", externalPort, mapping.ServerID, err)
+	}
+
+	pm.mu.Lock()
+	select {
+	case <-mapping.stop:
+		// Closed while the router was being asked
+		pm.mu.Unlock()
+		gateway.Unmap(mapping.InternalPort, externalPort)
+		return
+	default:
+	}
+	mapping.State, mapping.Protocol, mapping.gateway = "mapped", gateway.Protocol(), gateway
+	mapping.ExternalIP, mapping.ExternalPort, mapping.UpdatedAt = externalIP, externalPort, time.Now()
+	if externalIP != "" {
+		mapping.ExternalAddress = net.JoinHostPort(externalIP, strconv.Itoa(externalPort))
+	}
+	pm.mu.Unlock()
+	logAttrs(ctx, slog.LevelInfo, "port mapped", slog.String("server", mapping.ServerID), slog.String("protocol", gateway.Protocol()), slog.String("external", mapping.ExternalAddress))
+
+	for lease > 0 {
+		select {
+		case <-mapping.stop:
+			return
+		case <-time.After(lease / 2):
+		}
+		if _, lease, err = gateway.Map(description, mapping.InternalPort, externalPort, portMappingLease); err != nil {
+			pm.fail(ctx, mapping, fmt.Errorf("renewing the %s mapping: %v", gateway.Protocol(), err))
+			return
+		}
+	}
+}
+
+// fail records why a mapping could not be created or kept
+func (pm *PortMapper) fail(ctx context.Context, mapping *PortMapping, err error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	select {
+	case <-mapping.stop:
+		return
+	default:
+	}
+	mapping.State, mapping.Error, mapping.UpdatedAt = "failed", err.Error(), time.Now()
+	mapping.ExternalIP, mapping.ExternalPort, mapping.ExternalAddress = "", 0, ""
+	pm.warnings.AddContext(ctx, "port-mapping", "Error forwarding port %d of server %s on the router: %v", mapping.InternalPort, mapping.ServerID, err)
+}
+
+// Get returns the port mapping of a server
+func (pm *PortMapper) Get(serverID string) (PortMapping, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	mapping, exists := pm.mappings[serverID]
+	if !exists {
+		return PortMapping{}, false
+	}
+	return *mapping, true
+}
+
+// Close removes the port mapping of a server from the router and reports
+// whether the server had one
+func (pm *PortMapper) Close(serverID string) bool {
+	pm.mu.Lock()
+	mapping, exists := pm.mappings[serverID]
+	if !exists {
+		pm.mu.Unlock()
+		return false
+	}
+	delete(pm.mappings, serverID)
+	close(mapping.stop)
+	gateway, mapped := mapping.gateway, mapping.State == "mapped"
+	pm.mu.Unlock()
+
+	if mapped {
+		if err := gateway.Unmap(mapping.InternalPort, mapping.ExternalPort); err != nil {
+			pm.warnings.Add("port-mapping", "Error removing the port mapping of server %s from the router: %v", serverID, err)
+		}
+	}
+	return true
+}
+
+// openPortMapping forwards the port of a public server on the router
+func (a *App) openPortMapping(ctx context.Context, server Server) {
+	if !server.Public {
+		return
+	}
+	if server.IPv6Address != "" {
+		a.warnings.AddContext(ctx, "port-mapping", "Server %s listens on its VLAN's IPv6 address only, which the router can't forward IPv4 ports to", server.ID)
+		return
+	}
+	port, err := strconv.Atoi(server.Port)
+	if err != nil {
+		return
+	}
+	a.portMappings.Open(ctx, server.ID, server.Name, port)
+}
+
+// SetPublic marks whether a server's port is forwarded on the router. A
+// running server is mapped or unmapped at once.
+func (a *App) SetPublic(ctx context.Context, id string, public bool) bool {
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	if !exists {
+		a.mu.Unlock()
+		return false
+	}
+	server.Public = public
+	current := *server
+	a.requestSave()
+	a.mu.Unlock()
+
+	if !public {
+		a.portMappings.Close(id)
+	} else if current.Running {
+		a.openPortMapping(ctx, current)
+	}
+	return true
+}
+
+// handleSetPublic makes a server public or private ({"public": true}).
+// Public servers have their port forwarded on the home router through
+// UPnP or NAT-PMP while they run.
+func (a *App) handleSetPublic(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var request struct {
+		Public bool `json:"public"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if !a.SetPublic(r.Context(), id, request.Public) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"public": request.Public})
+}
+
+// handleGetPortMapping shows the router port mapping of a public server
+func (a *App) handleGetPortMapping(w http.ResponseWriter, r *http.Request) {
+	mapping, exists := a.portMappings.Get(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "The server has no port mapping; it is not public or not running")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mapping)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Linux capability bits, see capabilities(7)
+const (
+	capNetBindService = 10
+	capNetAdmin       = 12
+)
+
+// Privileges describes what the manager process is allowed to do
+type Privileges struct {
+	Root           bool   `json:"root"`
+	NetAdmin       bool   `json:"cap_net_admin"`
+	NetBindService bool   `json:"cap_net_bind_service"`
+	Sudo           bool   `json:"sudo"`
+	Helper         string `json:"net_helper,omitempty"` // socket of the network helper running privileged commands
+}
+
+// detectPrivileges inspects the effective user and capabilities of the
+// running process, whether the network helper at helperSocket answers
+// and whether passwordless sudo is available
+func detectPrivileges(helperSocket string) Privileges {
+	p := Privileges{Root: os.Geteuid() == 0}
+
+	capEff := readEffectiveCapabilities()
+	p.NetAdmin = p.Root || capEff&(1<<capNetAdmin) != 0
+	p.NetBindService = p.Root || capEff&(1<<capNetBindService) != 0
+
+	// Only consider the helper and sudo when capabilities don't already
+	// cover networking
+	if !p.NetAdmin && helperSocket != "" && pingNetHelper(helperSocket) == nil {
+		p.Helper = helperSocket
+	}
+	if !p.NetAdmin && p.Helper == "" {
+		if _, err := exec.LookPath("sudo"); err == nil {
+			p.Sudo = exec.Command("sudo", "-n", "true").Run() == nil
+		}
+	}
+
+	return p
+}
+
+// readEffectiveCapabilities returns the CapEff mask from /proc/self/status
+func readEffectiveCapabilities() uint64 {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "CapEff:") {
+			mask, _ := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return mask
+		}
+	}
+	return 0
+}
+
+// CanManageVLANs reports whether VLAN interfaces can be created
+func (p Privileges) CanManageVLANs() bool {
+	return p.NetAdmin || p.Helper != "" || p.Sudo
+}
+
+// CanBindPrivilegedPorts reports whether ports below 1024 can be bound
+func (p Privileges) CanBindPrivilegedPorts() bool {
+	return p.NetBindService
+}
+
+// Features lists which optional features are available
+func (p Privileges) Features() map[string]bool {
+	return map[string]bool{
+		"vlan":                  p.CanManageVLANs(),
+		"bind_privileged_ports": p.CanBindPrivilegedPorts(),
+		"sysctl":                p.Root || p.Helper != "" || p.Sudo,
+		"resource_limits":       cgroupsAvailable(),
+	}
+}
+
+// Command builds a command for a network operation, going through the
+// network helper or sudo only when the process lacks the capability to run
+// it directly. Commands run through either must match the sudo allowlist.
+func (p Privileges) Command(name string, args ...string) *exec.Cmd {
+	if p.NetAdmin {
+		return exec.Command(name, args...)
+	}
+	if p.Helper != "" {
+		return netHelperCommand(p.Helper, append([]string{name}, args...)...)
+	}
+	return sudoCommand(append([]string{name}, args...)...)
+}
+
+// SetSysctl sets a sysctl value, writing /proc/sys directly when possible
+func (p Privileges) SetSysctl(key, value string) error {
+	if p.Helper != "" && !p.Root {
+		return netHelperCommand(p.Helper, "sysctl", "-w", key+"="+value).Run()
+	}
+	if p.Sudo && !p.Root {
+		return sudoCommand("sysctl", "-w", key+"="+value).Run()
+	}
+
+	path := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("cannot write %s without root: %v", key, err)
+	}
+	return nil
+}
+
+// handleGetCapabilities reports the detected privileges and features
+func (p Privileges) handleGetCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"privileges": p,
+		"features":   p.Features(),
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ProbeCheck is the result of one readiness check
+type ProbeCheck struct {
+	OK       bool   `json:"ok"`
+	Required bool   `json:"required"` // a failed required check makes the manager unready
+	Message  string `json:"message,omitempty"`
+}
+
+// SetReady marks whether the manager serves requests. It is cleared when
+// shutdown begins, so orchestrators stop routing to the manager first.
+func (a *App) SetReady(ready bool) {
+	a.mu.Lock()
+	a.ready = ready
+	a.mu.Unlock()
+}
+
+// readinessChecks checks what the manager needs to manage servers: its
+// configuration and the PHP runtime. VLAN interfaces are optional, since
+// servers are created without them when they can't be managed.
+func (a *App) readinessChecks() map[string]ProbeCheck {
+	a.mu.Lock()
+	ready, configErr := a.ready, a.configErr
+	a.mu.Unlock()
+
+	checks := map[string]ProbeCheck{
+		"serving": {OK: true, Required: true},
+		"config":  {OK: true, Required: true},
+		"vlan":    {OK: true},
+	}
+	if !ready {
+		checks["serving"] = ProbeCheck{Required: true, Message: "starting or shutting down"}
+	}
+	if configErr != nil {
+		checks["config"] = ProbeCheck{Required: true, Message: configErr.Error()}
+	}
+	if !a.privileges.CanManageVLANs() {
+		checks["vlan"] = ProbeCheck{Message: "neither CAP_NET_ADMIN nor sudo is available"}
+	}
+	if path, err := findRuntimeBinary(runtimeBinary); err != nil {
+		checks["runtime"] = ProbeCheck{Required: true, Message: err.Error()}
+	} else {
+		checks["runtime"] = ProbeCheck{OK: true, Required: true, Message: path}
+	}
+	return checks
+}
+
+// handleHealthz reports that the manager process is alive. It needs no
+// session, so uptime monitors can poll it.
+func (a *App) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"time":   time.Now(),
+	})
+}
+
+// handleReadyz reports whether the manager can manage servers, with the
+// result of each check. It answers 503 when a required check fails.
+func (a *App) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := a.readinessChecks()
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Required && !check.OK {
+			status, code = "unready", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
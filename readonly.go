@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// readOnlyExempt lists mutating endpoints that stay available in
+// read-only mode
+var readOnlyExempt = []string{
+	"/api/auth/login",
+	"/api/auth/logout",
+	"/api/settings/readonly",
+}
+
+// ReadOnlyState is whether the manager rejects changes and whether
+// PSM_READONLY forces it
+type ReadOnlyState struct {
+	ReadOnly bool `json:"read_only"`
+	Forced   bool `json:"forced"` // set by PSM_READONLY, so it can't be turned off
+}
+
+// ReadOnly reports whether mutating requests are rejected
+func (a *App) ReadOnly() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.readOnly || a.readOnlyForced
+}
+
+// readOnlyState returns the read-only state
+func (a *App) readOnlyState() ReadOnlyState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return ReadOnlyState{ReadOnly: a.readOnly || a.readOnlyForced, Forced: a.readOnlyForced}
+}
+
+// SetReadOnly turns read-only mode on or off
+func (a *App) SetReadOnly(readOnly bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.readOnly = readOnly
+	a.requestSave()
+}
+
+// readOnlyMiddleware rejects mutating requests with 403 in read-only mode,
+// so the dashboard can be shown where nobody should change anything
+func (a *App) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, path := range readOnlyExempt {
+			if strings.TrimSuffix(r.URL.Path, "/") == path {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if a.ReadOnly() {
+			writeError(w, http.StatusForbidden, errCodeReadOnly, "Manager is in read-only mode")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleGetReadOnly shows whether the manager is read-only
+func (a *App) handleGetReadOnly(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.readOnlyState())
+}
+
+// handleSetReadOnly turns read-only mode on or off ({"read_only": true}).
+// It can't be turned off while PSM_READONLY forces it.
+func (a *App) handleSetReadOnly(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if request.ReadOnly == nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "read_only is required")
+		return
+	}
+	if !*request.ReadOnly && a.readOnlyState().Forced {
+		writeError(w, http.StatusConflict, errCodeConflict, "Read-only mode is forced by PSM_READONLY")
+		return
+	}
+
+	a.SetReadOnly(*request.ReadOnly)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.readOnlyState())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// redisImage is the image of the Redis containers
+	redisImage = "redis:7-alpine"
+	// sharedRedisName is the container shared by servers in shared mode
+	sharedRedisName = "psm-redis"
+	// redisPort is the container's port
+	redisPort = "6379/tcp"
+	// redisDatabases is the number of logical databases of a Redis, which
+	// bounds the servers sharing one
+	redisDatabases = 16
+)
+
+// RedisConfig attaches a managed Redis to a server for its cache, sessions
+// and queues. Servers sharing a Redis each get a logical database of
+// their own.
+type RedisConfig struct {
+	Mode     string `json:"mode"`               // shared or dedicated
+	Database int    `json:"database,omitempty"` // shared mode only, assigned when attached
+}
+
+// Validate checks the Redis options
+func (rc RedisConfig) Validate() error {
+	if rc.Mode != "shared" && rc.Mode != "dedicated" {
+		return fmt.Errorf("mode must be shared or dedicated")
+	}
+	if rc.Database < 0 || rc.Database >= redisDatabases {
+		return fmt.Errorf("database must be between 0 and %d", redisDatabases-1)
+	}
+	return nil
+}
+
+// containerName is the Redis container the server uses
+func (rc RedisConfig) containerName(serverID string) string {
+	if rc.Mode == "dedicated" {
+		return "psm-redis-" + serverID
+	}
+	return sharedRedisName
+}
+
+// redisEnvironment returns the variables that point the PHP process at
+// Redis, named as Laravel reads them plus REDIS_URL
+func redisEnvironment(address string, database int) []string {
+	host, port, _ := net.SplitHostPort(address)
+	db := strconv.Itoa(database)
+	return []string{"REDIS_HOST=" + host, "REDIS_PORT=" + port, "REDIS_DB=" + db, "REDIS_CACHE_DB=" + db,
+		"REDIS_URL=redis://" + address + "/" + db}
+}
+
+// ensureRedis creates and starts the server's Redis container unless it
+// runs and returns the address Docker published it on, a free port of
+// 127.0.0.1 picked on every start
+func ensureRedis(ctx context.Context, id string, rc *RedisConfig) (string, error) {
+	name := rc.containerName(id)
+	if name == sharedRedisName {
+		id = ""
+	}
+	status, err := newDockerClient().ensureContainer(ctx, name, map[string]interface{}{
+		"Image":        redisImage,
+		"Labels":       map[string]string{dockerServerLabel: id},
+		"ExposedPorts": map[string]interface{}{redisPort: map[string]interface{}{}},
+		"HostConfig": map[string]interface{}{
+			"PortBindings": map[string]interface{}{redisPort: []map[string]string{{"HostIp": "127.0.0.1", "HostPort": ""}}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if status.Ports[redisPort] == "" {
+		return "", fmt.Errorf("container %s does not publish the Redis port", name)
+	}
+	return status.Ports[redisPort], nil
+}
+
+// startRedis makes sure the Redis of a server runs and returns its
+// variables
+func (a *App) startRedis(ctx context.Context, id string, rc *RedisConfig) ([]string, error) {
+	if rc == nil {
+		return nil, nil
+	}
+	address, err := ensureRedis(ctx, id, rc)
+	if err != nil {
+		return nil, err
+	}
+	return redisEnvironment(address, rc.Database), nil
+}
+
+// stopRedis stops a server's dedicated Redis; the shared one keeps
+// running for the other servers
+func (a *App) stopRedis(ctx context.Context, id string, rc *RedisConfig) error {
+	if rc == nil || rc.Mode != "dedicated" {
+		return nil
+	}
+	return newDockerClient().stopContainer(ctx, rc.containerName(id))
+}
+
+// removeRedis removes a server's dedicated Redis with its data
+func (a *App) removeRedis(ctx context.Context, id string, rc *RedisConfig) error {
+	if rc == nil || rc.Mode != "dedicated" {
+		return nil
+	}
+	return newDockerClient().removeContainer(ctx, rc.containerName(id))
+}
+
+// SetRedis attaches a Redis to a server, or detaches it when rc is nil,
+// and returns the previous options. A server joining the shared Redis gets
+// the lowest logical database no other server uses.
+func (a *App) SetRedis(id string, rc *RedisConfig) (*RedisConfig, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return nil, false, nil
+	}
+	previous := server.Redis
+
+	if rc != nil && rc.Mode == "shared" {
+		if previous != nil && previous.Mode == "shared" {
+			rc.Database = previous.Database
+		} else {
+			used := make(map[int]bool)
+			for otherID, other := range a.servers {
+				if otherID != id && other.Redis != nil && other.Redis.Mode == "shared" {
+					used[other.Redis.Database] = true
+				}
+			}
+			rc.Database = -1
+			for db := 0; db < redisDatabases; db++ {
+				if !used[db] {
+					rc.Database = db
+					break
+				}
+			}
+			if rc.Database < 0 {
+				return previous, true, fmt.Errorf("all %d databases of the shared Redis are in use, use a dedicated one", redisDatabases)
+			}
+		}
+	} else if rc != nil {
+		rc.Database = 0
+	}
+	server.Redis = rc
+
+	a.requestSave()
+	return previous, true, nil
+}
+
+// handleGetRedis shows the Redis of a server and, while it runs, its
+// address and the variables the server gets
+func (a *App) handleGetRedis(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	response := map[string]interface{}{"server_id": id, "redis": server.Redis}
+	if server.Redis != nil {
+		status, err := newDockerClient().inspectContainer(r.Context(), server.Redis.containerName(id))
+		switch {
+		case isDockerNotFound(err) || (err == nil && !status.Running):
+			response["running"] = false
+		case err != nil:
+			response["error"] = err.Error()
+		default:
+			response["running"] = true
+			response["container"] = status.Name
+			if address := status.Ports[redisPort]; address != "" {
+				response["address"] = address
+				response["environment"] = redisEnvironment(address, server.Redis.Database)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleSetRedis attaches a Redis to a server, applied on its next start.
+// Detaching it or leaving dedicated mode removes the server's own Redis
+// with its data.
+func (a *App) handleSetRedis(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var rc *RedisConfig
+	if err := json.NewDecoder(r.Body).Decode(&rc); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if rc != nil {
+		if err := rc.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	previous, exists, err := a.SetRedis(id, rc)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return
+	}
+	if previous != nil && (rc == nil || rc.Mode != previous.Mode) {
+		if err := a.removeRedis(r.Context(), id, previous); err != nil {
+			a.warnings.AddContext(r.Context(), "redis", "Error removing the Redis of server %s: %v", id, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"redis":     rc,
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisEventsKey is the list of the most recent events in Redis
+	redisEventsKey = "php-server-manager:events"
+	// redisEventIDKey numbers the events of every instance
+	redisEventIDKey = "php-server-manager:events:id"
+	// redisEventChannel is where new events are published to the streams
+	// of every instance
+	redisEventChannel = "php-server-manager:events"
+)
+
+// recordEventScript numbers an event, appends it to the list, trims the
+// list to the events kept and publishes it, all at once so every instance
+// sees events in the order of their IDs
+var recordEventScript = redis.NewScript(`
+local event = cjson.decode(ARGV[1])
+event["id"] = redis.call("INCR", KEYS[1])
+local data = cjson.encode(event)
+redis.call("RPUSH", KEYS[2], data)
+redis.call("LTRIM", KEYS[2], -tonumber(ARGV[2]), -1)
+redis.call("PUBLISH", ARGV[3], data)
+return data
+`)
+
+// UseRedis shares the event log between manager instances: events are
+// kept in Redis instead of the events file, and streams of every instance
+// receive the events recorded by any of them
+func (el *EventLog) UseRedis(client *redis.Client) error {
+	pubsub := client.Subscribe(context.Background(), redisEventChannel)
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	el.mu.Lock()
+	el.redis = client
+	el.pubsub = pubsub
+	el.mu.Unlock()
+
+	go func() {
+		for message := range pubsub.Channel() {
+			var event Event
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				continue
+			}
+			el.mu.Lock()
+			if !el.closed {
+				el.publishLocked(event)
+			}
+			el.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// recordRedis adds an event to the shared log; the subscription hands it
+// to the streams
+func (el *EventLog) recordRedis(ctx context.Context, event Event) {
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = recordEventScript.Run(ctx, el.redis, []string{redisEventIDKey, redisEventsKey},
+			data, maxEvents, redisEventChannel).Err()
+	}
+	if err != nil {
+		logAttrs(ctx, slog.LevelWarn, "Error recording event in Redis",
+			slog.String("type", event.Type), slog.String("error", err.Error()))
+	}
+}
+
+// redisEntries returns the events kept in Redis, oldest first
+func (el *EventLog) redisEntries() []Event {
+	values, err := el.redis.LRange(context.Background(), redisEventsKey, 0, -1).Result()
+	if err != nil {
+		logAttrs(context.Background(), slog.LevelWarn, "Error reading events from Redis", slog.String("error", err.Error()))
+		return nil
+	}
+	entries := make([]Event, 0, len(values))
+	for _, value := range values {
+		var event Event
+		if json.Unmarshal([]byte(value), &event) == nil {
+			entries = append(entries, event)
+		}
+	}
+	return entries
+}
+
+// redisOldestID returns the ID of the oldest event kept in Redis, or zero
+// when there is none
+func (el *EventLog) redisOldestID() int64 {
+	var oldest Event
+	value, err := el.redis.LIndex(context.Background(), redisEventsKey, 0).Bytes()
+	if err != nil || json.Unmarshal(value, &oldest) != nil {
+		return 0
+	}
+	return oldest.ID
+}
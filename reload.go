@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// reloadHealthTimeout bounds how long a new process may take to answer
+	// before a reload is given up
+	reloadHealthTimeout = 30 * time.Second
+	// reloadProbeInterval is how often the new process is probed
+	reloadProbeInterval = 250 * time.Millisecond
+	// defaultReloadDrain is how long the old process may finish the
+	// requests it has before it is killed
+	defaultReloadDrain = 30 * time.Second
+	// reloadRulePrefix marks the NAT rules of reloaded servers
+	reloadRulePrefix = "psm-reload-"
+)
+
+var (
+	errNotRunning    = errors.New("server is not running")
+	errReloadRunning = errors.New("a reload of this server is already running")
+	// errReloadUnsupported is returned for servers a reload cannot hand over
+	errReloadUnsupported = errors.New("reloads need FrankenPHP on the host; restart containers and systemd units instead")
+	// errReloadPrivileges is returned when the manager cannot change NAT rules
+	errReloadPrivileges = errors.New("reloads need CAP_NET_ADMIN or sudo and iptables to redirect the server's port")
+)
+
+// ReloadRoute redirects the port of a reloaded server to the temporary
+// port its current process listens on, with iptables NAT rules in the
+// PREROUTING and OUTPUT chains
+type ReloadRoute struct {
+	Address    string    `json:"address,omitempty"` // the server's IPv6 address, empty for all local IPv4 addresses
+	Port       string    `json:"port"`              // the server's port
+	ListenPort string    `json:"listen_port"`       // where its process listens
+	PID        int       `json:"pid"`
+	ReloadedAt time.Time `json:"reloaded_at"`
+}
+
+// ruleArgs returns the iptables binary and the arguments that add (-I) or
+// delete (-D) the rule of chain. Local IPv4 traffic is redirected; an
+// IPv6 address needs DNAT, since REDIRECT would send local clients to ::1.
+func (rr ReloadRoute) ruleArgs(id, op, chain string) (string, []string) {
+	comment := []string{"-m", "comment", "--comment", reloadRulePrefix + id}
+	if rr.Address == "" {
+		args := []string{"-w", "-t", "nat", op, chain, "-p", "tcp", "--dport", rr.Port, "-m", "addrtype", "--dst-type", "LOCAL"}
+		args = append(args, comment...)
+		return "iptables", append(args, "-j", "REDIRECT", "--to-ports", rr.ListenPort)
+	}
+	args := []string{"-w", "-t", "nat", op, chain, "-d", rr.Address, "-p", "tcp", "--dport", rr.Port}
+	args = append(args, comment...)
+	return "ip6tables", append(args, "-j", "DNAT", "--to-destination", net.JoinHostPort(rr.Address, rr.ListenPort))
+}
+
+// ReloadResult describes a finished reload
+type ReloadResult struct {
+	ServerID   string `json:"server_id"`
+	OldPID     int    `json:"old_pid"`
+	NewPID     int    `json:"new_pid"`
+	ListenPort string `json:"listen_port"`
+	HealthyIn  string `json:"healthy_in"` // how long the new process took to answer
+	Drained    bool   `json:"drained"`    // false if the old process had to be killed
+}
+
+// ReloadManager keeps the routes of reloaded servers in reloads.json, so
+// their rules can be removed after the manager restarts
+type ReloadManager struct {
+	mu         sync.Mutex
+	path       string
+	privileges Privileges
+	routes     map[string]*ReloadRoute
+	busy       map[string]bool
+}
+
+// NewReloadManager loads the routes kept in baseDir
+func NewReloadManager(baseDir string, privileges Privileges) *ReloadManager {
+	rm := &ReloadManager{
+		path:       filepath.Join(baseDir, "reloads.json"),
+		privileges: privileges,
+		routes:     make(map[string]*ReloadRoute),
+		busy:       make(map[string]bool),
+	}
+	if data, err := ioutil.ReadFile(rm.path); err == nil {
+		json.Unmarshal(data, &rm.routes)
+	}
+	return rm
+}
+
+// saveLocked persists the routes; rm.mu must be held
+func (rm *ReloadManager) saveLocked() error {
+	data, err := json.MarshalIndent(rm.routes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rm.path, data, 0600)
+}
+
+// Supported reports why the manager cannot reload servers, if it cannot
+func (rm *ReloadManager) Supported(server Server) error {
+	if _, daemon := server.backend().(daemonBackend); daemon {
+		return errReloadUnsupported
+	}
+	binary := "iptables"
+	if server.IPv6Address != "" {
+		binary = "ip6tables"
+	}
+	if _, err := exec.LookPath(binary); err != nil || !rm.privileges.CanManageVLANs() {
+		return errReloadPrivileges
+	}
+	return nil
+}
+
+// PortOwner returns the server whose process listens on port after a
+// reload, so no other server is given it
+func (rm *ReloadManager) PortOwner(port string) (string, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for id, route := range rm.routes {
+		if route.ListenPort == port {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// apply adds or deletes the rules of a route
+func (rm *ReloadManager) apply(id, op string, route ReloadRoute) error {
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		binary, args := route.ruleArgs(id, op, chain)
+		if output, err := rm.privileges.Command(binary, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s %s: %v: %s", binary, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// Switch points a server's port at route.ListenPort. The new rules are
+// inserted ahead of the old ones before those are deleted, so no
+// connection finds the port unrouted; established ones keep their
+// destination.
+func (rm *ReloadManager) Switch(id string, route ReloadRoute) error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if err := rm.apply(id, "-I", route); err != nil {
+		rm.apply(id, "-D", route)
+		return err
+	}
+	if previous, exists := rm.routes[id]; exists {
+		if err := rm.apply(id, "-D", *previous); err != nil {
+			logAttrs(context.Background(), slog.LevelWarn, "reload rule", slog.String("server", id), slog.String("error", err.Error()))
+		}
+	}
+	rm.routes[id] = &route
+	return rm.saveLocked()
+}
+
+// Clear deletes the rules of a server that stopped, so its port is its
+// own again on the next start
+func (rm *ReloadManager) Clear(id string) error {
+	if rm == nil {
+		return nil
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	route, exists := rm.routes[id]
+	if !exists {
+		return nil
+	}
+	delete(rm.routes, id)
+	err := rm.apply(id, "-D", *route)
+	if saveErr := rm.saveLocked(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// begin marks a reload of a server as running; it returns false if one
+// already is
+func (rm *ReloadManager) begin(id string) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if rm.busy[id] {
+		return false
+	}
+	rm.busy[id] = true
+	return true
+}
+
+// finish marks a reload of a server as done
+func (rm *ReloadManager) finish(id string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.busy, id)
+}
+
+// freeListenPort returns a TCP port nothing listens on at address
+func freeListenPort(address string) (string, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, nil
+}
+
+// waitHealthy probes a new process on port until it answers, it exits or
+// the timeout passes
+func (a *App) waitHealthy(ctx context.Context, server Server, port string, pid int) error {
+	server.Port = port
+	useTLS := a.serverUsesTLS(server.ID)
+	client := newServerClient(reloadProbeInterval * 4)
+	deadline := time.Now().Add(reloadHealthTimeout)
+	for {
+		resp, err := client.Get(serverBaseURL(server, useTLS) + "/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				return nil
+			}
+			err = fmt.Errorf("responded with %s", resp.Status)
+		}
+		if !processAlive(pid) {
+			return fmt.Errorf("the new process exited; see the server log")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the new process did not become healthy within %s: %v", reloadHealthTimeout, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reloadProbeInterval):
+		}
+	}
+}
+
+// drainProcess sends SIGTERM to a process group so the server finishes
+// its requests, and SIGKILL once drain passes. It reports whether the
+// process exited by itself.
+func drainProcess(pid int, drain time.Duration) bool {
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err == syscall.ESRCH {
+		return true
+	}
+	for deadline := time.Now().Add(drain); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if !processAlive(pid) {
+			return true
+		}
+	}
+	killProcessGroup(pid)
+	return false
+}
+
+// ReloadServer replaces the process of a running server without dropping
+// requests: a new process is started on a free port, probed until it
+// answers, and the server's port is redirected to it before the old
+// process is drained. If the new process does not come up, it is killed
+// and the old one keeps serving.
+func (a *App) ReloadServer(ctx context.Context, id string, drain time.Duration) (ReloadResult, error) {
+	server, exists := a.GetServer(id)
+	if !exists || !server.Running {
+		return ReloadResult{}, errNotRunning
+	}
+	if err := a.reloads.Supported(server); err != nil {
+		return ReloadResult{}, err
+	}
+	if !a.reloads.begin(id) {
+		return ReloadResult{}, errReloadRunning
+	}
+	defer a.reloads.finish(id)
+
+	a.mu.Lock()
+	oldPID := a.processes[id]
+	a.mu.Unlock()
+	address := server.IPv6Address
+	listenPort, err := freeListenPort(firstNonEmpty(address, "0.0.0.0"))
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	started := time.Now()
+	newPID, ok := a.launchServer(ctx, id, listenPort)
+	if !ok {
+		return ReloadResult{}, fmt.Errorf("the new process did not start; see /api/warnings for details")
+	}
+	if err := a.waitHealthy(ctx, server, listenPort, newPID); err != nil {
+		killProcessGroup(newPID)
+		return ReloadResult{}, err
+	}
+	result := ReloadResult{ServerID: id, OldPID: oldPID, NewPID: newPID, ListenPort: listenPort, HealthyIn: time.Since(started).Round(time.Millisecond).String()}
+
+	route := ReloadRoute{Address: address, Port: server.Port, ListenPort: listenPort, PID: newPID, ReloadedAt: time.Now()}
+	if err := a.reloads.Switch(id, route); err != nil {
+		killProcessGroup(newPID)
+		return ReloadResult{}, err
+	}
+
+	// Adopt the new process unless the server was stopped meanwhile
+	a.mu.Lock()
+	current, running := a.servers[id]
+	adopted := running && current.Running && a.processes[id] == oldPID
+	if adopted {
+		a.processes[id] = newPID
+	}
+	a.mu.Unlock()
+	if !adopted {
+		killProcessGroup(newPID)
+		a.reloads.Clear(id)
+		return ReloadResult{}, fmt.Errorf("server %s was stopped during the reload", id)
+	}
+	if err := writePIDFile(serverPIDPath(a.configDir, id), newPID); err != nil {
+		a.warnings.AddContext(ctx, "server", "Error writing PID file for server %s: %v", id, err)
+	}
+	a.runtime.RecordStart(id)
+
+	logAttrs(ctx, slog.LevelInfo, "drain", slog.String("server", id), slog.Int("pid", oldPID), slog.Duration("timeout", drain))
+	result.Drained = drainProcess(oldPID, drain)
+
+	details := fmt.Sprintf("pid %d on port %s replaced pid %d", newPID, listenPort, oldPID)
+	if err := a.store.Record(id, "reloaded", details); err != nil {
+		a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, err)
+	}
+	a.annotations.Record(ctx, id, server.Name, "reload", fmt.Sprintf("Reloaded %s without downtime", server.Name))
+	return result, nil
+}
+
+// handleReloadServer replaces a running server's process without
+// dropping requests. ?drain= (30s by default) bounds how long the old
+// process may finish its requests.
+func (a *App) handleReloadServer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	drain := defaultReloadDrain
+	if value := r.URL.Query().Get("drain"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 || parsed > 10*time.Minute {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "drain must be a duration up to 10m")
+			return
+		}
+		drain = parsed
+	}
+
+	ctx := withRequestID(context.Background(), requestIDFromContext(r.Context()))
+	result, err := a.ReloadServer(ctx, id, drain)
+	switch {
+	case errors.Is(err, errNotRunning):
+		writeError(w, http.StatusConflict, errCodeNotRunning, "Server is not running")
+		return
+	case errors.Is(err, errReloadRunning):
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return
+	case errors.Is(err, errReloadUnsupported), errors.Is(err, errReloadPrivileges):
+		writeError(w, http.StatusNotImplemented, errCodeUnavailable, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, errCodeStartFailed, fmt.Sprintf("Reload failed, the old process keeps serving: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
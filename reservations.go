@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// errAddressReserved is returned when the address derived for a VLAN is
+// reserved for another system
+var errAddressReserved = errors.New("address is reserved")
+
+// Reservation keeps ports and IPv6 addresses in use by systems outside
+// the manager from being assigned to servers
+type Reservation struct {
+	ID        string    `json:"id"`
+	Ports     string    `json:"ports,omitempty"`     // "8080" or a range such as "9000-9099"
+	Addresses string    `json:"addresses,omitempty"` // an address or a prefix such as 2001:db8::/112
+	Owner     string    `json:"owner"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// portRange parses the reserved ports; ok is false when none are reserved
+func (r Reservation) portRange() (low, high int, ok bool, err error) {
+	if r.Ports == "" {
+		return 0, 0, false, nil
+	}
+	lowText, highText := r.Ports, r.Ports
+	if i := strings.Index(r.Ports, "-"); i >= 0 {
+		lowText, highText = r.Ports[:i], r.Ports[i+1:]
+	}
+	low, errLow := strconv.Atoi(strings.TrimSpace(lowText))
+	high, errHigh := strconv.Atoi(strings.TrimSpace(highText))
+	if errLow != nil || errHigh != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, false, fmt.Errorf("ports must be a port or a range such as 9000-9099 within 1-65535")
+	}
+	return low, high, true, nil
+}
+
+// network parses the reserved addresses; a single address is a /128
+func (r Reservation) network() (*net.IPNet, error) {
+	if r.Addresses == "" {
+		return nil, nil
+	}
+	if _, network, err := net.ParseCIDR(r.Addresses); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(r.Addresses)
+	if ip == nil {
+		return nil, fmt.Errorf("addresses must be an IP address or a prefix such as 2001:db8::/112")
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Validate checks that the reservation names an owner and something to
+// reserve
+func (r Reservation) Validate() error {
+	if r.Owner == "" {
+		return fmt.Errorf("owner is required")
+	}
+	if r.Ports == "" && r.Addresses == "" {
+		return fmt.Errorf("ports or addresses is required")
+	}
+	if _, _, _, err := r.portRange(); err != nil {
+		return err
+	}
+	_, err := r.network()
+	return err
+}
+
+// coversPort reports whether port is reserved
+func (r Reservation) coversPort(port string) bool {
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	low, high, ok, _ := r.portRange()
+	return ok && number >= low && number <= high
+}
+
+// coversAddress reports whether address is reserved
+func (r Reservation) coversAddress(address string) bool {
+	ip := net.ParseIP(address)
+	network, _ := r.network()
+	return ip != nil && network != nil && network.Contains(ip)
+}
+
+// ReservationState is the persisted list of reservations
+type ReservationState struct {
+	NextID       int           `json:"next_id"`
+	Reservations []Reservation `json:"reservations"`
+}
+
+// ReservationManager stores reservations in reservations.json below the
+// config directory
+type ReservationManager struct {
+	mu    sync.Mutex
+	path  string
+	state ReservationState
+}
+
+// NewReservationManager loads the reservations stored below baseDir
+func NewReservationManager(baseDir string) *ReservationManager {
+	rm := &ReservationManager{
+		path:  filepath.Join(baseDir, "reservations.json"),
+		state: ReservationState{NextID: 1, Reservations: []Reservation{}},
+	}
+
+	if data, err := ioutil.ReadFile(rm.path); err == nil {
+		json.Unmarshal(data, &rm.state)
+	}
+
+	return rm
+}
+
+// saveLocked persists the reservations; rm.mu must be held
+func (rm *ReservationManager) saveLocked() error {
+	data, err := json.MarshalIndent(rm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rm.path, data, 0600)
+}
+
+// List returns all reservations
+func (rm *ReservationManager) List() []Reservation {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return append([]Reservation{}, rm.state.Reservations...)
+}
+
+// Add stores a validated reservation and returns it with its ID
+func (rm *ReservationManager) Add(reservation Reservation) (Reservation, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	reservation.ID = strconv.Itoa(rm.state.NextID)
+	reservation.CreatedAt = time.Now()
+	rm.state.NextID++
+	rm.state.Reservations = append(rm.state.Reservations, reservation)
+	return reservation, rm.saveLocked()
+}
+
+// Delete removes a reservation
+func (rm *ReservationManager) Delete(id string) (bool, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for i, reservation := range rm.state.Reservations {
+		if reservation.ID == id {
+			rm.state.Reservations = append(rm.state.Reservations[:i], rm.state.Reservations[i+1:]...)
+			return true, rm.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// PortReservation returns the reservation covering port, if any. It is
+// safe to call on a nil manager.
+func (rm *ReservationManager) PortReservation(port string) (Reservation, bool) {
+	if rm == nil {
+		return Reservation{}, false
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, reservation := range rm.state.Reservations {
+		if reservation.coversPort(port) {
+			return reservation, true
+		}
+	}
+	return Reservation{}, false
+}
+
+// AddressReservation returns the reservation covering address, if any. It
+// is safe to call on a nil manager.
+func (rm *ReservationManager) AddressReservation(address string) (Reservation, bool) {
+	if rm == nil {
+		return Reservation{}, false
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for _, reservation := range rm.state.Reservations {
+		if reservation.coversAddress(address) {
+			return reservation, true
+		}
+	}
+	return Reservation{}, false
+}
+
+// writeReservedPort rejects a port that is reserved, reporting whether it
+// wrote an error
+func (a *App) writeReservedPort(w http.ResponseWriter, port string) bool {
+	reservation, reserved := a.reservations.PortReservation(port)
+	if !reserved {
+		return false
+	}
+	writeErrorDetails(w, http.StatusConflict, errCodePortReserved, "Port is reserved for "+reservation.Owner, map[string]interface{}{
+		"port":           port,
+		"reservation_id": reservation.ID,
+	})
+	return true
+}
+
+// handleGetReservations lists all reservations
+func (a *App) handleGetReservations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.reservations.List())
+}
+
+// handleCreateReservation reserves ports and/or addresses for an external
+// system. Anything already assigned to a server is refused.
+func (a *App) handleCreateReservation(w http.ResponseWriter, r *http.Request) {
+	var reservation Reservation
+	if err := json.NewDecoder(r.Body).Decode(&reservation); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := reservation.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	for _, id := range a.serverIDs() {
+		server, exists := a.GetServer(id)
+		if !exists {
+			continue
+		}
+		if reservation.coversPort(server.Port) || reservation.coversAddress(server.IPv6Address) {
+			writeErrorDetails(w, http.StatusConflict, errCodeConflict, "Reservation overlaps server "+id, map[string]interface{}{
+				"server_id":    id,
+				"port":         server.Port,
+				"ipv6_address": server.IPv6Address,
+			})
+			return
+		}
+	}
+
+	reservation, err := a.reservations.Add(reservation)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save reservation: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
+
+// handleDeleteReservation releases a reservation
+func (a *App) handleDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	deleted, err := a.reservations.Delete(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save reservations: %v", err))
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Reservation not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
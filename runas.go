@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// defaultMemberUser is the account servers of members run as unless
+// PSM_MEMBER_USER names another
+const defaultMemberUser = "nobody"
+
+// validUsername matches the portable subset of Unix user names
+var validUsername = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*\$?$`)
+
+// runAccount is the Unix account a server's processes run as
+type runAccount struct {
+	name   string
+	home   string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+// lookupRunAccount resolves the account a server runs as. Servers without
+// a run_as_user keep running as the user owning the manager's home
+// directory.
+func lookupRunAccount(name string) (runAccount, error) {
+	if name == "" {
+		name = getCurrentUsername()
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return runAccount{}, fmt.Errorf("user %s does not exist", name)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return runAccount{}, fmt.Errorf("user %s has a non-numeric uid", name)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return runAccount{}, fmt.Errorf("user %s has a non-numeric gid", name)
+	}
+
+	account := runAccount{name: u.Username, home: u.HomeDir, uid: uint32(uid), gid: uint32(gid)}
+	groupIDs, _ := u.GroupIds()
+	for _, groupID := range groupIDs {
+		if g, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+			account.groups = append(account.groups, uint32(g))
+		}
+	}
+	return account, nil
+}
+
+// credential returns the credential that makes a started process run as
+// the account
+func (ra runAccount) credential() *syscall.Credential {
+	return &syscall.Credential{Uid: ra.uid, Gid: ra.gid, Groups: ra.groups}
+}
+
+// environment returns the variables that describe the account, overriding
+// the manager's own
+func (ra runAccount) environment() []string {
+	return []string{"HOME=" + ra.home, "USER=" + ra.name, "LOGNAME=" + ra.name}
+}
+
+// chownTree hands path and everything below it to the account, so the
+// server can read its generated config and write its access log
+func (ra runAccount) chownTree(path string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, int(ra.uid), int(ra.gid))
+	})
+}
+
+// runAsUser returns the user a server's processes and commands run as
+// when the manager is root. Servers of members without a run_as_user run
+// as PSM_MEMBER_USER, nobody by default, instead of the manager's own
+// account; empty means the manager's account.
+func (a *App) runAsUser(server Server) string {
+	if server.RunAsUser == "" && server.Owner != "" && !a.isAdmin(server.Owner) {
+		return firstNonEmpty(a.memberUser, defaultMemberUser)
+	}
+	return server.RunAsUser
+}
+
+// SetRunAsUser sets the user a server runs as from its next start; empty
+// restores the default
+func (a *App) SetRunAsUser(id, username string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.RunAsUser = username
+
+	a.requestSave()
+	return true
+}
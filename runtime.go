@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runtimeBinary is the PHP runtime servers are started with
+const runtimeBinary = "frankenphp"
+
+// RuntimeInfo identifies an installed runtime binary. A package upgrade
+// changes its size, modification time or version.
+type RuntimeInfo struct {
+	Binary  string    `json:"binary"`
+	Version string    `json:"version"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// sameBinary reports whether two infos describe the same file on disk
+func (ri RuntimeInfo) sameBinary(other RuntimeInfo) bool {
+	return ri.Binary == other.Binary && ri.Size == other.Size && ri.ModTime.Equal(other.ModTime)
+}
+
+// RuntimeStatus reports the runtime a server was started with and whether
+// the installed runtime has changed since
+type RuntimeStatus struct {
+	ServerID           string      `json:"server_id"`
+	StartedWith        RuntimeInfo `json:"started_with"`
+	RestartRecommended bool        `json:"restart_recommended"`
+}
+
+// RuntimeWatcher tracks the installed runtime and the runtime each running
+// server was started with, so servers still running an upgraded binary can
+// be flagged
+type RuntimeWatcher struct {
+	mu       sync.Mutex
+	current  RuntimeInfo
+	started  map[string]RuntimeInfo
+	warnings *WarningCenter
+}
+
+// NewRuntimeWatcher creates a runtime watcher
+func NewRuntimeWatcher(warnings *WarningCenter) *RuntimeWatcher {
+	return &RuntimeWatcher{
+		started:  make(map[string]RuntimeInfo),
+		warnings: warnings,
+	}
+}
+
+// resolveRuntime locates the runtime binary and reads its version. The
+// version is only queried again when the file itself changed.
+func resolveRuntime(previous RuntimeInfo) (RuntimeInfo, error) {
+	path, err := findRuntimeBinary(runtimeBinary)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+
+	info := RuntimeInfo{Binary: path, Size: stat.Size(), ModTime: stat.ModTime()}
+	if info.sameBinary(previous) {
+		info.Version = previous.Version
+		return info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "version").Output()
+	if err == nil {
+		info.Version = strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	}
+	return info, nil
+}
+
+// Check refreshes the installed runtime and raises a warning when it
+// changed while servers are running the previous one
+func (rw *RuntimeWatcher) Check() RuntimeInfo {
+	rw.mu.Lock()
+	previous := rw.current
+	rw.mu.Unlock()
+
+	info, err := resolveRuntime(previous)
+	if err != nil {
+		return previous
+	}
+
+	rw.mu.Lock()
+	rw.current = info
+	affected := 0
+	for _, started := range rw.started {
+		if !started.sameBinary(info) {
+			affected++
+		}
+	}
+	rw.mu.Unlock()
+
+	if previous.Binary != "" && !previous.sameBinary(info) && affected > 0 {
+		rw.warnings.Add("runtime", "%s changed (%s -> %s); %d running server(s) should be restarted", runtimeBinary, previous.Version, info.Version, affected)
+	}
+	return info
+}
+
+// RecordStart remembers the runtime a server was started with
+func (rw *RuntimeWatcher) RecordStart(serverID string) {
+	if rw == nil {
+		return
+	}
+	info := rw.Check()
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.started[serverID] = info
+}
+
+// Forget drops a stopped server
+func (rw *RuntimeWatcher) Forget(serverID string) {
+	if rw == nil {
+		return
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	delete(rw.started, serverID)
+}
+
+// Status returns the runtime status of a running server
+func (rw *RuntimeWatcher) Status(serverID string) (RuntimeStatus, bool) {
+	if rw == nil {
+		return RuntimeStatus{}, false
+	}
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	started, exists := rw.started[serverID]
+	if !exists {
+		return RuntimeStatus{}, false
+	}
+	return RuntimeStatus{
+		ServerID:           serverID,
+		StartedWith:        started,
+		RestartRecommended: rw.current.Binary != "" && !started.sameBinary(rw.current),
+	}, true
+}
+
+// Outdated returns the IDs of running servers started with an older
+// runtime, ordered numerically
+func (rw *RuntimeWatcher) Outdated() []string {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	ids := []string{}
+	for id, started := range rw.started {
+		if rw.current.Binary != "" && !started.sameBinary(rw.current) {
+			ids = append(ids, id)
+		}
+	}
+	sortByNumericID(ids)
+	return ids
+}
+
+// Current returns the installed runtime as of the last check
+func (rw *RuntimeWatcher) Current() RuntimeInfo {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.current
+}
+
+// Run checks the runtime every interval and restarts outdated servers
+// whose runtime_upgrade setting is "restart" while their maintenance
+// window is open (or at any time when none is set)
+func (rw *RuntimeWatcher) Run(interval time.Duration, app *App) {
+	for {
+		rw.Check()
+		app.restartOutdatedServers(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// restartOutdatedServers restarts servers running an old runtime when
+// their settings allow it at time now, unless the manager is frozen
+func (a *App) restartOutdatedServers(now time.Time) {
+	due := []string{}
+	for _, id := range a.runtime.Outdated() {
+		settings, exists := a.EffectiveSettings(id)
+		if !exists || settings["runtime_upgrade"].Value != "restart" {
+			continue
+		}
+		if !a.MaintenanceOpen(id, now) {
+			continue
+		}
+		due = append(due, id)
+	}
+	if len(due) > 0 && a.Frozen() {
+		logAttrs(context.Background(), slog.LevelInfo, "runtime restart skipped", slog.String("reason", "frozen"), slog.Any("servers", due))
+		return
+	}
+
+	for _, id := range due {
+		ctx := withRequestID(context.Background(), newRequestID())
+		logAttrs(ctx, slog.LevelInfo, "runtime restart", slog.String("server", id))
+		if a.StopServerContext(ctx, id) && !a.StartServerContext(ctx, id) {
+			a.warnings.AddContext(ctx, "runtime", "Server %s did not start again after the runtime upgrade", id)
+		}
+	}
+}
+
+// handleGetRuntime reports the installed runtime and every running server
+// that should be restarted to pick it up
+func (a *App) handleGetRuntime(w http.ResponseWriter, r *http.Request) {
+	current := a.runtime.Check()
+
+	statuses := []RuntimeStatus{}
+	for _, id := range a.runtime.Outdated() {
+		if status, exists := a.runtime.Status(id); exists {
+			statuses = append(statuses, status)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":  current,
+		"outdated": statuses,
+	})
+}
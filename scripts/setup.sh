@@ -26,33 +26,14 @@ echo "Enabling IPv6 forwarding..."
 echo "net.ipv6.conf.all.forwarding=1" >> /etc/sysctl.conf
 sysctl -p
 
-# Create systemd service file
-echo "Creating systemd service..."
-cat > /etc/systemd/system/php-server-manager.service << EOF
-[Unit]
-Description=PHP Server Manager with VLAN
-After=network.target
-
-[Service]
-Type=simple
-User=root
-WorkingDirectory=/opt/php-server-manager
-ExecStart=/opt/php-server-manager/php-server-manager
-Restart=always
-RestartSec=5
-
-[Install]
-WantedBy=multi-user.target
-EOF
-
 # Create installation directory
 mkdir -p /opt/php-server-manager
 
 echo "Setup completed!"
 echo "To install the application:"
 echo "1. Copy the compiled binary to /opt/php-server-manager/"
-echo "2. Run: systemctl enable php-server-manager"
-echo "3. Run: systemctl start php-server-manager"
+echo "2. Run: /opt/php-server-manager/php-server-manager passwd admin"
+echo "3. Run: /opt/php-server-manager/php-server-manager install-service"
+echo "4. Run: systemctl daemon-reload && systemctl enable --now php-server-manager"
 echo ""
 echo "The application will be available at http://localhost"
-echo "Default password: admin123"
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSearchLimit is how many results a search returns by default
+	defaultSearchLimit = 20
+	// searchedEvents is how many of each server's latest history entries
+	// are searched
+	searchedEvents = 50
+)
+
+// searchTypeOrder ranks result types with equal scores
+var searchTypeOrder = map[string]int{"server": 0, "group": 1, "user": 2, "event": 3}
+
+// SearchResult is one match of a search
+type SearchResult struct {
+	Type     string     `json:"type"` // server, group, user or event
+	ID       string     `json:"id"`
+	Title    string     `json:"title"`
+	Subtitle string     `json:"subtitle,omitempty"`
+	Match    string     `json:"match"` // the field that matched, e.g. directory
+	ServerID string     `json:"server_id,omitempty"`
+	Time     *time.Time `json:"time,omitempty"`
+	score    int
+}
+
+// searchScore rates how well value matches the lowercase query: exact
+// matches beat prefixes, which beat substrings. Zero means no match.
+func searchScore(value, query string) int {
+	value = strings.ToLower(value)
+	switch {
+	case value == "":
+		return 0
+	case value == query:
+		return 3
+	case strings.HasPrefix(value, query):
+		return 2
+	case strings.Contains(value, query):
+		return 1
+	}
+	return 0
+}
+
+// bestField returns the best matching field among name/value pairs
+func bestField(query string, fields ...string) (string, int) {
+	match, best := "", 0
+	for i := 0; i+1 < len(fields); i += 2 {
+		if score := searchScore(fields[i+1], query); score > best {
+			match, best = fields[i], score
+		}
+	}
+	return match, best
+}
+
+// Search finds servers by name, ID, port, directory, domain or label,
+// groups by name, users by name and recent history events by event or
+// details
+func (a *App) Search(query string, current string) []SearchResult {
+	query = strings.ToLower(strings.TrimSpace(query))
+	results := []SearchResult{}
+	if query == "" {
+		return results
+	}
+
+	servers := []Server{}
+	for _, id := range a.serverIDs() {
+		if server, exists := a.GetServer(id); exists {
+			servers = append(servers, server)
+		}
+	}
+	names := make(map[string]string, len(servers))
+	for _, server := range servers {
+		names[server.ID] = server.Name
+		fields := []string{"name", server.Name, "id", server.ID, "port", server.Port, "directory", server.Directory}
+		for _, domain := range a.traffic.Domains(server.ID) {
+			fields = append(fields, "domain", domain.Host)
+		}
+		for key, value := range server.Labels {
+			fields = append(fields, "label", key+"="+value)
+		}
+		if match, score := bestField(query, fields...); score > 0 {
+			state := "stopped"
+			if server.Running {
+				state = "running"
+			}
+			results = append(results, SearchResult{
+				Type: "server", ID: server.ID, Title: server.Name, ServerID: server.ID, Match: match, score: score,
+				Subtitle: "port " + server.Port + " · " + server.Directory + " · " + state,
+			})
+		}
+	}
+
+	for _, group := range a.GetGroups() {
+		if match, score := bestField(query, "name", group.Name, "id", group.ID); score > 0 {
+			results = append(results, SearchResult{
+				Type: "group", ID: group.ID, Title: group.Name, Match: match, score: score,
+				Subtitle: strconv.Itoa(len(group.Servers)) + " servers",
+			})
+		}
+	}
+
+	if a.store != nil {
+		users, _ := a.store.Users()
+		if !containsString(users, current) {
+			users = append(users, current)
+		}
+		for _, user := range users {
+			if score := searchScore(user, query); score > 0 {
+				results = append(results, SearchResult{Type: "user", ID: user, Title: user, Match: "name", score: score})
+			}
+		}
+
+		for _, server := range servers {
+			entries, _, err := a.store.History(server.ID, searchedEvents)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if match, score := bestField(query, "event", entry.Event, "details", entry.Details); score > 0 {
+					entryTime := entry.Time
+					results = append(results, SearchResult{
+						Type: "event", ID: server.ID + "/" + strconv.FormatUint(entry.Sequence, 10),
+						Title: entry.Event + " · " + names[server.ID], Subtitle: entry.Details,
+						ServerID: server.ID, Match: match, Time: &entryTime, score: score,
+					})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		x, y := results[i], results[j]
+		if x.score != y.score {
+			return x.score > y.score
+		}
+		if x.Type != y.Type {
+			return searchTypeOrder[x.Type] < searchTypeOrder[y.Type]
+		}
+		// Newest events first
+		if x.Time != nil && y.Time != nil {
+			return x.Time.After(*y.Time)
+		}
+		return strings.ToLower(x.Title) < strings.ToLower(y.Title)
+	})
+	return results
+}
+
+// handleSearch searches servers, groups, users and recent events
+// (?q=billing&limit=20&type=server)
+func (a *App) handleSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if strings.TrimSpace(query.Get("q")) == "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "q is required")
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	kind := query.Get("type")
+	if _, known := searchTypeOrder[kind]; kind != "" && !known {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "type must be server, group, user or event")
+		return
+	}
+
+	results := []SearchResult{}
+	for _, result := range a.Search(query.Get("q"), userFromContext(r.Context())) {
+		if kind == "" || result.Type == kind {
+			results = append(results, result)
+		}
+	}
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":   query.Get("q"),
+		"total":   total,
+		"results": results,
+	})
+}
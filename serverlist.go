@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultPerPage is the page size when ?page is given without ?per_page
+	defaultPerPage = 50
+	// maxPerPage bounds the page size
+	maxPerPage = 500
+)
+
+// ServerListOptions searches, sorts and pages a server list. Zero options
+// return every server ordered by ID.
+type ServerListOptions struct {
+	Query   string // case-insensitive substring of name, ID, port, directory, address or a label
+	Sort    string // id, name, port or status
+	Desc    bool
+	Page    int // from 1; 0 returns every server
+	PerPage int
+}
+
+// parseServerListOptions reads ?q=, ?sort=, ?order=, ?page= and ?per_page=
+func parseServerListOptions(query url.Values) (ServerListOptions, error) {
+	opts := ServerListOptions{Query: strings.ToLower(strings.TrimSpace(query.Get("q"))), Sort: query.Get("sort")}
+
+	switch opts.Sort {
+	case "", "id", "name", "port", "status":
+	default:
+		return opts, fmt.Errorf("sort must be id, name, port or status")
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("order must be asc or desc")
+	}
+
+	if value := query.Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			return opts, fmt.Errorf("page must be a positive number")
+		}
+		opts.Page = page
+		opts.PerPage = defaultPerPage
+	}
+	if value := query.Get("per_page"); value != "" {
+		perPage, err := strconv.Atoi(value)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return opts, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+		}
+		opts.PerPage = perPage
+		if opts.Page == 0 {
+			opts.Page = 1
+		}
+	}
+	return opts, nil
+}
+
+// matchesQuery reports whether a server contains the search text
+func (s *Server) matchesQuery(text string) bool {
+	if text == "" {
+		return true
+	}
+	for _, field := range []string{s.Name, s.ID, s.Port, s.Directory, s.IPv6Address} {
+		if strings.Contains(strings.ToLower(field), text) {
+			return true
+		}
+	}
+	for key, value := range s.Labels {
+		if strings.Contains(strings.ToLower(key+"="+value), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// numericLess orders numeric strings such as IDs and ports by value
+func numericLess(a, b string) bool {
+	x, errX := strconv.Atoi(a)
+	y, errY := strconv.Atoi(b)
+	if errX != nil || errY != nil {
+		return a < b
+	}
+	return x < y
+}
+
+// listServers applies opts to servers. It returns the requested page and
+// the number of servers that matched before paging. Ties are broken by ID
+// so pages are stable.
+func listServers(servers []*Server, opts ServerListOptions) ([]*Server, int) {
+	matched := make([]*Server, 0, len(servers))
+	for _, server := range servers {
+		if server.matchesQuery(opts.Query) {
+			matched = append(matched, server)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if opts.Desc {
+			a, b = b, a
+		}
+		switch opts.Sort {
+		case "name":
+			if x, y := strings.ToLower(a.Name), strings.ToLower(b.Name); x != y {
+				return x < y
+			}
+		case "port":
+			if a.Port != b.Port {
+				return numericLess(a.Port, b.Port)
+			}
+		case "status":
+			// Running servers come first
+			if a.Running != b.Running {
+				return a.Running
+			}
+		}
+		return numericLess(a.ID, b.ID)
+	})
+
+	total := len(matched)
+	if opts.Page == 0 {
+		return matched, total
+	}
+	start := (opts.Page - 1) * opts.PerPage
+	if start >= total {
+		return []*Server{}, total
+	}
+	end := start + opts.PerPage
+	if end > total {
+		end = total
+	}
+	return matched[start:end], total
+}
+
+// writePageHeaders reports the total in X-Total-Count and links the
+// neighbouring pages in a Link header, as GitHub's API does
+func writePageHeaders(w http.ResponseWriter, r *http.Request, opts ServerListOptions, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if opts.Page == 0 {
+		return
+	}
+
+	link := func(page int, rel string) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(opts.PerPage))
+		return fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, query.Encode(), rel)
+	}
+	last := (total + opts.PerPage - 1) / opts.PerPage
+	if last < 1 {
+		last = 1
+	}
+	links := []string{link(1, "first")}
+	if opts.Page > 1 {
+		links = append(links, link(opts.Page-1, "prev"))
+	}
+	if opts.Page < last {
+		links = append(links, link(opts.Page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
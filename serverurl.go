@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// defaultQRSize is the width and height of QR codes in pixels
+	defaultQRSize = 256
+	// maxQRSize bounds ?size=
+	maxQRSize = 1024
+)
+
+// bridgeInterfacePrefixes name virtual interfaces whose addresses are
+// not reachable from other devices on the LAN
+var bridgeInterfacePrefixes = []string{"docker", "br-", "veth", "virbr"}
+
+// ServerURL is one address a server can be opened at
+type ServerURL struct {
+	Kind string `json:"kind"` // tunnel, public, lan, vlan or host
+	URL  string `json:"url"`
+}
+
+// lanIPv4Addresses returns the private IPv4 addresses of the host's
+// physical interfaces
+func lanIPv4Addresses() []string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var addresses []string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		bridge := false
+		for _, prefix := range bridgeInterfacePrefixes {
+			bridge = bridge || strings.HasPrefix(iface.Name, prefix)
+		}
+		if bridge {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsPrivate() {
+				addresses = append(addresses, ipNet.IP.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// ServerURLs lists the URLs a running server can be reached at, the one
+// most likely to work from another device first: a public tunnel or
+// router port mapping, then the server's VLAN address, or the host's LAN
+// addresses and the host name the manager was reached at
+func (a *App) ServerURLs(server Server, requestHost string) []ServerURL {
+	scheme := "http"
+	if a.serverUsesTLS(server.ID) {
+		scheme = "https"
+	}
+	link := func(host string) string {
+		return scheme + "://" + net.JoinHostPort(host, server.Port) + "/"
+	}
+
+	urls := []ServerURL{}
+	if tunnel, exists := a.tunnels.Get(server.ID); exists {
+		urls = append(urls, ServerURL{Kind: "tunnel", URL: tunnel.URL})
+	}
+	if mapping, exists := a.portMappings.Get(server.ID); exists && mapping.ExternalAddress != "" {
+		urls = append(urls, ServerURL{Kind: "public", URL: scheme + "://" + mapping.ExternalAddress + "/"})
+	}
+	// A server with a VLAN address listens on that address only
+	if server.IPv6Address != "" {
+		return append(urls, ServerURL{Kind: "vlan", URL: link(server.IPv6Address)})
+	}
+
+	seen := make(map[string]bool)
+	for _, address := range lanIPv4Addresses() {
+		seen[address] = true
+		urls = append(urls, ServerURL{Kind: "lan", URL: link(address)})
+	}
+	if requestHost != "" && !seen[requestHost] && requestHost != "localhost" {
+		if ip := net.ParseIP(requestHost); ip == nil || !ip.IsLoopback() {
+			urls = append(urls, ServerURL{Kind: "host", URL: link(requestHost)})
+		}
+	}
+	return urls
+}
+
+// handleGetServerURL lists the URLs of a running server with a QR code
+// of the first, so a dev site can be opened on a phone. ?kind= picks the
+// URL the QR code encodes, ?size= its size in pixels, and ?format=png
+// returns the QR code alone as an image.
+func (a *App) handleGetServerURL(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if !server.Running {
+		writeError(w, http.StatusConflict, errCodeNotRunning, "Server is not running")
+		return
+	}
+
+	query := r.URL.Query()
+	size := defaultQRSize
+	if value := query.Get("size"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 64 || parsed > maxQRSize {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "size must be between 64 and 1024")
+			return
+		}
+		size = parsed
+	}
+
+	urls := a.ServerURLs(server, requestHostname(r))
+	kind := query.Get("kind")
+	var chosen *ServerURL
+	for i := range urls {
+		if kind == "" || urls[i].Kind == kind {
+			chosen = &urls[i]
+			break
+		}
+	}
+	switch {
+	case chosen == nil && kind != "":
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("The server has no %s URL", kind))
+		return
+	case chosen == nil:
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No other device can reach the server; open a tunnel or give it a VLAN address")
+		return
+	}
+
+	png, err := qrcode.Encode(chosen.URL, qrcode.Medium, size)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	if query.Get("format") == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"urls":      urls,
+		"qr_url":    chosen.URL,
+		"qr_png":    "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
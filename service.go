@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// managerUnitName is the systemd unit of the manager itself
+const managerUnitName = "php-server-manager.service"
+
+// serverUnitName returns the systemd unit of a managed server
+func serverUnitName(id string) string {
+	return "php-server-manager-server-" + id + ".service"
+}
+
+// generateManagerUnit returns a systemd unit that runs the manager.
+// systemd stops it with SIGTERM, on which the manager stops its PHP
+// processes and removes its VLAN interfaces before exiting.
+func generateManagerUnit(binary, username string) string {
+	var b strings.Builder
+	b.WriteString("# Generated by php-server-manager install-service\n")
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=PHP Server Manager with VLAN\n")
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n\n")
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=simple\n")
+	fmt.Fprintf(&b, "User=%s\n", username)
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", filepath.Dir(binary))
+	fmt.Fprintf(&b, "ExecStart=%s\n", binary)
+	b.WriteString("KillSignal=SIGTERM\n")
+	b.WriteString("KillMode=mixed\n")
+	b.WriteString("TimeoutStopSec=30\n")
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=5\n")
+	if username != "root" {
+		b.WriteString("AmbientCapabilities=CAP_NET_ADMIN CAP_NET_BIND_SERVICE\n")
+		b.WriteString("CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_BIND_SERVICE\n")
+	}
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// generateServerUnit returns a unit that starts and stops one server
+// through the manager's API, so the server can be controlled with
+// systemctl while the manager stays the owner of its process
+func generateServerUnit(binary, envFile string, server *Server) string {
+	var b strings.Builder
+	b.WriteString("# Generated by php-server-manager install-service\n")
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=PHP server %s (%s) on port %s\n", server.ID, server.Name, server.Port)
+	fmt.Fprintf(&b, "Requires=%s\n", managerUnitName)
+	fmt.Fprintf(&b, "After=%s\n", managerUnitName)
+	fmt.Fprintf(&b, "PartOf=%s\n\n", managerUnitName)
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=oneshot\n")
+	b.WriteString("RemainAfterExit=yes\n")
+	fmt.Fprintf(&b, "EnvironmentFile=-%s\n", envFile)
+	fmt.Fprintf(&b, "ExecStart=%s servers start %s\n", binary, server.ID)
+	fmt.Fprintf(&b, "ExecStop=%s servers stop %s\n", binary, server.ID)
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// runInstallServiceCommand implements the `install-service` subcommand
+func runInstallServiceCommand(app *App, args []string) int {
+	flags := flag.NewFlagSet("install-service", flag.ExitOnError)
+	username := flags.String("user", "root", "user the manager runs as")
+	unitDir := flags.String("dir", "/etc/systemd/system", "directory to write the units to")
+	envFile := flags.String("env-file", "/etc/default/php-server-manager", "environment file for per-server units (PSM_URL, PSM_USER, PSM_PASSWORD)")
+	withServers := flags.Bool("servers", false, "also write one unit per server")
+	printOnly := flags.Bool("print", false, "print the manager unit instead of writing it")
+	flags.Parse(args)
+
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot determine the path of the binary: %v\n", err)
+		return 1
+	}
+
+	if *printOnly {
+		fmt.Print(generateManagerUnit(binary, *username))
+		return 0
+	}
+
+	units := map[string]string{managerUnitName: generateManagerUnit(binary, *username)}
+	if *withServers {
+		servers, _ := app.GetServers(ServerListOptions{})
+		for _, server := range servers {
+			units[serverUnitName(server.ID)] = generateServerUnit(binary, *envFile, server)
+		}
+	}
+
+	if err := os.MkdirAll(*unitDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", *unitDir, err)
+		return 1
+	}
+	for name, unit := range units {
+		path := filepath.Join(*unitDir, name)
+		if err := writeFileAtomic(path, []byte(unit), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+
+	fmt.Println("Enable the service with:")
+	fmt.Println("  systemctl daemon-reload")
+	fmt.Println("  systemctl enable --now " + managerUnitName)
+	if *withServers {
+		fmt.Printf("Per-server units read PSM_URL, PSM_USER and PSM_PASSWORD from %s\n", *envFile)
+	}
+	return 0
+}
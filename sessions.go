@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSessionPrefix namespaces session keys in Redis
+const redisSessionPrefix = "php-server-manager:session:"
+
+// SessionStore keeps login sessions. Get returns nil for unknown tokens.
+type SessionStore interface {
+	Put(ctx context.Context, session *Session) error
+	Get(ctx context.Context, token string) (*Session, error)
+	Delete(ctx context.Context, token string) error
+}
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost
+// on restart and not shared between instances.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewMemorySessionStore creates an empty in-memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*Session)}
+}
+
+// Put stores a session and drops expired ones
+func (ms *MemorySessionStore) Put(ctx context.Context, session *Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	for token, existing := range ms.sessions {
+		if now.After(existing.ExpiresAt) {
+			delete(ms.sessions, token)
+		}
+	}
+	ms.sessions[session.Token] = session
+	return nil
+}
+
+// Get returns the session for a token
+func (ms *MemorySessionStore) Get(ctx context.Context, token string) (*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.sessions[token], nil
+}
+
+// Delete removes the session for a token
+func (ms *MemorySessionStore) Delete(ctx context.Context, token string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.sessions, token)
+	return nil
+}
+
+// RedisSessionStore keeps sessions in Redis so that every manager instance
+// behind a load balancer accepts the same tokens. Keys expire together
+// with their sessions.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+// newRedisClient connects to the Redis server at url
+// (redis://[:password@]host:port/db) and checks that it is reachable
+func newRedisClient(url string) (*redis.Client, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewRedisSessionStore creates a session store on a Redis connection
+func NewRedisSessionStore(client *redis.Client) *RedisSessionStore {
+	return &RedisSessionStore{client: client}
+}
+
+// Put stores a session until it expires
+func (rs *RedisSessionStore) Put(ctx context.Context, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return rs.client.Set(ctx, redisSessionPrefix+session.Token, data, time.Until(session.ExpiresAt)).Err()
+}
+
+// Get returns the session for a token
+func (rs *RedisSessionStore) Get(ctx context.Context, token string) (*Session, error) {
+	data, err := rs.client.Get(ctx, redisSessionPrefix+token).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Delete removes the session for a token
+func (rs *RedisSessionStore) Delete(ctx context.Context, token string) error {
+	return rs.client.Del(ctx, redisSessionPrefix+token).Err()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Settings holds values that can be set globally, per group and per
+// server. Empty fields are unset and inherit from the next level up.
+type Settings struct {
+	RestartPolicy     string `json:"restart_policy,omitempty"`
+	PHPVersion        string `json:"php_version,omitempty"`
+	LogLevel          string `json:"log_level,omitempty"`
+	HealthInterval    string `json:"health_interval,omitempty"`
+	RuntimeUpgrade    string `json:"runtime_upgrade,omitempty"`
+	MaintenanceWindow string `json:"maintenance_window,omitempty"`
+	LogForwarding     string `json:"log_forwarding,omitempty"`
+}
+
+// defaultSettings apply when no level sets a value
+var defaultSettings = Settings{
+	RestartPolicy:  "no",
+	PHPVersion:     "system",
+	LogLevel:       "info",
+	HealthInterval: "30s",
+	RuntimeUpgrade: "notify",
+	LogForwarding:  "off",
+}
+
+// validPHPVersion matches "system" or a major.minor version
+var validPHPVersion = regexp.MustCompile(`^(system|[0-9]+\.[0-9]+)$`)
+
+// Validate checks the values that are set
+func (s Settings) Validate() error {
+	switch s.RestartPolicy {
+	case "", "no", "on-failure", "always":
+	default:
+		return fmt.Errorf("restart_policy must be no, on-failure or always")
+	}
+
+	if s.PHPVersion != "" && !validPHPVersion.MatchString(s.PHPVersion) {
+		return fmt.Errorf("php_version must be system or a version such as 8.3")
+	}
+
+	switch s.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log_level must be debug, info, warn or error")
+	}
+
+	if s.HealthInterval != "" {
+		interval, err := time.ParseDuration(s.HealthInterval)
+		if err != nil || interval < time.Second {
+			return fmt.Errorf("health_interval must be a duration of at least 1s")
+		}
+	}
+
+	switch s.RuntimeUpgrade {
+	case "", "notify", "restart":
+	default:
+		return fmt.Errorf("runtime_upgrade must be notify or restart")
+	}
+
+	if s.MaintenanceWindow != "" {
+		if _, err := parseMaintenanceWindows(s.MaintenanceWindow); err != nil {
+			return err
+		}
+	}
+
+	if _, err := parseLogForwarding(s.LogForwarding); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fields returns the settings as name/value pairs in a stable order
+func (s Settings) fields() [][2]string {
+	return [][2]string{
+		{"restart_policy", s.RestartPolicy},
+		{"php_version", s.PHPVersion},
+		{"log_level", s.LogLevel},
+		{"health_interval", s.HealthInterval},
+		{"runtime_upgrade", s.RuntimeUpgrade},
+		{"maintenance_window", s.MaintenanceWindow},
+		{"log_forwarding", s.LogForwarding},
+	}
+}
+
+// EffectiveSetting is a resolved value and the level it came from:
+// "server", "group:<id>", "global" or "default"
+type EffectiveSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// EffectiveSettings resolves the settings of a server. Server values
+// override group values, which override global values. When a server is
+// in several groups the group with the lowest ID wins.
+func (a *App) EffectiveSettings(id string) (map[string]EffectiveSetting, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return nil, false
+	}
+
+	type level struct {
+		source   string
+		settings Settings
+	}
+	levels := []level{{"server", server.Settings}}
+
+	groupIDs := []string{}
+	for groupID, group := range a.groups {
+		for _, member := range group.Servers {
+			if member == id {
+				groupIDs = append(groupIDs, groupID)
+				break
+			}
+		}
+	}
+	sort.Slice(groupIDs, func(i, j int) bool {
+		x, _ := strconv.Atoi(groupIDs[i])
+		y, _ := strconv.Atoi(groupIDs[j])
+		return x < y
+	})
+	for _, groupID := range groupIDs {
+		levels = append(levels, level{"group:" + groupID, a.groups[groupID].Settings})
+	}
+
+	levels = append(levels, level{"global", a.settings}, level{"default", defaultSettings})
+
+	effective := make(map[string]EffectiveSetting)
+	for _, l := range levels {
+		for _, field := range l.settings.fields() {
+			if _, resolved := effective[field[0]]; resolved || field[1] == "" {
+				continue
+			}
+			effective[field[0]] = EffectiveSetting{Value: field[1], Source: l.source}
+		}
+	}
+	return effective, true
+}
+
+// GetGlobalSettings returns the global settings
+func (a *App) GetGlobalSettings() Settings {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.settings
+}
+
+// SetGlobalSettings replaces the global settings
+func (a *App) SetGlobalSettings(settings Settings) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.settings = settings
+	a.requestSave()
+}
+
+// SetGroupSettings replaces the settings of a group
+func (a *App) SetGroupSettings(id string, settings Settings) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	group, exists := a.groups[id]
+	if !exists {
+		return false
+	}
+	group.Settings = settings
+
+	a.requestSave()
+	return true
+}
+
+// SetServerSettings replaces the settings of a server
+func (a *App) SetServerSettings(id string, settings Settings) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Settings = settings
+
+	a.requestSave()
+	return true
+}
+
+// decodeSettings reads and validates a settings body
+func decodeSettings(w http.ResponseWriter, r *http.Request) (Settings, bool) {
+	var settings Settings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return settings, false
+	}
+
+	if err := settings.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return settings, false
+	}
+	return settings, true
+}
+
+// HTTP handlers for settings
+func (a *App) handleGetGlobalSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.GetGlobalSettings())
+}
+
+func (a *App) handleSetGlobalSettings(w http.ResponseWriter, r *http.Request) {
+	settings, ok := decodeSettings(w, r)
+	if !ok {
+		return
+	}
+
+	a.SetGlobalSettings(settings)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (a *App) handleSetGroupSettings(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	settings, ok := decodeSettings(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.SetGroupSettings(id, settings) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Group not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (a *App) handleSetServerSettings(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	settings, ok := decodeSettings(w, r)
+	if !ok {
+		return
+	}
+
+	if !a.SetServerSettings(id, settings) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (a *App) handleGetEffectiveSettings(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	effective, exists := a.EffectiveSettings(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effective)
+}
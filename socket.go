@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSocketMode lets only the manager's user connect to its Unix
+// socket
+const defaultSocketMode os.FileMode = 0600
+
+// socketURLHost is the host the CLI puts in request URLs sent over a Unix
+// socket; the socket path decides where they go
+const socketURLHost = "http://unix"
+
+// parseSocketMode reads PSM_SOCKET_MODE, an octal permission such as 0660
+func parseSocketMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return defaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid PSM_SOCKET_MODE %q: use octal permissions such as 0660", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenUnixSocket listens on a Unix socket with the given permissions.
+// A socket left behind by a manager that died is replaced; one another
+// manager still answers on, or a file that isn't a socket, is an error.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another process is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is only reachable with write permission, so the mode
+	// decides who may connect
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// viaUnixSocket reports whether a request came in over the Unix socket,
+// i.e. from the manager's own host
+func viaUnixSocket(r *http.Request) bool {
+	_, local := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return local
+}
+
+// unixSocketPath returns the socket path of a unix:/path or unix:///path
+// manager URL
+func unixSocketPath(baseURL string) (string, bool) {
+	if !strings.HasPrefix(baseURL, "unix:") {
+		return "", false
+	}
+	return "/" + strings.TrimLeft(strings.TrimPrefix(baseURL, "unix:"), "/"), true
+}
+
+// newCLIHTTPClient returns the HTTP client of the CLI, which dials the
+// socket for unix: manager URLs
+func newCLIHTTPClient(baseURL string, timeout time.Duration) *http.Client {
+	path, isSocket := unixSocketPath(baseURL)
+	if !isSocket {
+		return &http.Client{Timeout: timeout}
+	}
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// StartPlan describes what starting a server would do, without doing it
+type StartPlan struct {
+	ServerID       string              `json:"server_id"`
+	Backend        string              `json:"backend"`
+	Command        []string            `json:"command"`
+	WorkingDir     string              `json:"working_dir"`
+	Env            []string            `json:"env"` // added to the manager's own environment
+	User           string              `json:"user"`
+	Listen         string              `json:"listen"`
+	Directory      string              `json:"directory"` // the directory served
+	Framework      string              `json:"framework,omitempty"`
+	Caddyfile      string              `json:"caddyfile,omitempty"` // written when the server starts
+	LogFile        string              `json:"log_file"`
+	Cgroup         string              `json:"cgroup,omitempty"`
+	VLANOperations []string            `json:"vlan_operations"`
+	VLANState      *VLANReadiness      `json:"vlan_state,omitempty"`
+	Problems       []ValidationProblem `json:"problems"`
+	Ready          bool                `json:"ready"` // no problem would stop the start
+}
+
+// planStart works out the command line, environment, listen address and
+// VLAN operations StartServerContext would use for a server, and the
+// problems that would make it fail. Nothing is written or executed.
+func (a *App) planStart(id string) (StartPlan, bool) {
+	server, exists := a.GetServer(id)
+	if !exists {
+		return StartPlan{}, false
+	}
+
+	backend := server.backend()
+	daemon, isDaemon := backend.(daemonBackend)
+	plan := StartPlan{ServerID: id, Backend: backend.Name(), Env: []string{}, VLANOperations: []string{}, Problems: []ValidationProblem{}}
+	add := func(field, code, severity, message string) {
+		plan.Problems = append(plan.Problems, ValidationProblem{Field: field, Code: code, Message: message, Severity: severity})
+	}
+	if server.Running {
+		add("", "already_running", "error", "Server is already running")
+	}
+
+	preset := detectFramework(server.Directory)
+	plan.Framework = preset.Framework
+	launch := LaunchSpec{ServerID: id, Address: "0.0.0.0", Port: server.Port, Directory: preset.servedRoot(server.Directory)}
+	if server.IPv6Address != "" {
+		launch.Address = server.IPv6Address
+	}
+	if isDaemon {
+		launch.Address = daemon.ListenAddress(launch.Address)
+	}
+	plan.Listen = net.JoinHostPort(launch.Address, launch.Port)
+	plan.Directory = launch.Directory
+	if info, err := os.Stat(launch.Directory); err != nil || !info.IsDir() {
+		add("directory", "not_found", "error", "Directory "+launch.Directory+" does not exist")
+	}
+
+	if worker := server.Worker; worker != nil {
+		if _, err := worker.route(server.Directory, launch.Directory); err != nil {
+			add("worker", "invalid", "error", err.Error())
+		}
+		launch.WorkerScript, launch.WorkerWatch = worker.scriptPath(server.Directory), worker.Watch
+	}
+
+	// The site directives always include the access log, so a Caddyfile
+	// is used whenever the certificate store is available
+	if a.certs != nil {
+		launch.Caddyfile = a.certs.caddyfilePath(id)
+		plan.Caddyfile = launch.Caddyfile
+	}
+	names := make([]string, 0, len(server.Env))
+	for name := range server.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var serviceEnv []string
+	if server.Database != nil {
+		serviceEnv = maskedDatabase(*server.Database, false).Environment()
+	}
+	if isDaemon {
+		if err := a.fillDaemonSpec(&launch, server, names, serviceEnv); err != nil {
+			add("run_as_user", "user_not_found", "error", err.Error())
+		}
+	}
+	argv, err := backend.Command(launch)
+	if err != nil {
+		add("runtime", "runtime_missing", "error", err.Error())
+		argv = []string{}
+	}
+	plan.Command = argv
+	plan.WorkingDir, _ = os.Getwd()
+	plan.LogFile = filepath.Join(serverLogDir(a.configDir, id), activeLogName)
+
+	if isDaemon {
+		// The client runs as the manager, the daemon applies the user
+		plan.User = firstNonEmpty(a.runAsUser(server), "the "+backend.Name()+" default")
+	} else if a.privileges.Root {
+		account, err := lookupRunAccount(a.runAsUser(server))
+		if err != nil {
+			add("run_as_user", "user_not_found", "error", err.Error())
+		} else {
+			plan.User = account.name
+			plan.Env = append(plan.Env, account.environment()...)
+		}
+	} else {
+		plan.User = currentUsername()
+		if server.RunAsUser != "" && server.RunAsUser != plan.User {
+			add("run_as_user", "not_root", "error", fmt.Sprintf("Server is set to run as %s, which needs a manager running as root", server.RunAsUser))
+		}
+	}
+
+	if server.Limits.Set() && !isDaemon {
+		plan.Cgroup = serverCgroupDir(id)
+		if !cgroupsAvailable() {
+			add("limits", "cgroups_unavailable", "error", "Resource limits need cgroup v2 with the cpu and memory controllers and a manager running as root")
+		}
+	}
+
+	if len(server.PHPIni) > 0 || server.Debug.Enabled {
+		plan.Env = append(plan.Env, "PHP_INI_SCAN_DIR=:"+serverPHPDir(a.configDir, id))
+	}
+	plan.Env = append(plan.Env, serviceEnv...)
+	for _, name := range names {
+		plan.Env = append(plan.Env, name+"="+server.Env[name])
+	}
+
+	// Interfaces are created with their server; starting only waits for them
+	if server.VLANInterface == "" || server.IPv6Address == "" {
+		plan.VLANOperations = append(plan.VLANOperations, "none: the server has no VLAN interface and listens on all IPv4 addresses")
+	} else {
+		readiness := readVLANReadiness(server.VLANInterface, server.IPv6Address)
+		plan.VLANState = &readiness
+		plan.VLANOperations = append(plan.VLANOperations, fmt.Sprintf("wait up to %s for %s to be up with %s past duplicate address detection",
+			vlanReadyTimeout, server.VLANInterface, server.IPv6Address))
+		switch {
+		case readiness.ready():
+		case readiness.OperState == "" || readiness.DADFailed:
+			add("vlan", "vlan_not_ready", "error", readiness.String())
+		default:
+			add("vlan", "vlan_not_ready", "warning", readiness.String())
+		}
+	}
+
+	if isDaemon {
+		plan.VLANOperations = append(plan.VLANOperations, daemon.Operations(launch)...)
+	}
+
+	plan.Ready = true
+	for _, problem := range plan.Problems {
+		if problem.Severity == "error" {
+			plan.Ready = false
+		}
+	}
+	return plan, true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// secretContent is written outside the static root; no request may read it
+const secretContent = "TOP-SECRET"
+
+// newTestStaticRoot lays out a static root with a page, a hidden file and
+// symlinks pointing outside it, next to a directory holding a secret
+func newTestStaticRoot(t *testing.T) (string, string) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "css"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(root, "custom.html"):    "custom page",
+		filepath.Join(root, "css", "app.css"): "body {}",
+		filepath.Join(root, ".env"):           secretContent,
+		filepath.Join(outside, "secret.txt"):  secretContent,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func TestStaticRootOpen(t *testing.T) {
+	root, _ := newTestStaticRoot(t)
+	sr, err := newStaticRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string // content, or empty when the file must not open
+	}{
+		{"file", "/custom.html", "custom page"},
+		{"nested file", "/css/app.css", "body {}"},
+		{"parent", "/../outside/secret.txt", ""},
+		{"nested parent", "/css/../../outside/secret.txt", ""},
+		{"encoded parent", "/%2e%2e/outside/secret.txt", ""},
+		{"backslash parent", "/..\\outside\\secret.txt", ""},
+		{"backslash", "\\custom.html", ""},
+		{"absolute", "/etc/passwd", ""},
+		{"double slash absolute", "//etc/passwd", ""},
+		{"hidden file", "/.env", ""},
+		{"symlink outside", "/escape.txt", ""},
+		{"symlinked directory outside", "/outside/secret.txt", ""},
+		{"nul byte", "/custom.html\x00.txt", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := sr.Open(tt.path)
+			if tt.want == "" {
+				if err == nil {
+					file.Close()
+					t.Fatalf("Open(%q) succeeded, want an error", tt.path)
+				}
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Open(%q) = %v, want fs.ErrNotExist", tt.path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open(%q) = %v", tt.path, err)
+			}
+			defer file.Close()
+			buf := make([]byte, 64)
+			n, _ := file.Read(buf)
+			if got := string(buf[:n]); got != tt.want {
+				t.Errorf("Open(%q) read %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStaticRootRejectsFiles(t *testing.T) {
+	root, _ := newTestStaticRoot(t)
+	if _, err := newStaticRoot(filepath.Join(root, "custom.html")); err == nil {
+		t.Error("newStaticRoot accepted a file")
+	}
+	if _, err := newStaticRoot(filepath.Join(root, "missing")); err == nil {
+		t.Error("newStaticRoot accepted a missing directory")
+	}
+}
+
+func TestServeStatic(t *testing.T) {
+	root, _ := newTestStaticRoot(t)
+	if err := setStaticOverrideDir(root); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { staticOverride, staticOverrideHandler = nil, nil })
+
+	tests := []struct {
+		name   string
+		target string
+		status []int // any of these
+	}{
+		{"override file", "/custom.html", []int{http.StatusOK}},
+		{"parent", "/../outside/secret.txt", []int{http.StatusBadRequest}},
+		{"nested parent", "/css/../../outside/secret.txt", []int{http.StatusBadRequest}},
+		{"encoded parent", "/%2e%2e/outside/secret.txt", []int{http.StatusBadRequest}},
+		{"encoded nested parent", "/css/%2e%2e/%2e%2e/outside/secret.txt", []int{http.StatusBadRequest}},
+		{"backslash parent", "/..%5coutside%5csecret.txt", []int{http.StatusBadRequest}},
+		{"backslash", "/%5cetc%5cpasswd", []int{http.StatusBadRequest}},
+		{"absolute", "/etc/passwd", []int{http.StatusNotFound}},
+		{"double slash absolute", "//etc/passwd", []int{http.StatusNotFound, http.StatusMovedPermanently}},
+		{"hidden file", "/.env", []int{http.StatusBadRequest}},
+		{"symlink outside", "/escape.txt", []int{http.StatusNotFound}},
+		{"symlinked directory outside", "/outside/secret.txt", []int{http.StatusNotFound}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serveStatic(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			ok := false
+			for _, status := range tt.status {
+				ok = ok || w.Code == status
+			}
+			if !ok {
+				t.Errorf("GET %s = %d, want one of %v", tt.target, w.Code, tt.status)
+			}
+			body := w.Body.String()
+			if strings.Contains(body, secretContent) || strings.Contains(body, "root:") {
+				t.Errorf("GET %s served a file outside the root: %q", tt.target, body)
+			}
+		})
+	}
+}
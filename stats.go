@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// statsInterval is how often server processes are sampled
+	statsInterval = 10 * time.Second
+	// statsRetention is how long samples are kept
+	statsRetention = time.Hour
+	// clockTicks is USER_HZ, the unit of CPU times in /proc
+	clockTicks = 100
+)
+
+// StatsSample is the resource usage of a server's processes at one point
+// in time. Values are summed over the server's process group, which
+// includes any children the PHP runtime spawned.
+type StatsSample struct {
+	Time          time.Time `json:"time"`
+	CPUPercent    float64   `json:"cpu_percent"`
+	RSSBytes      int64     `json:"rss_bytes"`
+	OpenFiles     int       `json:"open_files"`
+	Processes     int       `json:"processes"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// ServerStats is the current usage of a server and its recent history,
+// oldest first
+type ServerStats struct {
+	ServerID string        `json:"server_id"`
+	Running  bool          `json:"running"`
+	Current  *StatsSample  `json:"current,omitempty"`
+	Samples  []StatsSample `json:"samples"`
+}
+
+// procStat is the part of /proc/<pid>/stat used for sampling
+type procStat struct {
+	pgrp       int
+	cpuTicks   uint64
+	startTicks uint64
+	rssPages   int64
+}
+
+// procStatEntry is a process and its stat
+type procStatEntry struct {
+	pid  int
+	stat procStat
+}
+
+// readProcStat parses /proc/<pid>/stat
+func readProcStat(pid int) (procStat, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, false
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 22 {
+		return procStat{}, false
+	}
+
+	var ps procStat
+	ps.pgrp, _ = strconv.Atoi(fields[2])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	ps.cpuTicks = utime + stime
+	ps.startTicks, _ = strconv.ParseUint(fields[19], 10, 64)
+	ps.rssPages, _ = strconv.ParseInt(fields[21], 10, 64)
+	return ps, true
+}
+
+// systemUptime returns the time since boot
+func systemUptime() (time.Duration, bool) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// countOpenFiles returns the number of open file descriptors of a process
+func countOpenFiles(pid int) int {
+	entries, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return 0
+	}
+	return len(entries)
+}
+
+// processGroups lists the processes of every process group
+func processGroups() map[int][]procStatEntry {
+	groups := make(map[int][]procStatEntry)
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return groups
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if stat, ok := readProcStat(pid); ok {
+			groups[stat.pgrp] = append(groups[stat.pgrp], procStatEntry{pid, stat})
+		}
+	}
+	return groups
+}
+
+// statsRing keeps the samples of one server for statsRetention
+type statsRing struct {
+	samples   []StatsSample
+	next      int
+	full      bool
+	lastTicks uint64
+	lastTime  time.Time
+}
+
+// newStatsRing creates a ring sized for statsRetention at statsInterval
+func newStatsRing() *statsRing {
+	return &statsRing{samples: make([]StatsSample, int(statsRetention/statsInterval))}
+}
+
+// add appends a sample, overwriting the oldest once the ring is full
+func (sr *statsRing) add(sample StatsSample) {
+	sr.samples[sr.next] = sample
+	sr.next = (sr.next + 1) % len(sr.samples)
+	if sr.next == 0 {
+		sr.full = true
+	}
+}
+
+// list returns the samples oldest first
+func (sr *statsRing) list() []StatsSample {
+	if !sr.full {
+		return append([]StatsSample{}, sr.samples[:sr.next]...)
+	}
+	return append(append([]StatsSample{}, sr.samples[sr.next:]...), sr.samples[:sr.next]...)
+}
+
+// latest returns the most recent sample
+func (sr *statsRing) latest() (StatsSample, bool) {
+	if !sr.full && sr.next == 0 {
+		return StatsSample{}, false
+	}
+	return sr.samples[(sr.next+len(sr.samples)-1)%len(sr.samples)], true
+}
+
+// StatsCollector samples the resource usage of running servers
+type StatsCollector struct {
+	mu    sync.Mutex
+	rings map[string]*statsRing
+}
+
+// NewStatsCollector creates a stats collector
+func NewStatsCollector() *StatsCollector {
+	return &StatsCollector{rings: make(map[string]*statsRing)}
+}
+
+// Collect samples the process groups of the given servers, keyed by
+// server ID. Servers are started as process group leaders, so the group ID
+// is the PID of the started process.
+func (sc *StatsCollector) Collect(pids map[string]int, now time.Time) {
+	groups := processGroups()
+	uptime, hasUptime := systemUptime()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for id, pid := range pids {
+		members := groups[pid]
+		if len(members) == 0 {
+			continue
+		}
+
+		sample := StatsSample{Time: now, Processes: len(members)}
+		var ticks uint64
+		for _, member := range members {
+			ticks += member.stat.cpuTicks
+			sample.RSSBytes += member.stat.rssPages * int64(os.Getpagesize())
+			sample.OpenFiles += countOpenFiles(member.pid)
+			if member.pid == pid && hasUptime {
+				started := time.Duration(member.stat.startTicks) * time.Second / clockTicks
+				sample.UptimeSeconds = int64((uptime - started) / time.Second)
+			}
+		}
+
+		ring, exists := sc.rings[id]
+		if !exists {
+			ring = newStatsRing()
+			sc.rings[id] = ring
+		}
+		// Usage between two samples; a restarted server starts over
+		if !ring.lastTime.IsZero() && ticks >= ring.lastTicks {
+			elapsed := now.Sub(ring.lastTime).Seconds()
+			if elapsed > 0 {
+				sample.CPUPercent = float64(ticks-ring.lastTicks) / clockTicks / elapsed * 100
+			}
+		}
+		ring.lastTicks, ring.lastTime = ticks, now
+		ring.add(sample)
+	}
+
+	// Keep the history of stopped servers until it ages out
+	for id, ring := range sc.rings {
+		if _, running := pids[id]; running {
+			continue
+		}
+		ring.lastTicks, ring.lastTime = 0, time.Time{}
+		if latest, ok := ring.latest(); !ok || now.Sub(latest.Time) > statsRetention {
+			delete(sc.rings, id)
+		}
+	}
+}
+
+// Stats returns the samples of a server from the last hour
+func (sc *StatsCollector) Stats(id string, now time.Time) []StatsSample {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	samples := []StatsSample{}
+	ring, exists := sc.rings[id]
+	if !exists {
+		return samples
+	}
+	for _, sample := range ring.list() {
+		if now.Sub(sample.Time) <= statsRetention {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// Forget drops the history of a deleted server
+func (sc *StatsCollector) Forget(id string) {
+	if sc == nil {
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.rings, id)
+}
+
+// Run samples the running servers every interval
+func (sc *StatsCollector) Run(interval time.Duration, app *App) {
+	for {
+		sc.Collect(app.runningPIDs(), time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// runningPIDs returns the process of every running server
+func (a *App) runningPIDs() map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pids := make(map[string]int, len(a.processes))
+	for id, pid := range a.processes {
+		pids[id] = pid
+	}
+	return pids
+}
+
+// handleGetStats reports the current resource usage of a server and its
+// samples from the last hour
+func (a *App) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	exists, running := a.GetServerStatus(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	stats := ServerStats{ServerID: id, Running: running, Samples: a.stats.Stats(id, time.Now())}
+	if running && len(stats.Samples) > 0 {
+		current := stats.Samples[len(stats.Samples)-1]
+		stats.Current = &current
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
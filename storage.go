@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// activeLogName is the log file a running server writes to; it is never
+// archived
+const activeLogName = "server.log"
+
+// accessLogName is the access log a running server writes to; rolled
+// copies are archived like other logs
+const accessLogName = "access.log"
+
+// activeLog reports whether name is a log that a running server or one of
+// its worker processes writes to
+func activeLog(name string) bool {
+	return name == activeLogName || name == accessLogName || strings.HasSuffix(name, workerLogSuffix)
+}
+
+// StorageState is the persisted configuration and history of storage
+// maintenance
+type StorageState struct {
+	ArchiveAfterDays int       `json:"archive_after_days"`
+	ReclaimedBytes   int64     `json:"reclaimed_bytes"`
+	LastRun          time.Time `json:"last_run,omitempty"`
+	LastArchived     int       `json:"last_archived"`
+	LastReclaimed    int64     `json:"last_reclaimed"`
+	PrunedLogs       int       `json:"pruned_logs"`
+
+	// Logging is the log rotation and retention policy; the default
+	// applies while it is unset
+	Logging *LogPolicy           `json:"logging,omitempty"`
+	Rotated map[string]time.Time `json:"rotated,omitempty"` // when each server's output log was last rotated
+}
+
+// ServerStorage reports disk usage of one server
+type ServerStorage struct {
+	ServerID      string `json:"server_id"`
+	LogBytes      int64  `json:"log_bytes"`
+	ReleaseBytes  int64  `json:"release_bytes"`
+	ArchivedBytes int64  `json:"archived_bytes"`
+	TotalBytes    int64  `json:"total_bytes"`
+}
+
+// StorageManager compresses old logs and releases below baseDir with zstd.
+// Logs live in logs/<server id>/ and releases in releases/<server id>/.
+type StorageManager struct {
+	mu       sync.Mutex
+	baseDir  string
+	path     string
+	state    StorageState
+	warnings *WarningCenter
+}
+
+// NewStorageManager creates a storage manager rooted at baseDir
+func NewStorageManager(baseDir string, warnings *WarningCenter) *StorageManager {
+	sm := &StorageManager{
+		baseDir:  baseDir,
+		path:     filepath.Join(baseDir, "storage.json"),
+		warnings: warnings,
+	}
+
+	if data, err := ioutil.ReadFile(sm.path); err == nil {
+		json.Unmarshal(data, &sm.state)
+	}
+
+	return sm
+}
+
+// serverLogDir returns the log directory of a server
+func serverLogDir(baseDir, id string) string {
+	return filepath.Join(baseDir, "logs", id)
+}
+
+// serverReleaseDir returns the release directory of a server
+func serverReleaseDir(baseDir, id string) string {
+	return filepath.Join(baseDir, "releases", id)
+}
+
+// State returns the current storage state
+func (sm *StorageManager) State() StorageState {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.state
+}
+
+// saveLocked persists the state; sm.mu must be held
+func (sm *StorageManager) saveLocked() error {
+	data, err := json.MarshalIndent(sm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sm.path, data, 0600)
+}
+
+// SetArchiveAfterDays configures the archive age; zero disables archival
+func (sm *StorageManager) SetArchiveAfterDays(days int) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.state.ArchiveAfterDays = days
+	return sm.saveLocked()
+}
+
+// compressFile writes src to dst with zstd
+func compressFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := zstd.NewWriter(out)
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if _, err := io.Copy(encoder, in); err != nil {
+		encoder.Close()
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// compressDir writes the contents of src to dst as a zstd-compressed tar
+func compressDir(src, dst string) error {
+	return compressTrees(dst, archiveTree{Source: src, Name: filepath.Base(src)})
+}
+
+// archiveTree is a file or directory written to an archive under Name
+type archiveTree struct {
+	Source string
+	Name   string
+}
+
+// compressTrees writes trees to dst as a zstd-compressed tar, in order
+func compressTrees(dst string, trees ...archiveTree) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := zstd.NewWriter(out)
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	tw := tar.NewWriter(encoder)
+
+	for _, tree := range trees {
+		if err = writeTarTree(tw, tree.Source, tree.Name); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// writeTarTree writes src and, for a directory, everything below it to tw
+// with src itself named name
+func writeTarTree(tw *tar.Writer, src, name string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, rel))
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
+
+// diskUsage returns the size of all regular files below path
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// archiveCandidates lists the entries of dir that are older than cutoff
+// and not yet compressed. The newest entry of a release directory is the
+// live release and is always kept.
+func archiveCandidates(dir string, cutoff time.Time, keepNewest bool) []os.FileInfo {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	candidates := []os.FileInfo{}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+	for i, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".zst") || strings.HasSuffix(entry.Name(), ".gz") || activeLog(entry.Name()) {
+			continue
+		}
+		if keepNewest && i == len(entries)-1 {
+			continue
+		}
+		if entry.ModTime().Before(cutoff) {
+			candidates = append(candidates, entry)
+		}
+	}
+	return candidates
+}
+
+// Compress archives logs and releases older than the configured age for
+// the given servers. It returns the number of entries archived and the
+// bytes reclaimed.
+func (sm *StorageManager) Compress(ids []string) (int, int64) {
+	state := sm.State()
+	if state.ArchiveAfterDays <= 0 {
+		return 0, 0
+	}
+	cutoff := time.Now().AddDate(0, 0, -state.ArchiveAfterDays)
+
+	archived := 0
+	var reclaimed int64
+	for _, id := range ids {
+		logDir := serverLogDir(sm.baseDir, id)
+		for _, entry := range archiveCandidates(logDir, cutoff, false) {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			src := filepath.Join(logDir, entry.Name())
+			if err := compressFile(src, src+".zst"); err != nil {
+				sm.warnings.Add("storage", "Error compressing %s: %v", src, err)
+				continue
+			}
+			reclaimed += entry.Size() - diskUsage(src+".zst")
+			os.Remove(src)
+			archived++
+		}
+
+		releaseDir := serverReleaseDir(sm.baseDir, id)
+		for _, entry := range archiveCandidates(releaseDir, cutoff, true) {
+			src := filepath.Join(releaseDir, entry.Name())
+			size := diskUsage(src)
+			dst := src + ".zst"
+			var err error
+			if entry.IsDir() {
+				dst = src + ".tar.zst"
+				err = compressDir(src, dst)
+			} else {
+				err = compressFile(src, dst)
+			}
+			if err != nil {
+				sm.warnings.Add("storage", "Error compressing %s: %v", src, err)
+				continue
+			}
+			reclaimed += size - diskUsage(dst)
+			os.RemoveAll(src)
+			archived++
+		}
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.state.LastRun = time.Now()
+	sm.state.LastArchived = archived
+	sm.state.LastReclaimed = reclaimed
+	sm.state.ReclaimedBytes += reclaimed
+	if err := sm.saveLocked(); err != nil {
+		sm.warnings.Add("storage", "Error saving storage state: %v", err)
+	}
+
+	return archived, reclaimed
+}
+
+// Usage reports disk usage for the given servers
+func (sm *StorageManager) Usage(ids []string) []ServerStorage {
+	usage := make([]ServerStorage, 0, len(ids))
+	for _, id := range ids {
+		entry := ServerStorage{ServerID: id}
+		for _, dir := range []string{serverLogDir(sm.baseDir, id), serverReleaseDir(sm.baseDir, id)} {
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return nil
+				}
+				switch {
+				case strings.HasSuffix(path, ".zst"):
+					entry.ArchivedBytes += info.Size()
+				case dir == serverLogDir(sm.baseDir, id):
+					entry.LogBytes += info.Size()
+				default:
+					entry.ReleaseBytes += info.Size()
+				}
+				return nil
+			})
+		}
+		entry.TotalBytes = entry.LogBytes + entry.ReleaseBytes + entry.ArchivedBytes
+		usage = append(usage, entry)
+	}
+	return usage
+}
+
+// Run compresses old entries every interval until the process exits
+func (sm *StorageManager) Run(interval time.Duration, ids func() []string) {
+	for {
+		sm.Compress(ids())
+		time.Sleep(interval)
+	}
+}
+
+// serverIDs returns the IDs of all servers in numeric order
+func (a *App) serverIDs() []string {
+	a.mu.Lock()
+	ids := make([]string, 0, len(a.servers))
+	for id := range a.servers {
+		ids = append(ids, id)
+	}
+	a.mu.Unlock()
+
+	sortByNumericID(ids)
+	return ids
+}
+
+// handleGetStorage returns the storage summary: per-server usage, totals
+// and archival history
+func (a *App) handleGetStorage(w http.ResponseWriter, r *http.Request, storage *StorageManager) {
+	usage := storage.Usage(a.serverIDs())
+
+	var total int64
+	for _, entry := range usage {
+		total += entry.TotalBytes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"servers":     usage,
+		"total_bytes": total,
+		"maintenance": storage.State(),
+	})
+}
+
+// handleSetStorageConfig sets the archive age ({"archive_after_days": 14})
+func (sm *StorageManager) handleSetStorageConfig(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		ArchiveAfterDays int `json:"archive_after_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if config.ArchiveAfterDays < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "archive_after_days must not be negative")
+		return
+	}
+
+	if err := sm.SetArchiveAfterDays(config.ArchiveAfterDays); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save storage config: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sm.State())
+}
+
+// handleCompressStorage runs the archival task immediately
+func (a *App) handleCompressStorage(w http.ResponseWriter, r *http.Request, storage *StorageManager) {
+	if storage.State().ArchiveAfterDays <= 0 {
+		writeError(w, http.StatusConflict, errCodeConflict, "Archival is disabled; set archive_after_days first")
+		return
+	}
+
+	archived, reclaimed := storage.Compress(a.serverIDs())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"archived":        archived,
+		"reclaimed_bytes": reclaimed,
+	})
+}
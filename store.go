@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxHistoryEntries bounds the history kept per server
+const maxHistoryEntries = 1000
+
+var (
+	bucketServers   = []byte("servers")
+	bucketGroups    = []byte("groups")
+	bucketTemplates = []byte("templates")
+	bucketMeta      = []byte("meta")
+	bucketHistory   = []byte("history")
+	bucketPrefs     = []byte("preferences")
+)
+
+// HistoryEntry records a change to a server definition, a state
+// transition or a VLAN assignment
+type HistoryEntry struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Details  string    `json:"details,omitempty"`
+	Server   *Server   `json:"server,omitempty"`
+}
+
+// Store keeps a copy of the configuration in an embedded bbolt database,
+// next to the per-server history and user preferences. The config file
+// stays the source of truth. Every save runs in a single transaction and
+// appends history entries for the servers it changes.
+type Store struct {
+	db *bolt.DB
+}
+
+// OpenStore opens or creates the database at path
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("database %s is locked; is the manager already running?", path)
+		}
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketServers, bucketGroups, bucketTemplates, bucketMeta, bucketHistory, bucketPrefs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Empty reports whether nothing has been saved yet
+func (s *Store) Empty() bool {
+	empty := true
+	s.db.View(func(tx *bolt.Tx) error {
+		empty = tx.Bucket(bucketMeta).Get([]byte("nextID")) == nil
+		return nil
+	})
+	return empty
+}
+
+// Load reads the stored configuration
+func (s *Store) Load() (AppConfig, error) {
+	config := AppConfig{
+		Servers:   make(map[string]*Server),
+		Groups:    make(map[string]*Group),
+		Templates: make(map[string]*Template),
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketServers).ForEach(func(k, v []byte) error {
+			var server Server
+			if err := json.Unmarshal(v, &server); err != nil {
+				return fmt.Errorf("server %s: %v", k, err)
+			}
+			config.Servers[string(k)] = &server
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketGroups).ForEach(func(k, v []byte) error {
+			var group Group
+			if err := json.Unmarshal(v, &group); err != nil {
+				return fmt.Errorf("group %s: %v", k, err)
+			}
+			config.Groups[string(k)] = &group
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketTemplates).ForEach(func(k, v []byte) error {
+			var template Template
+			if err := json.Unmarshal(v, &template); err != nil {
+				return fmt.Errorf("template %s: %v", k, err)
+			}
+			config.Templates[string(k)] = &template
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		meta := tx.Bucket(bucketMeta)
+		config.NextID, _ = strconv.Atoi(string(meta.Get([]byte("nextID"))))
+		config.NextGroupID, _ = strconv.Atoi(string(meta.Get([]byte("nextGroupID"))))
+		config.NextTemplateID, _ = strconv.Atoi(string(meta.Get([]byte("nextTemplateID"))))
+		if data := meta.Get([]byte("settings")); data != nil {
+			if err := json.Unmarshal(data, &config.Settings); err != nil {
+				return fmt.Errorf("settings: %v", err)
+			}
+		}
+		if data := meta.Get([]byte("headerRules")); data != nil {
+			if err := json.Unmarshal(data, &config.HeaderRules); err != nil {
+				return fmt.Errorf("header rules: %v", err)
+			}
+		}
+		if data := meta.Get([]byte("branding")); data != nil {
+			if err := json.Unmarshal(data, &config.Branding); err != nil {
+				return fmt.Errorf("branding: %v", err)
+			}
+		}
+		config.ReadOnly = string(meta.Get([]byte("readOnly"))) == "true"
+		if data := meta.Get([]byte("manager")); data != nil {
+			if err := json.Unmarshal(data, &config.Manager); err != nil {
+				return fmt.Errorf("manager options: %v", err)
+			}
+		}
+		if data := meta.Get([]byte("access")); data != nil {
+			if err := json.Unmarshal(data, &config.Access); err != nil {
+				return fmt.Errorf("management access: %v", err)
+			}
+		}
+		return nil
+	})
+
+	return config, err
+}
+
+// serverSnapshot encodes a server without its runtime state
+func serverSnapshot(server *Server) ([]byte, error) {
+	copied := *server
+	copied.Running = false
+	return json.Marshal(&copied)
+}
+
+// Save writes the whole configuration in one transaction and records
+// created, updated, deleted and VLAN events for the servers that changed
+func (s *Store) Save(config AppConfig) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		servers := tx.Bucket(bucketServers)
+
+		stale := [][]byte{}
+		err := servers.ForEach(func(k, v []byte) error {
+			if _, exists := config.Servers[string(k)]; !exists {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			var old Server
+			json.Unmarshal(servers.Get(k), &old)
+			if err := servers.Delete(k); err != nil {
+				return err
+			}
+			if err := appendHistory(tx, string(k), "deleted", "", &old); err != nil {
+				return err
+			}
+		}
+
+		for id, server := range config.Servers {
+			data, err := serverSnapshot(server)
+			if err != nil {
+				return err
+			}
+
+			previous := servers.Get([]byte(id))
+			if bytes.Equal(previous, data) {
+				continue
+			}
+
+			snapshot := *server
+			snapshot.Running = false
+			if previous == nil {
+				if err := appendHistory(tx, id, "created", "", &snapshot); err != nil {
+					return err
+				}
+			} else {
+				var old Server
+				json.Unmarshal(previous, &old)
+				if err := appendHistory(tx, id, "updated", "", &snapshot); err != nil {
+					return err
+				}
+				if old.VLANInterface != server.VLANInterface {
+					event, details := "vlan_assigned", server.VLANInterface
+					if server.VLANInterface == "" {
+						event, details = "vlan_released", old.VLANInterface
+					}
+					if err := appendHistory(tx, id, event, details, nil); err != nil {
+						return err
+					}
+				}
+			}
+			if previous == nil && server.VLANInterface != "" {
+				if err := appendHistory(tx, id, "vlan_assigned", server.VLANInterface, nil); err != nil {
+					return err
+				}
+			}
+
+			if err := servers.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+
+		groups, err := resetBucket(tx, bucketGroups)
+		if err != nil {
+			return err
+		}
+		for id, group := range config.Groups {
+			if err := putJSON(groups, id, group); err != nil {
+				return err
+			}
+		}
+
+		templates, err := resetBucket(tx, bucketTemplates)
+		if err != nil {
+			return err
+		}
+		for id, template := range config.Templates {
+			if err := putJSON(templates, id, template); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(bucketMeta)
+		settings, err := json.Marshal(config.Settings)
+		if err != nil {
+			return err
+		}
+		headerRules, err := json.Marshal(config.HeaderRules)
+		if err != nil {
+			return err
+		}
+		branding, err := json.Marshal(config.Branding)
+		if err != nil {
+			return err
+		}
+		manager, err := json.Marshal(config.Manager)
+		if err != nil {
+			return err
+		}
+		access, err := json.Marshal(config.Access)
+		if err != nil {
+			return err
+		}
+		for key, value := range map[string][]byte{
+			"nextID":         []byte(strconv.Itoa(config.NextID)),
+			"nextGroupID":    []byte(strconv.Itoa(config.NextGroupID)),
+			"nextTemplateID": []byte(strconv.Itoa(config.NextTemplateID)),
+			"settings":       settings,
+			"headerRules":    headerRules,
+			"branding":       branding,
+			"readOnly":       []byte(strconv.FormatBool(config.ReadOnly)),
+			"manager":        manager,
+			"access":         access,
+		} {
+			if err := meta.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// resetBucket empties a bucket by recreating it
+func resetBucket(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	if err := tx.DeleteBucket(name); err != nil {
+		return nil, err
+	}
+	return tx.CreateBucket(name)
+}
+
+// putJSON stores item under key as JSON
+func putJSON(bucket *bolt.Bucket, key string, item interface{}) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+// appendHistory adds an entry to the history of a server, dropping the
+// oldest entries beyond maxHistoryEntries
+func appendHistory(tx *bolt.Tx, serverID, event, details string, server *Server) error {
+	bucket, err := tx.Bucket(bucketHistory).CreateBucketIfNotExists([]byte(serverID))
+	if err != nil {
+		return err
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	entry := HistoryEntry{Sequence: seq, Time: time.Now(), Event: event, Details: details, Server: server}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	if err := bucket.Put(key, data); err != nil {
+		return err
+	}
+
+	if seq <= maxHistoryEntries {
+		return nil
+	}
+	cutoff := seq - maxHistoryEntries
+	expired := [][]byte{}
+	cursor := bucket.Cursor()
+	for k, _ := cursor.First(); k != nil && binary.BigEndian.Uint64(k) <= cutoff; k, _ = cursor.Next() {
+		expired = append(expired, append([]byte(nil), k...))
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record appends a history entry outside of a config save, used for state
+// transitions such as starts and stops
+func (s *Store) Record(serverID, event, details string) error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return appendHistory(tx, serverID, event, details, nil)
+	})
+}
+
+// History returns up to limit of the most recent entries for a server,
+// newest first. The boolean is false when the server has no history.
+func (s *Store) History(serverID string, limit int) ([]HistoryEntry, bool, error) {
+	entries := []HistoryEntry{}
+	found := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketHistory).Bucket([]byte(serverID))
+		if bucket == nil {
+			return nil
+		}
+		found = true
+
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			if limit > 0 && len(entries) >= limit {
+				break
+			}
+			var entry HistoryEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries, found, err
+}
+
+// Preferences returns the preferences stored for a user
+func (s *Store) Preferences(user string) (Preferences, error) {
+	prefs := Preferences{Views: []SavedView{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucketPrefs).Get([]byte(user)); data != nil {
+			return json.Unmarshal(data, &prefs)
+		}
+		return nil
+	})
+	return prefs, err
+}
+
+// UpdatePreferences changes a user's preferences with fn in a single
+// transaction
+func (s *Store) UpdatePreferences(user string, fn func(*Preferences) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketPrefs)
+		prefs := Preferences{Views: []SavedView{}}
+		if data := bucket.Get([]byte(user)); data != nil {
+			if err := json.Unmarshal(data, &prefs); err != nil {
+				return err
+			}
+		}
+		if err := fn(&prefs); err != nil {
+			return err
+		}
+		return putJSON(bucket, user, prefs)
+	})
+}
+
+// Users returns the users that have stored preferences
+func (s *Store) Users() ([]string, error) {
+	users := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPrefs).ForEach(func(k, v []byte) error {
+			users = append(users, string(k))
+			return nil
+		})
+	})
+	return users, err
+}
+
+// restoredConfigPath returns where the config file is written. Earlier
+// versions imported the file into the database and renamed it to
+// .migrated; when only such a file is left, its name keeps the format.
+func restoredConfigPath(path string) string {
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	dir := filepath.Dir(path)
+	for _, name := range configFileNames {
+		if _, err := os.Stat(filepath.Join(dir, name+".migrated")); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return path
+}
+
+// handleGetHistory returns the change history of a server; ?limit= bounds
+// the number of entries
+func (a *App) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if a.store == nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "History requires the embedded database")
+		return
+	}
+
+	entries, found, err := a.store.History(id, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	_, exists := a.servers[id]
+	a.mu.Unlock()
+	if !found && !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
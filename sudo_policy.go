@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+)
+
+// sudoRules lists every command the manager may run through sudo. At
+// runtime each argument is matched with path.Match, so "*" stays within
+// one argument; generateSudoers translates the rules into anchored
+// regular expressions that keep that property in sudoers as well.
+var sudoRules = [][]string{
+	{"ip", "link", "add", "link", "*", "name", "vlan*", "type", "vlan", "id", "*"},
+	{"ip", "link", "set", "dev", "vlan*", "up"},
+	{"ip", "link", "set", "dev", "vlan*", "mtu", "*"},
+	{"ip", "link", "set", "dev", "vlan*", "txqueuelen", "*"},
+	{"ip", "-6", "addr", "add", "*", "dev", "vlan*"},
+	{"ip", "link", "delete", "vlan*"},
+	{"sysctl", "-w", "net.ipv6.conf.vlan*.accept_ra=*"},
+	// Port redirects of reloaded servers
+	{"iptables", "-w", "-t", "nat", "-[ID]", "PREROUTING", "-p", "tcp", "--dport", "*", "-m", "addrtype", "--dst-type", "LOCAL", "-m", "comment", "--comment", "psm-reload-*", "-j", "REDIRECT", "--to-ports", "*"},
+	{"iptables", "-w", "-t", "nat", "-[ID]", "OUTPUT", "-p", "tcp", "--dport", "*", "-m", "addrtype", "--dst-type", "LOCAL", "-m", "comment", "--comment", "psm-reload-*", "-j", "REDIRECT", "--to-ports", "*"},
+	{"ip6tables", "-w", "-t", "nat", "-[ID]", "PREROUTING", "-d", "*", "-p", "tcp", "--dport", "*", "-m", "comment", "--comment", "psm-reload-*", "-j", "DNAT", "--to-destination", "*"},
+	{"ip6tables", "-w", "-t", "nat", "-[ID]", "OUTPUT", "-d", "*", "-p", "tcp", "--dport", "*", "-m", "comment", "--comment", "psm-reload-*", "-j", "DNAT", "--to-destination", "*"},
+}
+
+// sudoAllowed reports whether argv matches one of the sudo rules
+func sudoAllowed(argv []string) bool {
+	for _, rule := range sudoRules {
+		if len(rule) != len(argv) {
+			continue
+		}
+		matched := true
+		for i, pattern := range rule {
+			if ok, _ := path.Match(pattern, argv[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sudoCommand builds a sudo command, refusing anything outside the
+// allowlist. A refused command fails when it is started.
+func sudoCommand(argv ...string) *exec.Cmd {
+	cmd := exec.Command("sudo", append([]string{"-n"}, argv...)...)
+	if !sudoAllowed(argv) {
+		cmd.Err = fmt.Errorf("refusing to run %q through sudo: not in the allowlist", strings.Join(argv, " "))
+	}
+	return cmd
+}
+
+// resolveBinary returns the absolute path of a binary for sudoers
+func resolveBinary(name string) string {
+	if resolved, err := exec.LookPath(name); err == nil {
+		return resolved
+	}
+	return "/usr/sbin/" + name
+}
+
+// sudoersArgs renders the arguments of a rule as a sudoers regular
+// expression. A sudoers glob "*" also matches spaces, so a rule such as
+// "accept_ra=*" would let extra arguments through; here "*" becomes
+// "[^ ]*", which can't cross into the next argument, and the expression is
+// anchored at both ends. Regex metacharacters are put in brackets and the
+// characters sudoers treats specially are escaped.
+func sudoersArgs(args []string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		for _, c := range arg {
+			switch {
+			case c == '*':
+				b.WriteString("[^ ]*")
+			case strings.ContainsRune(".+?(){}|^$", c):
+				b.WriteString("[" + string(c) + "]")
+			case strings.ContainsRune(",:=\\", c):
+				b.WriteString("\\" + string(c))
+			default:
+				b.WriteRune(c)
+			}
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// generateSudoers renders a sudoers snippet granting exactly the
+// allowlisted commands to the given user
+func generateSudoers(username string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by php-server-manager: minimal privileges for VLAN management\n")
+	fmt.Fprintf(&b, "# Requires sudo 1.9.10 or later for the ^...$ regular expression arguments\n")
+	fmt.Fprintf(&b, "# Install with: visudo -cf <file> && install -m 0440 <file> /etc/sudoers.d/php-server-manager\n")
+	for _, rule := range sudoRules {
+		fmt.Fprintf(&b, "%s ALL=(root) NOPASSWD: %s %s\n", username, resolveBinary(rule[0]), sudoersArgs(rule[1:]))
+	}
+	return b.String()
+}
+
+// currentUsername returns the login name of the running user
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return getCurrentUsername()
+}
+
+// runSudoersCommand implements the `sudoers` subcommand
+func runSudoersCommand(args []string) int {
+	flags := flag.NewFlagSet("sudoers", flag.ExitOnError)
+	username := flags.String("user", currentUsername(), "user the manager runs as")
+	flags.Parse(args)
+
+	fmt.Fprint(os.Stdout, generateSudoers(*username))
+	return 0
+}
+
+// handleGetSudoers returns the sudoers snippet; ?user= overrides the user
+func handleGetSudoers(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		username = currentUsername()
+	}
+	if strings.ContainsAny(username, " \t\n,:=") {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid user name")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, generateSudoers(username))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// systemdRestartSec is how long systemd waits before restarting a
+	// server that failed
+	systemdRestartSec = "2s"
+	// defaultJournalLines is how many journal lines are shown by default
+	defaultJournalLines = 200
+)
+
+// transientUnitName is the name of a server's transient service. It
+// differs from the unit install-service writes, which only calls the API.
+func transientUnitName(serverID string) string {
+	return "psm-server-" + serverID + ".service"
+}
+
+// systemdBackend runs each server as a transient systemd service, created
+// through systemd's D-Bus API by systemd-run. systemd restarts the server
+// when it fails, sends its output to the journal and accounts its CPU and
+// memory in the unit's cgroup. systemd-run stays attached with --wait, so
+// the manager still sees the server end once systemd gives up on it.
+type systemdBackend struct{}
+
+// Name returns the backend name
+func (systemdBackend) Name() string {
+	return "systemd"
+}
+
+// Command returns the systemd-run argv for spec
+func (systemdBackend) Command(spec LaunchSpec) ([]string, error) {
+	systemdRun, err := findRuntimeBinary("systemd-run")
+	if err != nil {
+		return nil, err
+	}
+	binary, err := findRuntimeBinary(runtimeBinary)
+	if err != nil {
+		return nil, err
+	}
+
+	argv := []string{systemdRun, "--unit=" + transientUnitName(spec.ServerID), "--description=PHP server " + spec.ServerID,
+		"--wait", "--collect", "--quiet", "--service-type=exec",
+		"--property=Restart=on-failure", "--property=RestartSec=" + systemdRestartSec,
+		"--property=CPUAccounting=yes", "--property=MemoryAccounting=yes"}
+	if spec.Limits.CPUPercent > 0 {
+		argv = append(argv, fmt.Sprintf("--property=CPUQuota=%d%%", spec.Limits.CPUPercent))
+	}
+	if spec.Limits.MemoryMB > 0 {
+		argv = append(argv, fmt.Sprintf("--property=MemoryMax=%dM", spec.Limits.MemoryMB))
+	}
+	if uid, gid, ok := strings.Cut(spec.User, ":"); ok {
+		argv = append(argv, "--uid="+uid, "--gid="+gid)
+	}
+	// Without a value systemd-run passes on its own value of the variable
+	for _, name := range spec.Env {
+		argv = append(argv, "--setenv="+name)
+	}
+	argv = append(argv, "--")
+	return append(argv, frankenPHPArgs(binary, spec)...), nil
+}
+
+// ListenAddress returns address; the service runs on the host
+func (systemdBackend) ListenAddress(address string) string {
+	return address
+}
+
+// Operations describes what Prepare does for spec
+func (systemdBackend) Operations(spec LaunchSpec) []string {
+	return []string{"stop and reset unit " + transientUnitName(spec.ServerID) + " if one was left behind"}
+}
+
+// Prepare stops a service left behind by a manager that exited while the
+// server ran, so its name is free for the new one
+func (systemdBackend) Prepare(ctx context.Context, spec LaunchSpec) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("the systemd backend needs a manager running as root")
+	}
+	unit := transientUnitName(spec.ServerID)
+	if err := systemctl(ctx, "stop", unit); err != nil {
+		return err
+	}
+	// Fails for units that are not loaded, which is what is wanted
+	systemctl(ctx, "reset-failed", unit)
+	return nil
+}
+
+// Stop stops the server's service; --collect unloads it once stopped
+func (systemdBackend) Stop(ctx context.Context, serverID string) error {
+	return systemctl(ctx, "stop", transientUnitName(serverID))
+}
+
+// systemctl runs a systemctl command against the system manager
+func systemctl(ctx context.Context, args ...string) error {
+	output, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// UnitStatus is what systemd reports about a server's service
+type UnitStatus struct {
+	ServerID    string `json:"server_id"`
+	Unit        string `json:"unit"`
+	ActiveState string `json:"active_state"` // active, activating, deactivating, failed or inactive
+	SubState    string `json:"sub_state"`
+	Result      string `json:"result"`
+	MainPID     int    `json:"main_pid"`
+	Restarts    int    `json:"restarts"`
+	Since       string `json:"since,omitempty"`
+	MemoryBytes uint64 `json:"memory_bytes"`
+	CPUNanos    uint64 `json:"cpu_nanoseconds"`
+}
+
+// unitStatus reads the state and cgroup accounting of a server's service.
+// It returns false when systemd has no such unit loaded.
+func unitStatus(ctx context.Context, serverID string) (UnitStatus, bool, error) {
+	unit := transientUnitName(serverID)
+	output, err := exec.CommandContext(ctx, "systemctl", "show", unit,
+		"--property=LoadState,ActiveState,SubState,Result,MainPID,NRestarts,ActiveEnterTimestamp,MemoryCurrent,CPUUsageNSec").Output()
+	if err != nil {
+		return UnitStatus{}, false, fmt.Errorf("systemctl show %s: %v", unit, err)
+	}
+
+	status := UnitStatus{ServerID: serverID, Unit: unit}
+	loaded := false
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		// Unset counters are shown as [not set] or the maximum uint64
+		number, _ := strconv.ParseUint(value, 10, 64)
+		if number == ^uint64(0) {
+			number = 0
+		}
+		switch key {
+		case "LoadState":
+			loaded = value == "loaded"
+		case "ActiveState":
+			status.ActiveState = value
+		case "SubState":
+			status.SubState = value
+		case "Result":
+			status.Result = value
+		case "MainPID":
+			status.MainPID = int(number)
+		case "NRestarts":
+			status.Restarts = int(number)
+		case "ActiveEnterTimestamp":
+			status.Since = value
+		case "MemoryCurrent":
+			status.MemoryBytes = number
+		case "CPUUsageNSec":
+			status.CPUNanos = number
+		}
+	}
+	return status, loaded, nil
+}
+
+// handleGetUnit shows the state, restarts and resource usage of a
+// server's systemd service
+func (a *App) handleGetUnit(w http.ResponseWriter, r *http.Request) {
+	server, ok := a.serverOnBackend(w, r, "systemd")
+	if !ok {
+		return
+	}
+
+	status, loaded, err := unitStatus(r.Context(), server.ID)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errCodeUpstream, err.Error())
+		return
+	}
+	if !loaded {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server has no systemd unit; it is not running")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleGetUnitLogs returns the last ?lines= lines (200 by default) the
+// server's service wrote to the journal, as plain text
+func (a *App) handleGetUnitLogs(w http.ResponseWriter, r *http.Request) {
+	server, ok := a.serverOnBackend(w, r, "systemd")
+	if !ok {
+		return
+	}
+	lines := defaultJournalLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "lines must be a positive number")
+			return
+		}
+		lines = n
+	}
+
+	output, err := exec.CommandContext(r.Context(), "journalctl", "--unit", transientUnitName(server.ID),
+		"--lines", strconv.Itoa(lines), "--output", "short-iso", "--no-pager", "--quiet").Output()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errCodeUpstream, fmt.Sprintf("journalctl: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, string(output))
+}
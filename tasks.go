@@ -0,0 +1,621 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxTaskRuns bounds the runs kept per task
+	maxTaskRuns = 50
+	// maxTaskOutput bounds the command output kept with a run
+	maxTaskOutput = 16 * 1024
+	// defaultTaskTimeout bounds a run unless the task sets its own timeout
+	defaultTaskTimeout = 10 * time.Minute
+	// taskKillDelay is how long a timed out command's output is waited
+	// for after its process group was killed
+	taskKillDelay = 5 * time.Second
+)
+
+// errTaskRunning is returned while the previous run of a task still runs
+var errTaskRunning = errors.New("the previous run of this task is still running")
+
+// errTaskFrozen is recorded for scheduled runs that fall in a freeze
+var errTaskFrozen = errors.New("the manager is frozen")
+
+// ScheduledTask runs a shell command in a server's directory on a cron
+// schedule, e.g. "php artisan schedule:run" every minute
+type ScheduledTask struct {
+	ID              string    `json:"id"`
+	ServerID        string    `json:"server_id"`
+	Name            string    `json:"name,omitempty"`
+	Schedule        string    `json:"schedule"` // five cron fields or a macro such as @hourly
+	Command         string    `json:"command"`
+	Enabled         bool      `json:"enabled"`
+	Timeout         string    `json:"timeout,omitempty"`          // 10m by default
+	MaintenanceOnly bool      `json:"maintenance_only,omitempty"` // only run while the maintenance window is open
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// TaskRequest creates or replaces a task; enabled defaults to true
+type TaskRequest struct {
+	Name            string `json:"name"`
+	Schedule        string `json:"schedule"`
+	Command         string `json:"command"`
+	Enabled         *bool  `json:"enabled"`
+	Timeout         string `json:"timeout"`
+	MaintenanceOnly bool   `json:"maintenance_only"`
+}
+
+// Validate checks the schedule, command and timeout
+func (req TaskRequest) Validate() error {
+	if _, err := parseCron(req.Schedule); err != nil {
+		return err
+	}
+	if strings.TrimSpace(req.Command) == "" || strings.ContainsRune(req.Command, 0) {
+		return fmt.Errorf("command is required")
+	}
+	if req.Timeout != "" {
+		timeout, err := time.ParseDuration(req.Timeout)
+		if err != nil || timeout < time.Second || timeout > 24*time.Hour {
+			return fmt.Errorf("timeout must be a duration between 1s and 24h")
+		}
+	}
+	return nil
+}
+
+// apply copies the request onto task
+func (req TaskRequest) apply(task *ScheduledTask) {
+	task.Name = req.Name
+	task.Schedule = strings.TrimSpace(req.Schedule)
+	task.Command = req.Command
+	task.Enabled = req.Enabled == nil || *req.Enabled
+	task.Timeout = req.Timeout
+	task.MaintenanceOnly = req.MaintenanceOnly
+}
+
+// timeout returns how long a run may take
+func (task ScheduledTask) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(task.Timeout); err == nil {
+		return timeout
+	}
+	return defaultTaskTimeout
+}
+
+// TaskRun is one run of a task
+type TaskRun struct {
+	ID         int       `json:"id"`
+	TaskID     string    `json:"task_id"`
+	Trigger    string    `json:"trigger"` // schedule or manual
+	Status     string    `json:"status"`  // succeeded, failed, timed_out or skipped
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Output     string    `json:"output,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// TaskState is the persisted tasks and their runs
+type TaskState struct {
+	NextID int                  `json:"next_id"`
+	Tasks  []ScheduledTask      `json:"tasks"`
+	Runs   map[string][]TaskRun `json:"runs"`
+}
+
+// TaskManager stores scheduled tasks and their runs in tasks.json below
+// the config directory. A task never runs twice at the same time.
+type TaskManager struct {
+	mu      sync.Mutex
+	path    string
+	state   TaskState
+	running map[string]bool
+}
+
+// NewTaskManager loads the tasks stored below baseDir
+func NewTaskManager(baseDir string) *TaskManager {
+	tm := &TaskManager{
+		path:    filepath.Join(baseDir, "tasks.json"),
+		state:   TaskState{NextID: 1, Tasks: []ScheduledTask{}, Runs: make(map[string][]TaskRun)},
+		running: make(map[string]bool),
+	}
+
+	if data, err := ioutil.ReadFile(tm.path); err == nil {
+		json.Unmarshal(data, &tm.state)
+	}
+	if tm.state.Runs == nil {
+		tm.state.Runs = make(map[string][]TaskRun)
+	}
+
+	return tm
+}
+
+// saveLocked persists the tasks; tm.mu must be held
+func (tm *TaskManager) saveLocked() error {
+	data, err := json.MarshalIndent(tm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(tm.path, data, 0600)
+}
+
+// Add creates a task for a server
+func (tm *TaskManager) Add(serverID string, req TaskRequest) (ScheduledTask, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	task := ScheduledTask{ID: strconv.Itoa(tm.state.NextID), ServerID: serverID, CreatedAt: time.Now()}
+	req.apply(&task)
+	tm.state.NextID++
+	tm.state.Tasks = append(tm.state.Tasks, task)
+	return task, tm.saveLocked()
+}
+
+// Update replaces a task of a server
+func (tm *TaskManager) Update(serverID, id string, req TaskRequest) (ScheduledTask, bool, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for i := range tm.state.Tasks {
+		if tm.state.Tasks[i].ServerID == serverID && tm.state.Tasks[i].ID == id {
+			req.apply(&tm.state.Tasks[i])
+			return tm.state.Tasks[i], true, tm.saveLocked()
+		}
+	}
+	return ScheduledTask{}, false, nil
+}
+
+// Delete removes a task of a server and its runs
+func (tm *TaskManager) Delete(serverID, id string) (bool, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for i, task := range tm.state.Tasks {
+		if task.ServerID == serverID && task.ID == id {
+			tm.state.Tasks = append(tm.state.Tasks[:i], tm.state.Tasks[i+1:]...)
+			delete(tm.state.Runs, id)
+			return true, tm.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// Get returns a task of a server
+func (tm *TaskManager) Get(serverID, id string) (ScheduledTask, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for _, task := range tm.state.Tasks {
+		if task.ServerID == serverID && task.ID == id {
+			return task, true
+		}
+	}
+	return ScheduledTask{}, false
+}
+
+// List returns the tasks of a server, or of all servers for ""
+func (tm *TaskManager) List(serverID string) []ScheduledTask {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tasks := []ScheduledTask{}
+	for _, task := range tm.state.Tasks {
+		if serverID == "" || task.ServerID == serverID {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks
+}
+
+// Runs returns the runs of a task, newest first
+func (tm *TaskManager) Runs(id string) []TaskRun {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	runs := make([]TaskRun, 0, len(tm.state.Runs[id]))
+	for i := len(tm.state.Runs[id]) - 1; i >= 0; i-- {
+		runs = append(runs, tm.state.Runs[id][i])
+	}
+	return runs
+}
+
+// Forget removes the tasks of a deleted server
+func (tm *TaskManager) Forget(serverID string) {
+	if tm == nil {
+		return
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	kept := []ScheduledTask{}
+	for _, task := range tm.state.Tasks {
+		if task.ServerID == serverID {
+			delete(tm.state.Runs, task.ID)
+			continue
+		}
+		kept = append(kept, task)
+	}
+	if len(kept) != len(tm.state.Tasks) {
+		tm.state.Tasks = kept
+		tm.saveLocked()
+	}
+}
+
+// begin marks a task as running; it returns false when it already runs
+func (tm *TaskManager) begin(id string) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if tm.running[id] {
+		return false
+	}
+	tm.running[id] = true
+	return true
+}
+
+// record stores a run, clearing the running flag of a run that started
+func (tm *TaskManager) record(run *TaskRun) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if run.Status != "skipped" {
+		delete(tm.running, run.TaskID)
+	}
+
+	runs := tm.state.Runs[run.TaskID]
+	run.ID = 1
+	if len(runs) > 0 {
+		run.ID = runs[len(runs)-1].ID + 1
+	}
+	runs = append(runs, *run)
+	if len(runs) > maxTaskRuns {
+		runs = runs[len(runs)-maxTaskRuns:]
+	}
+	tm.state.Runs[run.TaskID] = runs
+	return tm.saveLocked()
+}
+
+// Run starts the tasks due in each minute until the process exits
+func (tm *TaskManager) Run(app *App) {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		app.runDueTasks(time.Now().Truncate(time.Minute))
+	}
+}
+
+// runDueTasks starts the enabled tasks of running servers whose schedule
+// matches the minute now. A run still going when the next is due makes
+// that one skipped, and so does a freeze.
+func (a *App) runDueTasks(now time.Time) {
+	for _, task := range a.tasks.List("") {
+		schedule, err := parseCron(task.Schedule)
+		if !task.Enabled || err != nil || !schedule.matches(now) {
+			continue
+		}
+		server, exists := a.GetServer(task.ServerID)
+		if !exists || !server.Running {
+			continue
+		}
+		if task.MaintenanceOnly && !a.MaintenanceOpen(task.ServerID, now) {
+			continue
+		}
+
+		ctx := withRequestID(context.Background(), newRequestID())
+		if a.Frozen() {
+			run := TaskRun{TaskID: task.ID, Trigger: "schedule", Status: "skipped", Error: errTaskFrozen.Error(), StartedAt: time.Now(), RequestID: requestIDFromContext(ctx)}
+			run.FinishedAt = run.StartedAt
+			a.tasks.record(&run)
+			logAttrs(ctx, slog.LevelWarn, "task skipped", slog.String("server", task.ServerID), slog.String("task", task.ID), slog.String("error", errTaskFrozen.Error()))
+			continue
+		}
+		go func(task ScheduledTask) {
+			if _, err := a.RunTask(ctx, task, "schedule"); err != nil {
+				logAttrs(ctx, slog.LevelWarn, "task skipped", slog.String("server", task.ServerID), slog.String("task", task.ID), slog.String("error", err.Error()))
+			}
+		}(task)
+	}
+}
+
+// taskEnvironment returns the environment of a task's command: the
+// server's user, php.ini directives, attached services and env, as the
+// PHP process gets them
+func (a *App) taskEnvironment(ctx context.Context, server Server, account *runAccount) []string {
+	env := childEnvironment()
+	if account != nil {
+		env = append(env, account.environment()...)
+	}
+	if dir := serverPHPDir(a.configDir, server.ID); dirExists(dir) {
+		env = append(env, "PHP_INI_SCAN_DIR=:"+dir)
+	}
+	if server.Database != nil {
+		env = append(env, server.Database.Environment()...)
+	}
+	client := newDockerClient()
+	if server.Redis != nil {
+		if status, err := client.inspectContainer(ctx, server.Redis.containerName(server.ID)); err == nil && status.Ports[redisPort] != "" {
+			env = append(env, redisEnvironment(status.Ports[redisPort], server.Redis.Database)...)
+		}
+	}
+	if server.Mail != nil {
+		if status, err := client.inspectContainer(ctx, server.Mail.containerName(server.ID)); err == nil {
+			if endpoint, err := mailEndpoint(status); err == nil {
+				env = append(env, endpoint.Environment()...)
+			}
+		}
+	}
+	for name, value := range server.Env {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// dirExists reports whether path is a directory
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// RunTask runs a task's command with sh in the server directory, as the
+// server's user when the manager runs as root, and records the run. The
+// whole process group is killed when the task's timeout passes.
+func (a *App) RunTask(ctx context.Context, task ScheduledTask, trigger string) (TaskRun, error) {
+	run := TaskRun{TaskID: task.ID, Trigger: trigger, StartedAt: time.Now(), RequestID: requestIDFromContext(ctx)}
+	if !a.tasks.begin(task.ID) {
+		run.Status, run.Error, run.FinishedAt = "skipped", errTaskRunning.Error(), run.StartedAt
+		a.tasks.record(&run)
+		return run, errTaskRunning
+	}
+
+	server, exists := a.GetServer(task.ServerID)
+	err := func() error {
+		if !exists {
+			return fmt.Errorf("server not found")
+		}
+		var account *runAccount
+		if a.privileges.Root {
+			found, err := lookupRunAccount(a.runAsUser(server))
+			if err != nil {
+				return err
+			}
+			account = &found
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, task.timeout())
+		defer cancel()
+		cmd := exec.CommandContext(runCtx, "sh", "-c", task.Command)
+		cmd.Dir = server.Directory
+		cmd.Env = a.taskEnvironment(ctx, server, account)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if account != nil {
+			cmd.SysProcAttr.Credential = account.credential()
+		}
+		// Kill what the command started too, or its output never closes
+		cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+		cmd.WaitDelay = taskKillDelay
+
+		output := &tailBuffer{limit: maxTaskOutput}
+		cmd.Stdout, cmd.Stderr = output, output
+		logAttrs(ctx, slog.LevelInfo, "task", slog.String("server", task.ServerID), slog.String("task", task.ID), slog.String("command", task.Command))
+		err := cmd.Run()
+		run.Output = output.String()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			run.ExitCode = exitErr.ExitCode()
+		}
+		if runCtx.Err() == context.DeadlineExceeded {
+			run.Status = "timed_out"
+			return fmt.Errorf("timed out after %s", task.timeout())
+		}
+		return err
+	}()
+
+	run.FinishedAt = time.Now()
+	switch {
+	case err == nil:
+		run.Status = "succeeded"
+	case run.Status == "":
+		run.Status = "failed"
+		fallthrough
+	default:
+		run.Error = err.Error()
+	}
+	if saveErr := a.tasks.record(&run); saveErr != nil {
+		a.warnings.AddContext(ctx, "tasks", "Error saving the runs of task %s of server %s: %v", task.ID, task.ServerID, saveErr)
+	}
+	return run, nil
+}
+
+// tailBuffer keeps the last limit bytes written to it
+type tailBuffer struct {
+	mu        sync.Mutex
+	data      []byte
+	limit     int
+	truncated bool
+}
+
+// Write appends p, dropping the oldest bytes beyond the limit
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.data = append(tb.data, p...)
+	if len(tb.data) > tb.limit {
+		tb.data = tb.data[len(tb.data)-tb.limit:]
+		tb.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the kept output
+func (tb *tailBuffer) String() string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.truncated {
+		return "...\n" + string(tb.data)
+	}
+	return string(tb.data)
+}
+
+// TaskStatus is a task with when it runs next and how it ran last
+type TaskStatus struct {
+	ScheduledTask
+	NextRun *time.Time `json:"next_run,omitempty"`
+	LastRun *TaskRun   `json:"last_run,omitempty"`
+}
+
+// taskStatus adds the next and last run to a task
+func (a *App) taskStatus(task ScheduledTask, now time.Time) TaskStatus {
+	status := TaskStatus{ScheduledTask: task}
+	if schedule, err := parseCron(task.Schedule); err == nil && task.Enabled {
+		if next, ok := schedule.next(now); ok {
+			status.NextRun = &next
+		}
+	}
+	if runs := a.tasks.Runs(task.ID); len(runs) > 0 {
+		runs[0].Output = ""
+		status.LastRun = &runs[0]
+	}
+	return status
+}
+
+// handleGetTasks lists a server's tasks with their next and last runs
+func (a *App) handleGetTasks(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	now := time.Now()
+	statuses := []TaskStatus{}
+	for _, task := range a.tasks.List(id) {
+		statuses = append(statuses, a.taskStatus(task, now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// decodeTaskRequest reads and validates a task from the body
+func decodeTaskRequest(w http.ResponseWriter, r *http.Request) (TaskRequest, bool) {
+	var req TaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return req, false
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return req, false
+	}
+	return req, true
+}
+
+// handleCreateTask adds a task to a server ({"schedule": "* * * * *",
+// "command": "php artisan schedule:run"})
+func (a *App) handleCreateTask(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	req, ok := decodeTaskRequest(w, r)
+	if !ok {
+		return
+	}
+
+	task, err := a.tasks.Add(id, req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save tasks: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a.taskStatus(task, time.Now()))
+}
+
+// handleUpdateTask replaces a task; {"enabled": false} with the rest of
+// the task pauses it
+func (a *App) handleUpdateTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	req, ok := decodeTaskRequest(w, r)
+	if !ok {
+		return
+	}
+
+	task, exists, err := a.tasks.Update(vars["id"], vars["task"], req)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Task not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save tasks: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.taskStatus(task, time.Now()))
+}
+
+// handleDeleteTask removes a task and its runs
+func (a *App) handleDeleteTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deleted, err := a.tasks.Delete(vars["id"], vars["task"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save tasks: %v", err))
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Task not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleRunTask runs a task now, whether it is enabled and the server
+// runs or not, and returns the run
+func (a *App) handleRunTask(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	task, exists := a.tasks.Get(vars["id"], vars["task"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Task not found")
+		return
+	}
+
+	// A client that gives up waiting doesn't kill the command
+	ctx := withRequestID(context.Background(), requestIDFromContext(r.Context()))
+	run, err := a.RunTask(ctx, task, "manual")
+	if err != nil {
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// handleGetTaskRuns lists the runs of a task with their output, newest
+// first
+func (a *App) handleGetTaskRuns(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, exists := a.tasks.Get(vars["id"], vars["task"]); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Task not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.tasks.Runs(vars["task"]))
+}
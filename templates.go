@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Template is a reusable server definition. DirectoryPattern may contain
+// {name} and {port} placeholders.
+type Template struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	DirectoryPattern string            `json:"directory_pattern,omitempty"`
+	VLANOptions      VLANOptions       `json:"vlan_options"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Env              map[string]string `json:"env,omitempty"`
+}
+
+// Apply fills the unset fields of spec from the template
+func (t *Template) Apply(spec ServerSpec) ServerSpec {
+	if spec.Directory == "" && t.DirectoryPattern != "" {
+		spec.Directory = strings.NewReplacer("{name}", spec.Name, "{port}", spec.Port).Replace(t.DirectoryPattern)
+	}
+
+	if spec.VLANOptions == (VLANOptions{}) {
+		spec.VLANOptions = t.VLANOptions
+	}
+
+	spec.Labels = mergeStringMaps(t.Labels, spec.Labels)
+	spec.Env = mergeStringMaps(t.Env, spec.Env)
+	return spec
+}
+
+// mergeStringMaps returns base overlaid with overrides
+func mergeStringMaps(base, overrides map[string]string) map[string]string {
+	if len(base) == 0 && len(overrides) == 0 {
+		return overrides
+	}
+
+	merged := make(map[string]string, len(base)+len(overrides))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	return merged
+}
+
+// GetTemplates returns all templates ordered by ID
+func (a *App) GetTemplates() []*Template {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	templates := make([]*Template, 0, len(a.templates))
+	for _, template := range a.templates {
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		x, _ := strconv.Atoi(templates[i].ID)
+		y, _ := strconv.Atoi(templates[j].ID)
+		return x < y
+	})
+	return templates
+}
+
+// GetTemplate returns a copy of a template
+func (a *App) GetTemplate(id string) (*Template, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	template, exists := a.templates[id]
+	if !exists {
+		return nil, false
+	}
+	copied := *template
+	return &copied, true
+}
+
+// SaveTemplate creates a template, or replaces it when t.ID is set
+func (a *App) SaveTemplate(t *Template) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if t.ID == "" {
+		t.ID = strconv.Itoa(a.nextTemplateID)
+		a.nextTemplateID++
+	} else if _, exists := a.templates[t.ID]; !exists {
+		return false
+	}
+	a.templates[t.ID] = t
+
+	a.requestSave()
+	return true
+}
+
+// DeleteTemplate removes a template
+func (a *App) DeleteTemplate(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, exists := a.templates[id]; !exists {
+		return false
+	}
+	delete(a.templates, id)
+
+	a.requestSave()
+	return true
+}
+
+// validateTemplate checks a template's fields
+func validateTemplate(t *Template) string {
+	if t.Name == "" {
+		return "Name is required"
+	}
+	if err := t.VLANOptions.Validate(); err != nil {
+		return err.Error()
+	}
+	if err := validateLabels(t.Labels); err != nil {
+		return err.Error()
+	}
+	for name := range t.Env {
+		if !validEnvName.MatchString(name) {
+			return "invalid environment variable name " + strconv.Quote(name)
+		}
+	}
+	return ""
+}
+
+// HTTP handlers for template management
+func (a *App) handleGetTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.GetTemplates())
+}
+
+func (a *App) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	template, exists := a.GetTemplate(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Template not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+func (a *App) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var template Template
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if msg := validateTemplate(&template); msg != "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, msg)
+		return
+	}
+
+	template.ID = ""
+	a.SaveTemplate(&template)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": template.ID})
+}
+
+func (a *App) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var template Template
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if msg := validateTemplate(&template); msg != "" {
+		writeError(w, http.StatusBadRequest, errCodeValidation, msg)
+		return
+	}
+
+	template.ID = id
+	if !a.SaveTemplate(&template) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Template not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *App) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !a.DeleteTemplate(id) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Template not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleCloneServer duplicates a server onto a new port and VLAN. The body
+// must give the new port and may override the name and directory.
+func (a *App) handleCloneServer(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	id := mux.Vars(r)["id"]
+
+	var cloneData struct {
+		Name      string `json:"name"`
+		Port      string `json:"port"`
+		Directory string `json:"directory"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cloneData); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	source, exists := a.servers[id]
+	var spec ServerSpec
+	if exists {
+		spec = ServerSpec{
+			Name:        source.Name + " (copy)",
+			Port:        cloneData.Port,
+			Directory:   source.Directory,
+			VLANOptions: source.VLANOptions,
+			Labels:      mergeStringMaps(source.Labels, nil),
+			Env:         mergeStringMaps(source.Env, nil),
+			PHPIni:      mergeStringMaps(source.PHPIni, nil),
+			RunAsUser:   source.RunAsUser,
+			Git:         source.Git,
+		}
+	}
+	a.mu.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	if cloneData.Name != "" {
+		spec.Name = cloneData.Name
+	}
+	if cloneData.Directory != "" {
+		spec.Directory = cloneData.Directory
+	}
+
+	if writeValidationProblems(w, a.validateServerFields(r.Context(), "", spec.Name, spec.Port, spec.Directory)) {
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	if spec.Git == nil {
+		if _, err := validateDocumentRoot(spec.Directory); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if owner, inUse := a.portOwner(spec.Port); inUse {
+		writeErrorDetails(w, http.StatusConflict, errCodePortInUse, "Port is already assigned to server "+owner, map[string]interface{}{
+			"port":      spec.Port,
+			"server_id": owner,
+		})
+		return
+	}
+	if a.writeReservedPort(w, spec.Port) {
+		return
+	}
+
+	spec.Owner = userFromContext(r.Context())
+	newID, vlanInterface, err := a.provisionServer(spec, vlanManager)
+	if err != nil {
+		writeProvisionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":             newID,
+		"vlan_interface": vlanInterface.Name,
+		"ipv6_address":   vlanInterface.IPv6Address,
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultTimelineLimit is the page size when ?limit= is not given
+	defaultTimelineLimit = 100
+	// maxTimelineLimit bounds the page size
+	maxTimelineLimit = 1000
+)
+
+// timelineKinds groups recorded events into the categories shown on the
+// server detail page
+var timelineKinds = map[string]string{
+	"created":          "config",
+	"updated":          "config",
+	"deleted":          "config",
+	"started":          "lifecycle",
+	"stopped":          "lifecycle",
+	"reattached":       "lifecycle",
+	"exited":           "lifecycle",
+	"vlan_assigned":    "network",
+	"vlan_released":    "network",
+	"health_failed":    "health",
+	"health_recovered": "health",
+}
+
+// annotationEvents maps annotation events to their history names
+var annotationEvents = map[string]string{
+	"start":  "started",
+	"stop":   "stopped",
+	"update": "updated",
+}
+
+// TimelineEvent is one entry of a server's timeline
+type TimelineEvent struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Event     string    `json:"event"`
+	Text      string    `json:"text,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// TimelinePage is one page of a server's timeline. NextSince is set when
+// more events follow and is passed back as ?since= to fetch them.
+type TimelinePage struct {
+	ServerID  string          `json:"server_id"`
+	Events    []TimelineEvent `json:"events"`
+	NextSince string          `json:"next_since,omitempty"`
+}
+
+// timelineKind returns the category of an event
+func timelineKind(event string) string {
+	if kind, ok := timelineKinds[event]; ok {
+		return kind
+	}
+	return "other"
+}
+
+// Timeline merges everything recorded about a server into one list,
+// oldest first. The persistent history is used when the embedded database
+// is available; otherwise the in-memory annotations stand in for it.
+func (a *App) Timeline(serverID string) ([]TimelineEvent, bool, error) {
+	events := []TimelineEvent{}
+	found := false
+
+	if a.store != nil {
+		entries, ok, err := a.store.History(serverID, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		found = ok
+		for _, entry := range entries {
+			events = append(events, TimelineEvent{
+				Time:  entry.Time,
+				Kind:  timelineKind(entry.Event),
+				Event: entry.Event,
+				Text:  entry.Details,
+			})
+		}
+	} else if a.annotations != nil {
+		for _, annotation := range a.annotations.Query(0, 0, serverID, "") {
+			event, ok := annotationEvents[annotation.Event]
+			if !ok {
+				event = annotation.Event
+			}
+			found = true
+			events = append(events, TimelineEvent{
+				Time:      time.Unix(0, annotation.Time*int64(time.Millisecond)),
+				Kind:      timelineKind(event),
+				Event:     event,
+				Text:      annotation.Text,
+				RequestID: annotation.RequestID,
+			})
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, found, nil
+}
+
+// parseTimelineSince accepts RFC 3339 (with optional fractional seconds)
+// or Unix milliseconds
+func parseTimelineSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return t, nil
+}
+
+// handleGetTimeline returns a page of a server's timeline; ?since= returns
+// only events after that time and ?limit= bounds the page size
+func (a *App) handleGetTimeline(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	since, err := parseTimelineSince(query.Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	limit := defaultTimelineLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTimelineLimit {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxTimelineLimit))
+			return
+		}
+	}
+
+	events, found, err := a.Timeline(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	a.mu.Lock()
+	_, exists := a.servers[id]
+	a.mu.Unlock()
+	if !found && !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	page := TimelinePage{ServerID: id, Events: []TimelineEvent{}}
+	for _, event := range events {
+		if !event.Time.After(since) {
+			continue
+		}
+		if len(page.Events) == limit {
+			page.NextSince = page.Events[limit-1].Time.Format(time.RFC3339Nano)
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
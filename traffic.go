@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// accessLogDirective returns the Caddyfile directive that writes a JSON
+// access log to path. Caddy rolls the file itself as the log policy says.
+func accessLogDirective(path string, policy LogPolicy) string {
+	return fmt.Sprintf("log {\n\t\toutput file %s {\n\t\t\t%s\n\t\t}\n\t\tformat json\n\t}",
+		caddyQuote(path), strings.Join(policy.accessLogOptions(), "\n\t\t\t"))
+}
+
+// DomainTraffic counts the requests served for one Host header
+type DomainTraffic struct {
+	Host         string    `json:"host"`
+	Requests     int64     `json:"requests"`
+	BytesServed  int64     `json:"bytes_served"`
+	BytesRead    int64     `json:"bytes_read"`
+	ServerErrors int64     `json:"server_errors"`
+	LastRequest  time.Time `json:"last_request"`
+}
+
+// ServerTraffic is the traffic of one server broken down by domain
+type ServerTraffic struct {
+	ServerID          string          `json:"server_id"`
+	ActiveConnections int             `json:"active_connections"`
+	Domains           []DomainTraffic `json:"domains"`
+}
+
+// accessLogEntry is the part of a Caddy access log line that is counted
+type accessLogEntry struct {
+	Timestamp float64 `json:"ts"`
+	Request   struct {
+		Host string `json:"host"`
+	} `json:"request"`
+	BytesRead int64 `json:"bytes_read"`
+	Size      int64 `json:"size"`
+	Status    int   `json:"status"`
+}
+
+// TrafficTracker aggregates the access logs of servers. Logs are read
+// incrementally, so counters cover everything since the log was created.
+type TrafficTracker struct {
+	mu       sync.Mutex
+	baseDir  string
+	offsets  map[string]int64
+	counters map[string]map[string]*DomainTraffic
+}
+
+// NewTrafficTracker creates a tracker reading the logs below baseDir
+func NewTrafficTracker(baseDir string) *TrafficTracker {
+	return &TrafficTracker{
+		baseDir:  baseDir,
+		offsets:  make(map[string]int64),
+		counters: make(map[string]map[string]*DomainTraffic),
+	}
+}
+
+// serverAccessLog returns the access log of a server
+func serverAccessLog(baseDir, id string) string {
+	return filepath.Join(serverLogDir(baseDir, id), accessLogName)
+}
+
+// scanLocked reads the lines appended to a server's access log since the
+// last scan. A log that shrank has been rolled and is read from the start.
+func (tt *TrafficTracker) scanLocked(id string) {
+	file, err := os.Open(serverAccessLog(tt.baseDir, id))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	offset := tt.offsets[id]
+	if stat, err := file.Stat(); err == nil && stat.Size() < offset {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+
+	domains, exists := tt.counters[id]
+	if !exists {
+		domains = make(map[string]*DomainTraffic)
+		tt.counters[id] = domains
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A partial line is read again once it is complete
+			break
+		}
+		offset += int64(len(line))
+
+		var entry accessLogEntry
+		if json.Unmarshal(line, &entry) != nil || entry.Status == 0 {
+			continue
+		}
+		host := strings.ToLower(entry.Request.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		domain, exists := domains[host]
+		if !exists {
+			domain = &DomainTraffic{Host: host}
+			domains[host] = domain
+		}
+		domain.Requests++
+		domain.BytesServed += entry.Size
+		domain.BytesRead += entry.BytesRead
+		if entry.Status >= 500 {
+			domain.ServerErrors++
+		}
+		if t := time.Unix(0, int64(entry.Timestamp*float64(time.Second))); t.After(domain.LastRequest) {
+			domain.LastRequest = t
+		}
+	}
+	tt.offsets[id] = offset
+}
+
+// Domains returns the traffic of a server per domain, busiest first
+func (tt *TrafficTracker) Domains(id string) []DomainTraffic {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tt.scanLocked(id)
+	domains := []DomainTraffic{}
+	for _, domain := range tt.counters[id] {
+		domains = append(domains, *domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Requests != domains[j].Requests {
+			return domains[i].Requests > domains[j].Requests
+		}
+		return domains[i].Host < domains[j].Host
+	})
+	return domains
+}
+
+// Forget drops the counters of a deleted server
+func (tt *TrafficTracker) Forget(id string) {
+	if tt == nil {
+		return
+	}
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	delete(tt.offsets, id)
+	delete(tt.counters, id)
+}
+
+// activeConnections counts established TCP connections to a local port.
+// Connections are not attributed to a domain until a request is logged,
+// so they are counted per server.
+func activeConnections(port string) int {
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	local := fmt.Sprintf(":%04X", number)
+
+	count := 0
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		file, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			// 01 is TCP_ESTABLISHED
+			if len(fields) > 3 && strings.HasSuffix(fields[1], local) && fields[3] == "01" {
+				count++
+			}
+		}
+		file.Close()
+	}
+	return count
+}
+
+// Traffic returns the traffic of a server
+func (a *App) Traffic(id string) (ServerTraffic, bool) {
+	server, exists := a.GetServer(id)
+	if !exists {
+		return ServerTraffic{}, false
+	}
+
+	traffic := ServerTraffic{ServerID: id, Domains: a.traffic.Domains(id)}
+	if server.Running {
+		traffic.ActiveConnections = activeConnections(server.Port)
+	}
+	return traffic, true
+}
+
+// handleGetTraffic reports a server's requests, bytes and active
+// connections per domain
+func (a *App) handleGetTraffic(w http.ResponseWriter, r *http.Request) {
+	traffic, exists := a.Traffic(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(traffic)
+}
+
+// handleGetMetrics exposes the traffic counters of all servers in the
+// Prometheus text format
+func (a *App) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
+	var requests, served, active strings.Builder
+	for _, id := range a.serverIDs() {
+		traffic, exists := a.Traffic(id)
+		if !exists {
+			continue
+		}
+		fmt.Fprintf(&active, "psm_active_connections{server=%q} %d\n", id, traffic.ActiveConnections)
+		for _, domain := range traffic.Domains {
+			fmt.Fprintf(&requests, "psm_http_requests_total{server=%q,host=%q} %d\n", id, domain.Host, domain.Requests)
+			fmt.Fprintf(&served, "psm_http_response_bytes_total{server=%q,host=%q} %d\n", id, domain.Host, domain.BytesServed)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP psm_http_requests_total Requests served per server and Host header.")
+	fmt.Fprintln(w, "# TYPE psm_http_requests_total counter")
+	fmt.Fprint(w, requests.String())
+	fmt.Fprintln(w, "# HELP psm_http_response_bytes_total Response bytes served per server and Host header.")
+	fmt.Fprintln(w, "# TYPE psm_http_response_bytes_total counter")
+	fmt.Fprint(w, served.String())
+	fmt.Fprintln(w, "# HELP psm_active_connections Established TCP connections per server.")
+	fmt.Fprintln(w, "# TYPE psm_active_connections gauge")
+	fmt.Fprint(w, active.String())
+}
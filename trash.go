@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// trashPurgeInterval is how often servers past the retention period
+	// are purged from the trash
+	trashPurgeInterval = time.Hour
+	// defaultTrashRetentionDays is how long deleted servers stay in the
+	// trash
+	defaultTrashRetentionDays = 7
+)
+
+// TrashedServer is a deleted server kept in the trash so it can be
+// restored
+type TrashedServer struct {
+	Server    Server    `json:"server"`
+	Groups    []string  `json:"groups,omitempty"` // groups it was a member of
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// TrashState is the persisted retention period and the trashed servers,
+// oldest first
+type TrashState struct {
+	RetentionDays int             `json:"retention_days"`
+	Servers       []TrashedServer `json:"servers"`
+}
+
+// TrashManager keeps deleted servers for the retention period. Until they
+// are purged, their databases, certificates, backups, tasks and other
+// resources are kept, so a restore gets all of them back.
+type TrashManager struct {
+	mu       sync.Mutex
+	path     string
+	state    TrashState
+	warnings *WarningCenter
+}
+
+// NewTrashManager creates a trash persisted in baseDir
+func NewTrashManager(baseDir string, warnings *WarningCenter) *TrashManager {
+	tm := &TrashManager{
+		path:     filepath.Join(baseDir, "trash.json"),
+		state:    TrashState{RetentionDays: defaultTrashRetentionDays, Servers: []TrashedServer{}},
+		warnings: warnings,
+	}
+
+	if data, err := ioutil.ReadFile(tm.path); err == nil {
+		json.Unmarshal(data, &tm.state)
+	}
+
+	return tm
+}
+
+// State returns the retention period and the trashed servers with when
+// each is purged
+func (tm *TrashManager) State() TrashState {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	state := tm.state
+	state.Servers = make([]TrashedServer, len(tm.state.Servers))
+	for i, trashed := range tm.state.Servers {
+		trashed.PurgeAt = trashed.DeletedAt.AddDate(0, 0, tm.state.RetentionDays)
+		state.Servers[i] = trashed
+	}
+	return state
+}
+
+// saveLocked persists the state; tm.mu must be held
+func (tm *TrashManager) saveLocked() error {
+	data, err := json.MarshalIndent(tm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(tm.path, data, 0600)
+}
+
+// SetRetentionDays configures how long deleted servers are kept; zero
+// deletes servers right away and purges the trash on its next run
+func (tm *TrashManager) SetRetentionDays(days int) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.state.RetentionDays = days
+	return tm.saveLocked()
+}
+
+// Enabled reports whether deleted servers go to the trash
+func (tm *TrashManager) Enabled() bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.state.RetentionDays > 0
+}
+
+// Get returns a trashed server
+func (tm *TrashManager) Get(id string) (TrashedServer, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	for _, trashed := range tm.state.Servers {
+		if trashed.Server.ID == id {
+			return trashed, true
+		}
+	}
+	return TrashedServer{}, false
+}
+
+// add puts a deleted server in the trash, replacing an older entry of the
+// same ID
+func (tm *TrashManager) add(trashed TrashedServer) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.removeLocked(trashed.Server.ID)
+	tm.state.Servers = append(tm.state.Servers, trashed)
+	if err := tm.saveLocked(); err != nil {
+		tm.warnings.Add("trash", "Error saving the trash: %v", err)
+	}
+}
+
+// take removes a server from the trash and returns it
+func (tm *TrashManager) take(id string) (TrashedServer, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	trashed, exists := tm.removeLocked(id)
+	if exists {
+		if err := tm.saveLocked(); err != nil {
+			tm.warnings.Add("trash", "Error saving the trash: %v", err)
+		}
+	}
+	return trashed, exists
+}
+
+// removeLocked drops a server from the trash; tm.mu must be held
+func (tm *TrashManager) removeLocked(id string) (TrashedServer, bool) {
+	for i, trashed := range tm.state.Servers {
+		if trashed.Server.ID == id {
+			tm.state.Servers = append(tm.state.Servers[:i], tm.state.Servers[i+1:]...)
+			return trashed, true
+		}
+	}
+	return TrashedServer{}, false
+}
+
+// expired returns the trashed servers past the retention period at now
+func (tm *TrashManager) expired(now time.Time) []string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ids := []string{}
+	for _, trashed := range tm.state.Servers {
+		if !trashed.DeletedAt.AddDate(0, 0, tm.state.RetentionDays).After(now) {
+			ids = append(ids, trashed.Server.ID)
+		}
+	}
+	return ids
+}
+
+// Run purges the servers past the retention period every interval until
+// the process exits. Nothing is purged while the manager is frozen, so a
+// server deleted by mistake during an incident can still be restored.
+func (tm *TrashManager) Run(interval time.Duration, app *App) {
+	for {
+		expired := tm.expired(time.Now())
+		if len(expired) > 0 && app.Frozen() {
+			logAttrs(context.Background(), slog.LevelInfo, "purge skipped", slog.String("reason", "frozen"), slog.Any("servers", expired))
+			expired = nil
+		}
+		for _, id := range expired {
+			if trashed, exists := tm.take(id); exists {
+				logAttrs(context.Background(), slog.LevelInfo, "purge", slog.String("server", id))
+				app.releaseServer(trashed.Server)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// TrashServer stops a server and moves it to the trash, or deletes it
+// when the trash is disabled. Its VLAN interface is left to the caller.
+func (a *App) TrashServer(ctx context.Context, id string) bool {
+	if !a.trash.Enabled() {
+		return a.DeleteServer(id)
+	}
+
+	server, groups, exists := a.detachServer(id)
+	if !exists {
+		return false
+	}
+	server.Running = false
+	a.trash.add(TrashedServer{Server: server, Groups: groups, DeletedAt: time.Now()})
+	a.events.Record(ctx, eventServerDeleted, id, server.Name, fmt.Sprintf("Moved %s to the trash", server.Name))
+	return true
+}
+
+// trashServerWithVLAN moves a server to the trash and removes its VLAN
+// interface
+func (a *App) trashServerWithVLAN(ctx context.Context, id string, vlanManager *VLANManager) error {
+	server, exists := a.GetServer(id)
+	if !exists || !a.TrashServer(ctx, id) {
+		return fmt.Errorf("server not found")
+	}
+
+	if err := vlanManager.RemoveVLANInterface(server.Port); err != nil {
+		return fmt.Errorf("server deleted but failed to remove VLAN interface: %v", err)
+	}
+	return nil
+}
+
+// RestoreServer takes a server out of the trash, back into the groups
+// that still exist and, when it had one, onto a recreated VLAN interface.
+// The server stays stopped. An error means the server was restored
+// without its VLAN interface.
+func (a *App) RestoreServer(ctx context.Context, id string, vlanManager *VLANManager) (Server, bool, error) {
+	trashed, exists := a.trash.take(id)
+	if !exists {
+		return Server{}, false, nil
+	}
+	server := trashed.Server
+
+	a.mu.Lock()
+	restored := server
+	a.servers[id] = &restored
+	for _, groupID := range trashed.Groups {
+		if group, exists := a.groups[groupID]; exists {
+			group.Servers = append(group.Servers, id)
+		}
+	}
+	a.requestSave()
+	a.mu.Unlock()
+
+	a.events.Record(ctx, eventServerRestored, id, server.Name, fmt.Sprintf("Restored %s from the trash", server.Name))
+	logAttrs(ctx, slog.LevelInfo, "restore", slog.String("server", id))
+
+	if server.VLANInterface == "" || !vlanManager.privileges.CanManageVLANs() {
+		return server, true, nil
+	}
+	if _, err := vlanManager.RestoreVLANInterface(server.Port, server.VLANOptions); err != nil {
+		a.warnings.AddContext(ctx, "vlan", "Error recreating the VLAN interface of restored server %s: %v", id, err)
+		return server, true, err
+	}
+	vlanManager.AssignServer(server.Port, id)
+	return server, true, nil
+}
+
+// handleGetTrash lists the servers in the trash, oldest first, with the
+// retention period
+func (a *App) handleGetTrash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.trash.State())
+}
+
+// handleSetTrashConfig sets how long deleted servers are kept
+// ({"retention_days": 7}); 0 deletes them right away
+func (a *App) handleSetTrashConfig(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		RetentionDays int `json:"retention_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if config.RetentionDays < 0 {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "retention_days must not be negative")
+		return
+	}
+
+	if err := a.trash.SetRetentionDays(config.RetentionDays); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, fmt.Sprintf("Failed to save trash config: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.trash.State())
+}
+
+// handleRestoreServer brings a server back from the trash. It fails with
+// 409 when a server with its ID exists again or another server took its
+// port.
+func (a *App) handleRestoreServer(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	id := mux.Vars(r)["id"]
+
+	a.editMu.Lock()
+	defer a.editMu.Unlock()
+
+	trashed, exists := a.trash.Get(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server is not in the trash")
+		return
+	}
+	if _, exists := a.GetServer(id); exists {
+		writeError(w, http.StatusConflict, errCodeConflict, "A server with ID "+id+" exists")
+		return
+	}
+	if owner, inUse := a.portOwner(trashed.Server.Port); inUse {
+		writeErrorDetails(w, http.StatusConflict, errCodePortInUse, "Port is already assigned to server "+owner, map[string]interface{}{
+			"port":      trashed.Server.Port,
+			"server_id": owner,
+		})
+		return
+	}
+
+	server, restored, err := a.RestoreServer(r.Context(), id, vlanManager)
+	if !restored {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server is not in the trash")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusPartialContent, errCodePartialFailure, "Server restored but failed to recreate its VLAN interface: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tunnelStartTimeout bounds how long a driver may take to report its URL
+const tunnelStartTimeout = 30 * time.Second
+
+// Tunnel is a temporary public URL forwarding to a local server
+type Tunnel struct {
+	ServerID  string    `json:"server_id"`
+	Driver    string    `json:"driver"`
+	URL       string    `json:"url"`
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	cmd       *exec.Cmd
+}
+
+// tunnelDriver describes how to run a tunneling client and find the
+// public URL in its output
+type tunnelDriver struct {
+	command func(target string) *exec.Cmd
+	url     *regexp.Regexp
+}
+
+// tunnelDrivers lists the supported tunneling clients
+var tunnelDrivers = map[string]tunnelDriver{
+	"cloudflared": {
+		command: func(target string) *exec.Cmd {
+			return exec.Command("cloudflared", "tunnel", "--no-autoupdate", "--url", target)
+		},
+		url: regexp.MustCompile(`https://[a-z0-9-]+\.trycloudflare\.com`),
+	},
+	"ngrok": {
+		command: func(target string) *exec.Cmd {
+			return exec.Command("ngrok", "http", target, "--log", "stdout", "--log-format", "logfmt")
+		},
+		url: regexp.MustCompile(`url=(https://[^\s]+)`),
+	},
+}
+
+// TunnelManager runs one tunnel per server. Tunnels end when the server
+// stops or is deleted.
+type TunnelManager struct {
+	mu       sync.Mutex
+	tunnels  map[string]*Tunnel
+	warnings *WarningCenter
+}
+
+// NewTunnelManager creates a tunnel manager
+func NewTunnelManager(warnings *WarningCenter) *TunnelManager {
+	return &TunnelManager{
+		tunnels:  make(map[string]*Tunnel),
+		warnings: warnings,
+	}
+}
+
+// Open starts a tunnel to target using the named driver and waits until
+// the driver reports the public URL
+func (tm *TunnelManager) Open(serverID, driverName, target string) (*Tunnel, error) {
+	driver, ok := tunnelDrivers[driverName]
+	if !ok {
+		return nil, fmt.Errorf("unknown tunnel driver %q", driverName)
+	}
+	if _, err := exec.LookPath(driverName); err != nil {
+		return nil, fmt.Errorf("%s was not found in PATH", driverName)
+	}
+
+	tm.mu.Lock()
+	if _, exists := tm.tunnels[serverID]; exists {
+		tm.mu.Unlock()
+		return nil, fmt.Errorf("server %s already has a tunnel", serverID)
+	}
+	tunnel := &Tunnel{ServerID: serverID, Driver: driverName, Target: target, StartedAt: time.Now()}
+	tm.tunnels[serverID] = tunnel
+	tm.mu.Unlock()
+
+	cmd := driver.command(target)
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	if err := cmd.Start(); err != nil {
+		tm.remove(serverID, tunnel)
+		return nil, fmt.Errorf("failed to start %s: %v", driverName, err)
+	}
+	tunnel.cmd = cmd
+
+	found := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			match := driver.url.FindStringSubmatch(scanner.Text())
+			if match == nil {
+				continue
+			}
+			select {
+			case found <- match[len(match)-1]:
+			default:
+			}
+		}
+		io.Copy(io.Discard, reader)
+	}()
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		writer.Close()
+		close(exited)
+		if tm.remove(serverID, tunnel) {
+			tm.warnings.Add("tunnel", "Tunnel for server %s exited unexpectedly", serverID)
+		}
+	}()
+
+	select {
+	case url := <-found:
+		tm.mu.Lock()
+		tunnel.URL = url
+		tm.mu.Unlock()
+		return tunnel, nil
+	case <-exited:
+		return nil, fmt.Errorf("%s exited before reporting a URL", driverName)
+	case <-time.After(tunnelStartTimeout):
+		tm.Close(serverID)
+		return nil, fmt.Errorf("%s did not report a URL within %s", driverName, tunnelStartTimeout)
+	}
+}
+
+// remove forgets tunnel if it is still registered for serverID
+func (tm *TunnelManager) remove(serverID string, tunnel *Tunnel) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.tunnels[serverID] != tunnel {
+		return false
+	}
+	delete(tm.tunnels, serverID)
+	return true
+}
+
+// Close stops the tunnel of a server, if any
+func (tm *TunnelManager) Close(serverID string) bool {
+	if tm == nil {
+		return false
+	}
+
+	tm.mu.Lock()
+	tunnel, exists := tm.tunnels[serverID]
+	delete(tm.tunnels, serverID)
+	tm.mu.Unlock()
+
+	if !exists {
+		return false
+	}
+	if tunnel.cmd != nil && tunnel.cmd.Process != nil {
+		tunnel.cmd.Process.Kill()
+	}
+	return true
+}
+
+// Get returns a copy of the tunnel of a server
+func (tm *TunnelManager) Get(serverID string) (Tunnel, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tunnel, exists := tm.tunnels[serverID]
+	if !exists || tunnel.URL == "" {
+		return Tunnel{}, false
+	}
+	return *tunnel, true
+}
+
+// List returns all established tunnels ordered by server ID
+func (tm *TunnelManager) List() []Tunnel {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	ids := make([]string, 0, len(tm.tunnels))
+	for id, tunnel := range tm.tunnels {
+		if tunnel.URL != "" {
+			ids = append(ids, id)
+		}
+	}
+	sortByNumericID(ids)
+
+	tunnels := make([]Tunnel, 0, len(ids))
+	for _, id := range ids {
+		tunnels = append(tunnels, *tm.tunnels[id])
+	}
+	return tunnels
+}
+
+// handleOpenTunnel opens a tunnel for a running server. The body may
+// choose the driver ({"driver": "ngrok"}); cloudflared is the default.
+func (a *App) handleOpenTunnel(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var req struct {
+		Driver string `json:"driver"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.Driver == "" {
+		req.Driver = "cloudflared"
+	}
+	if _, ok := tunnelDrivers[req.Driver]; !ok {
+		names := make([]string, 0, len(tunnelDrivers))
+		for name := range tunnelDrivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Driver must be one of %v", names))
+		return
+	}
+
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	var running bool
+	target := ""
+	if exists {
+		running = server.Running
+		target = "http://localhost:" + server.Port
+		if server.IPv6Address != "" {
+			target = "http://[" + server.IPv6Address + "]:" + server.Port
+		}
+	}
+	a.mu.Unlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if !running {
+		writeError(w, http.StatusConflict, errCodeNotRunning, "Server is not running")
+		return
+	}
+
+	tunnel, err := a.tunnels.Open(id, req.Driver, target)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errCodeUpstream, err.Error())
+		return
+	}
+	logAttrs(r.Context(), slog.LevelInfo, "tunnel", slog.String("server", id), slog.String("driver", req.Driver), slog.String("url", tunnel.URL))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tunnel)
+}
+
+func (a *App) handleGetTunnel(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	tunnel, exists := a.tunnels.Get(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server has no tunnel")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tunnel)
+}
+
+func (a *App) handleCloseTunnel(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !a.tunnels.Close(id) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server has no tunnel")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *App) handleGetTunnels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.tunnels.List())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// passwordIterations is the PBKDF2-SHA256 work factor of new hashes
+	passwordIterations = 600000
+	// minPasswordLength is the shortest password passwd accepts
+	minPasswordLength = 8
+)
+
+// UserStore checks logins against a file with one `name:hash` line per
+// user. The file is read on every login, so users added or removed with
+// `php-server-manager passwd` take effect without a restart.
+type UserStore struct {
+	path string
+	mu   sync.Mutex // serializes updates of the file
+}
+
+// NewUserStore creates a store backed by the given file
+func NewUserStore(path string) *UserStore {
+	return &UserStore{path: path}
+}
+
+// usersFilePath returns the users file: PSM_USERS_FILE, or users in the
+// config directory
+func usersFilePath(configDir string) string {
+	return firstNonEmpty(os.Getenv("PSM_USERS_FILE"), filepath.Join(configDir, "users"))
+}
+
+// load reads the users and their password hashes; a missing file has none
+func (us *UserStore) load() (map[string]string, error) {
+	users := make(map[string]string)
+	file, err := os.Open(us.path)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, hash, found := strings.Cut(text, ":")
+		if !found || !validUsername.MatchString(name) {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", us.path, line)
+		}
+		users[name] = hash
+	}
+	return users, scanner.Err()
+}
+
+// Users returns the names of the users who can log in
+func (us *UserStore) Users() ([]string, error) {
+	users, err := us.load()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Verify reports whether a user exists and the password is theirs. Unknown
+// users are checked against a dummy hash, so both take as long.
+func (us *UserStore) Verify(name, password string) bool {
+	users, err := us.load()
+	if err != nil {
+		return false
+	}
+	hash, exists := users[name]
+	if !exists {
+		checkLoginPassword(dummyPasswordHash(), password)
+		return false
+	}
+	return checkLoginPassword(hash, password)
+}
+
+// SetPassword adds a user or changes their password
+func (us *UserStore) SetPassword(name, password string) error {
+	hash, err := hashLoginPassword(password)
+	if err != nil {
+		return err
+	}
+	return us.update(func(users map[string]string) { users[name] = hash })
+}
+
+// Delete removes a user
+func (us *UserStore) Delete(name string) error {
+	return us.update(func(users map[string]string) { delete(users, name) })
+}
+
+// update changes the users and rewrites the file atomically, readable by
+// the manager's user only
+func (us *UserStore) update(change func(map[string]string)) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	users, err := us.load()
+	if err != nil {
+		return err
+	}
+	change(users)
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var content strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&content, "%s:%s\n", name, users[name])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(us.path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(us.path, []byte(content.String()), 0600)
+}
+
+// hashLoginPassword derives a salted PBKDF2-SHA256 hash, encoded as
+// pbkdf2-sha256$iterations$salt$key
+func hashLoginPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkLoginPassword reports whether a password matches a hash, comparing the
+// derived keys in constant time
+func checkLoginPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived := pbkdf2SHA256([]byte(password), salt, iterations, len(key))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// dummyPasswordHash is what logins of unknown users are checked against
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashLoginPassword("not a password anyone has")
+	return hash
+})
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// runPasswdCommand implements `passwd NAME`, which sets the password of a
+// login read from standard input, and `passwd --delete NAME`
+func runPasswdCommand(app *App, args []string) int {
+	flags := flag.NewFlagSet("passwd", flag.ExitOnError)
+	remove := flags.Bool("delete", false, "remove the user instead")
+	flags.Parse(args)
+	if flags.NArg() != 1 || !validUsername.MatchString(flags.Arg(0)) {
+		fmt.Fprintln(os.Stderr, "Usage: php-server-manager passwd [--delete] NAME")
+		return 2
+	}
+	name := flags.Arg(0)
+	users := NewUserStore(usersFilePath(app.configDir))
+
+	if *remove {
+		if err := users.Delete(name); err != nil {
+			fmt.Fprintf(os.Stderr, "passwd: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Removed %s\n", name)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(os.Stderr, "passwd: no password given")
+		return 1
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < minPasswordLength {
+		fmt.Fprintf(os.Stderr, "passwd: use at least %d characters\n", minPasswordLength)
+		return 1
+	}
+	if err := users.SetPassword(name, password); err != nil {
+		fmt.Fprintf(os.Stderr, "passwd: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Set the password of %s in %s\n", name, users.path)
+	return 0
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ValidationProblem describes one issue found while validating a server
+type ValidationProblem struct {
+	Field    string `json:"field,omitempty"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"` // "error" or "warning"
+}
+
+// parseReservedPorts reads the ports no server may use from the value of
+// PSM_RESERVED_PORTS: ports and ranges separated by commas, such as
+// "1-1023,9000-9099"
+func parseReservedPorts(value string) ([]Reservation, error) {
+	reserved := []Reservation{}
+	for _, ports := range strings.Split(value, ",") {
+		ports = strings.TrimSpace(ports)
+		if ports == "" {
+			continue
+		}
+		reservation := Reservation{Ports: ports, Owner: "PSM_RESERVED_PORTS"}
+		if _, _, _, err := reservation.portRange(); err != nil {
+			return nil, fmt.Errorf("invalid PSM_RESERVED_PORTS entry %q: %v", ports, err)
+		}
+		reserved = append(reserved, reservation)
+	}
+	return reserved, nil
+}
+
+// resolvePath returns path made absolute with symlinks resolved, as far as
+// it exists
+func resolvePath(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// pathsOverlap reports whether one of two directories contains the other
+func pathsOverlap(a, b string) bool {
+	a, b = resolvePath(a), resolvePath(b)
+	within := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	return within(a, b) || within(b, a)
+}
+
+// validateServerFields runs the checks shared by creating and updating a
+// server: a name no other server uses, a port within 1-65535 outside the
+// reserved ports, and a directory apart from the manager's own config
+// directory. id is the server being updated, or empty for a new one.
+func (a *App) validateServerFields(ctx context.Context, id, name, port, directory string) []ValidationProblem {
+	problems := []ValidationProblem{}
+	add := func(field, code, message string) {
+		problems = append(problems, ValidationProblem{Field: field, Code: code, Message: message, Severity: "error"})
+	}
+
+	a.mu.Lock()
+	currentPort, currentDirectory := "", ""
+	if server, exists := a.servers[id]; exists {
+		currentPort, currentDirectory = server.Port, server.Directory
+	}
+	taken := ""
+	for otherID, server := range a.servers {
+		if otherID != id && strings.EqualFold(strings.TrimSpace(server.Name), strings.TrimSpace(name)) {
+			taken = otherID
+			break
+		}
+	}
+	a.mu.Unlock()
+
+	if strings.TrimSpace(name) == "" {
+		add("name", "required", "name is required")
+	} else if taken != "" {
+		add("name", "name_taken", "name is already used by server "+taken)
+	}
+
+	portNum, err := strconv.Atoi(port)
+	switch {
+	case port == "":
+		add("port", "required", "port is required")
+	case err != nil:
+		add("port", "invalid", "port must be a number")
+	case portNum < 1 || portNum > 65535:
+		add("port", "out_of_range", "port must be between 1 and 65535")
+	case port != currentPort:
+		// A server keeps a port that was reserved after it was assigned
+		for _, reserved := range a.reservedPorts {
+			if reserved.coversPort(port) {
+				add("port", "port_reserved", "port is in the reserved range "+reserved.Ports)
+				break
+			}
+		}
+	}
+
+	if directory == "" {
+		add("directory", "required", "directory is required")
+	} else if pathsOverlap(directory, a.configDir) {
+		add("directory", "overlaps_config_dir", "directory must not overlap the manager's config directory "+a.configDir)
+	} else if directory != currentDirectory && !a.isAdmin(userFromContext(ctx)) && !withinBrowseRoots(directory) {
+		// Members only get directories the picker offers them
+		add("directory", "outside_browse_roots", "directory must be inside "+strings.Join(browseRoots(), ", "))
+	}
+
+	return problems
+}
+
+// writeValidationProblems rejects a request with the problems found, one
+// per field, in the details of the error. It reports whether it wrote an
+// error.
+func writeValidationProblems(w http.ResponseWriter, problems []ValidationProblem) bool {
+	if len(problems) == 0 {
+		return false
+	}
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Message
+	}
+	writeErrorDetails(w, http.StatusBadRequest, errCodeValidation, strings.Join(messages, "; "), map[string]interface{}{
+		"problems": problems,
+	})
+	return true
+}
+
+// validateServerSpec runs every check performed when creating a server,
+// plus environment checks, and returns all problems found
+func (a *App) validateServerSpec(ctx context.Context, spec ServerSpec, vlanManager *VLANManager) []ValidationProblem {
+	problems := a.validateServerFields(ctx, "", spec.Name, spec.Port, spec.Directory)
+	add := func(field, code, severity, message string) {
+		problems = append(problems, ValidationProblem{Field: field, Code: code, Message: message, Severity: severity})
+	}
+
+	portValid := true
+	for _, problem := range problems {
+		if problem.Field == "port" {
+			portValid = false
+		}
+	}
+	if portValid {
+		a.mu.Lock()
+		for id, server := range a.servers {
+			if server.Port == spec.Port {
+				add("port", "port_in_use", "error", "port is already assigned to server "+id)
+				break
+			}
+		}
+		a.mu.Unlock()
+
+		if reservation, reserved := a.reservations.PortReservation(spec.Port); reserved {
+			add("port", "port_reserved", "error", "port is reserved for "+reservation.Owner+" (reservation "+reservation.ID+")")
+		}
+
+		if listener, err := net.Listen("tcp", ":"+spec.Port); err != nil {
+			add("port", "port_in_use", "error", "port is not free on this host: "+err.Error())
+		} else {
+			listener.Close()
+		}
+	}
+
+	if spec.Directory != "" && spec.Git == nil {
+		if code, err := validateDocumentRoot(spec.Directory); err != nil {
+			add("directory", code, "error", err.Error())
+		}
+	}
+
+	if spec.Git != nil {
+		if err := spec.Git.Validate(); err != nil {
+			add("git", "invalid", "error", err.Error())
+		}
+	}
+
+	if err := spec.VLANOptions.Validate(); err != nil {
+		add("vlan_options", "invalid", "error", err.Error())
+	}
+
+	if err := validateLabels(spec.Labels); err != nil {
+		add("labels", "invalid", "error", err.Error())
+	}
+
+	for name := range spec.Env {
+		if !validEnvName.MatchString(name) {
+			add("env", "invalid", "error", "invalid environment variable name "+strconv.Quote(name))
+		}
+	}
+
+	if err := validatePHPIni(spec.PHPIni); err != nil {
+		add("php_ini", "invalid", "error", err.Error())
+	}
+
+	if spec.RunAsUser != "" {
+		if !validUsername.MatchString(spec.RunAsUser) {
+			add("run_as_user", "invalid", "error", "invalid user name "+strconv.Quote(spec.RunAsUser))
+		} else if _, err := user.Lookup(spec.RunAsUser); err != nil {
+			add("run_as_user", "user_not_found", "error", "user "+spec.RunAsUser+" does not exist on this host")
+		}
+	}
+
+	// VLAN allocation
+	if !vlanManager.privileges.CanManageVLANs() {
+		add("vlan", "vlan_unavailable", "warning", "VLAN management is unavailable; the server will be created without a VLAN interface")
+	} else if portValid {
+		name := "vlan" + spec.Port
+		if vlanManager.GetVLANForPort(spec.Port) == nil {
+			if _, err := net.InterfaceByName(name); err == nil {
+				add("vlan", "vlan_exists", "error", "interface "+name+" already exists on this host")
+			}
+		}
+	}
+
+	// Runtime availability
+	if _, err := findRuntimeBinary(runtimeBinary); err != nil {
+		add("runtime", "runtime_missing", "error", err.Error())
+	}
+
+	return problems
+}
+
+// handleValidateServer validates a server definition without creating it
+func (a *App) handleValidateServer(w http.ResponseWriter, r *http.Request, vlanManager *VLANManager) {
+	var spec ServerSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	problems := []ValidationProblem{}
+	if spec.Template != "" {
+		template, exists := a.GetTemplate(spec.Template)
+		if exists {
+			spec = template.Apply(spec)
+		} else {
+			problems = append(problems, ValidationProblem{Field: "template", Code: "not_found", Message: "template not found", Severity: "error"})
+		}
+	}
+	problems = append(problems, a.validateServerSpec(r.Context(), spec, vlanManager)...)
+
+	valid := true
+	for _, problem := range problems {
+		if problem.Severity == "error" {
+			valid = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":    valid,
+		"problems": problems,
+	})
+}
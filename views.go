@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// serverFilterKeys are the query parameters that select servers, and the
+// only keys a saved view may set
+var serverFilterKeys = map[string]bool{
+	"label":          true,
+	"group":          true,
+	"status":         true,
+	"framework":      true,
+	"crashed_within": true,
+}
+
+// serverFilter selects servers by label, group, state, framework and
+// recent crashes. Zero fields match every server.
+type serverFilter struct {
+	selector     []labelRequirement
+	group        string
+	status       string
+	framework    string
+	crashedSince time.Time
+}
+
+// parseServerFilter reads the filters from a query such as
+// ?label=env=prod&status=running&crashed_within=24h
+func parseServerFilter(query url.Values) (serverFilter, error) {
+	var filter serverFilter
+	var err error
+	if filter.selector, err = parseLabelSelector(query["label"]); err != nil {
+		return filter, err
+	}
+	filter.group = query.Get("group")
+
+	switch filter.status = query.Get("status"); filter.status {
+	case "", "running", "stopped":
+	default:
+		return filter, fmt.Errorf("status must be running or stopped")
+	}
+	filter.framework = query.Get("framework")
+
+	if value := query.Get("crashed_within"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			return filter, fmt.Errorf("crashed_within must be a duration such as 24h")
+		}
+		filter.crashedSince = time.Now().Add(-window)
+	}
+	return filter, nil
+}
+
+// crashedSince reports whether a server's process exited unexpectedly
+// after since
+func (a *App) crashedSince(id string, since time.Time) bool {
+	if a.store == nil {
+		return false
+	}
+	entries, _, err := a.store.History(id, 0)
+	if err != nil {
+		return false
+	}
+	// Entries are newest first
+	for _, entry := range entries {
+		if entry.Time.Before(since) {
+			break
+		}
+		if entry.Event == "exited" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchServerIDs returns the IDs of servers matching filter, ordered
+// numerically
+func (a *App) matchServerIDs(filter serverFilter) ([]string, error) {
+	var members map[string]bool
+	if filter.group != "" {
+		group, exists := a.GetGroup(filter.group)
+		if !exists {
+			return nil, fmt.Errorf("group %s not found", filter.group)
+		}
+		members = make(map[string]bool, len(group.Servers))
+		for _, id := range group.Servers {
+			members[id] = true
+		}
+	}
+
+	a.mu.Lock()
+	ids := make([]string, 0, len(a.servers))
+	for id, server := range a.servers {
+		if members != nil && !members[id] {
+			continue
+		}
+		if !matchLabels(server.Labels, filter.selector) {
+			continue
+		}
+		if (filter.status == "running" && !server.Running) || (filter.status == "stopped" && server.Running) {
+			continue
+		}
+		if filter.framework != "" && server.Framework != filter.framework {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	a.mu.Unlock()
+
+	// History is read outside the lock
+	if !filter.crashedSince.IsZero() {
+		crashed := ids[:0]
+		for _, id := range ids {
+			if a.crashedSince(id, filter.crashedSince) {
+				crashed = append(crashed, id)
+			}
+		}
+		ids = crashed
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		x, _ := strconv.Atoi(ids[i])
+		y, _ := strconv.Atoi(ids[j])
+		return x < y
+	})
+	return ids, nil
+}
+
+// serversByID returns the servers with the given IDs, skipping any that
+// were deleted meanwhile
+func (a *App) serversByID(ids []string) []*Server {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	servers := make([]*Server, 0, len(ids))
+	for _, id := range ids {
+		if server, exists := a.servers[id]; exists {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// validViewName allows short names with spaces, such as
+// "prod running servers"
+var validViewName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._-]{0,63}$`)
+
+// SavedView is a named server filter that the UI and the CLI can list
+// and run
+type SavedView struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Query       map[string]string `json:"query"` // filters for GET /api/servers
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// Validate checks the view's name and filters
+func (sv SavedView) Validate() error {
+	if !validViewName.MatchString(sv.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, spaces, dots, dashes or underscores")
+	}
+	for key := range sv.Query {
+		if !serverFilterKeys[key] {
+			return fmt.Errorf("unknown filter %q", key)
+		}
+	}
+	_, err := parseServerFilter(sv.values())
+	return err
+}
+
+// values returns the view's filters as a query
+func (sv SavedView) values() url.Values {
+	query := url.Values{}
+	for key, value := range sv.Query {
+		query.Set(key, value)
+	}
+	return query
+}
+
+// Preferences are the settings kept for one user
+type Preferences struct {
+	Views []SavedView `json:"views"`
+}
+
+// view returns the index of the named view, or -1
+func (p Preferences) view(name string) int {
+	for i, view := range p.Views {
+		if view.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleGetViews lists the current user's saved views
+func (a *App) handleGetViews(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Saved views require the embedded database")
+		return
+	}
+
+	prefs, err := a.store.Preferences(userFromContext(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs.Views)
+}
+
+// handlePutView creates or replaces a saved view of the current user
+func (a *App) handlePutView(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Saved views require the embedded database")
+		return
+	}
+
+	var view SavedView
+	if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	view.Name = mux.Vars(r)["name"]
+	if view.Query == nil {
+		view.Query = map[string]string{}
+	}
+	if err := view.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+	view.UpdatedAt = time.Now()
+
+	err := a.store.UpdatePreferences(userFromContext(r.Context()), func(prefs *Preferences) error {
+		if i := prefs.view(view.Name); i >= 0 {
+			prefs.Views[i] = view
+		} else {
+			prefs.Views = append(prefs.Views, view)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// handleDeleteView removes a saved view of the current user
+func (a *App) handleDeleteView(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Saved views require the embedded database")
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	found := false
+	err := a.store.UpdatePreferences(userFromContext(r.Context()), func(prefs *Preferences) error {
+		if i := prefs.view(name); i >= 0 {
+			prefs.Views = append(prefs.Views[:i], prefs.Views[i+1:]...)
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "View not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetViewServers lists the servers a saved view currently matches
+func (a *App) handleGetViewServers(w http.ResponseWriter, r *http.Request) {
+	if a.store == nil {
+		writeError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Saved views require the embedded database")
+		return
+	}
+
+	prefs, err := a.store.Preferences(userFromContext(r.Context()))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+	i := prefs.view(mux.Vars(r)["name"])
+	if i < 0 {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "View not found")
+		return
+	}
+
+	filter, err := parseServerFilter(prefs.Views[i].values())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+	opts, err := parseServerListOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	ids, err := a.matchServerIDs(filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	servers, total := listServers(a.serversByID(ids), opts)
+	writePageHeaders(w, r, opts, total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
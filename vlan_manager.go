@@ -1,50 +1,134 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 )
 
+// maxVLANID is the highest usable 802.1Q VLAN ID
+const maxVLANID = 4094
+
+// errVLANExhausted is returned when no VLAN ID can be allocated for a port
+var errVLANExhausted = errors.New("no VLAN ID available")
+
 // VLANManager manages VLAN interfaces and IPv6 addresses
 type VLANManager struct {
-	ipv6Prefix    string
-	mu            sync.Mutex
-	interfaces    map[string]*VLANInterface
-	portToVLAN    map[string]string
+	ipv6Prefix   string
+	mu           sync.Mutex
+	interfaces   map[string]*VLANInterface
+	portToVLAN   map[string]string
+	warnings     *WarningCenter
+	privileges   Privileges
+	reservations *ReservationManager
+	events       *EventLog
+	firstVLANID  int // ports outside firstVLANID-lastVLANID get no VLAN
+	lastVLANID   int
 }
 
 // VLANInterface represents a VLAN interface configuration
 type VLANInterface struct {
-	Name        string `json:"name"`
-	VLANID      int    `json:"vlan_id"`
-	IPv6Address string `json:"ipv6_address"`
-	Port        string `json:"port"`
-	Active      bool   `json:"active"`
+	Name        string      `json:"name"`
+	VLANID      int         `json:"vlan_id"`
+	IPv6Address string      `json:"ipv6_address"`
+	Port        string      `json:"port"`
+	Active      bool        `json:"active"`
+	Options     VLANOptions `json:"options"`
+	ServerID    string      `json:"server_id,omitempty"`
+}
+
+// VLANInterfaceReport combines an interface's configuration with live
+// link state and counters read from the kernel
+type VLANInterfaceReport struct {
+	VLANInterface
+	OperState string   `json:"operstate"`
+	Carrier   bool     `json:"carrier"`
+	RxBytes   uint64   `json:"rx_bytes"`
+	TxBytes   uint64   `json:"tx_bytes"`
+	RxPackets uint64   `json:"rx_packets"`
+	TxPackets uint64   `json:"tx_packets"`
+	Addresses []string `json:"addresses"`
+}
+
+// VLANOptions holds per-interface link settings applied at creation time
+type VLANOptions struct {
+	MTU        int   `json:"mtu,omitempty"`
+	TxQueueLen int   `json:"txqueuelen,omitempty"`
+	AcceptRA   *bool `json:"accept_ra,omitempty"`
+}
+
+// Validate checks the options are within sane limits
+func (o VLANOptions) Validate() error {
+	// IPv6 requires a minimum link MTU of 1280
+	if o.MTU != 0 && (o.MTU < 1280 || o.MTU > 9216) {
+		return fmt.Errorf("mtu must be between 1280 and 9216")
+	}
+	if o.TxQueueLen < 0 {
+		return fmt.Errorf("txqueuelen must not be negative")
+	}
+	return nil
+}
+
+// equal reports whether two sets of options configure a link the same way
+func (o VLANOptions) equal(other VLANOptions) bool {
+	if (o.AcceptRA == nil) != (other.AcceptRA == nil) {
+		return false
+	}
+	if o.AcceptRA != nil && *o.AcceptRA != *other.AcceptRA {
+		return false
+	}
+	return o.MTU == other.MTU && o.TxQueueLen == other.TxQueueLen
 }
 
+// defaultIPv6Prefix is the /64 that server addresses are allocated from
+const defaultIPv6Prefix = "2a0e:b107:384:ee25::/64"
+
 // NewVLANManager creates a new VLAN manager
 func NewVLANManager(ipv6Prefix string) *VLANManager {
 	return &VLANManager{
-		ipv6Prefix: ipv6Prefix,
-		interfaces: make(map[string]*VLANInterface),
-		portToVLAN: make(map[string]string),
+		ipv6Prefix:  ipv6Prefix,
+		interfaces:  make(map[string]*VLANInterface),
+		portToVLAN:  make(map[string]string),
+		firstVLANID: 1,
+		lastVLANID:  maxVLANID,
 	}
 }
 
-// CreateVLANInterface creates a new VLAN interface for a given port
-func (vm *VLANManager) CreateVLANInterface(port string) (*VLANInterface, error) {
+// SetVLANRange limits the VLAN IDs, and so the ports, interfaces are
+// created for. Existing interfaces are kept.
+func (vm *VLANManager) SetVLANRange(first, last int) {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
+	vm.firstVLANID, vm.lastVLANID = first, last
+}
 
-	// Check if VLAN already exists for this port
+// CreateVLANInterface creates a new VLAN interface for a given port, or
+// returns the one it already has with opts applied
+func (vm *VLANManager) CreateVLANInterface(port string, opts VLANOptions) (*VLANInterface, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	// An interface that already exists for this port is reused, with the
+	// new options applied to its link
 	if existingVLAN, exists := vm.portToVLAN[port]; exists {
-		return vm.interfaces[existingVLAN], nil
+		vlanInterface := vm.interfaces[existingVLAN]
+		if !opts.equal(vlanInterface.Options) {
+			if err := vm.applyLinuxVLANOptions(existingVLAN, opts); err != nil {
+				vm.warnings.Add("vlan", "Failed to apply options to %s: %v", existingVLAN, err)
+				return nil, fmt.Errorf("failed to apply VLAN options: %v", err)
+			}
+			vlanInterface.Options = opts
+		}
+		return vlanInterface, nil
 	}
 
 	portNum, err := strconv.Atoi(port)
@@ -54,10 +138,16 @@ func (vm *VLANManager) CreateVLANInterface(port string) (*VLANInterface, error)
 
 	// Generate VLAN ID based on port (use port number as VLAN ID)
 	vlanID := portNum
+	if vlanID < vm.firstVLANID || vlanID > vm.lastVLANID {
+		return nil, fmt.Errorf("%w: port %s is outside the VLAN ID range %d-%d", errVLANExhausted, port, vm.firstVLANID, vm.lastVLANID)
+	}
 	interfaceName := fmt.Sprintf("vlan%d", vlanID)
 
 	// Generate IPv6 address: prefix + ::port
 	ipv6Addr := strings.Replace(vm.ipv6Prefix, "/64", "", 1) + "::" + port
+	if reservation, reserved := vm.reservations.AddressReservation(ipv6Addr); reserved {
+		return nil, fmt.Errorf("%w: %s belongs to %s", errAddressReserved, ipv6Addr, reservation.Owner)
+	}
 
 	vlanInterface := &VLANInterface{
 		Name:        interfaceName,
@@ -65,15 +155,18 @@ func (vm *VLANManager) CreateVLANInterface(port string) (*VLANInterface, error)
 		IPv6Address: ipv6Addr,
 		Port:        port,
 		Active:      false,
+		Options:     opts,
 	}
 
 	// Create the VLAN interface using ip command
 	if err := vm.createLinuxVLANInterface(vlanInterface); err != nil {
+		vm.warnings.Add("vlan", "Failed to create %s: %v", interfaceName, err)
 		return nil, fmt.Errorf("failed to create VLAN interface: %v", err)
 	}
 
 	vm.interfaces[interfaceName] = vlanInterface
 	vm.portToVLAN[port] = interfaceName
+	vm.events.Record(context.Background(), eventVLANCreated, "", "", fmt.Sprintf("Created %s (%s) for port %s", interfaceName, ipv6Addr, port))
 
 	return vlanInterface, nil
 }
@@ -87,19 +180,24 @@ func (vm *VLANManager) createLinuxVLANInterface(vlan *VLANInterface) error {
 	}
 
 	// Create VLAN interface
-	cmd := exec.Command("sudo", "ip", "link", "add", "link", mainInterface, "name", vlan.Name, "type", "vlan", "id", strconv.Itoa(vlan.VLANID))
+	cmd := vm.privileges.Command("ip", "link", "add", "link", mainInterface, "name", vlan.Name, "type", "vlan", "id", strconv.Itoa(vlan.VLANID))
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to create VLAN interface: %v", err)
 	}
 
+	// Apply link options before the interface comes up
+	if err := vm.applyLinuxVLANOptions(vlan.Name, vlan.Options); err != nil {
+		return err
+	}
+
 	// Bring the interface up
-	cmd = exec.Command("sudo", "ip", "link", "set", "dev", vlan.Name, "up")
+	cmd = vm.privileges.Command("ip", "link", "set", "dev", vlan.Name, "up")
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to bring up VLAN interface: %v", err)
 	}
 
 	// Add IPv6 address
-	cmd = exec.Command("sudo", "ip", "-6", "addr", "add", vlan.IPv6Address+"/64", "dev", vlan.Name)
+	cmd = vm.privileges.Command("ip", "-6", "addr", "add", vlan.IPv6Address+"/64", "dev", vlan.Name)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to add IPv6 address: %v", err)
 	}
@@ -108,6 +206,53 @@ func (vm *VLANManager) createLinuxVLANInterface(vlan *VLANInterface) error {
 	return nil
 }
 
+// applyLinuxVLANOptions applies MTU, txqueuelen and accept_ra to an interface
+func (vm *VLANManager) applyLinuxVLANOptions(name string, opts VLANOptions) error {
+	if opts.MTU != 0 {
+		cmd := vm.privileges.Command("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(opts.MTU))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to set MTU: %v", err)
+		}
+	}
+
+	if opts.TxQueueLen != 0 {
+		cmd := vm.privileges.Command("ip", "link", "set", "dev", name, "txqueuelen", strconv.Itoa(opts.TxQueueLen))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to set txqueuelen: %v", err)
+		}
+	}
+
+	if opts.AcceptRA != nil {
+		value := "0"
+		if *opts.AcceptRA {
+			value = "1"
+		}
+		if err := vm.privileges.SetSysctl("net.ipv6.conf."+name+".accept_ra", value); err != nil {
+			return fmt.Errorf("failed to set accept_ra: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// SetVLANOptions applies new link options to the VLAN interface of a port
+func (vm *VLANManager) SetVLANOptions(port string, opts VLANOptions) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	vlanName, exists := vm.portToVLAN[port]
+	if !exists {
+		return nil // Applied when the interface is created
+	}
+
+	if err := vm.applyLinuxVLANOptions(vlanName, opts); err != nil {
+		vm.warnings.Add("vlan", "Failed to apply options to %s: %v", vlanName, err)
+		return err
+	}
+	vm.interfaces[vlanName].Options = opts
+	return nil
+}
+
 // getMainInterface finds the main network interface
 func (vm *VLANManager) getMainInterface() (string, error) {
 	interfaces, err := net.Interfaces()
@@ -118,10 +263,10 @@ func (vm *VLANManager) getMainInterface() (string, error) {
 	for _, iface := range interfaces {
 		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
 			// Skip virtual interfaces
-			if !strings.HasPrefix(iface.Name, "lo") && 
-			   !strings.HasPrefix(iface.Name, "docker") && 
-			   !strings.HasPrefix(iface.Name, "veth") &&
-			   !strings.HasPrefix(iface.Name, "br-") {
+			if !strings.HasPrefix(iface.Name, "lo") &&
+				!strings.HasPrefix(iface.Name, "docker") &&
+				!strings.HasPrefix(iface.Name, "veth") &&
+				!strings.HasPrefix(iface.Name, "br-") {
 				return iface.Name, nil
 			}
 		}
@@ -143,17 +288,86 @@ func (vm *VLANManager) RemoveVLANInterface(port string) error {
 	vlan := vm.interfaces[vlanName]
 
 	// Remove the VLAN interface
-	cmd := exec.Command("sudo", "ip", "link", "delete", vlan.Name)
+	cmd := vm.privileges.Command("ip", "link", "delete", vlan.Name)
 	if err := cmd.Run(); err != nil {
+		vm.warnings.Add("vlan", "Failed to remove %s: %v", vlan.Name, err)
 		return fmt.Errorf("failed to remove VLAN interface: %v", err)
 	}
 
 	delete(vm.interfaces, vlanName)
 	delete(vm.portToVLAN, port)
+	vm.events.Record(context.Background(), eventVLANRemoved, vlan.ServerID, "", fmt.Sprintf("Removed %s of port %s", vlan.Name, port))
 
 	return nil
 }
 
+// RemoveAll removes every managed VLAN interface. It is called on shutdown
+// so interfaces are not left behind; they are recreated on the next start.
+func (vm *VLANManager) RemoveAll() {
+	vm.mu.Lock()
+	ports := make([]string, 0, len(vm.portToVLAN))
+	for port := range vm.portToVLAN {
+		ports = append(ports, port)
+	}
+	vm.mu.Unlock()
+
+	for _, port := range ports {
+		vm.RemoveVLANInterface(port)
+	}
+}
+
+// RestoreVLANInterface recreates the interface of a port after a restart,
+// replacing a stale interface of the same name left by an unclean exit
+func (vm *VLANManager) RestoreVLANInterface(port string, opts VLANOptions) (*VLANInterface, error) {
+	if err := vm.RemoveStaleInterface(port); err != nil {
+		return nil, err
+	}
+	return vm.CreateVLANInterface(port, opts)
+}
+
+// AdoptVLANInterface starts tracking an existing interface of a port, such
+// as one kept by a server that outlived a previous manager
+func (vm *VLANManager) AdoptVLANInterface(port string, opts VLANOptions) error {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port number: %s", port)
+	}
+	name := fmt.Sprintf("vlan%d", portNum)
+	if _, err := net.InterfaceByName(name); err != nil {
+		return err
+	}
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	vm.interfaces[name] = &VLANInterface{
+		Name:        name,
+		VLANID:      portNum,
+		IPv6Address: strings.Replace(vm.ipv6Prefix, "/64", "", 1) + "::" + port,
+		Port:        port,
+		Active:      true,
+		Options:     opts,
+	}
+	vm.portToVLAN[port] = name
+	return nil
+}
+
+// RemoveStaleInterface deletes the interface of a port that exists on the
+// host but is not tracked by this manager
+func (vm *VLANManager) RemoveStaleInterface(port string) error {
+	if vm.GetVLANForPort(port) != nil {
+		return nil
+	}
+	name := "vlan" + port
+	if _, err := net.InterfaceByName(name); err != nil {
+		return nil
+	}
+	if err := vm.privileges.Command("ip", "link", "delete", name).Run(); err != nil {
+		return fmt.Errorf("failed to remove stale interface %s: %v", name, err)
+	}
+	return nil
+}
+
 // GetVLANForPort returns the VLAN interface for a given port
 func (vm *VLANManager) GetVLANForPort(port string) *VLANInterface {
 	vm.mu.Lock()
@@ -165,6 +379,73 @@ func (vm *VLANManager) GetVLANForPort(port string) *VLANInterface {
 	return nil
 }
 
+// AssignServer records which server owns the VLAN interface of a port
+func (vm *VLANManager) AssignServer(port, serverID string) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+
+	if vlanName, exists := vm.portToVLAN[port]; exists {
+		vm.interfaces[vlanName].ServerID = serverID
+	}
+}
+
+// readSysfsValue reads a single value from /sys/class/net/<name>/<file>
+func readSysfsValue(name, file string) string {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readSysfsCounter reads a statistics counter for an interface
+func readSysfsCounter(name, counter string) uint64 {
+	value, _ := strconv.ParseUint(readSysfsValue(name, filepath.Join("statistics", counter)), 10, 64)
+	return value
+}
+
+// Report returns live link state and counters for every managed interface
+func (vm *VLANManager) Report() []VLANInterfaceReport {
+	vm.mu.Lock()
+	interfaces := make([]VLANInterface, 0, len(vm.interfaces))
+	for _, iface := range vm.interfaces {
+		interfaces = append(interfaces, *iface)
+	}
+	vm.mu.Unlock()
+
+	sort.Slice(interfaces, func(i, j int) bool {
+		return interfaces[i].VLANID < interfaces[j].VLANID
+	})
+
+	reports := make([]VLANInterfaceReport, 0, len(interfaces))
+	for _, iface := range interfaces {
+		report := VLANInterfaceReport{
+			VLANInterface: iface,
+			OperState:     readSysfsValue(iface.Name, "operstate"),
+			Carrier:       readSysfsValue(iface.Name, "carrier") == "1",
+			RxBytes:       readSysfsCounter(iface.Name, "rx_bytes"),
+			TxBytes:       readSysfsCounter(iface.Name, "tx_bytes"),
+			RxPackets:     readSysfsCounter(iface.Name, "rx_packets"),
+			TxPackets:     readSysfsCounter(iface.Name, "tx_packets"),
+			Addresses:     []string{},
+		}
+		if report.OperState == "" {
+			report.OperState = "missing"
+		}
+
+		if netIface, err := net.InterfaceByName(iface.Name); err == nil {
+			if addrs, err := netIface.Addrs(); err == nil {
+				for _, addr := range addrs {
+					report.Addresses = append(report.Addresses, addr.String())
+				}
+			}
+		}
+
+		reports = append(reports, report)
+	}
+	return reports
+}
+
 // HTTP handlers for VLAN management
 func (vm *VLANManager) handleGetInterfaces(w http.ResponseWriter, r *http.Request) {
 	vm.mu.Lock()
@@ -180,13 +461,31 @@ func (vm *VLANManager) handleGetInterfaces(w http.ResponseWriter, r *http.Reques
 }
 
 func (vm *VLANManager) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	reports := vm.Report()
+
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
 
+	// The VLAN ID is the port, so only ports in the VLAN ID range get an
+	// address; interfaces kept from a wider range don't count against it
+	capacity := vm.lastVLANID - vm.firstVLANID + 1
+	used := 0
+	for port := range vm.portToVLAN {
+		if vlanID, err := strconv.Atoi(port); err == nil && vlanID >= vm.firstVLANID && vlanID <= vm.lastVLANID {
+			used++
+		}
+	}
 	status := map[string]interface{}{
-		"ipv6_prefix":     vm.ipv6Prefix,
-		"active_vlans":    len(vm.interfaces),
-		"port_mappings":   vm.portToVLAN,
+		"ipv6_prefix":   vm.ipv6Prefix,
+		"active_vlans":  len(vm.interfaces),
+		"port_mappings": vm.portToVLAN,
+		"interfaces":    reports,
+		"address_utilization": map[string]interface{}{
+			"used":      used,
+			"available": capacity - used,
+			"capacity":  capacity,
+			"percent":   float64(used) * 100 / float64(capacity),
+		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
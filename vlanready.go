@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// vlanReadyTimeout bounds the wait for a VLAN interface to come up and
+	// finish duplicate address detection (DAD usually takes about a second)
+	vlanReadyTimeout = 10 * time.Second
+	// vlanReadyPoll is how often the interface state is checked
+	vlanReadyPoll = 100 * time.Millisecond
+)
+
+// Address flags in /proc/net/if_inet6 (IFA_F_* in linux/if_addr.h)
+const (
+	ifaFlagDADFailed = 0x08
+	ifaFlagTentative = 0x40
+)
+
+// errVLANNotReady is returned when a server's VLAN interface or address
+// isn't usable before the timeout
+var errVLANNotReady = errors.New("VLAN interface is not ready")
+
+// VLANReadiness is the state of a server's interface and address
+type VLANReadiness struct {
+	Interface string `json:"interface"`
+	Address   string `json:"address"`
+	OperState string `json:"operstate"`
+	Assigned  bool   `json:"assigned"`  // the address is on the interface
+	Tentative bool   `json:"tentative"` // duplicate address detection is running
+	DADFailed bool   `json:"dad_failed"`
+}
+
+// ready reports whether the address can be bound. Virtual links without
+// carrier detection report "unknown" rather than "up".
+func (vr VLANReadiness) ready() bool {
+	return (vr.OperState == "up" || vr.OperState == "unknown") && vr.Assigned && !vr.Tentative && !vr.DADFailed
+}
+
+// String describes what is still missing
+func (vr VLANReadiness) String() string {
+	switch {
+	case vr.OperState == "":
+		return fmt.Sprintf("%s does not exist", vr.Interface)
+	case vr.OperState != "up" && vr.OperState != "unknown":
+		return fmt.Sprintf("%s is %s", vr.Interface, vr.OperState)
+	case !vr.Assigned:
+		return fmt.Sprintf("%s is not assigned to %s", vr.Address, vr.Interface)
+	case vr.DADFailed:
+		return fmt.Sprintf("duplicate address detection failed for %s; another host uses it", vr.Address)
+	case vr.Tentative:
+		return fmt.Sprintf("duplicate address detection for %s has not finished", vr.Address)
+	}
+	return fmt.Sprintf("%s is up with %s", vr.Interface, vr.Address)
+}
+
+// readVLANReadiness reads the link state from sysfs and the address flags
+// from /proc/net/if_inet6
+func readVLANReadiness(name, address string) VLANReadiness {
+	vr := VLANReadiness{Interface: name, Address: address, OperState: readSysfsValue(name, "operstate")}
+
+	ip := net.ParseIP(address)
+	file, err := os.Open("/proc/net/if_inet6")
+	if err != nil || ip == nil {
+		return vr
+	}
+	defer file.Close()
+
+	// Lines look like "2a0eb1070384ee250000000000003000 05 40 00 80 vlan3000":
+	// address, ifindex, prefix length, scope, flags and device
+	want := fmt.Sprintf("%x", []byte(ip.To16()))
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 || fields[0] != want || fields[5] != name {
+			continue
+		}
+		flags, _ := strconv.ParseUint(fields[4], 16, 32)
+		vr.Assigned = true
+		vr.Tentative = flags&ifaFlagTentative != 0
+		vr.DADFailed = flags&ifaFlagDADFailed != 0
+	}
+	return vr
+}
+
+// waitForVLAN waits until a server's VLAN interface is up and its address
+// has passed duplicate address detection, so the runtime doesn't fail to
+// bind it. Servers without a VLAN interface are ready right away.
+func (a *App) waitForVLAN(ctx context.Context, id string) (VLANReadiness, error) {
+	server, exists := a.GetServer(id)
+	if !exists || server.VLANInterface == "" || server.IPv6Address == "" {
+		return VLANReadiness{}, nil
+	}
+
+	deadline := time.NewTimer(vlanReadyTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(vlanReadyPoll)
+	defer ticker.Stop()
+
+	for {
+		readiness := readVLANReadiness(server.VLANInterface, server.IPv6Address)
+		if readiness.ready() {
+			return readiness, nil
+		}
+		// A duplicate address never becomes usable
+		if readiness.DADFailed {
+			return readiness, fmt.Errorf("%w: %s", errVLANNotReady, readiness)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return readiness, fmt.Errorf("%w after %s: %s", errVLANNotReady, vlanReadyTimeout, readiness)
+		case <-ctx.Done():
+			return readiness, fmt.Errorf("%w: %v", errVLANNotReady, ctx.Err())
+		}
+	}
+}
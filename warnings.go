@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxWarnings bounds the number of warnings kept in memory
+const maxWarnings = 200
+
+// Warning represents a background failure surfaced to operators
+type Warning struct {
+	ID           string    `json:"id"`
+	Source       string    `json:"source"`
+	Message      string    `json:"message"`
+	Count        int       `json:"count"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	Acknowledged bool      `json:"acknowledged"`
+	RequestID    string    `json:"request_id,omitempty"`
+}
+
+// WarningCenter aggregates background failures from all subsystems
+type WarningCenter struct {
+	mu       sync.Mutex
+	warnings map[string]*Warning
+	nextID   int
+}
+
+// NewWarningCenter creates a new warning center
+func NewWarningCenter() *WarningCenter {
+	return &WarningCenter{
+		warnings: make(map[string]*Warning),
+		nextID:   1,
+	}
+}
+
+// Add records a warning from the given source and logs it. Repeated
+// warnings with the same source and message are coalesced. It is safe to
+// call on a nil WarningCenter, in which case the warning is only logged.
+func (wc *WarningCenter) Add(source, format string, args ...interface{}) {
+	wc.AddContext(context.Background(), source, format, args...)
+}
+
+// AddContext is like Add but tags the warning with the request ID from ctx
+func (wc *WarningCenter) AddContext(ctx context.Context, source, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	requestID := requestIDFromContext(ctx)
+	logAttrs(ctx, slog.LevelWarn, message, slog.String("source", source))
+
+	if wc == nil {
+		return
+	}
+
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	now := time.Now()
+	for _, warning := range wc.warnings {
+		if warning.Source == source && warning.Message == message {
+			warning.Count++
+			warning.LastSeen = now
+			warning.Acknowledged = false
+			warning.RequestID = requestID
+			return
+		}
+	}
+
+	id := strconv.Itoa(wc.nextID)
+	wc.nextID++
+	wc.warnings[id] = &Warning{
+		ID:        id,
+		Source:    source,
+		Message:   message,
+		Count:     1,
+		FirstSeen: now,
+		LastSeen:  now,
+		RequestID: requestID,
+	}
+
+	// Drop the oldest warnings once the limit is exceeded
+	if len(wc.warnings) > maxWarnings {
+		oldest := wc.sortedLocked()
+		for _, warning := range oldest[:len(wc.warnings)-maxWarnings] {
+			delete(wc.warnings, warning.ID)
+		}
+	}
+}
+
+// sortedLocked returns warnings ordered by first occurrence
+func (wc *WarningCenter) sortedLocked() []*Warning {
+	warnings := make([]*Warning, 0, len(wc.warnings))
+	for _, warning := range wc.warnings {
+		warnings = append(warnings, warning)
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		return warnings[i].FirstSeen.Before(warnings[j].FirstSeen)
+	})
+	return warnings
+}
+
+// List returns warnings, optionally including acknowledged ones
+func (wc *WarningCenter) List(includeAcknowledged bool) []Warning {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	warnings := make([]Warning, 0, len(wc.warnings))
+	for _, warning := range wc.sortedLocked() {
+		if warning.Acknowledged && !includeAcknowledged {
+			continue
+		}
+		warnings = append(warnings, *warning)
+	}
+	return warnings
+}
+
+// Acknowledge marks a warning as seen; it reappears if it happens again
+func (wc *WarningCenter) Acknowledge(id string) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	warning, exists := wc.warnings[id]
+	if !exists {
+		return false
+	}
+	warning.Acknowledged = true
+	return true
+}
+
+// Dismiss removes a warning entirely
+func (wc *WarningCenter) Dismiss(id string) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if _, exists := wc.warnings[id]; !exists {
+		return false
+	}
+	delete(wc.warnings, id)
+	return true
+}
+
+// HTTP handlers for the warning center
+func (wc *WarningCenter) handleGetWarnings(w http.ResponseWriter, r *http.Request) {
+	includeAcknowledged := r.URL.Query().Get("all") == "true"
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wc.List(includeAcknowledged))
+}
+
+func (wc *WarningCenter) handleAcknowledgeWarning(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !wc.Acknowledge(id) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Warning not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (wc *WarningCenter) handleDismissWarning(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !wc.Dismiss(id) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Warning not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
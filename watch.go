@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultWatchDebounce is how long a server's files must stay
+	// unchanged before it is restarted
+	defaultWatchDebounce = 500 * time.Millisecond
+	// maxWatchFiles bounds the changed files remembered per batch
+	maxWatchFiles = 20
+	// inotifyMask selects the events that count as a change
+	inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+	// inotifyEventSize is the fixed part of an inotify event: wd, mask,
+	// cookie and name length
+	inotifyEventSize = 16
+)
+
+// defaultWatchIgnore keeps dependencies, VCS data and the caches and logs
+// frameworks write while serving out of watch mode, which would otherwise
+// restart the server on every request
+var defaultWatchIgnore = []string{"vendor/", "node_modules/", ".git/", "storage/", "var/", "bootstrap/cache/", "*.log", "*.swp", "*~"}
+
+// WatchConfig restarts or reloads a server when files in its directory
+// change. Unlike a worker's watch, which FrankenPHP handles inside the
+// running process, it works with every runtime.
+type WatchConfig struct {
+	Action   string   `json:"action,omitempty"`   // restart (the default) or reload, which only resets OPcache
+	Debounce string   `json:"debounce,omitempty"` // quiet period before acting, 500ms by default
+	Ignore   []string `json:"ignore,omitempty"`   // replaces the default patterns
+}
+
+// Validate checks the watch options
+func (wc WatchConfig) Validate() error {
+	if wc.Action != "" && wc.Action != "restart" && wc.Action != "reload" {
+		return fmt.Errorf("action must be restart or reload")
+	}
+	if wc.Debounce != "" {
+		debounce, err := time.ParseDuration(wc.Debounce)
+		if err != nil || debounce < 50*time.Millisecond || debounce > time.Minute {
+			return fmt.Errorf("debounce must be a duration between 50ms and 1m")
+		}
+	}
+	for _, pattern := range wc.Ignore {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/"), ""); err != nil || strings.TrimSuffix(pattern, "/") == "" {
+			return fmt.Errorf("invalid ignore pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// debounce returns the quiet period before acting
+func (wc WatchConfig) debounce() time.Duration {
+	if debounce, err := time.ParseDuration(wc.Debounce); err == nil {
+		return debounce
+	}
+	return defaultWatchDebounce
+}
+
+// ignorePatterns returns the patterns of paths that are not watched
+func (wc WatchConfig) ignorePatterns() []string {
+	if len(wc.Ignore) > 0 {
+		return wc.Ignore
+	}
+	return defaultWatchIgnore
+}
+
+// ignored reports whether rel, a slash-separated path below the server
+// directory, or a directory it is in matches an ignore pattern. Patterns
+// without a slash match single names at any depth, others whole paths
+// from the directory; a trailing slash matches directories only.
+func (wc WatchConfig) ignored(rel string, dir bool) bool {
+	elements := strings.Split(rel, "/")
+	for _, pattern := range wc.ignorePatterns() {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		pattern = strings.TrimSuffix(pattern, "/")
+		anchored := strings.Contains(pattern, "/")
+		for i, element := range elements {
+			isDir := dir || i < len(elements)-1
+			if dirOnly && !isDir {
+				continue
+			}
+			subject := element
+			if anchored {
+				subject = strings.Join(elements[:i+1], "/")
+			}
+			if matched, _ := path.Match(pattern, subject); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WatchStatus is what the watcher saw of a server's files
+type WatchStatus struct {
+	ServerID    string     `json:"server_id"`
+	Watching    bool       `json:"watching"`
+	Directories int        `json:"directories"`
+	Changes     int        `json:"changes"` // batches acted on since the manager started
+	LastChange  *time.Time `json:"last_change,omitempty"`
+	LastFiles   []string   `json:"last_files,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// serverWatch is the inotify instance watching one server's directory
+type serverWatch struct {
+	mu      sync.Mutex
+	id      string
+	root    string
+	config  WatchConfig
+	fd      int
+	file    *os.File
+	dirs    map[int32]string // watch descriptor to path relative to root
+	pending []string
+	timer   *time.Timer
+	fire    func(files []string)
+}
+
+// FileWatcher watches the directories of running servers in watch mode
+// with inotify and calls back once their files stop changing
+type FileWatcher struct {
+	mu       sync.Mutex
+	watches  map[string]*serverWatch
+	statuses map[string]*WatchStatus
+	changed  func(id string, files []string)
+}
+
+// NewFileWatcher creates a watcher that calls changed with the changed
+// files of a server
+func NewFileWatcher(changed func(id string, files []string)) *FileWatcher {
+	return &FileWatcher{
+		watches:  make(map[string]*serverWatch),
+		statuses: make(map[string]*WatchStatus),
+		changed:  changed,
+	}
+}
+
+// Watch starts watching a server's directory, replacing a watch it had
+func (fw *FileWatcher) Watch(id, directory string, config WatchConfig) error {
+	fw.Unwatch(id)
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify: %v", err)
+	}
+	sw := &serverWatch{
+		id:     id,
+		root:   filepath.Clean(directory),
+		config: config,
+		fd:     fd,
+		// A non-blocking descriptor goes through the runtime poller, so
+		// closing it ends a pending read
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[int32]string),
+	}
+	sw.fire = func(files []string) { fw.fired(sw, files) }
+
+	err = sw.addTree(sw.root)
+	fw.mu.Lock()
+	status := fw.statusLocked(id)
+	if err != nil {
+		status.Watching, status.Directories, status.Error = false, 0, err.Error()
+		fw.mu.Unlock()
+		sw.file.Close()
+		return err
+	}
+	fw.watches[id] = sw
+	status.Watching, status.Directories, status.Error = true, len(sw.dirs), ""
+	fw.mu.Unlock()
+
+	go sw.read()
+	return nil
+}
+
+// Unwatch stops watching a server's directory; changes not acted on yet
+// are dropped
+func (fw *FileWatcher) Unwatch(id string) {
+	fw.mu.Lock()
+	sw, exists := fw.watches[id]
+	delete(fw.watches, id)
+	if status, ok := fw.statuses[id]; ok {
+		status.Watching, status.Directories = false, 0
+	}
+	fw.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	sw.mu.Lock()
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+	sw.fire = nil
+	sw.mu.Unlock()
+	sw.file.Close()
+}
+
+// Forget drops the status of a deleted server
+func (fw *FileWatcher) Forget(id string) {
+	fw.Unwatch(id)
+	fw.mu.Lock()
+	delete(fw.statuses, id)
+	fw.mu.Unlock()
+}
+
+// Status returns what the watcher saw of a server's files
+func (fw *FileWatcher) Status(id string) WatchStatus {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	status := *fw.statusLocked(id)
+	if sw, exists := fw.watches[id]; exists {
+		sw.mu.Lock()
+		status.Directories = len(sw.dirs)
+		sw.mu.Unlock()
+	}
+	status.LastFiles = append([]string{}, status.LastFiles...)
+	return status
+}
+
+// statusLocked returns the status of a server, creating it; fw.mu must be
+// held
+func (fw *FileWatcher) statusLocked(id string) *WatchStatus {
+	status, exists := fw.statuses[id]
+	if !exists {
+		status = &WatchStatus{ServerID: id}
+		fw.statuses[id] = status
+	}
+	return status
+}
+
+// fired records a batch of changes and hands it on, unless the watch has
+// been replaced meanwhile
+func (fw *FileWatcher) fired(sw *serverWatch, files []string) {
+	fw.mu.Lock()
+	if fw.watches[sw.id] != sw {
+		fw.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	status := fw.statusLocked(sw.id)
+	status.Changes++
+	status.LastChange = &now
+	status.LastFiles = files
+	fw.mu.Unlock()
+
+	fw.changed(sw.id, files)
+}
+
+// addTree watches dir and the directories below it that are not ignored
+func (sw *serverWatch) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Gone before it could be watched
+			if current != dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(sw.root, current)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != "." && sw.config.ignored(rel, true) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(sw.fd, current, inotifyMask|syscall.IN_ONLYDIR)
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("out of inotify watches at %s, raise fs.inotify.max_user_watches", current)
+		}
+		if err != nil {
+			return fmt.Errorf("watching %s: %v", current, err)
+		}
+		sw.mu.Lock()
+		sw.dirs[int32(wd)] = rel
+		sw.mu.Unlock()
+		return nil
+	})
+}
+
+// read decodes inotify events until the descriptor is closed
+func (sw *serverWatch) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := sw.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+inotifyEventSize <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			name := strings.TrimRight(string(buf[offset+inotifyEventSize:offset+inotifyEventSize+length]), "\x00")
+			offset += inotifyEventSize + length
+			sw.handle(wd, mask, name)
+		}
+	}
+}
+
+// handle takes one event: new directories are watched too and changes
+// outside ignored paths restart the debounce timer
+func (sw *serverWatch) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		sw.touch("")
+		return
+	}
+	sw.mu.Lock()
+	dir, known := sw.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(sw.dirs, wd)
+	}
+	sw.mu.Unlock()
+	if !known || name == "" {
+		return
+	}
+
+	rel := path.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	if sw.config.ignored(rel, isDir) {
+		return
+	}
+	if isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		sw.addTree(filepath.Join(sw.root, filepath.FromSlash(rel)))
+	}
+	sw.touch(rel)
+}
+
+// touch notes a changed file and restarts the debounce timer
+func (sw *serverWatch) touch(rel string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.fire == nil {
+		return
+	}
+
+	if rel != "" && len(sw.pending) < maxWatchFiles {
+		seen := false
+		for _, file := range sw.pending {
+			seen = seen || file == rel
+		}
+		if !seen {
+			sw.pending = append(sw.pending, rel)
+		}
+	}
+	if sw.timer != nil {
+		sw.timer.Reset(sw.config.debounce())
+		return
+	}
+	sw.timer = time.AfterFunc(sw.config.debounce(), func() {
+		sw.mu.Lock()
+		files, fire := sw.pending, sw.fire
+		sw.pending = nil
+		sw.mu.Unlock()
+		if fire != nil {
+			fire(files)
+		}
+	})
+}
+
+// startWatch starts watching a running server's directory when it is in
+// watch mode
+func (a *App) startWatch(ctx context.Context, server Server) {
+	if server.Watch == nil {
+		return
+	}
+	if err := a.fileWatcher.Watch(server.ID, server.Directory, *server.Watch); err != nil {
+		a.warnings.AddContext(ctx, "watch", "Error watching the files of server %s: %v", server.ID, err)
+	}
+}
+
+// filesChanged restarts a server, or resets its OPcache, once its files
+// stopped changing
+func (a *App) filesChanged(id string, files []string) {
+	server, exists := a.GetServer(id)
+	if !exists || !server.Running || server.Watch == nil {
+		return
+	}
+
+	ctx := withRequestID(context.Background(), newRequestID())
+	logAttrs(ctx, slog.LevelInfo, "files changed", slog.String("server", id), slog.Any("files", files), slog.String("action", firstNonEmpty(server.Watch.Action, "restart")))
+	if server.Watch.Action == "reload" {
+		if _, err := a.queryOPcache(ctx, server, "reset"); err != nil {
+			a.warnings.AddContext(ctx, "watch", "Error resetting the OPcache of server %s after a change: %v", id, err)
+		}
+		return
+	}
+	if a.StopServerContext(ctx, id) && !a.StartServerContext(ctx, id) {
+		a.warnings.AddContext(ctx, "watch", "Server %s did not start again after its files changed", id)
+	}
+}
+
+// SetWatch sets or, with nil, clears the watch mode of a server
+func (a *App) SetWatch(id string, watch *WatchConfig) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Watch = watch
+
+	a.requestSave()
+	return true
+}
+
+// handleGetWatch shows the watch mode of a server and what the watcher
+// saw
+func (a *App) handleGetWatch(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"watch":     server.Watch,
+		"status":    a.fileWatcher.Status(id),
+	})
+}
+
+// handleSetWatch sets the watch mode of a server ({"action": "restart",
+// "debounce": "1s", "ignore": ["vendor/"]}; null turns it off). It applies
+// to a running server right away.
+func (a *App) handleSetWatch(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var watch *WatchConfig
+	if err := json.NewDecoder(r.Body).Decode(&watch); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if watch != nil {
+		if err := watch.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if !a.SetWatch(id, watch) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	server, _ := a.GetServer(id)
+	a.fileWatcher.Unwatch(id)
+	if server.Running && watch != nil {
+		if err := a.fileWatcher.Watch(id, server.Directory, *watch); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"watch":     watch,
+		"status":    a.fileWatcher.Status(id),
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxWorkers bounds the number of worker threads of a server
+	maxWorkers = 256
+	// defaultWatchPattern is what watch mode watches when no pattern is
+	// given, FrankenPHP's own default
+	defaultWatchPattern = "**/*.{php,yaml,yml,twig,env}"
+)
+
+// WorkerConfig runs a server in FrankenPHP worker mode: the script boots
+// the app once and then handles requests in a loop, as Laravel Octane and
+// the Symfony runtime do. Paths are relative to the server directory.
+type WorkerConfig struct {
+	Script        string   `json:"script"`                   // e.g. public/frankenphp-worker.php
+	Count         int      `json:"count,omitempty"`          // 0 for FrankenPHP's default of twice the CPUs
+	Watch         bool     `json:"watch,omitempty"`          // restart the workers when files change
+	WatchPatterns []string `json:"watch_patterns,omitempty"` // e.g. app/**/*.php
+}
+
+// relativePath reports whether p stays inside the server directory
+func relativePath(p string) bool {
+	clean := filepath.Clean(p)
+	return p != "" && !filepath.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// Validate checks the worker options
+func (wc WorkerConfig) Validate() error {
+	if !relativePath(wc.Script) || strings.ContainsRune(wc.Script, '"') || hasControlChars(wc.Script) {
+		return fmt.Errorf("worker script must be a path inside the server directory")
+	}
+	if wc.Count < 0 || wc.Count > maxWorkers {
+		return fmt.Errorf("worker count must be between 1 and %d", maxWorkers)
+	}
+	for _, pattern := range wc.WatchPatterns {
+		if !relativePath(pattern) || strings.ContainsAny(pattern, "\" ") || hasControlChars(pattern) {
+			return fmt.Errorf("invalid watch pattern %q", pattern)
+		}
+	}
+	if len(wc.WatchPatterns) > 0 && !wc.Watch {
+		return fmt.Errorf("watch_patterns need watch")
+	}
+	return nil
+}
+
+// scriptPath returns the absolute path of the worker script
+func (wc WorkerConfig) scriptPath(directory string) string {
+	return filepath.Join(directory, wc.Script)
+}
+
+// watchPatterns returns the absolute patterns watched; the runtime does
+// not run in the server directory, so relative ones would miss
+func (wc WorkerConfig) watchPatterns(directory string) []string {
+	patterns := wc.WatchPatterns
+	if len(patterns) == 0 {
+		patterns = []string{defaultWatchPattern}
+	}
+	absolute := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		absolute[i] = filepath.Join(directory, pattern)
+	}
+	return absolute
+}
+
+// globalOptions returns the worker block of the Caddyfile's frankenphp
+// global option
+func (wc WorkerConfig) globalOptions(directory string) []string {
+	block := []string{"worker {", "\tfile " + caddyQuote(wc.scriptPath(directory))}
+	if wc.Count > 0 {
+		block = append(block, "\tnum "+strconv.Itoa(wc.Count))
+	}
+	if wc.Watch {
+		for _, pattern := range wc.watchPatterns(directory) {
+			block = append(block, "\twatch "+caddyQuote(pattern))
+		}
+	}
+	return append(block, "}")
+}
+
+// route returns the site directives sending every request that is not for
+// an existing file to the worker script, as Octane's own Caddyfile does.
+// The manager's own paths are left alone. The script must exist and be
+// inside the served root so php_server can run it.
+func (wc WorkerConfig) route(directory, servedRoot string) ([]string, error) {
+	script := wc.scriptPath(directory)
+	if info, err := os.Stat(script); err != nil || info.IsDir() {
+		return nil, fmt.Errorf("worker script %s does not exist", wc.Script)
+	}
+	rel, err := filepath.Rel(servedRoot, script)
+	if err != nil || !relativePath(rel) {
+		return nil, fmt.Errorf("worker script %s is outside the served directory %s", wc.Script, servedRoot)
+	}
+
+	return []string{
+		"@psm_worker {\n\t\tnot path /.psm/*\n\t\tnot {\n\t\t\tfile {path}\n\t\t\tnot path */\n\t\t}\n\t}",
+		"rewrite @psm_worker " + caddyQuote("/"+filepath.ToSlash(rel)),
+	}, nil
+}
+
+// SetWorker changes the worker options of a server; nil turns worker mode
+// off
+func (a *App) SetWorker(id string, worker *WorkerConfig) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false
+	}
+	server.Worker = worker
+
+	a.requestSave()
+	return true
+}
+
+// handleGetWorker shows the worker options of a server
+func (a *App) handleGetWorker(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"worker":    server.Worker,
+	})
+}
+
+// handleSetWorker sets the worker options of a server; a null body turns
+// worker mode off. They take effect the next time the server starts.
+func (a *App) handleSetWorker(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var worker *WorkerConfig
+	if err := json.NewDecoder(r.Body).Decode(&worker); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if worker != nil {
+		if err := worker.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+			return
+		}
+	}
+
+	if !a.SetWorker(id, worker) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"worker":    worker,
+	})
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxWorkerProcesses bounds the copies of one worker process
+	maxWorkerProcesses = 16
+	// defaultWorkerStopTimeout is how long a worker process may take to
+	// finish its job after SIGTERM before it is killed
+	defaultWorkerStopTimeout = 10 * time.Second
+	// workerMinBackoff and workerMaxBackoff bound the delay before a
+	// worker process that exited is started again; the delay doubles
+	// while it keeps exiting
+	workerMinBackoff = time.Second
+	workerMaxBackoff = time.Minute
+	// workerStableAfter is how long a worker process must run for its
+	// next restart to start over at the shortest delay
+	workerStableAfter = time.Minute
+	// workerLogSuffix ends the log files of worker processes
+	workerLogSuffix = ".worker.log"
+	// defaultWorkerLogLines is how many lines of a worker log are returned
+	defaultWorkerLogLines = 200
+)
+
+// validWorkerName restricts worker process names, which name their log
+// files; without dashes rotated logs stay apart from the active one
+var validWorkerName = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{0,31}$`)
+
+var (
+	errWorkerProcessExists   = errors.New("the server already has a worker process with this name")
+	errWorkerProcessNotFound = errors.New("worker process not found")
+	// errStopped ends the supervision of a worker process
+	errStopped = errors.New("stopped")
+)
+
+// WorkerProcess is a long-running command that runs next to a server's
+// web process, such as a queue worker, a websocket server or Horizon. It
+// starts and stops with the server and is started again when it exits.
+type WorkerProcess struct {
+	Name        string `json:"name"`                   // e.g. queue
+	Command     string `json:"command"`                // run with sh in the server directory
+	Processes   int    `json:"processes,omitempty"`    // copies to run, 1 by default
+	StopTimeout string `json:"stop_timeout,omitempty"` // grace period after SIGTERM, 10s by default
+}
+
+// Validate checks the worker process options
+func (wp WorkerProcess) Validate() error {
+	if !validWorkerName.MatchString(wp.Name) {
+		return fmt.Errorf("worker process name must be up to 32 lowercase letters, digits and underscores")
+	}
+	if strings.TrimSpace(wp.Command) == "" || strings.ContainsRune(wp.Command, 0) {
+		return fmt.Errorf("command is required")
+	}
+	if wp.Processes < 0 || wp.Processes > maxWorkerProcesses {
+		return fmt.Errorf("processes must be between 1 and %d", maxWorkerProcesses)
+	}
+	if wp.StopTimeout != "" {
+		timeout, err := time.ParseDuration(wp.StopTimeout)
+		if err != nil || timeout < time.Second || timeout > 5*time.Minute {
+			return fmt.Errorf("stop_timeout must be a duration between 1s and 5m")
+		}
+	}
+	return nil
+}
+
+// validateWorkerProcesses checks a server's worker processes and that
+// their names are unique
+func validateWorkerProcesses(processes []WorkerProcess) error {
+	names := make(map[string]bool)
+	for _, wp := range processes {
+		if err := wp.Validate(); err != nil {
+			return err
+		}
+		if names[wp.Name] {
+			return fmt.Errorf("worker process %q is defined twice", wp.Name)
+		}
+		names[wp.Name] = true
+	}
+	return nil
+}
+
+// processes returns how many copies run
+func (wp WorkerProcess) processes() int {
+	if wp.Processes > 0 {
+		return wp.Processes
+	}
+	return 1
+}
+
+// stopTimeout returns the grace period after SIGTERM
+func (wp WorkerProcess) stopTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(wp.StopTimeout); err == nil {
+		return timeout
+	}
+	return defaultWorkerStopTimeout
+}
+
+// workerLogPath returns the log all copies of a worker process write to
+func workerLogPath(configDir, id, name string) string {
+	return filepath.Join(serverLogDir(configDir, id), name+workerLogSuffix)
+}
+
+// workerPIDDir returns the directory of the PID files of a server's
+// worker processes
+func workerPIDDir(configDir, id string) string {
+	return filepath.Join(configDir, "run", "workers", id)
+}
+
+// workerPIDPath returns the PID file of one copy of a worker process
+func workerPIDPath(configDir, id, name string, index int) string {
+	return filepath.Join(workerPIDDir(configDir, id), fmt.Sprintf("%s.%d.pid", name, index))
+}
+
+// reapWorkers kills worker processes of a server that outlived a previous
+// manager. They are started again with their server, and two copies of a
+// queue worker must not run on the same queue unsupervised.
+func reapWorkers(configDir, id string) {
+	paths, _ := filepath.Glob(filepath.Join(workerPIDDir(configDir, id), "*.pid"))
+	for _, path := range paths {
+		if record, err := readPIDFile(path); err == nil && record.Alive() {
+			logAttrs(context.Background(), slog.LevelInfo, "reap worker", slog.String("server", id), slog.Int("pid", record.PID))
+			killProcessGroup(record.PID)
+		}
+		os.Remove(path)
+	}
+}
+
+// WorkerInstance is the state of one copy of a worker process
+type WorkerInstance struct {
+	Index      int        `json:"index"`
+	State      string     `json:"state"` // starting, running, backoff (waiting to be started again) or stopped
+	PID        int        `json:"pid,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	Restarts   int        `json:"restarts"`
+	LastExit   string     `json:"last_exit,omitempty"`
+	LastExitAt *time.Time `json:"last_exit_at,omitempty"`
+	Error      string     `json:"error,omitempty"` // why it could not be started
+}
+
+// WorkerStatus is a worker process with the state of its copies
+type WorkerStatus struct {
+	WorkerProcess
+	Instances []WorkerInstance `json:"instances"`
+}
+
+// workerRunner supervises one copy of a worker process
+type workerRunner struct {
+	mu       sync.Mutex
+	status   WorkerInstance
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// update changes the runner's status
+func (wr *workerRunner) update(change func(*WorkerInstance)) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	change(&wr.status)
+}
+
+// Status returns a copy of the runner's status
+func (wr *workerRunner) Status() WorkerInstance {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.status
+}
+
+// WorkerSupervisor runs the worker processes of running servers. Copies
+// that exit are started again after a delay; the state of stopped ones is
+// kept until their server starts again.
+type WorkerSupervisor struct {
+	mu        sync.Mutex
+	configDir string
+	runners   map[string]map[string][]*workerRunner // server ID → worker name → copies
+}
+
+// NewWorkerSupervisor creates a supervisor keeping PID files under
+// configDir
+func NewWorkerSupervisor(configDir string) *WorkerSupervisor {
+	return &WorkerSupervisor{
+		configDir: configDir,
+		runners:   make(map[string]map[string][]*workerRunner),
+	}
+}
+
+// Start starts the copies of a worker process of server id, replacing
+// any that run. command returns a new command for every start.
+func (ws *WorkerSupervisor) Start(id string, wp WorkerProcess, command func() *exec.Cmd) {
+	ws.Stop(id, wp.Name)
+
+	runners := make([]*workerRunner, wp.processes())
+	for i := range runners {
+		runners[i] = &workerRunner{
+			status: WorkerInstance{Index: i, State: "starting"},
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		go ws.supervise(id, wp, i, runners[i], command)
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.runners[id] == nil {
+		ws.runners[id] = make(map[string][]*workerRunner)
+	}
+	ws.runners[id][wp.Name] = runners
+}
+
+// supervise runs one copy until it is stopped, starting it again each
+// time it exits
+func (ws *WorkerSupervisor) supervise(id string, wp WorkerProcess, index int, wr *workerRunner, command func() *exec.Cmd) {
+	defer close(wr.done)
+	defer wr.update(func(status *WorkerInstance) { status.State, status.PID = "stopped", 0 })
+
+	logPath := workerLogPath(ws.configDir, id, wp.Name)
+	pidPath := workerPIDPath(ws.configDir, id, wp.Name, index)
+	backoff := workerMinBackoff
+	for {
+		started, err := ws.runOnce(id, wp, wr, command(), logPath, pidPath)
+		if err == errStopped {
+			return
+		}
+		if started.IsZero() {
+			wr.update(func(status *WorkerInstance) { status.Error = err.Error() })
+			logAttrs(context.Background(), slog.LevelWarn, "worker failed to start", slog.String("server", id), slog.String("worker", wp.Name), slog.String("error", err.Error()))
+		} else {
+			exit := "exited cleanly"
+			if err != nil {
+				exit = err.Error()
+			}
+			now := time.Now()
+			wr.update(func(status *WorkerInstance) { status.LastExit, status.LastExitAt = exit, &now })
+			logAttrs(context.Background(), slog.LevelWarn, "worker exited", slog.String("server", id), slog.String("worker", wp.Name), slog.Int("index", index), slog.String("exit", exit))
+			if now.Sub(started) >= workerStableAfter {
+				backoff = workerMinBackoff
+			}
+		}
+
+		wr.update(func(status *WorkerInstance) { status.State, status.PID, status.StartedAt = "backoff", 0, nil })
+		select {
+		case <-wr.stop:
+			return
+		case <-time.After(backoff):
+		}
+		wr.update(func(status *WorkerInstance) { status.Restarts++ })
+		if backoff *= 2; backoff > workerMaxBackoff {
+			backoff = workerMaxBackoff
+		}
+	}
+}
+
+// runOnce starts cmd with its output appended to the worker log and waits
+// for it to exit or to be stopped, which sends SIGTERM to its process
+// group and SIGKILL once the grace period passed. It returns when the
+// process started, zero if it did not.
+func (ws *WorkerSupervisor) runOnce(id string, wp WorkerProcess, wr *workerRunner, cmd *exec.Cmd, logPath, pidPath string) (time.Time, error) {
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return time.Time{}, err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer logFile.Close()
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+
+	if err := cmd.Start(); err != nil {
+		return time.Time{}, err
+	}
+	pid := cmd.Process.Pid
+	started := time.Now()
+	wr.update(func(status *WorkerInstance) {
+		status.State, status.PID, status.StartedAt, status.Error = "running", pid, &started, ""
+	})
+	if err := writePIDFile(pidPath, pid); err != nil {
+		logAttrs(context.Background(), slog.LevelWarn, "worker PID file", slog.String("server", id), slog.String("error", err.Error()))
+	}
+	defer removePIDFile(pidPath, pid)
+	// Whatever the process left behind in its group goes with it
+	defer syscall.Kill(-pid, syscall.SIGKILL)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		return started, err
+	case <-wr.stop:
+	}
+
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(wp.stopTimeout()):
+		killProcessGroup(pid)
+		<-exited
+	}
+	return started, errStopped
+}
+
+// stopRunners stops the given copies together and waits for them to exit
+func stopRunners(runners []*workerRunner) {
+	for _, wr := range runners {
+		wr.stopOnce.Do(func() { close(wr.stop) })
+	}
+	for _, wr := range runners {
+		<-wr.done
+	}
+}
+
+// Stop stops the copies of a worker process of server id
+func (ws *WorkerSupervisor) Stop(id, name string) {
+	ws.mu.Lock()
+	runners := ws.runners[id][name]
+	ws.mu.Unlock()
+
+	stopRunners(runners)
+}
+
+// StopAll stops every worker process of server id
+func (ws *WorkerSupervisor) StopAll(id string) {
+	ws.mu.Lock()
+	var runners []*workerRunner
+	for _, copies := range ws.runners[id] {
+		runners = append(runners, copies...)
+	}
+	ws.mu.Unlock()
+
+	stopRunners(runners)
+}
+
+// Remove stops a worker process of server id and drops its state
+func (ws *WorkerSupervisor) Remove(id, name string) {
+	ws.Stop(id, name)
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	delete(ws.runners[id], name)
+}
+
+// Forget stops the worker processes of a deleted server and drops their
+// state
+func (ws *WorkerSupervisor) Forget(id string) {
+	ws.StopAll(id)
+
+	ws.mu.Lock()
+	delete(ws.runners, id)
+	ws.mu.Unlock()
+	os.RemoveAll(workerPIDDir(ws.configDir, id))
+}
+
+// Status returns the state of the copies of a worker process, none if it
+// has not run since the manager started
+func (ws *WorkerSupervisor) Status(id, name string) []WorkerInstance {
+	ws.mu.Lock()
+	runners := ws.runners[id][name]
+	ws.mu.Unlock()
+
+	instances := make([]WorkerInstance, 0, len(runners))
+	for _, wr := range runners {
+		instances = append(instances, wr.Status())
+	}
+	return instances
+}
+
+// startWorkerProcesses starts the worker processes of a running server.
+// They run as the server's user with the environment its PHP process
+// gets.
+func (a *App) startWorkerProcesses(ctx context.Context, server Server, processes ...WorkerProcess) {
+	if len(processes) == 0 {
+		return
+	}
+
+	var account *runAccount
+	if a.privileges.Root {
+		found, err := lookupRunAccount(a.runAsUser(server))
+		if err != nil {
+			a.warnings.AddContext(ctx, "workers", "Error starting the worker processes of server %s: %v", server.ID, err)
+			return
+		}
+		account = &found
+	}
+	env := a.taskEnvironment(ctx, server, account)
+
+	for _, wp := range processes {
+		command := wp.Command
+		logAttrs(ctx, slog.LevelInfo, "worker", slog.String("server", server.ID), slog.String("worker", wp.Name), slog.String("command", command), slog.Int("processes", wp.processes()))
+		a.supervisor.Start(server.ID, wp, func() *exec.Cmd {
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Dir = server.Directory
+			cmd.Env = env
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if account != nil {
+				cmd.SysProcAttr.Credential = account.credential()
+			}
+			return cmd
+		})
+	}
+}
+
+// SetWorkerProcess adds a worker process to a server or, with replace,
+// replaces the one with the same name
+func (a *App) SetWorkerProcess(id string, wp WorkerProcess, replace bool) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false, nil
+	}
+	for i, existing := range server.Workers {
+		if existing.Name != wp.Name {
+			continue
+		}
+		if !replace {
+			return true, errWorkerProcessExists
+		}
+		// Copies of the server handed out share the old slice
+		workers := append([]WorkerProcess(nil), server.Workers...)
+		workers[i] = wp
+		server.Workers = workers
+		a.requestSave()
+		return true, nil
+	}
+	if replace {
+		return true, errWorkerProcessNotFound
+	}
+	server.Workers = append(server.Workers, wp)
+
+	a.requestSave()
+	return true, nil
+}
+
+// RemoveWorkerProcess removes a worker process from a server
+func (a *App) RemoveWorkerProcess(id, name string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	server, exists := a.servers[id]
+	if !exists {
+		return false, nil
+	}
+	for i, existing := range server.Workers {
+		if existing.Name == name {
+			server.Workers = append(server.Workers[:i:i], server.Workers[i+1:]...)
+			a.requestSave()
+			return true, nil
+		}
+	}
+	return true, errWorkerProcessNotFound
+}
+
+// findWorkerProcess returns a server's worker process by name
+func findWorkerProcess(server Server, name string) (WorkerProcess, bool) {
+	for _, wp := range server.Workers {
+		if wp.Name == name {
+			return wp, true
+		}
+	}
+	return WorkerProcess{}, false
+}
+
+// handleGetWorkerProcesses lists a server's worker processes with the
+// state of their copies
+func (a *App) handleGetWorkerProcesses(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	statuses := make([]WorkerStatus, 0, len(server.Workers))
+	for _, wp := range server.Workers {
+		statuses = append(statuses, WorkerStatus{WorkerProcess: wp, Instances: a.supervisor.Status(id, wp.Name)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// writeWorkerProcess saves a worker process from the body and (re)starts
+// it when the server runs
+func (a *App) writeWorkerProcess(w http.ResponseWriter, r *http.Request, replace bool) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	var wp WorkerProcess
+	if err := json.NewDecoder(r.Body).Decode(&wp); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if replace {
+		wp.Name = vars["name"]
+	}
+	if err := wp.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+
+	exists, err := a.SetWorkerProcess(id, wp, replace)
+	switch {
+	case !exists:
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	case errors.Is(err, errWorkerProcessNotFound):
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+		return
+	case errors.Is(err, errWorkerProcessExists):
+		writeError(w, http.StatusConflict, errCodeConflict, err.Error())
+		return
+	}
+
+	if server, _ := a.GetServer(id); server.Running {
+		a.startWorkerProcesses(r.Context(), server, wp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !replace {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(WorkerStatus{WorkerProcess: wp, Instances: a.supervisor.Status(id, wp.Name)})
+}
+
+// handleCreateWorkerProcess adds a worker process to a server ({"name":
+// "queue", "command": "php artisan queue:work", "processes": 2}). It
+// starts right away when the server runs.
+func (a *App) handleCreateWorkerProcess(w http.ResponseWriter, r *http.Request) {
+	a.writeWorkerProcess(w, r, false)
+}
+
+// handleUpdateWorkerProcess replaces a worker process of a server,
+// restarting it when the server runs
+func (a *App) handleUpdateWorkerProcess(w http.ResponseWriter, r *http.Request) {
+	a.writeWorkerProcess(w, r, true)
+}
+
+// handleDeleteWorkerProcess stops a worker process and removes it from
+// its server
+func (a *App) handleDeleteWorkerProcess(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, name := vars["id"], vars["name"]
+
+	exists, err := a.RemoveWorkerProcess(id, name)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, err.Error())
+		return
+	}
+	a.supervisor.Remove(id, name)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"server_id": id, "name": name})
+}
+
+// handleRestartWorkerProcess restarts the copies of a worker process of
+// a running server, e.g. after a deploy
+func (a *App) handleRestartWorkerProcess(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, name := vars["id"], vars["name"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	wp, found := findWorkerProcess(server, name)
+	if !found {
+		writeError(w, http.StatusNotFound, errCodeNotFound, errWorkerProcessNotFound.Error())
+		return
+	}
+	if !server.Running {
+		writeError(w, http.StatusConflict, errCodeConflict, "Server is not running")
+		return
+	}
+
+	a.startWorkerProcesses(r.Context(), server, wp)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WorkerStatus{WorkerProcess: wp, Instances: a.supervisor.Status(id, name)})
+}
+
+// handleGetWorkerProcessLogs returns the last ?lines= lines (200 by
+// default) all copies of a worker process wrote, as plain text
+func (a *App) handleGetWorkerProcessLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, name := vars["id"], vars["name"]
+	server, exists := a.GetServer(id)
+	if !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	if _, found := findWorkerProcess(server, name); !found {
+		writeError(w, http.StatusNotFound, errCodeNotFound, errWorkerProcessNotFound.Error())
+		return
+	}
+	lines := defaultWorkerLogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "lines must be a positive number")
+			return
+		}
+		lines = n
+	}
+
+	logs, err := readLastLines(workerLogPath(a.configDir, id, name), lines)
+	if err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, logs)
+}
+
+// readLastLines returns the last n lines of a file, reading it backwards
+// in blocks so large logs are not read whole
+func readLastLines(path string, n int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	const blockSize = 64 * 1024
+	var data []byte
+	offset := info.Size()
+	for offset > 0 {
+		size := int64(blockSize)
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		block := make([]byte, size)
+		if _, err := file.ReadAt(block, offset); err != nil {
+			return "", err
+		}
+		data = append(block, data...)
+		// One more newline than lines, as the last line ends with one
+		if strings.Count(string(data), "\n") > n {
+			break
+		}
+	}
+
+	text := string(data)
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, ""), nil
+}
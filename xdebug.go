@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultDebugClientHost is where xdebug connects to by default
+	defaultDebugClientHost = "localhost"
+	// defaultDebugClientPort is xdebug 3's default client port
+	defaultDebugClientPort = 9003
+)
+
+// validDebugValue matches hosts, IDE keys and extension paths written to
+// the generated ini file
+var validDebugValue = regexp.MustCompile(`^[A-Za-z0-9._:/@+-]+$`)
+
+// DebugConfig runs a server with xdebug step debugging. It is applied
+// through an ini file added to PHP's scan directories, so php.ini is left
+// alone.
+type DebugConfig struct {
+	Enabled    bool   `json:"enabled"`
+	ClientHost string `json:"client_host,omitempty"` // where the IDE listens, localhost when empty
+	ClientPort int    `json:"client_port,omitempty"` // 9003 when zero
+	IDEKey     string `json:"ide_key,omitempty"`
+	// Extension loads xdebug when the runtime doesn't already, e.g.
+	// "xdebug" or a path to xdebug.so
+	Extension string `json:"extension,omitempty"`
+}
+
+// Validate checks the debug options
+func (d DebugConfig) Validate() error {
+	if d.ClientHost != "" && !validDebugValue.MatchString(d.ClientHost) {
+		return fmt.Errorf("invalid client_host %q", d.ClientHost)
+	}
+	if d.ClientPort < 0 || d.ClientPort > 65535 {
+		return fmt.Errorf("client_port must be between 1 and 65535")
+	}
+	if d.IDEKey != "" && !validDebugValue.MatchString(d.IDEKey) {
+		return fmt.Errorf("invalid ide_key %q", d.IDEKey)
+	}
+	if d.Extension != "" && !validDebugValue.MatchString(d.Extension) {
+		return fmt.Errorf("invalid extension %q", d.Extension)
+	}
+	return nil
+}
+
+// ini returns the xdebug settings for the server
+func (d DebugConfig) ini() string {
+	host, port := d.ClientHost, d.ClientPort
+	if host == "" {
+		host = defaultDebugClientHost
+	}
+	if port == 0 {
+		port = defaultDebugClientPort
+	}
+
+	lines := []string{"; Generated by php-server-manager, changes are overwritten"}
+	if d.Extension != "" {
+		lines = append(lines, "zend_extension="+d.Extension)
+	}
+	lines = append(lines,
+		"xdebug.mode=debug",
+		"xdebug.start_with_request=yes",
+		"xdebug.client_host="+host,
+		"xdebug.client_port="+strconv.Itoa(port),
+	)
+	if d.IDEKey != "" {
+		lines = append(lines, "xdebug.idekey="+d.IDEKey)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// SetDebug changes a server's debug options and restarts it when it is
+// running, so they take effect right away
+func (a *App) SetDebug(ctx context.Context, id string, debug DebugConfig) (bool, error) {
+	a.mu.Lock()
+	server, exists := a.servers[id]
+	if !exists {
+		a.mu.Unlock()
+		return false, nil
+	}
+	changed := server.Debug.Enabled != debug.Enabled
+	server.Debug = debug
+	running := server.Running
+	name := server.Name
+	a.requestSave()
+	a.mu.Unlock()
+
+	if changed {
+		event := "debug_disabled"
+		if debug.Enabled {
+			event = "debug_enabled"
+		}
+		if err := a.store.Record(id, event, ""); err != nil {
+			a.warnings.AddContext(ctx, "config", "Error recording history for server %s: %v", id, err)
+		}
+		a.annotations.Record(ctx, id, name, event, fmt.Sprintf("Xdebug %s on %s", strings.TrimPrefix(event, "debug_"), name))
+	}
+
+	if running && (!a.StopServerContext(ctx, id) || !a.StartServerContext(ctx, id)) {
+		return true, fmt.Errorf("server %s did not restart", id)
+	}
+	return running, nil
+}
+
+// writeDebug responds with a server's debug options
+func (a *App) writeDebug(w http.ResponseWriter, id string, restarted bool) {
+	server, _ := a.GetServer(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"server_id": id,
+		"debug":     server.Debug,
+		"restarted": restarted,
+	})
+}
+
+// applyDebug saves debug options and reports the result
+func (a *App) applyDebug(w http.ResponseWriter, r *http.Request, id string, debug DebugConfig) {
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+
+	restarted, err := a.SetDebug(r.Context(), id, debug)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeStartFailed, fmt.Sprintf("Debug options were saved but %v", err))
+		return
+	}
+	a.writeDebug(w, id, restarted)
+}
+
+// handleGetDebug shows a server's debug options
+func (a *App) handleGetDebug(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, exists := a.GetServer(id); !exists {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+		return
+	}
+	a.writeDebug(w, id, false)
+}
+
+// handleSetDebug replaces a server's debug options, restarting it when it
+// is running
+func (a *App) handleSetDebug(w http.ResponseWriter, r *http.Request) {
+	var debug DebugConfig
+	if err := json.NewDecoder(r.Body).Decode(&debug); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := debug.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeValidation, err.Error())
+		return
+	}
+	a.applyDebug(w, r, mux.Vars(r)["id"], debug)
+}
+
+// handleToggleDebug switches debugging on or off, keeping the other
+// options
+func (a *App) handleToggleDebug(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		server, exists := a.GetServer(id)
+		if !exists {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "Server not found")
+			return
+		}
+		debug := server.Debug
+		debug.Enabled = enabled
+		a.applyDebug(w, r, id, debug)
+	}
+}